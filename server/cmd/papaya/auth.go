@@ -0,0 +1,69 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/fridayflag/papaya/internal/auth"
+)
+
+const authUsage = `usage: papaya auth prune|reset-mfa USER [flags]`
+
+// authCmd implements the "papaya auth" commands. Both are safe to run while the server is up.
+//
+//   - prune: one janitor run with auth.prune_retention, e.g. from cron when
+//     auth.prune_interval is 0.
+//   - reset-mfa USER: removes the user's TOTP enrollment and recovery codes, for someone
+//     who lost both their authenticator and their codes. They log in with the password alone.
+func authCmd(args []string) error {
+	if len(args) == 0 {
+		return errors.New(authUsage)
+	}
+	cmd, args := args[0], args[1:]
+	var username string
+	switch cmd {
+	case "prune":
+	case "reset-mfa":
+		if len(args) == 0 || args[0] == "" || args[0][0] == '-' {
+			return errors.New(authUsage)
+		}
+		username, args = args[0], args[1:]
+	default:
+		return errors.New(authUsage)
+	}
+	cfg, err := loadConfig(args)
+	if err != nil {
+		return err
+	}
+	store, err := auth.OpenStore(cfg.App.Auth.Store, cfg.AuthDBPath, cfg.AuthPostgresURL)
+	if err != nil {
+		return fmt.Errorf("auth store: %w", err)
+	}
+	defer store.Close()
+
+	if cmd == "reset-mfa" {
+		if _, err := store.MFA(username); err != nil {
+			return fmt.Errorf("%s: %w", username, err)
+		}
+		if err := store.DeleteMFA(username); err != nil {
+			return err
+		}
+		if err := store.RecordEvent(auth.EventMFADisabled, username, "", "reset with papaya auth reset-mfa"); err != nil {
+			return err
+		}
+		fmt.Printf("Two-factor authentication is off for %s.\n", username)
+		return nil
+	}
+	retention := cfg.App.Auth.PruneRetention
+	r, err := auth.NewJanitor(store, nil).Prune(retention)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Removed what was spent or expired more than %s ago:\n", retention)
+	fmt.Printf("  refresh tokens         %d\n", r.Tokens)
+	fmt.Printf("  sessions               %d\n", r.Sessions)
+	fmt.Printf("  personal access tokens %d\n", r.PATs)
+	fmt.Printf("  failed logins          %d\n", r.FailedLogins)
+	fmt.Printf("  denylist entries       %d\n", r.Denylist)
+	return nil
+}
@@ -0,0 +1,29 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"text/tabwriter"
+)
+
+// configCmd implements "papaya config print".
+func configCmd(args []string) error {
+	if len(args) == 0 || args[0] != "print" {
+		return errors.New(`usage: papaya config print [flags]`)
+	}
+	cfg, err := loadConfig(args[1:])
+	if err != nil {
+		return err
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "KEY\tVALUE\tSOURCE")
+	for _, s := range cfg.Settings() {
+		source := string(s.Source)
+		if s.Origin != "" {
+			source += " (" + s.Origin + ")"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\n", s.Key, s.Display(), source)
+	}
+	return w.Flush()
+}
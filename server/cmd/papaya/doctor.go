@@ -0,0 +1,47 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/fridayflag/papaya/internal/env"
+	"github.com/fridayflag/papaya/internal/preflight"
+)
+
+// doctorCmd implements "papaya doctor": run the preflight checks and print the report.
+func doctorCmd(args []string) error {
+	cfg, err := loadConfig(args)
+	if err != nil {
+		return err
+	}
+	report := preflight.Run(context.Background(), cfg)
+	if err := report.Write(os.Stdout); err != nil {
+		return err
+	}
+	if report.Failed() {
+		os.Exit(1)
+	}
+	return nil
+}
+
+// startupPreflight runs the preflight checks before serving, as set by server.preflight.
+func startupPreflight(cfg *env.Config) error {
+	mode := cfg.App.Server.Preflight
+	if mode == "off" {
+		return nil
+	}
+	report := preflight.Run(context.Background(), cfg)
+	var buf bytes.Buffer
+	_ = report.Write(&buf)
+	for _, line := range strings.Split(strings.TrimRight(buf.String(), "\n"), "\n") {
+		log.Printf("preflight: %s", line)
+	}
+	if report.Failed() && mode == "strict" {
+		return errors.New(`preflight checks failed; fix the setup (see "papaya doctor") or set server.preflight to "warn"`)
+	}
+	return nil
+}
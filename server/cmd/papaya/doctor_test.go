@@ -0,0 +1,52 @@
+package main
+
+import (
+	"bytes"
+	"log"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/fridayflag/papaya/internal/config"
+	"github.com/fridayflag/papaya/internal/env"
+)
+
+// TestStartupPreflight runs the checks against a setup that fails them (no secrets, no
+// static files, no CouchDB) under each server.preflight mode.
+func TestStartupPreflight(t *testing.T) {
+	var logged bytes.Buffer
+	prev := log.Writer()
+	log.SetOutput(&logged)
+	t.Cleanup(func() { log.SetOutput(prev) })
+
+	tests := []struct {
+		mode    string
+		wantErr bool
+		wantLog bool
+	}{
+		{"off", false, false},
+		{"warn", false, true},
+		{"strict", true, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.mode, func(t *testing.T) {
+			logged.Reset()
+			dir := t.TempDir()
+			cfg := &env.Config{
+				ConfigDir:       dir,
+				StaticAssetsDir: filepath.Join(dir, "dist"),
+				CouchDBHost:     "127.0.0.1",
+				CouchDBPort:     1,
+				App:             config.Default(),
+			}
+			cfg.App.Server.Preflight = tt.mode
+			err := startupPreflight(cfg)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("startupPreflight() error = %v, want error %v", err, tt.wantErr)
+			}
+			if got := strings.Contains(logged.String(), "preflight: FAIL  auth.token_secret"); got != tt.wantLog {
+				t.Errorf("logged %q, want the failed check logged %v", logged.String(), tt.wantLog)
+			}
+		})
+	}
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/fridayflag/papaya/internal/auth"
+	"github.com/fridayflag/papaya/internal/env"
+)
+
+const keysUsage = `usage:
+  papaya keys generate -type rsa|ec|ed25519 -kid KID -out FILE
+  papaya keys couchdb [flags]
+  papaya keys list [flags]
+  papaya keys rotate [-type hmac|rsa|ec|ed25519] [-kid KID] [-- flags]
+  papaya keys retire KID [flags]`
+
+// keysCmd implements the "papaya keys" subcommands.
+func keysCmd(args []string) error {
+	if len(args) == 0 {
+		return errors.New(keysUsage)
+	}
+	switch args[0] {
+	case "generate":
+		return keysGenerate(args[1:])
+	case "couchdb":
+		ring, _, err := loadKeyring(args[1:])
+		if err != nil {
+			return err
+		}
+		return printCouchDBEntry(ring.Keys()...)
+	case "list":
+		ring, _, err := loadKeyring(args[1:])
+		if err != nil {
+			return err
+		}
+		tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(tw, "KID\tALG\tSTATUS")
+		for _, k := range ring.Keys() {
+			status := "accepted"
+			if ring.IsActive(k.Kid) {
+				status = "active"
+			}
+			fmt.Fprintf(tw, "%s\t%s\t%s\n", k.Kid, k.Method.Alg(), status)
+		}
+		return tw.Flush()
+	case "rotate":
+		return keysRotate(args[1:])
+	case "retire":
+		if len(args) < 2 {
+			return errors.New(keysUsage)
+		}
+		return keysRetire(args[1], args[2:])
+	default:
+		return errors.New(keysUsage)
+	}
+}
+
+// loadKeyring resolves the configuration from args and opens the access keyring.
+func loadKeyring(args []string) (*auth.Keyring, *env.Config, error) {
+	cfg, err := loadConfig(args)
+	if err != nil {
+		return nil, nil, err
+	}
+	key, err := auth.NewAccessKey(cfg.AuthTokenKid, cfg.AuthTokenSecret, cfg.AuthSigningKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	ring, err := auth.LoadKeyring(cfg.AuthKeyringPath, key)
+	if err != nil {
+		return nil, nil, err
+	}
+	return ring, cfg, nil
+}
+
+// keysRotate adds a new key to the keyring and makes it the active one. The running server
+// keeps signing with the old key until it is reloaded, so CouchDB can be told first.
+func keysRotate(args []string) error {
+	fs := flag.NewFlagSet("papaya keys rotate", flag.ContinueOnError)
+	keyType := fs.String("type", "", "key type: hmac, rsa, ec (P-256) or ed25519 (default: same as the active key)")
+	kid := fs.String("kid", "", "key ID for the new key (default: papaya_<timestamp>)")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	ring, cfg, err := loadKeyring(fs.Args())
+	if err != nil {
+		return err
+	}
+	old := ring.Active()
+	if *keyType == "" {
+		*keyType = keyTypeOf(old)
+	}
+	if *kid == "" {
+		*kid = "papaya_" + time.Now().UTC().Format("20060102150405")
+	}
+
+	var key *auth.SigningKey
+	if *keyType == "hmac" {
+		key, err = auth.GenerateHMACKey(*kid)
+	} else {
+		key, _, err = auth.GenerateKey(*kid, *keyType)
+	}
+	if err != nil {
+		return err
+	}
+	if err := ring.Rotate(key); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(cfg.ConfigDir, 0750); err != nil {
+		return err
+	}
+	if err := ring.Save(); err != nil {
+		return err
+	}
+
+	fmt.Fprintf(os.Stderr, "Added %s key %q to %s and made it active (was %q).\n", key.Method.Alg(), key.Kid, cfg.AuthKeyringPath, old.Kid)
+	fmt.Fprintln(os.Stderr, "1. Add this line to CouchDB's [jwt_keys] (papaya.couchdb.ini) and restart CouchDB:")
+	if err := printCouchDBEntry(key); err != nil {
+		fmt.Fprintf(os.Stderr, "Note: %v\n", err)
+	}
+	fmt.Fprintln(os.Stderr, "2. Reload papaya (SIGHUP) or restart it so it signs with the new key.")
+	fmt.Fprintf(os.Stderr, "3. Once tokens signed with %q have expired (auth.access_token_ttl), run: papaya keys retire %s\n", old.Kid, old.Kid)
+	return nil
+}
+
+// keysRetire removes a key from the keyring and prints the CouchDB line that can go with it.
+func keysRetire(kid string, args []string) error {
+	ring, cfg, err := loadKeyring(args)
+	if err != nil {
+		return err
+	}
+	key, err := ring.Retire(kid)
+	if err != nil {
+		return err
+	}
+	if err := ring.Save(); err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "Retired key %q in %s. Reload papaya (SIGHUP) to stop accepting it, then remove this line from CouchDB's [jwt_keys]:\n", kid, cfg.AuthKeyringPath)
+	if err := printCouchDBEntry(key); err != nil {
+		fmt.Fprintf(os.Stderr, "Note: %v\n", err)
+	}
+	return nil
+}
+
+// keyTypeOf returns the -type value that generates keys like k.
+func keyTypeOf(k *auth.SigningKey) string {
+	switch {
+	case k.IsHMAC():
+		return "hmac"
+	case strings.HasPrefix(k.Method.Alg(), "RS"):
+		return "rsa"
+	case strings.HasPrefix(k.Method.Alg(), "ES"):
+		return "ec"
+	default:
+		return "ed25519"
+	}
+}
+
+// keysGenerate writes a new PKCS#8 private key (mode 0600) and prints the matching CouchDB entry.
+func keysGenerate(args []string) error {
+	fs := flag.NewFlagSet("papaya keys generate", flag.ContinueOnError)
+	keyType := fs.String("type", "ec", "key type: rsa, ec (P-256) or ed25519")
+	kid := fs.String("kid", "", "key ID; must match auth.token_kid (PAPAYA_AUTH_TOKEN_KID)")
+	out := fs.String("out", "", "file to write the PEM private key to")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *kid == "" || *out == "" {
+		return errors.New(keysUsage)
+	}
+	key, pemBytes, err := auth.GenerateKey(*kid, *keyType)
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(*out, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(pemBytes); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "Wrote %s key to %s. Set auth.signing_key_file (PAPAYA_AUTH_SIGNING_KEY_FILE) to it and auth.token_kid to %q.\n", key.Method.Alg(), *out, *kid)
+	if err := printCouchDBEntry(key); err != nil {
+		fmt.Fprintf(os.Stderr, "Note: %v\n", err)
+	}
+	return nil
+}
+
+func printCouchDBEntry(keys ...*auth.SigningKey) error {
+	var entries []string
+	for _, key := range keys {
+		entry, err := key.CouchDBEntry()
+		if err != nil {
+			return fmt.Errorf("kid %q: %w", key.Kid, err)
+		}
+		entries = append(entries, entry)
+	}
+	fmt.Println("[jwt_keys]")
+	for _, entry := range entries {
+		fmt.Println(entry)
+	}
+	return nil
+}
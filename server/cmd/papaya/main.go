@@ -1,56 +1,227 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"log"
+	"log/slog"
+	"net"
 	"net/http"
+	"os"
+	"os/signal"
 	"strconv"
+	"strings"
+	"syscall"
+	"time"
 
 	"github.com/fridayflag/papaya/internal/api"
 	"github.com/fridayflag/papaya/internal/auth"
-	"github.com/fridayflag/papaya/internal/config"
 	"github.com/fridayflag/papaya/internal/env"
 	"github.com/fridayflag/papaya/internal/proxy"
 	"github.com/fridayflag/papaya/internal/static"
 )
 
+const usage = `Usage:
+  papaya [serve] [flags]    Run the server
+  papaya config print       Show effective settings and where each came from
+  papaya doctor             Check the setup and print a pass/warn/fail report
+  papaya migrate status     List auth database migrations and whether they are applied
+  papaya migrate up         Apply pending auth database migrations
+  papaya auth prune         Delete expired, used and revoked refresh tokens now
+  papaya auth reset-mfa U   Turn off two-factor authentication for user U (lost device)
+  papaya keys generate      Create a private key for signing access tokens
+  papaya keys couchdb       Print the CouchDB [jwt_keys] entries for the keys in use
+  papaya keys list          List the access-token keys and which one is active
+  papaya keys rotate        Add a new access-token key and make it active
+  papaya keys retire KID    Stop accepting tokens signed with an old key
+
+Run "papaya serve -h" to list the flags shared by all commands.
+`
+
 func main() {
-	cfg, err := env.Load()
+	args := os.Args[1:]
+	cmd := "serve"
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		cmd, args = args[0], args[1:]
+	}
+	var err error
+	switch cmd {
+	case "serve":
+		err = serve(args)
+	case "config":
+		err = configCmd(args)
+	case "doctor":
+		err = doctorCmd(args)
+	case "keys":
+		err = keysCmd(args)
+	case "auth":
+		err = authCmd(args)
+	case "migrate":
+		err = migrateCmd(args)
+	case "help":
+		fmt.Print(usage)
+	default:
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+	if env.IsHelp(err) {
+		return
+	}
 	if err != nil {
-		log.Fatalf("env: %v", err)
+		log.Fatal(err)
 	}
+}
+
+// loadConfig resolves settings from flags and the other sources (see env.Load).
+func loadConfig(args []string) (*env.Config, error) {
+	cfg, err := env.Load(args)
+	if err != nil && !env.IsHelp(err) {
+		return nil, fmt.Errorf("config: %w", err)
+	}
+	return cfg, err
+}
+
+// configPollInterval is how often config.yaml is checked for changes.
+const configPollInterval = 2 * time.Second
 
-	_, _ = config.Load(cfg.ConfigDir) // TODO: use when config is implemented
+// shutdownTimeout bounds how long in-flight requests may take after SIGINT or SIGTERM.
+const shutdownTimeout = 15 * time.Second
+
+// logLevel filters slog and the standard logger (which logs at info once slog's default
+// handler is replaced); server.log_level sets it at startup and on reload.
+var logLevel = new(slog.LevelVar)
+
+func init() {
+	slog.SetDefault(slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: logLevel})))
+}
+
+func setLogLevel(name string) {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(name)); err == nil {
+		logLevel.Set(level)
+	}
+}
+
+// reloadOnSignal reloads the configuration on every SIGHUP.
+func reloadOnSignal(live *env.Live) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	for range hup {
+		slog.Info("config: SIGHUP received; reloading")
+		if err := live.Reload(); err != nil {
+			slog.Error("config: reload failed; keeping the current settings", "err", err)
+		}
+	}
+}
 
-	dbProxy, err := proxy.ReverseProxy("/db", cfg.CouchDBProxiedURL)
+func serve(args []string) error {
+	cfg, err := loadConfig(args)
 	if err != nil {
-		log.Fatalf("proxy: %v", err)
+		return err
 	}
 
-	tokenStore, err := auth.Open(cfg.AuthDBPath)
+	setLogLevel(cfg.App.Server.LogLevel)
+
+	if err := startupPreflight(cfg); err != nil {
+		return err
+	}
+
+	// SIGINT and SIGTERM stop the server gracefully: in-flight requests finish, background
+	// jobs stop, and the token store is closed last.
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	live := env.NewLive(cfg, args)
+	live.OnReload(func(next *env.Config) { setLogLevel(next.App.Server.LogLevel) })
+
+	tokenStore, err := auth.OpenStore(cfg.App.Auth.Store, cfg.AuthDBPath, cfg.AuthPostgresURL)
 	if err != nil {
-		log.Fatalf("auth store: %v", err)
+		return fmt.Errorf("auth store: %w", err)
 	}
 	defer tokenStore.Close()
 
-	ginRouter, err := api.Router(cfg, tokenStore)
+	keys, err := auth.LoadKeys(cfg.AuthTokenKid, cfg.AuthTokenSecret, cfg.AuthRefreshSecret, cfg.AuthMFASecret, cfg.AuthSigningKey, cfg.AuthKeyringPath)
+	if err != nil {
+		return fmt.Errorf("signing key: %w", err)
+	}
+	live.OnReload(func(*env.Config) {
+		// Picks up `papaya keys rotate` and `papaya keys retire`.
+		if err := keys.Access.Reload(); err != nil {
+			slog.Error("keyring: reload failed; keeping the current keys", "err", err)
+		}
+	})
+	go reloadOnSignal(live)
+	go live.Watch(ctx, configPollInterval)
+
+	janitor := auth.NewJanitor(tokenStore, func() (time.Duration, time.Duration) {
+		a := live.Get().App.Auth
+		return a.PruneInterval, a.PruneRetention
+	})
+	janitorDone := make(chan struct{})
+	go func() {
+		defer close(janitorDone)
+		janitor.Run(ctx)
+	}()
+	defer func() { stop(); <-janitorDone }() // Before tokenStore.Close
+
+	denylist, err := auth.NewDenylist(tokenStore)
 	if err != nil {
-		log.Fatalf("api: %v", err)
+		return fmt.Errorf("auth store: %w", err)
 	}
+	denylistDone := make(chan struct{})
+	go func() {
+		defer close(denylistDone)
+		denylist.Run(ctx)
+	}()
+	defer func() { stop(); <-denylistDone }() // Before tokenStore.Close
 
-	spa, err := static.SPA(cfg.StaticAssetsDir)
+	roles := api.NewRolesCache()
+	accessCookie := auth.CookieName(auth.CookieAccessToken, cfg.App.Auth.Cookies.HostPrefix)
+	dbProxy, err := proxy.ReverseProxy("/db", cfg.CouchDBProxiedURL, cfg.App.CouchDB, accessCookie,
+		api.ExchangePersonalAccessToken(live, tokenStore, keys, roles), api.AccessTokenRevoked(keys, denylist))
 	if err != nil {
-		log.Fatalf("static: %v", err)
+		return fmt.Errorf("proxy: %w", err)
+	}
+
+	ginRouter, err := api.Router(live, tokenStore, keys, denylist, roles)
+	if err != nil {
+		return fmt.Errorf("api: %w", err)
+	}
+
+	spa, err := static.SPA(cfg.StaticAssetsDir, cfg.App.Static)
+	if err != nil {
+		return fmt.Errorf("static: %w", err)
 	}
 
 	mux := http.NewServeMux()
-	mux.Handle("/db/", dbProxy)
+	mux.Handle("/db/", api.CSRFProtect(live, dbProxy))
 	mux.Handle("/db", http.RedirectHandler("/db/", http.StatusMovedPermanently))
 	mux.Handle("/api/", ginRouter)
 	mux.Handle("/", spa)
 
-	addr := ":" + strconv.Itoa(cfg.ServerPort)
-	log.Printf("Papaya server listening on %s", addr)
-	if err := http.ListenAndServe(addr, mux); err != nil {
-		log.Fatalf("serve: %v", err)
+	srv := &http.Server{
+		Addr:              net.JoinHostPort(cfg.App.Server.Address, strconv.Itoa(cfg.ServerPort)),
+		Handler:           mux,
+		ReadHeaderTimeout: cfg.App.Server.ReadHeaderTimeout,
+		IdleTimeout:       cfg.App.Server.IdleTimeout,
+	}
+	shutdownErr := make(chan error, 1)
+	go func() {
+		<-ctx.Done()
+		slog.Info("shutting down")
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		shutdownErr <- srv.Shutdown(shutdownCtx)
+	}()
+
+	log.Printf("Papaya server listening on %s", srv.Addr)
+	if err := srv.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
+		stop()
+		return fmt.Errorf("serve: %w", err)
+	}
+	if err := <-shutdownErr; err != nil {
+		return fmt.Errorf("shutdown: %w", err)
 	}
+	return nil
 }
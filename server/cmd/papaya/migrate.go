@@ -0,0 +1,69 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/fridayflag/papaya/internal/auth"
+)
+
+const migrateUsage = `usage: papaya migrate status|up [flags]`
+
+// migrateCmd implements "papaya migrate status" and "papaya migrate up" for the auth
+// database selected by auth.store (papaya.db in the config directory, or PostgreSQL). The
+// server applies pending migrations at startup too; "up" is for migrating ahead of a deploy.
+func migrateCmd(args []string) error {
+	if len(args) == 0 {
+		return errors.New(migrateUsage)
+	}
+	cfg, err := loadConfig(args[1:])
+	if err != nil {
+		return err
+	}
+	statusOf, migrate := auth.Migrations, auth.MigrateUp
+	target := cfg.AuthDBPath
+	switch cfg.App.Auth.Store {
+	case "postgres":
+		statusOf, migrate = auth.PostgresMigrations, auth.PostgresMigrateUp
+		target = cfg.AuthPostgresURL
+	case "memory":
+		return errors.New("auth.store is memory; there is no database to migrate")
+	}
+	switch args[0] {
+	case "status":
+		status, err := statusOf(target)
+		if status == nil {
+			return err
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "VERSION\tNAME\tAPPLIED")
+		for _, m := range status {
+			applied := "pending"
+			if !m.Pending() {
+				applied = m.AppliedAt.Format(time.RFC3339)
+			}
+			fmt.Fprintf(w, "%d\t%s\t%s\n", m.Version, m.Name, applied)
+		}
+		if err := w.Flush(); err != nil {
+			return err
+		}
+		return err
+	case "up":
+		ran, err := migrate(target)
+		for _, m := range ran {
+			fmt.Printf("Applied %d %s\n", m.Version, m.Name)
+		}
+		if err != nil {
+			return err
+		}
+		if len(ran) == 0 {
+			fmt.Println("Up to date.")
+		}
+		return nil
+	default:
+		return errors.New(migrateUsage)
+	}
+}
@@ -3,12 +3,16 @@ package api
 import (
 	"encoding/base64"
 	"errors"
+	"expvar"
+	"fmt"
+	"log/slog"
 	"net/http"
 	"net/url"
 	"strings"
 	"time"
 
 	"github.com/fridayflag/papaya/internal/auth"
+	"github.com/fridayflag/papaya/internal/config"
 	"github.com/fridayflag/papaya/internal/env"
 	"github.com/gin-gonic/gin"
 )
@@ -22,43 +26,164 @@ const (
 )
 
 // Router returns a Gin engine with /api routes (login, refresh, logout).
-func Router(cfg *env.Config, store *auth.TokenStore) (*gin.Engine, error) {
+// Handlers read settings from live on every request, so reloaded settings apply immediately.
+// Admin routes answer 404 while features.admin is disabled. Logging out denylists access
+// tokens in denylist. Role changes made through the admin API drop the user from roles,
+// which should be the cache given to ExchangePersonalAccessToken too.
+func Router(live *env.Live, store auth.Store, keys *auth.Keys, denylist *auth.Denylist, roles *RolesCache) (*gin.Engine, error) {
 	gin.SetMode(gin.ReleaseMode)
 	r := gin.New()
 	r.Use(gin.Recovery())
+	// Only listed proxies may name the client in X-Forwarded-For; login throttling keys on it.
+	if err := r.SetTrustedProxies(live.Get().App.Server.TrustedProxies); err != nil {
+		return nil, fmt.Errorf("server.trusted_proxies: %w", err)
+	}
+	attempts := newMFAAttempts()
+	providers := &oidcProvider{}
 
 	api := r.Group("/api")
+	api.Use(corsMiddleware(live), csrfMiddleware(live))
 	{
 		api.GET("/health", healthHandler())
-		api.GET("/config", configHandler(cfg))
-		api.GET("/session", sessionHandler(cfg, store))
-		api.POST("/login", loginHandler(cfg, store))
-		api.POST("/refresh", refreshHandler(cfg, store))
-		api.POST("/logout", logoutHandler(cfg, store))
+		api.GET("/.well-known/jwks.json", jwksHandler(keys))
+		api.GET("/config", configHandler(live))
+		api.GET("/session", sessionHandler(live, store, keys, denylist, roles))
+		api.POST("/login", loginHandler(live, store, keys))
+		api.POST("/login/mfa", loginMFAHandler(live, store, keys, attempts))
+		api.POST("/refresh", refreshHandler(live, store, keys, roles))
+		api.POST("/logout", logoutHandler(live, store, keys, denylist))
+
+		sessions := api.Group("/sessions")
+		sessions.Use(requireUser(live, keys, denylist))
+		{
+			sessions.GET("", listSessionsHandler(store))
+			sessions.DELETE("", revokeAllSessionsHandler(live, store, denylist))
+			sessions.DELETE("/:id", revokeSessionHandler(live, store, denylist))
+			sessions.POST("/revoke-others", revokeOtherSessionsHandler(live, store, denylist))
+		}
+
+		mfa := api.Group("/mfa")
+		mfa.Use(requireUser(live, keys, denylist))
+		{
+			mfa.GET("", mfaStatusHandler(store))
+			mfa.DELETE("", mfaDisableHandler(store, keys))
+			mfa.POST("/totp", mfaEnrollHandler(live, store, keys))
+			mfa.POST("/totp/verify", mfaVerifyHandler(store, keys))
+			mfa.POST("/recovery-codes", mfaRecoveryCodesHandler(store, keys))
+		}
+
+		passkeys := api.Group("/webauthn")
+		passkeys.Use(passkeysMiddleware(live))
+		{
+			passkeys.POST("/login/begin", passkeyLoginBeginHandler(live, keys))
+			passkeys.POST("/login/finish", passkeyLoginFinishHandler(live, store, keys))
+
+			own := passkeys.Group("")
+			own.Use(requireUser(live, keys, denylist))
+			own.POST("/register/begin", passkeyRegisterBeginHandler(live, store, keys))
+			own.POST("/register/finish", passkeyRegisterFinishHandler(live, store, keys))
+			own.GET("/credentials", listPasskeysHandler(store))
+			own.DELETE("/credentials/:id", deletePasskeyHandler(store))
+		}
+
+		sso := api.Group("/oidc")
+		sso.Use(oidcMiddleware(live))
+		{
+			sso.GET("/login", oidcLoginHandler(live, providers, keys))
+			sso.GET("/callback", oidcCallbackHandler(live, providers, store, keys))
+		}
+
+		tokens := api.Group("/tokens")
+		tokens.Use(personalTokensMiddleware(live), requireUser(live, keys, denylist))
+		{
+			tokens.GET("", listPATsHandler(store))
+			tokens.POST("", createPATHandler(live, store))
+			tokens.DELETE("/:id", revokePATHandler(store))
+		}
 
 		admin := api.Group("/admin")
-		admin.Use(adminAuthMiddleware(cfg))
+		admin.Use(featureMiddleware(live, func(f config.FeaturesConfig) bool { return f.Admin }))
+		admin.Use(adminAuthMiddleware(live, store))
 		{
-			admin.GET("/", adminStatusHandler(cfg))
-			admin.GET("/users", adminListUsersHandler(cfg))
-			admin.PUT("/users", adminPutUserHandler(cfg))
-			admin.DELETE("/users/:id", adminDeleteUserHandler(cfg))
+			admin.GET("/", adminStatusHandler(live))
+			admin.GET("/users", adminListUsersHandler(live))
+			admin.PUT("/users", adminPutUserHandler(live, store, denylist, roles))
+			admin.DELETE("/users/:id", adminDeleteUserHandler(live))
+			admin.DELETE("/users/:id/sessions", adminLogoutUserHandler(live, store, denylist))
+			admin.GET("/lockouts", adminListLockoutsHandler(live, store))
+			admin.DELETE("/lockouts/:key", adminClearLockoutHandler(store))
+			admin.GET("/metrics", gin.WrapH(expvar.Handler())) // Includes papaya_auth_janitor
 		}
 	}
 	return r, nil
 }
 
+// featureMiddleware answers 404 while the feature selected by enabled is turned off.
+func featureMiddleware(live *env.Live, enabled func(config.FeaturesConfig) bool) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !enabled(live.Get().App.Features) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "not found"})
+			c.Abort()
+			return
+		}
+		c.Next()
+	}
+}
+
+// corsMiddleware allows credentialed cross-origin requests from server.cors_origins.
+// Requests from other origins get no CORS headers, so browsers block them.
+func corsMiddleware(live *env.Live) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		origin := c.GetHeader("Origin")
+		if origin == "" || !originAllowed(live.Get().App.Server.CORSOrigins, origin) {
+			c.Next()
+			return
+		}
+		c.Header("Access-Control-Allow-Origin", origin)
+		c.Header("Access-Control-Allow-Credentials", "true")
+		c.Header("Vary", "Origin")
+		if c.Request.Method == http.MethodOptions {
+			c.Header("Access-Control-Allow-Methods", "GET, POST, PUT, DELETE, OPTIONS")
+			c.Header("Access-Control-Allow-Headers", "Authorization, Content-Type")
+			c.Header("Access-Control-Max-Age", "600")
+			c.AbortWithStatus(http.StatusNoContent)
+			return
+		}
+		c.Next()
+	}
+}
+
+func originAllowed(allowed []string, origin string) bool {
+	for _, o := range allowed {
+		if o == "*" || strings.EqualFold(o, origin) {
+			return true
+		}
+	}
+	return false
+}
+
 func healthHandler() gin.HandlerFunc {
 	return func(c *gin.Context) {
 		c.JSON(http.StatusOK, gin.H{"status": "ok"})
 	}
 }
 
-func configHandler(cfg *env.Config) gin.HandlerFunc {
+// jwksHandler publishes the public keys access tokens are signed with (all keys in the
+// keyring that are not retired), so CouchDB and other consumers can verify them without a
+// secret that could also mint them. HMAC keys are never listed.
+func jwksHandler(keys *auth.Keys) gin.HandlerFunc {
 	return func(c *gin.Context) {
-		// Sync is enabled if CouchDBProxiedURL is set and is a valid URL
+		c.Header("Cache-Control", "public, max-age=300")
+		c.JSON(http.StatusOK, auth.PublicJWKS(keys.Access.Keys()...))
+	}
+}
+
+func configHandler(live *env.Live) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		cfg := live.Get()
+		// Sync is enabled if the feature is on and CouchDBProxiedURL is set and is a valid URL
 		syncEnabled := false
-		if cfg.CouchDBProxiedURL != "" {
+		if cfg.App.Features.Sync && cfg.CouchDBProxiedURL != "" {
 			if _, err := url.Parse(cfg.CouchDBProxiedURL); err == nil {
 				syncEnabled = true
 			}
@@ -70,208 +195,366 @@ func configHandler(cfg *env.Config) gin.HandlerFunc {
 }
 
 type loginRequest struct {
-	Username string `json:"username" binding:"required"`
-	Password string `json:"password" binding:"required"`
+	Username    string `json:"username" binding:"required"`
+	Password    string `json:"password" binding:"required"`
+	DeviceLabel string `json:"deviceLabel"` // Optional name for the session, e.g. "Work laptop"
+	RememberMe  *bool  `json:"rememberMe"`  // false: the session's refresh token lasts auth.short_refresh_token_ttl
 }
 
-func loginHandler(cfg *env.Config, store *auth.TokenStore) gin.HandlerFunc {
+func loginHandler(live *env.Live, store auth.Store, keys *auth.Keys) gin.HandlerFunc {
 	return func(c *gin.Context) {
+		cfg := live.Get()
+		// Behind a trusted authenticating proxy, its header stands in for the password.
+		if username := forwardedUser(c, cfg); username != "" {
+			var req struct {
+				DeviceLabel string `json:"deviceLabel"`
+			}
+			_ = c.ShouldBindJSON(&req) // The body is optional here
+			if forwardAuthLogin(c, cfg, store, keys, username, req.DeviceLabel) {
+				c.JSON(http.StatusOK, gin.H{"ok": true})
+			}
+			return
+		}
 		var req loginRequest
 		if err := c.ShouldBindJSON(&req); err != nil {
 			c.JSON(http.StatusBadRequest, gin.H{"error": "username and password required"})
 			return
 		}
-		// Validate credentials against CouchDB _session so the same credentials work for DB access.
-		if err := validateCouchDBCredentials(cfg, req.Username, req.Password); err != nil {
-			c.JSON(http.StatusUnauthorized, gin.H{"error": "invalid credentials"})
+		if loginThrottled(c, cfg, store, req.Username) {
 			return
 		}
-		access, err := auth.MintAccessToken(req.Username, cfg.AuthTokenSecret, cfg.AuthTokenKid)
+		username, err := credentialsFor(cfg, store).Validate(req.Username, req.Password)
 		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to mint token"})
+			if errors.Is(err, errUnauthorized) {
+				recordLoginFailure(c, cfg, store, req.Username)
+			} else {
+				slog.Warn("auth: credential check failed", "backend", cfg.App.Auth.Backend, "err", err)
+			}
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "invalid credentials"})
 			return
 		}
-		refresh, err := auth.MintRefreshToken(req.Username, cfg.AuthRefreshSecret, cfg.AuthTokenKid)
-		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to mint refresh token"})
+		req.Username = username
+		// With a second factor enrolled, the password alone only earns an MFA token for
+		// /api/login/mfa, and the failures counted so far stand until the code is right.
+		enrollment, err := store.MFA(req.Username)
+		if err != nil && !errors.Is(err, auth.ErrMFANotEnrolled) {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to issue tokens"})
+			return
+		}
+		if enrollment != nil && enrollment.Confirmed() {
+			token, err := auth.MintMFAToken(req.Username, req.DeviceLabel, shortLogin(req.RememberMe), keys.Refresh, cfg.App.Auth.MFAPendingTTL)
+			if err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to issue tokens"})
+				return
+			}
+			c.JSON(http.StatusOK, gin.H{"mfaRequired": true, "mfaToken": token})
 			return
 		}
-		hash := auth.TokenHash(refresh)
-		expiresAt := time.Now().Add(auth.RefreshTokenDuration)
-		if err := store.Store(hash, req.Username, expiresAt); err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to store refresh token"})
+		clearLoginFailures(c, cfg, store, req.Username)
+		if err := issueTokens(c, cfg, store, keys, req.Username, req.DeviceLabel, shortLogin(req.RememberMe)); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to issue tokens"})
 			return
 		}
-		setAuthCookies(c, access, refresh)
 		c.JSON(http.StatusOK, gin.H{"ok": true})
 	}
 }
 
-func refreshHandler(cfg *env.Config, store *auth.TokenStore) gin.HandlerFunc {
+func refreshHandler(live *env.Live, store auth.Store, keys *auth.Keys, roles *RolesCache) gin.HandlerFunc {
 	return func(c *gin.Context) {
-		refresh, err := c.Cookie(auth.CookieRefreshToken)
-		if err != nil || refresh == "" {
+		cfg := live.Get()
+		refresh := readCookie(c, cfg, auth.CookieRefreshToken)
+		if refresh == "" {
 			c.JSON(http.StatusUnauthorized, gin.H{"error": "missing refresh token"})
 			return
 		}
-		username, err := auth.ValidateRefreshToken(refresh, cfg.AuthRefreshSecret)
-		if err != nil {
-			clearAuthCookies(c)
-			c.JSON(http.StatusUnauthorized, gin.H{"error": "invalid refresh token"})
+		if _, ok := rotateTokens(c, cfg, store, keys, roles, refresh); !ok {
 			return
 		}
-		hash := auth.TokenHash(refresh)
-		username, err = store.Consume(hash)
-		if err != nil {
-			clearAuthCookies(c)
-			if errors.Is(err, auth.ErrTokenUsed) || errors.Is(err, auth.ErrTokenRevoked) {
-				c.JSON(http.StatusUnauthorized, gin.H{"error": "refresh token already used or revoked"})
-				return
-			}
-			if errors.Is(err, auth.ErrTokenNotFound) || errors.Is(err, auth.ErrTokenExpired) {
-				c.JSON(http.StatusUnauthorized, gin.H{"error": "invalid or expired refresh token"})
-				return
-			}
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to validate refresh token"})
-			return
-		}
-		access, err := auth.MintAccessToken(username, cfg.AuthTokenSecret, cfg.AuthTokenKid)
-		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to mint token"})
-			return
-		}
-		newRefresh, err := auth.MintRefreshToken(username, cfg.AuthRefreshSecret, cfg.AuthTokenKid)
-		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to mint refresh token"})
-			return
-		}
-		newHash := auth.TokenHash(newRefresh)
-		expiresAt := time.Now().Add(auth.RefreshTokenDuration)
-		if err := store.Store(newHash, username, expiresAt); err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to store refresh token"})
-			return
-		}
-		setAuthCookies(c, access, newRefresh)
 		c.JSON(http.StatusOK, gin.H{"ok": true})
 	}
 }
 
-func sessionHandler(cfg *env.Config, store *auth.TokenStore) gin.HandlerFunc {
+func sessionHandler(live *env.Live, store auth.Store, keys *auth.Keys, denylist *auth.Denylist, roles *RolesCache) gin.HandlerFunc {
 	return func(c *gin.Context) {
+		cfg := live.Get()
+		// A trusted proxy's header wins over cookies that are missing or someone else's.
+		if username := forwardedUser(c, cfg); username != "" && cookieUser(c, cfg, keys) != username {
+			if forwardAuthLogin(c, cfg, store, keys, username, "") {
+				c.JSON(http.StatusOK, gin.H{"username": username})
+			}
+			return
+		}
+		refresh := readCookie(c, cfg, auth.CookieRefreshToken)
 		// Try to get access token first
-		access, err := c.Cookie(auth.CookieAccessToken)
-		if err == nil && access != "" {
-			username, err := auth.ValidateAccessToken(access, cfg.AuthTokenSecret)
-			if err == nil {
-				// Access token is valid, refresh it and return user context
-				newAccess, err := auth.MintAccessToken(username, cfg.AuthTokenSecret, cfg.AuthTokenKid)
+		if access := readCookie(c, cfg, auth.CookieAccessToken); access != "" {
+			claims, err := auth.ParseAccessToken(access, keys.Access)
+			if err == nil && refresh == "" && !denylist.Denied(claims.ID, claims.SessionID) {
+				// No refresh token, just set new access token
+				username := claims.Subject
+				authTime := claims.LoginTime()
+				ttl := accessTTL(cfg, authTime, time.Now())
+				if ttl <= 0 {
+					clearAuthCookies(c, cfg)
+					c.JSON(http.StatusUnauthorized, gin.H{"error": "session expired; log in again"})
+					return
+				}
+				newAccess, err := mintSessionAccessToken(keys, roles.get(cfg, username), username, claims.SessionID, authTime, ttl)
 				if err != nil {
 					c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to mint token"})
 					return
 				}
-				refresh, _ := c.Cookie(auth.CookieRefreshToken)
-				if refresh != "" {
-					// Also refresh the refresh token
-					newRefresh, err := auth.MintRefreshToken(username, cfg.AuthRefreshSecret, cfg.AuthTokenKid)
-					if err == nil {
-						newHash := auth.TokenHash(newRefresh)
-						expiresAt := time.Now().Add(auth.RefreshTokenDuration)
-						if err := store.Store(newHash, username, expiresAt); err == nil {
-							setAuthCookies(c, newAccess, newRefresh)
-						} else {
-							// If store fails, keep old refresh token
-							setAuthCookies(c, newAccess, refresh)
-						}
-					} else {
-						// If mint fails, keep old refresh token
-						setAuthCookies(c, newAccess, refresh)
-					}
-				} else {
-					// No refresh token, just set new access token
-					c.SetCookie(auth.CookieAccessToken, newAccess, 15*60, "/", "", false, true)
-				}
+				setCookie(c, cfg, auth.CookieAccessToken, newAccess, maxAge(ttl), "/")
 				c.JSON(http.StatusOK, gin.H{"username": username})
 				return
 			}
+			// With a refresh token, rotate it below so the session stays in its family.
 		}
 
-		// Access token invalid or missing, try refresh token
-		refresh, err := c.Cookie(auth.CookieRefreshToken)
-		if err != nil || refresh == "" {
+		if refresh == "" {
 			c.JSON(http.StatusUnauthorized, gin.H{"error": "missing or invalid token"})
 			return
 		}
-		username, err := auth.ValidateRefreshToken(refresh, cfg.AuthRefreshSecret)
-		if err != nil {
-			clearAuthCookies(c)
-			c.JSON(http.StatusUnauthorized, gin.H{"error": "invalid refresh token"})
+		username, ok := rotateTokens(c, cfg, store, keys, roles, refresh)
+		if !ok {
 			return
 		}
-		hash := auth.TokenHash(refresh)
-		username, err = store.Consume(hash)
-		if err != nil {
-			clearAuthCookies(c)
-			if errors.Is(err, auth.ErrTokenUsed) || errors.Is(err, auth.ErrTokenRevoked) {
-				c.JSON(http.StatusUnauthorized, gin.H{"error": "refresh token already used or revoked"})
-				return
-			}
-			if errors.Is(err, auth.ErrTokenNotFound) || errors.Is(err, auth.ErrTokenExpired) {
-				c.JSON(http.StatusUnauthorized, gin.H{"error": "invalid or expired refresh token"})
-				return
-			}
+		c.JSON(http.StatusOK, gin.H{"username": username})
+	}
+}
+
+// rotateTokens exchanges a refresh token for new access and refresh tokens and sets the
+// cookies. The new refresh token keeps the login time of the old one, so the session ends
+// auth.session_max_age after the login however often it is rotated. A token rotated
+// within auth.refresh_grace (a concurrent request from another tab) yields the same
+// successor. On failure it clears the auth cookies, writes the error response and
+// returns ok == false; a replayed token revokes its family (see
+// SessionStore.Rotate) and is logged.
+func rotateTokens(c *gin.Context, cfg *env.Config, store auth.Store, keys *auth.Keys, roles *RolesCache, refresh string) (username string, ok bool) {
+	claims, err := auth.ParseRefreshToken(refresh, keys.Refresh)
+	if err != nil {
+		clearAuthCookies(c, cfg)
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "invalid refresh token"})
+		return "", false
+	}
+	username = claims.Subject
+	now := time.Now()
+	authTime := claims.LoginTime()
+	expiresAt := refreshExpiry(cfg, authTime, claims.Short, now)
+	if !expiresAt.After(now) {
+		// Past auth.session_max_age, which may have been lowered since the token was minted.
+		if err := store.Revoke(auth.TokenHash(refresh)); err != nil {
+			slog.Warn("auth: failed to revoke expired session", "err", err)
+		}
+		clearAuthCookies(c, cfg)
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "session expired; log in again"})
+		return "", false
+	}
+	next, err := auth.MintRefreshToken(username, keys.Refresh, authTime, expiresAt, claims.Short)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to mint refresh token"})
+		return "", false
+	}
+	sealed, err := auth.SealSuccessor(refresh, next)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to mint refresh token"})
+		return "", false
+	}
+	t := auth.RefreshToken{
+		Hash:      auth.TokenHash(next),
+		Username:  username,
+		ExpiresAt: expiresAt,
+	}
+	parent, prior, err := store.Rotate(auth.TokenHash(refresh), t, sealed, cfg.App.Auth.RefreshGrace)
+	if err != nil {
+		clearAuthCookies(c, cfg)
+		if errors.Is(err, auth.ErrTokenUsed) {
+			slog.Warn("auth: refresh token reused; revoked its session", "user", parent.Username, "family", parent.FamilyID, "ip", c.ClientIP())
+		}
+		if errors.Is(err, auth.ErrTokenUsed) || errors.Is(err, auth.ErrTokenRevoked) {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "refresh token already used or revoked"})
+			return "", false
+		}
+		if errors.Is(err, auth.ErrTokenNotFound) || errors.Is(err, auth.ErrTokenExpired) {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "invalid or expired refresh token"})
+			return "", false
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to validate refresh token"})
+		return "", false
+	}
+	if prior != nil {
+		if next, err = auth.OpenSuccessor(refresh, prior); err != nil {
 			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to validate refresh token"})
-			return
-		}
-		// Mint new tokens
-		newAccess, err := auth.MintAccessToken(username, cfg.AuthTokenSecret, cfg.AuthTokenKid)
-		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to mint token"})
-			return
+			return "", false
 		}
-		newRefresh, err := auth.MintRefreshToken(username, cfg.AuthRefreshSecret, cfg.AuthTokenKid)
-		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to mint refresh token"})
-			return
-		}
-		newHash := auth.TokenHash(newRefresh)
-		expiresAt := time.Now().Add(auth.RefreshTokenDuration)
-		if err := store.Store(newHash, username, expiresAt); err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to store refresh token"})
-			return
+		// The successor minted by the first request may expire a moment earlier.
+		if prev, err := auth.ParseRefreshToken(next, keys.Refresh); err == nil {
+			expiresAt = prev.ExpiresAt.Time
 		}
-		setAuthCookies(c, newAccess, newRefresh)
-		c.JSON(http.StatusOK, gin.H{"username": username})
+	} else if err := store.Touch(parent.FamilyID, c.Request.UserAgent(), c.ClientIP()); err != nil {
+		slog.Warn("auth: failed to record session use", "err", err)
+	}
+	ttl := accessTTL(cfg, authTime, now)
+	access, err := mintSessionAccessToken(keys, roles.get(cfg, parent.Username), parent.Username, parent.FamilyID, authTime, ttl)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to mint token"})
+		return "", false
+	}
+	setAuthCookies(c, cfg, access, next, ttl, expiresAt.Sub(now))
+	return parent.Username, true
+}
+
+// issueTokens mints an access token and the first refresh token of a new family (a fresh
+// login) for username, stores the refresh token with a new session labelled deviceLabel
+// and sets both cookies. A short login (no "remember me") gets a refresh token valid for
+// auth.short_refresh_token_ttl instead of auth.refresh_token_ttl.
+func issueTokens(c *gin.Context, cfg *env.Config, store auth.Store, keys *auth.Keys, username, deviceLabel string, short bool) error {
+	sessionID := auth.NewFamilyID()
+	now := time.Now()
+	ttl := accessTTL(cfg, now, now)
+	access, err := mintSessionAccessToken(keys, tokenRoles(cfg, username), username, sessionID, now, ttl)
+	if err != nil {
+		return err
+	}
+	expiresAt := refreshExpiry(cfg, now, short, now)
+	refresh, err := auth.MintRefreshToken(username, keys.Refresh, now, expiresAt, short)
+	if err != nil {
+		return err
+	}
+	t := auth.RefreshToken{
+		Hash:      auth.TokenHash(refresh),
+		Username:  username,
+		FamilyID:  sessionID,
+		ExpiresAt: expiresAt,
+	}
+	sess := auth.Session{DeviceLabel: deviceLabel, UserAgent: c.Request.UserAgent(), IP: c.ClientIP()}
+	if err := store.Store(t, sess); err != nil {
+		return err
+	}
+	setAuthCookies(c, cfg, access, refresh, ttl, expiresAt.Sub(now))
+	return nil
+}
+
+// mintSessionAccessToken mints an access token with roles for the user's session. Ending
+// the session denylists it by its sid claim (see auth.Denylist). A login reads the roles
+// afresh (see tokenRoles); refreshes take them from a RolesCache, so role changes apply
+// within rolesTTL.
+func mintSessionAccessToken(keys *auth.Keys, roles auth.Roles, username, sessionID string, authTime time.Time, ttl time.Duration) (string, error) {
+	token, _, err := auth.MintAccessToken(username, sessionID, authTime, roles, keys.Access.Active(), ttl)
+	return token, err
+}
+
+// tokenRoles returns the roles to put in username's access tokens: their roles in _users,
+// read with the server admin credentials (couchdb.admin_user), under couchdb.roles_claim.
+// Without a claim name or admin credentials tokens carry no roles claim; when _users
+// cannot be read they carry none either, and the failure is logged.
+func tokenRoles(cfg *env.Config, username string) auth.Roles {
+	claim := cfg.App.CouchDB.RolesClaim
+	if claim == "" || cfg.CouchDBAdminUser == "" {
+		return auth.Roles{}
+	}
+	doc, err := adminGetUser(cfg, cfg.CouchDBAdminUser, cfg.CouchDBAdminPass, username)
+	if err != nil {
+		slog.Warn("auth: failed to read roles; token carries none", "user", username, "err", err)
+		return auth.Roles{}
+	}
+	roles := auth.Roles{Claim: claim}
+	if doc != nil {
+		roles.Names = doc.Roles
 	}
+	return roles
 }
 
-func logoutHandler(cfg *env.Config, store *auth.TokenStore) gin.HandlerFunc {
+// refreshExpiry returns when a refresh token minted at now for a login at authTime
+// expires: auth.refresh_token_ttl (auth.short_refresh_token_ttl for a short login) from
+// now, but no later than auth.session_max_age after the login.
+func refreshExpiry(cfg *env.Config, authTime time.Time, short bool, now time.Time) time.Time {
+	ttl := cfg.App.Auth.RefreshTokenTTL
+	if short {
+		ttl = cfg.App.Auth.ShortRefreshTTL
+	}
+	expiresAt := now.Add(ttl)
+	if limit := cfg.App.Auth.SessionMaxAge; limit > 0 && authTime.Add(limit).Before(expiresAt) {
+		expiresAt = authTime.Add(limit)
+	}
+	return expiresAt
+}
+
+// accessTTL returns the lifetime of an access token minted at now for a login at
+// authTime: auth.access_token_ttl, cut short by auth.session_max_age. It is not positive
+// once the session is past its maximum age.
+func accessTTL(cfg *env.Config, authTime, now time.Time) time.Duration {
+	ttl := cfg.App.Auth.AccessTokenTTL
+	if limit := cfg.App.Auth.SessionMaxAge; limit > 0 {
+		ttl = min(ttl, authTime.Add(limit).Sub(now))
+	}
+	return ttl
+}
+
+// shortLogin reports whether a login asked not to be remembered; without an answer it is.
+func shortLogin(rememberMe *bool) bool {
+	return rememberMe != nil && !*rememberMe
+}
+
+// logoutHandler ends the session in the cookies: its refresh token family is revoked and
+// its access tokens are denylisted, so they stop working at /db at once.
+func logoutHandler(live *env.Live, store auth.Store, keys *auth.Keys, denylist *auth.Denylist) gin.HandlerFunc {
 	return func(c *gin.Context) {
-		refresh, _ := c.Cookie(auth.CookieRefreshToken)
+		cfg := live.Get()
+		refresh := readCookie(c, cfg, auth.CookieRefreshToken)
 		if refresh != "" {
 			hash := auth.TokenHash(refresh)
 			_ = store.Revoke(hash)
 		}
-		clearAuthCookies(c)
+		if access := readCookie(c, cfg, auth.CookieAccessToken); access != "" {
+			if claims, err := auth.ParseAccessToken(access, keys.Access); err == nil {
+				err := denylist.DenyToken(claims.ID, claims.ExpiresAt.Time)
+				if err == nil && claims.SessionID != "" {
+					// Also ends the session when the refresh cookie was missing.
+					if err := store.RevokeSession(claims.Subject, claims.SessionID); err != nil && !errors.Is(err, auth.ErrSessionNotFound) {
+						slog.Warn("auth: failed to revoke session", "err", err)
+					}
+					err = denySessions(cfg, denylist, claims.SessionID)
+				}
+				if err != nil {
+					slog.Warn("auth: failed to denylist access tokens", "err", err)
+				}
+			}
+		}
+		clearAuthCookies(c, cfg)
 		c.JSON(http.StatusOK, gin.H{"ok": true})
 	}
 }
 
-func setAuthCookies(c *gin.Context, access, refresh string) {
-	maxAge := 7 * 24 * 3600                                                     // 7 days in seconds for refresh; access is short-lived
-	c.SetCookie(auth.CookieAccessToken, access, 15*60, "/", "", false, true)    // 15 min, httpOnly
-	c.SetCookie(auth.CookieRefreshToken, refresh, maxAge, "/", "", false, true) // 7 days, httpOnly
+// setAuthCookies sets both auth cookies to expire with their tokens, which are valid for
+// accessTTL and refreshTTL.
+func setAuthCookies(c *gin.Context, cfg *env.Config, access, refresh string, accessTTL, refreshTTL time.Duration) {
+	setCookie(c, cfg, auth.CookieAccessToken, access, maxAge(accessTTL), "/")
+	setCookie(c, cfg, auth.CookieRefreshToken, refresh, maxAge(refreshTTL), "/")
 }
 
-func clearAuthCookies(c *gin.Context) {
-	c.SetCookie(auth.CookieAccessToken, "", -1, "/", "", false, true)
-	c.SetCookie(auth.CookieRefreshToken, "", -1, "/", "", false, true)
+// maxAge returns a cookie max-age in whole seconds for a token valid for ttl, at least 1:
+// a cookie with max-age 0 would be deleted instead.
+func maxAge(ttl time.Duration) int {
+	return max(int(ttl.Seconds()), 1)
+}
+
+func clearAuthCookies(c *gin.Context, cfg *env.Config) {
+	setCookie(c, cfg, auth.CookieAccessToken, "", -1, "/")
+	setCookie(c, cfg, auth.CookieRefreshToken, "", -1, "/")
 }
 
 // adminAuthMiddleware parses Basic auth and validates credentials against CouchDB; stores user/pass in context for downstream handlers.
-func adminAuthMiddleware(cfg *env.Config) gin.HandlerFunc {
+// A personal access token with the admin scope ("Authorization: Bearer pat_...") is accepted
+// too, as long as its user is still a server admin; handlers then use couchdb.admin_user.
+func adminAuthMiddleware(live *env.Live, store auth.Store) gin.HandlerFunc {
 	return func(c *gin.Context) {
+		cfg := live.Get()
 		const prefix = "Basic "
 		authHeader := c.GetHeader("Authorization")
+		if token, ok := strings.CutPrefix(authHeader, "Bearer "); ok && auth.IsPersonalAccessToken(token) {
+			adminTokenAuth(c, cfg, store, token)
+			return
+		}
 		if authHeader == "" || !strings.HasPrefix(authHeader, prefix) {
 			c.Header("WWW-Authenticate", `Basic realm="admin"`)
 			c.JSON(http.StatusUnauthorized, gin.H{"error": "missing or invalid Authorization header; use Basic auth"})
@@ -294,18 +577,50 @@ func adminAuthMiddleware(cfg *env.Config) gin.HandlerFunc {
 			return
 		}
 		username, password := parts[0], parts[1]
+		if loginThrottled(c, cfg, store, username) {
+			c.Abort()
+			return
+		}
 		if err := validateCouchDBCredentials(cfg, username, password); err != nil {
+			if errors.Is(err, errUnauthorized) {
+				recordLoginFailure(c, cfg, store, username)
+			}
 			c.Header("WWW-Authenticate", `Basic realm="admin"`)
 			c.JSON(http.StatusUnauthorized, gin.H{"error": "invalid admin credentials"})
 			c.Abort()
 			return
 		}
+		clearLoginFailures(c, cfg, store, username)
 		c.Set(string(adminUsernameKey), username)
 		c.Set(string(adminPasswordKey), password)
 		c.Next()
 	}
 }
 
+// adminTokenAuth authenticates an admin request made with a personal access token; see
+// adminAuthMiddleware.
+func adminTokenAuth(c *gin.Context, cfg *env.Config, store auth.Store, token string) {
+	t, err := usePersonalAccessToken(cfg, store, token, auth.ScopeAdmin)
+	if errors.Is(err, auth.ErrScopeMissing) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "personal access token lacks the admin scope"})
+		c.Abort()
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "invalid or expired personal access token"})
+		c.Abort()
+		return
+	}
+	if status, msg := checkServerAdmin(cfg, t.Username); status != http.StatusOK {
+		c.JSON(status, gin.H{"error": msg})
+		c.Abort()
+		return
+	}
+	c.Set(string(adminUsernameKey), cfg.CouchDBAdminUser)
+	c.Set(string(adminPasswordKey), cfg.CouchDBAdminPass)
+	c.Next()
+}
+
 func getAdminCreds(c *gin.Context) (username, password string) {
 	u, _ := c.Get(string(adminUsernameKey))
 	p, _ := c.Get(string(adminPasswordKey))
@@ -315,8 +630,9 @@ func getAdminCreds(c *gin.Context) (username, password string) {
 }
 
 // adminStatusHandler returns DB connection status: managed vs external, couch-per-user, etc.
-func adminStatusHandler(cfg *env.Config) gin.HandlerFunc {
+func adminStatusHandler(live *env.Live) gin.HandlerFunc {
 	return func(c *gin.Context) {
+		cfg := live.Get()
 		username, password := getAdminCreds(c)
 		managed, couchPerUser, err := adminDBStatus(cfg, username, password)
 		if err != nil {
@@ -338,8 +654,9 @@ func adminStatusHandler(cfg *env.Config) gin.HandlerFunc {
 }
 
 // adminListUsersHandler lists users from _users.
-func adminListUsersHandler(cfg *env.Config) gin.HandlerFunc {
+func adminListUsersHandler(live *env.Live) gin.HandlerFunc {
 	return func(c *gin.Context) {
+		cfg := live.Get()
 		username, password := getAdminCreds(c)
 		users, err := adminListUsers(cfg, username, password)
 		if err != nil {
@@ -360,9 +677,11 @@ type putUserRequest struct {
 	Password string   `json:"password,omitempty"`
 }
 
-// adminPutUserHandler creates or updates a user.
-func adminPutUserHandler(cfg *env.Config) gin.HandlerFunc {
+// adminPutUserHandler creates or updates a user. Setting a new password logs the user
+// out everywhere.
+func adminPutUserHandler(live *env.Live, store auth.Store, denylist *auth.Denylist, roles *RolesCache) gin.HandlerFunc {
 	return func(c *gin.Context) {
+		cfg := live.Get()
 		adminUser, adminPass := getAdminCreds(c)
 		var req putUserRequest
 		if err := c.ShouldBindJSON(&req); err != nil {
@@ -391,6 +710,18 @@ func adminPutUserHandler(cfg *env.Config) gin.HandlerFunc {
 			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 			return
 		}
+		// The document's _id, when given, names the user: _users requires
+		// "org.couchdb.user:<name>".
+		username := req.Name
+		if req.ID != "" {
+			username = strings.TrimPrefix(req.ID, userDocPrefix)
+		}
+		roles.forget(username) // The next refresh carries the new roles
+		if !created && req.Password != "" {
+			if err := logOutEverywhere(cfg, store, denylist, username); err != nil {
+				slog.Warn("auth: failed to revoke sessions after password change", "user", username, "err", err)
+			}
+		}
 		if created {
 			c.JSON(http.StatusCreated, gin.H{"ok": true, "rev": rev, "created": true})
 		} else {
@@ -400,8 +731,9 @@ func adminPutUserHandler(cfg *env.Config) gin.HandlerFunc {
 }
 
 // adminDeleteUserHandler deletes a user.
-func adminDeleteUserHandler(cfg *env.Config) gin.HandlerFunc {
+func adminDeleteUserHandler(live *env.Live) gin.HandlerFunc {
 	return func(c *gin.Context) {
+		cfg := live.Get()
 		adminUser, adminPass := getAdminCreds(c)
 		docID := c.Param("id")
 		if docID == "" {
@@ -419,3 +751,17 @@ func adminDeleteUserHandler(cfg *env.Config) gin.HandlerFunc {
 		c.JSON(http.StatusOK, gin.H{"ok": true})
 	}
 }
+
+// adminLogoutUserHandler logs a user out everywhere: their refresh tokens are revoked and
+// the access tokens issued to their sessions denylisted. :id is the username or the
+// _users document ID.
+func adminLogoutUserHandler(live *env.Live, store auth.SessionStore, denylist *auth.Denylist) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		username := strings.TrimPrefix(c.Param("id"), userDocPrefix)
+		if err := logOutEverywhere(live.Get(), store, denylist, username); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to revoke sessions"})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"ok": true})
+	}
+}
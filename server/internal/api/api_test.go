@@ -0,0 +1,252 @@
+package api
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/fridayflag/papaya/internal/auth"
+	"github.com/fridayflag/papaya/internal/env"
+)
+
+// jwksKids fetches /api/.well-known/jwks.json and returns the kids it lists.
+func jwksKids(t *testing.T, s *testServer) []string {
+	t.Helper()
+	resp, body := s.do(http.DefaultClient, http.MethodGet, "/api/.well-known/jwks.json", nil)
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Cache-Control") != "public, max-age=300" {
+		t.Fatalf("GET jwks.json: %d %v %s", resp.StatusCode, resp.Header, body)
+	}
+	var set auth.JWKS
+	decode(t, body, &set)
+	kids := []string{}
+	for _, k := range set.Keys {
+		kids = append(kids, k.Kid)
+	}
+	return kids
+}
+
+// TestJWKS checks that the key set follows the keyring: the configured key pair, keys
+// added by rotation and none that were retired. HMAC keys are secret and never listed.
+func TestJWKS(t *testing.T) {
+	_, pemBytes, err := auth.GenerateKey("rsa1", "rsa")
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyFile := filepath.Join(t.TempDir(), "key.pem")
+	if err := os.WriteFile(keyFile, pemBytes, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	s := newTestServer(t, func(cfg *env.Config) {
+		cfg.AuthTokenKid = "rsa1"
+		cfg.AuthSigningKey = keyFile
+	})
+	if got := jwksKids(t, s); !slices.Equal(got, []string{"rsa1"}) {
+		t.Errorf("JWKS kids = %v, want [rsa1]", got)
+	}
+
+	// Tokens from a login name a key the set lists.
+	s.couch.addUser("alice", "pw")
+	browser := s.client()
+	s.login(browser, "alice", "pw")
+	if _, err := auth.ValidateAccessToken(s.cookie(browser, auth.CookieAccessToken), s.keys.Access); err != nil {
+		t.Fatalf("access token from login: %v", err)
+	}
+
+	ec, _, err := auth.GenerateKey("ec1", "ec")
+	if err != nil {
+		t.Fatal(err)
+	}
+	hmac, err := auth.GenerateHMACKey("hmac1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, k := range []*auth.SigningKey{ec, hmac} {
+		if err := s.keys.Access.Rotate(k); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := jwksKids(t, s); !slices.Equal(got, []string{"rsa1", "ec1"}) {
+		t.Errorf("JWKS kids after rotation = %v, want [rsa1 ec1]", got)
+	}
+	if _, err := s.keys.Access.Retire("rsa1"); err != nil {
+		t.Fatal(err)
+	}
+	if got := jwksKids(t, s); !slices.Equal(got, []string{"ec1"}) {
+		t.Errorf("JWKS kids after retiring rsa1 = %v, want [ec1]", got)
+	}
+
+	if got := jwksKids(t, newTestServer(t, nil)); len(got) != 0 {
+		t.Errorf("JWKS kids with only an HMAC secret = %v, want none", got)
+	}
+}
+
+// storeSession stores a session for alice that logged in at authTime, whose refresh token
+// expires at expiresAt, and returns a Cookie header with its refresh token (when refresh is
+// set) and an access token of it.
+func (s *testServer) storeSession(authTime, expiresAt time.Time, refresh bool) string {
+	s.t.Helper()
+	sessionID := auth.NewFamilyID()
+	access, _, err := auth.MintAccessToken("alice", sessionID, authTime, auth.Roles{}, s.keys.Access.Active(), 15*time.Minute)
+	if err != nil {
+		s.t.Fatal(err)
+	}
+	hostPrefix := s.live.Get().App.Auth.Cookies.HostPrefix
+	cookie := auth.CookieName(auth.CookieAccessToken, hostPrefix) + "=" + access
+	if !refresh {
+		return cookie
+	}
+	token, err := auth.MintRefreshToken("alice", s.keys.Refresh, authTime, expiresAt, false)
+	if err != nil {
+		s.t.Fatal(err)
+	}
+	t := auth.RefreshToken{Hash: auth.TokenHash(token), Username: "alice", FamilyID: sessionID, ExpiresAt: expiresAt}
+	if err := s.store.Store(t, auth.Session{}); err != nil {
+		s.t.Fatal(err)
+	}
+	return cookie + "; " + auth.CookieName(auth.CookieRefreshToken, hostPrefix) + "=" + token
+}
+
+// authCookies returns the access and refresh cookies resp sets (nil when it sets none).
+func (s *testServer) authCookies(resp *http.Response) (access, refresh *http.Cookie) {
+	hostPrefix := s.live.Get().App.Auth.Cookies.HostPrefix
+	set := setCookies(resp)
+	return set[auth.CookieName(auth.CookieAccessToken, hostPrefix)], set[auth.CookieName(auth.CookieRefreshToken, hostPrefix)]
+}
+
+// within reports whether a cookie's Max-Age is want, allowing for the seconds a test takes.
+func within(c *http.Cookie, want time.Duration) bool {
+	return c != nil && c.MaxAge <= int(want.Seconds()) && c.MaxAge >= int(want.Seconds())-5
+}
+
+func TestRememberMeCookies(t *testing.T) {
+	remember, forget := true, false
+	tests := []struct {
+		name       string
+		rememberMe *bool
+		want       time.Duration // Max-Age of the refresh cookie
+	}{
+		{"unanswered", nil, 7 * 24 * time.Hour},
+		{"remember me", &remember, 7 * 24 * time.Hour},
+		{"do not remember me", &forget, 12 * time.Hour},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestServer(t, nil)
+			s.couch.addUser("alice", "pw")
+			browser := s.client()
+			body := map[string]any{"username": "alice", "password": "pw"}
+			if tt.rememberMe != nil {
+				body["rememberMe"] = *tt.rememberMe
+			}
+			resp, b := s.do(browser, http.MethodPost, "/api/login", body)
+			if resp.StatusCode != http.StatusOK {
+				t.Fatalf("login: %d %s", resp.StatusCode, b)
+			}
+			access, refresh := s.authCookies(resp)
+			if !within(access, 15*time.Minute) || !within(refresh, tt.want) {
+				t.Errorf("login set access %v and refresh %v, want Max-Age %v and %v", access, refresh, 15*time.Minute, tt.want)
+			}
+			// Rotation keeps the choice.
+			resp, b = s.do(browser, http.MethodPost, "/api/refresh", nil)
+			if _, refresh := s.authCookies(resp); resp.StatusCode != http.StatusOK || !within(refresh, tt.want) {
+				t.Errorf("refresh: %d %s setting %v, want Max-Age %v", resp.StatusCode, b, refresh, tt.want)
+			}
+		})
+	}
+}
+
+// TestSessionMaxAge checks that rotating the refresh token never carries a session past
+// auth.session_max_age after its login, even one whose token outlives it because the
+// setting was lowered since.
+func TestSessionMaxAge(t *testing.T) {
+	const maxAge = 30 * 24 * time.Hour
+	now := time.Now()
+	tests := []struct {
+		name        string
+		maxAge      time.Duration
+		authTime    time.Time
+		want        int
+		wantRefresh time.Duration // Max-Age of the new refresh cookie
+		wantAccess  time.Duration // And of the access cookie
+	}{
+		{"recent login", maxAge, now.Add(-time.Hour), http.StatusOK, 7 * 24 * time.Hour, 15 * time.Minute},
+		{"limit within the refresh TTL", maxAge, now.Add(-maxAge + 24*time.Hour), http.StatusOK, 24 * time.Hour, 15 * time.Minute},
+		{"limit within the access TTL", maxAge, now.Add(-maxAge + 10*time.Minute), http.StatusOK, 10 * time.Minute, 10 * time.Minute},
+		{"past the limit", maxAge, now.Add(-maxAge - time.Minute), http.StatusUnauthorized, 0, 0},
+		{"no limit", 0, now.Add(-2 * maxAge), http.StatusOK, 7 * 24 * time.Hour, 15 * time.Minute},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestServer(t, func(cfg *env.Config) { cfg.App.Auth.SessionMaxAge = tt.maxAge })
+			cookie := s.storeSession(tt.authTime, now.Add(7*24*time.Hour), true)
+			resp, body := s.do(http.DefaultClient, http.MethodPost, "/api/refresh", nil, "Cookie", cookie)
+			if resp.StatusCode != tt.want {
+				t.Fatalf("refresh: %d %s, want %d", resp.StatusCode, body, tt.want)
+			}
+			access, refresh := s.authCookies(resp)
+			if tt.want != http.StatusOK {
+				if access == nil || access.MaxAge >= 0 || refresh == nil || refresh.MaxAge >= 0 {
+					t.Errorf("refused refresh set access %v and refresh %v, want both cleared", access, refresh)
+				}
+				if sessions, _ := s.store.Sessions("alice"); len(sessions) != 0 {
+					t.Errorf("Sessions(alice) = %+v, want the expired one revoked", sessions)
+				}
+				return
+			}
+			if !within(access, tt.wantAccess) || !within(refresh, tt.wantRefresh) {
+				t.Errorf("refresh set access %v and refresh %v, want Max-Age %v and %v", access, refresh, tt.wantAccess, tt.wantRefresh)
+			}
+			if got := claims(t, refresh.Value)["auth_time"]; got != float64(tt.authTime.Unix()) {
+				t.Errorf("new refresh token auth_time = %v, want the login's %d", got, tt.authTime.Unix())
+			}
+		})
+	}
+}
+
+// TestSessionFromAccessCookie checks GET /api/session with an access cookie and no refresh
+// cookie: it renews the access token within the same session and login time, cut short by
+// auth.session_max_age, and without setting a refresh cookie.
+func TestSessionFromAccessCookie(t *testing.T) {
+	const maxAge = 30 * 24 * time.Hour
+	now := time.Now()
+	tests := []struct {
+		name       string
+		authTime   time.Time
+		want       int
+		wantAccess time.Duration // Max-Age of the new access cookie
+	}{
+		{"recent login", now.Add(-time.Hour), http.StatusOK, 15 * time.Minute},
+		{"limit within the access TTL", now.Add(-maxAge + 5*time.Minute), http.StatusOK, 5 * time.Minute},
+		{"past the limit", now.Add(-maxAge - time.Minute), http.StatusUnauthorized, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestServer(t, func(cfg *env.Config) { cfg.App.Auth.SessionMaxAge = maxAge })
+			cookie := s.storeSession(tt.authTime, time.Time{}, false)
+			resp, body := s.do(http.DefaultClient, http.MethodGet, "/api/session", nil, "Cookie", cookie)
+			if resp.StatusCode != tt.want {
+				t.Fatalf("session: %d %s, want %d", resp.StatusCode, body, tt.want)
+			}
+			access, refresh := s.authCookies(resp)
+			if tt.want != http.StatusOK {
+				if access == nil || access.MaxAge >= 0 {
+					t.Errorf("refused session set access %v, want it cleared", access)
+				}
+				return
+			}
+			var got struct{ Username string }
+			decode(t, body, &got)
+			if got.Username != "alice" || refresh != nil || !within(access, tt.wantAccess) {
+				t.Fatalf("session = %s setting access %v and refresh %v, want alice with Max-Age %v and no refresh cookie", body, access, refresh, tt.wantAccess)
+			}
+			old, renewed := claims(t, strings.TrimPrefix(cookie, auth.CookieName(auth.CookieAccessToken, false)+"=")), claims(t, access.Value)
+			if renewed["jti"] == old["jti"] || renewed["sid"] != old["sid"] || renewed["auth_time"] != old["auth_time"] {
+				t.Errorf("renewed token %v, want a new one of session %v logged in at %v", renewed, old["sid"], old["auth_time"])
+			}
+		})
+	}
+}
@@ -0,0 +1,60 @@
+package api
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/fridayflag/papaya/internal/auth"
+	"github.com/fridayflag/papaya/internal/config"
+	"github.com/fridayflag/papaya/internal/env"
+	"github.com/gin-gonic/gin"
+)
+
+// setCookie sets an httpOnly cookie with the attributes from auth.cookies; a negative
+// maxAge deletes it. With auth.cookies.host_prefix the path is always /, as the prefix
+// requires.
+func setCookie(c *gin.Context, cfg *env.Config, name, value string, maxAge int, path string) {
+	ck := cfg.App.Auth.Cookies
+	if ck.HostPrefix {
+		path = "/"
+	}
+	c.SetSameSite(cookieSameSite(ck, name))
+	c.SetCookie(auth.CookieName(name, ck.HostPrefix), value, maxAge, path, ck.Domain, secureCookie(c, ck), true)
+}
+
+// readCookie returns the value of the cookie called name, or "" when the request has none.
+func readCookie(c *gin.Context, cfg *env.Config, name string) string {
+	value, _ := c.Cookie(auth.CookieName(name, cfg.App.Auth.Cookies.HostPrefix))
+	return value
+}
+
+// secureCookie reports whether cookies set in response to c get the Secure attribute.
+func secureCookie(c *gin.Context, ck config.CookiesConfig) bool {
+	switch {
+	case ck.Secure == "always" || ck.HostPrefix:
+		return true
+	case ck.Secure == "never":
+		return false
+	}
+	if c.Request.TLS != nil {
+		return true
+	}
+	proto, _, _ := strings.Cut(c.GetHeader("X-Forwarded-Proto"), ",")
+	return strings.EqualFold(strings.TrimSpace(proto), "https")
+}
+
+// cookieSameSite returns the SameSite mode for the cookie called name. The single sign-on
+// state is at most Lax: the provider sends the browser back from another site, and a
+// Strict cookie would not come along.
+func cookieSameSite(ck config.CookiesConfig, name string) http.SameSite {
+	switch ck.SameSite {
+	case "strict":
+		if name == auth.CookieOIDC {
+			return http.SameSiteLaxMode
+		}
+		return http.SameSiteStrictMode
+	case "none":
+		return http.SameSiteNoneMode
+	}
+	return http.SameSiteLaxMode
+}
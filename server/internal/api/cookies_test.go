@@ -0,0 +1,195 @@
+package api
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/fridayflag/papaya/internal/auth"
+	"github.com/fridayflag/papaya/internal/config"
+	"github.com/fridayflag/papaya/internal/env"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// setCookies returns the cookies resp sets, by name.
+func setCookies(resp *http.Response) map[string]*http.Cookie {
+	m := map[string]*http.Cookie{}
+	for _, c := range resp.Cookies() {
+		m[c.Name] = c
+	}
+	return m
+}
+
+// cookieServer is a test server with auth.cookies set to ck.
+func cookieServer(t *testing.T, ck config.CookiesConfig) *testServer {
+	s := newTestServer(t, func(cfg *env.Config) { cfg.App.Auth.Cookies = ck })
+	s.couch.addUser("alice", "pw")
+	return s
+}
+
+func TestLoginCookieAttributes(t *testing.T) {
+	tests := []struct {
+		name     string
+		cookies  config.CookiesConfig
+		proto    string // X-Forwarded-Proto; "" for none
+		prefix   string // Before the cookie names
+		secure   bool
+		sameSite http.SameSite
+		domain   string
+	}{
+		{"defaults over http", config.CookiesConfig{Secure: "auto", SameSite: "lax"}, "", "", false, http.SameSiteLaxMode, ""},
+		{"proxied https", config.CookiesConfig{Secure: "auto", SameSite: "lax"}, "https", "", true, http.SameSiteLaxMode, ""},
+		{"proxied https, upper case", config.CookiesConfig{Secure: "auto", SameSite: "lax"}, "HTTPS", "", true, http.SameSiteLaxMode, ""},
+		{"proxy chain, first hop https", config.CookiesConfig{Secure: "auto", SameSite: "lax"}, "https, http", "", true, http.SameSiteLaxMode, ""},
+		{"proxy chain, first hop http", config.CookiesConfig{Secure: "auto", SameSite: "lax"}, "http, https", "", false, http.SameSiteLaxMode, ""},
+		{"proxied http", config.CookiesConfig{Secure: "auto", SameSite: "lax"}, "http", "", false, http.SameSiteLaxMode, ""},
+		{"always secure", config.CookiesConfig{Secure: "always", SameSite: "lax"}, "", "", true, http.SameSiteLaxMode, ""},
+		{"never secure", config.CookiesConfig{Secure: "never", SameSite: "lax"}, "https", "", false, http.SameSiteLaxMode, ""},
+		{"strict", config.CookiesConfig{Secure: "auto", SameSite: "strict"}, "", "", false, http.SameSiteStrictMode, ""},
+		{"none", config.CookiesConfig{Secure: "always", SameSite: "none"}, "", "", true, http.SameSiteNoneMode, ""},
+		{"domain", config.CookiesConfig{Secure: "auto", SameSite: "lax", Domain: "example.com"}, "", "", false, http.SameSiteLaxMode, "example.com"},
+		{"host prefix", config.CookiesConfig{Secure: "auto", SameSite: "lax", HostPrefix: true}, "", auth.HostPrefix, true, http.SameSiteLaxMode, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := cookieServer(t, tt.cookies)
+			var header []string
+			if tt.proto != "" {
+				header = []string{"X-Forwarded-Proto", tt.proto}
+			}
+			check := func(step string, resp *http.Response, deleted bool) {
+				t.Helper()
+				set := setCookies(resp)
+				for _, name := range []string{auth.CookieAccessToken, auth.CookieRefreshToken} {
+					c := set[tt.prefix+name]
+					if c == nil {
+						t.Errorf("%s set no %s cookie; got %v", step, tt.prefix+name, resp.Header["Set-Cookie"])
+						continue
+					}
+					if c.Secure != tt.secure || c.SameSite != tt.sameSite || c.Domain != tt.domain || c.Path != "/" || !c.HttpOnly {
+						t.Errorf("%s cookie = %q, want Secure %v, SameSite %v, Domain %q, Path /, HttpOnly",
+							step, c.Raw, tt.secure, tt.sameSite, tt.domain)
+					}
+					if deleted != (c.MaxAge < 0) {
+						t.Errorf("%s cookie = %q, want deleted %v", step, c.Raw, deleted)
+					}
+				}
+			}
+			resp, body := s.do(http.DefaultClient, http.MethodPost, "/api/login", map[string]any{"username": "alice", "password": "pw"}, header...)
+			if resp.StatusCode != http.StatusOK {
+				t.Fatalf("login: %d %s", resp.StatusCode, body)
+			}
+			check("login", resp, false)
+			refresh := setCookies(resp)[tt.prefix+auth.CookieRefreshToken]
+			if refresh == nil {
+				return
+			}
+
+			// Logging out deletes the cookies with the same attributes, or browsers keep them.
+			cookie := append([]string{"Cookie", refresh.Name + "=" + refresh.Value}, header...)
+			resp, body = s.do(http.DefaultClient, http.MethodPost, "/api/logout", nil, cookie...)
+			if resp.StatusCode != http.StatusOK {
+				t.Fatalf("logout: %d %s", resp.StatusCode, body)
+			}
+			check("logout", resp, true)
+		})
+	}
+}
+
+// TestHostPrefixCookieRead checks that with auth.cookies.host_prefix on, only the
+// prefixed cookie is read: a plain one may have been planted by a subdomain.
+func TestHostPrefixCookieRead(t *testing.T) {
+	s := cookieServer(t, config.CookiesConfig{Secure: "auto", SameSite: "lax", HostPrefix: true})
+	resp, body := s.do(http.DefaultClient, http.MethodPost, "/api/login", map[string]any{"username": "alice", "password": "pw"})
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("login: %d %s", resp.StatusCode, body)
+	}
+	refresh := setCookies(resp)[auth.HostPrefix+auth.CookieRefreshToken].Value
+
+	tests := []struct {
+		name   string
+		cookie string
+		want   int
+	}{
+		{"unprefixed", auth.CookieRefreshToken + "=" + refresh, http.StatusUnauthorized},
+		{"prefixed", auth.HostPrefix + auth.CookieRefreshToken + "=" + refresh, http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if resp, body := s.do(http.DefaultClient, http.MethodPost, "/api/refresh", nil, "Cookie", tt.cookie); resp.StatusCode != tt.want {
+				t.Errorf("refresh: %d %s, want %d", resp.StatusCode, body, tt.want)
+			}
+		})
+	}
+}
+
+// TestFlowCookieAttributes checks the short-lived single sign-on and passkey cookies: they
+// are scoped to their own API path, except under the host prefix, and the single sign-on
+// one stays Lax under strict so that it comes back with the provider's redirect.
+func TestFlowCookieAttributes(t *testing.T) {
+	tests := []struct {
+		name        string
+		cookies     config.CookiesConfig
+		oidcPath    string
+		oidcSite    http.SameSite
+		passkeyPath string
+		passkeySite http.SameSite
+	}{
+		{"lax", config.CookiesConfig{Secure: "auto", SameSite: "lax"}, "/api/oidc", http.SameSiteLaxMode, "/api/webauthn", http.SameSiteLaxMode},
+		{"strict", config.CookiesConfig{Secure: "auto", SameSite: "strict"}, "/api/oidc", http.SameSiteLaxMode, "/api/webauthn", http.SameSiteStrictMode},
+		{"none", config.CookiesConfig{Secure: "always", SameSite: "none"}, "/api/oidc", http.SameSiteNoneMode, "/api/webauthn", http.SameSiteNoneMode},
+		{"host prefix", config.CookiesConfig{Secure: "auto", SameSite: "strict", HostPrefix: true}, "/", http.SameSiteLaxMode, "/", http.SameSiteStrictMode},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, _ := oidcServer(t, func(cfg *env.Config) {
+				cfg.App.Auth.Cookies = tt.cookies
+				cfg.App.Auth.WebAuthnRPID = passkeyRPID
+				cfg.App.Auth.WebAuthnOrigins = []string{passkeyOrigin}
+			})
+			prefix := auth.CookieName("", tt.cookies.HostPrefix)
+
+			resp, body := s.do(s.client(), http.MethodGet, "/api/oidc/login", nil)
+			c := setCookies(resp)[prefix+auth.CookieOIDC]
+			if resp.StatusCode != http.StatusFound || c == nil {
+				t.Fatalf("GET /api/oidc/login: %d %s %v, want a redirect setting %s", resp.StatusCode, body, resp.Header["Set-Cookie"], prefix+auth.CookieOIDC)
+			}
+			if c.Path != tt.oidcPath || c.SameSite != tt.oidcSite {
+				t.Errorf("OIDC cookie = %q, want Path %s, SameSite %v", c.Raw, tt.oidcPath, tt.oidcSite)
+			}
+
+			resp, body = s.do(http.DefaultClient, http.MethodPost, "/api/webauthn/login/begin", nil)
+			c = setCookies(resp)[prefix+auth.CookieWebAuthn]
+			if resp.StatusCode != http.StatusOK || c == nil {
+				t.Fatalf("POST /api/webauthn/login/begin: %d %s %v, want %s set", resp.StatusCode, body, resp.Header["Set-Cookie"], prefix+auth.CookieWebAuthn)
+			}
+			if c.Path != tt.passkeyPath || c.SameSite != tt.passkeySite {
+				t.Errorf("passkey cookie = %q, want Path %s, SameSite %v", c.Raw, tt.passkeyPath, tt.passkeySite)
+			}
+		})
+	}
+}
+
+// TestOIDCFlowHostPrefix signs in through a provider with host-prefixed cookies, which
+// must be sent back under the same name for the callback to find the flow.
+func TestOIDCFlowHostPrefix(t *testing.T) {
+	s, issuer := oidcServer(t, func(cfg *env.Config) {
+		cfg.App.Auth.Cookies = config.CookiesConfig{Secure: "auto", SameSite: "lax", HostPrefix: true}
+	})
+	resp, body := s.do(s.client(), http.MethodGet, "/api/oidc/login", nil)
+	if resp.StatusCode != http.StatusFound {
+		t.Fatalf("GET /api/oidc/login: %d %s", resp.StatusCode, body)
+	}
+	flow := setCookies(resp)[auth.HostPrefix+auth.CookieOIDC]
+	redirect, err := resp.Location()
+	if err != nil || flow == nil {
+		t.Fatalf("GET /api/oidc/login = %v, %v, want a redirect and a flow cookie", resp.Header, err)
+	}
+	callback := issuer.authorize(redirect, jwt.MapClaims{"sub": "alice"})
+	resp, body = s.do(s.client(), http.MethodGet, "/api/oidc/callback?"+callback.Encode(), nil, "Cookie", flow.Name+"="+flow.Value)
+	if resp.StatusCode != http.StatusFound {
+		t.Fatalf("callback: %d %s, want 302", resp.StatusCode, body)
+	}
+	if setCookies(resp)[auth.HostPrefix+auth.CookieAccessToken] == nil {
+		t.Errorf("callback set %v, want %s", resp.Header["Set-Cookie"], auth.HostPrefix+auth.CookieAccessToken)
+	}
+}
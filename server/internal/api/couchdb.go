@@ -9,15 +9,24 @@ import (
 	"io"
 	"net/http"
 	"net/url"
+	"slices"
 	"strings"
 
 	"github.com/fridayflag/papaya/internal/env"
 )
 
-var errUnauthorized = errors.New("unauthorized")
+var (
+	errUnauthorized = errors.New("unauthorized")
+	errConflict     = errors.New("document update conflict") // CouchDB's 409: the _rev is stale
+)
 
 const userDocPrefix = "org.couchdb.user:"
 
+// couchDBClient returns an HTTP client for API calls to CouchDB, bounded by couchdb.request_timeout.
+func couchDBClient(cfg *env.Config) *http.Client {
+	return &http.Client{Timeout: cfg.App.CouchDB.RequestTimeout}
+}
+
 // validateCouchDBCredentials checks username/password against CouchDB _session.
 func validateCouchDBCredentials(cfg *env.Config, username, password string) error {
 	baseURL := cfg.CouchDBBaseURL()
@@ -28,7 +37,7 @@ func validateCouchDBCredentials(cfg *env.Config, username, password string) erro
 		return err
 	}
 	req.Header.Set("Content-Type", "application/json")
-	resp, err := http.DefaultClient.Do(req)
+	resp, err := couchDBClient(cfg).Do(req)
 	if err != nil {
 		return err
 	}
@@ -59,7 +68,7 @@ func adminCouchDBRequest(cfg *env.Config, username, password, method, path strin
 		req.Header.Set("Content-Type", "application/json")
 	}
 	req.Header.Set("Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte(username+":"+password)))
-	resp, err := http.DefaultClient.Do(req)
+	resp, err := couchDBClient(cfg).Do(req)
 	if err != nil {
 		return nil, err
 	}
@@ -133,8 +142,8 @@ func adminListUsers(cfg *env.Config, username, password string) ([]couchDBUserDo
 	}
 	var out struct {
 		Rows []struct {
-			ID    string         `json:"id"`
-			Doc   *couchDBUserDoc `json:"doc,omitempty"`
+			ID  string          `json:"id"`
+			Doc *couchDBUserDoc `json:"doc,omitempty"`
 		} `json:"rows"`
 	}
 	if err := json.NewDecoder(resp.Body).Decode(&out); err != nil {
@@ -155,7 +164,7 @@ func adminListUsers(cfg *env.Config, username, password string) ([]couchDBUserDo
 // adminGetUser fetches one user doc by username. Returns nil doc if not found.
 func adminGetUser(cfg *env.Config, adminUser, adminPass, targetUsername string) (*couchDBUserDoc, error) {
 	docID := userDocPrefix + targetUsername
-	resp, err := adminCouchDBRequest(cfg, adminUser, adminPass, http.MethodGet, "/_users/" + pathEscape(docID), nil)
+	resp, err := adminCouchDBRequest(cfg, adminUser, adminPass, http.MethodGet, "/_users/"+pathEscape(docID), nil)
 	if err != nil {
 		return nil, err
 	}
@@ -183,7 +192,7 @@ func adminPutUser(cfg *env.Config, adminUser, adminPass string, req *couchDBUser
 	} else {
 		docID = userDocPrefix + req.Name
 	}
-	
+
 	// Build the document to send
 	doc := couchDBUserDoc{
 		ID:   docID,
@@ -196,7 +205,7 @@ func adminPutUser(cfg *env.Config, adminUser, adminPass string, req *couchDBUser
 	if req.Roles != nil {
 		doc.Roles = req.Roles
 	}
-	
+
 	// Check if user exists by fetching current doc by _id
 	var existing *couchDBUserDoc
 	respGet, err := adminCouchDBRequest(cfg, adminUser, adminPass, http.MethodGet, "/_users/"+pathEscape(docID), nil)
@@ -213,7 +222,7 @@ func adminPutUser(cfg *env.Config, adminUser, adminPass string, req *couchDBUser
 		// Some other error
 		return "", false, fmt.Errorf("couchdb: get user: %s", respGet.Status)
 	}
-	
+
 	if existing != nil {
 		// Update: use existing _rev, or req.Rev if provided
 		if req.Rev != "" {
@@ -232,19 +241,19 @@ func adminPutUser(cfg *env.Config, adminUser, adminPass string, req *couchDBUser
 		}
 		doc.Password = req.Password
 	}
-	
+
 	body, _ := json.Marshal(doc)
 	resp, err := adminCouchDBRequest(cfg, adminUser, adminPass, http.MethodPut, "/_users/"+pathEscape(docID), bytes.NewReader(body))
 	if err != nil {
 		return "", false, err
 	}
 	defer resp.Body.Close()
-	
+
 	// Check for 403 Forbidden - might indicate credential issue
 	if resp.StatusCode == http.StatusForbidden {
 		return "", false, fmt.Errorf("couchdb: forbidden - check admin credentials")
 	}
-	
+
 	var result struct {
 		OK  bool   `json:"ok"`
 		Rev string `json:"rev"`
@@ -256,6 +265,110 @@ func adminPutUser(cfg *env.Config, adminUser, adminPass string, req *couchDBUser
 	return result.Rev, existing == nil, nil
 }
 
+// isServerAdmin reports whether username is a CouchDB server admin (listed in the admins
+// config section), asking with the server admin credentials (couchdb.admin_user).
+func isServerAdmin(cfg *env.Config, username string) (bool, error) {
+	path := "/_node/_local/_config/admins/" + pathEscape(username)
+	resp, err := adminCouchDBRequest(cfg, cfg.CouchDBAdminUser, cfg.CouchDBAdminPass, http.MethodGet, path, nil)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return true, nil
+	case http.StatusNotFound:
+		return false, nil
+	}
+	return false, fmt.Errorf("couchdb: get admins: %s", resp.Status)
+}
+
+// provisionUser makes sure username exists in _users, using the server admin credentials
+// (couchdb.admin_user). A missing user is created with roles and a random password: they
+// sign in through Papaya's other backends, never with it. For an existing user, the roles
+// listed in managed are added or removed to match roles; other roles and the rest of the
+// document are left alone. When the document changes between the read and the write
+// (another login provisioning the same user, an admin editing it), it is read again.
+func provisionUser(cfg *env.Config, username string, roles, managed []string) (created bool, err error) {
+	if cfg.CouchDBAdminUser == "" {
+		return false, errors.New("couchdb.admin_user is not set")
+	}
+	for range provisionAttempts {
+		created, err = provisionUserOnce(cfg, username, roles, managed)
+		if !errors.Is(err, errConflict) {
+			break
+		}
+	}
+	return created, err
+}
+
+// provisionAttempts bounds provisionUser's read-modify-write cycles.
+const provisionAttempts = 3
+
+// provisionUserOnce is one read-modify-write of provisionUser; a conflicting write gives
+// errConflict.
+func provisionUserOnce(cfg *env.Config, username string, roles, managed []string) (created bool, err error) {
+	admin, pass := cfg.CouchDBAdminUser, cfg.CouchDBAdminPass
+	path := "/_users/" + pathEscape(userDocPrefix+username)
+	resp, err := adminCouchDBRequest(cfg, admin, pass, http.MethodGet, path, nil)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+	// A raw document, so that fields this package does not model (the password hash) survive.
+	var doc map[string]any
+	switch resp.StatusCode {
+	case http.StatusNotFound:
+		doc = map[string]any{
+			"_id": userDocPrefix + username, "name": username, "type": "user",
+			"roles": append([]string{}, roles...), "password": randomURLToken(),
+		}
+		created = true
+	case http.StatusOK:
+		if len(managed) == 0 {
+			return false, nil
+		}
+		if err := json.NewDecoder(resp.Body).Decode(&doc); err != nil {
+			return false, err
+		}
+		var have []string
+		if list, ok := doc["roles"].([]any); ok {
+			for _, r := range list {
+				if s, ok := r.(string); ok {
+					have = append(have, s)
+				}
+			}
+		}
+		want := append([]string{}, roles...)
+		for _, r := range have {
+			if !slices.Contains(managed, r) && !slices.Contains(want, r) {
+				want = append(want, r)
+			}
+		}
+		slices.Sort(want)
+		slices.Sort(have)
+		if slices.Equal(want, have) {
+			return false, nil
+		}
+		doc["roles"] = want
+	default:
+		return false, fmt.Errorf("couchdb: get user: %s", resp.Status)
+	}
+	body, _ := json.Marshal(doc)
+	resp2, err := adminCouchDBRequest(cfg, admin, pass, http.MethodPut, path, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	defer resp2.Body.Close()
+	if resp2.StatusCode == http.StatusConflict {
+		return false, fmt.Errorf("couchdb: put user: %w", errConflict)
+	}
+	if resp2.StatusCode != http.StatusOK && resp2.StatusCode != http.StatusCreated {
+		return false, fmt.Errorf("couchdb: put user: %s", resp2.Status)
+	}
+	return created, nil
+}
+
 // adminDeleteUser removes a user from _users by _id.
 func adminDeleteUser(cfg *env.Config, adminUser, adminPass, docID string) error {
 	// Fetch the document to get _rev
@@ -277,7 +390,7 @@ func adminDeleteUser(cfg *env.Config, adminUser, adminPass, docID string) error
 	if doc.Rev == "" {
 		return fmt.Errorf("user document missing _rev")
 	}
-	
+
 	// Delete with _rev
 	path := "/_users/" + pathEscape(docID) + "?rev=" + url.QueryEscape(doc.Rev)
 	resp2, err := adminCouchDBRequest(cfg, adminUser, adminPass, http.MethodDelete, path, nil)
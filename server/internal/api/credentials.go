@@ -0,0 +1,35 @@
+package api
+
+import (
+	"github.com/fridayflag/papaya/internal/auth"
+	"github.com/fridayflag/papaya/internal/env"
+)
+
+// credentialValidator checks the username and password given to /api/login.
+type credentialValidator interface {
+	// Validate returns the user's canonical CouchDB username (the backend may match names
+	// case-insensitively), errUnauthorized for a wrong username or password, or another
+	// error when the check could not be made.
+	Validate(username, password string) (string, error)
+}
+
+// credentialsFor returns the validator selected by auth.backend.
+func credentialsFor(cfg *env.Config, store auth.EventStore) credentialValidator {
+	if cfg.App.Auth.Backend == "ldap" {
+		return &ldapValidator{cfg: cfg, store: store}
+	}
+	return couchDBValidator{cfg: cfg}
+}
+
+// couchDBValidator checks passwords with CouchDB's _session, so the same credentials work
+// for direct database access.
+type couchDBValidator struct {
+	cfg *env.Config
+}
+
+func (v couchDBValidator) Validate(username, password string) (string, error) {
+	if err := validateCouchDBCredentials(v.cfg, username, password); err != nil {
+		return "", err
+	}
+	return username, nil
+}
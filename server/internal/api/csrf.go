@@ -0,0 +1,118 @@
+package api
+
+import (
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/fridayflag/papaya/internal/auth"
+	"github.com/fridayflag/papaya/internal/config"
+	"github.com/fridayflag/papaya/internal/env"
+	"github.com/gin-gonic/gin"
+)
+
+// csrfMiddleware refuses cross-site requests that could change state (see
+// server.csrf) with 403.
+func csrfMiddleware(live *env.Live) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !sameSiteRequest(c.Request, live.Get()) {
+			c.JSON(http.StatusForbidden, gin.H{"error": "cross-site request refused"})
+			c.Abort()
+			return
+		}
+		c.Next()
+	}
+}
+
+// CSRFProtect wraps next, the /db proxy, with the check of csrfMiddleware: CouchDB writes
+// are made with the same cookies.
+func CSRFProtect(live *env.Live, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !sameSiteRequest(r, live.Get()) {
+			http.Error(w, "cross-site request refused", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// sameSiteRequest reports whether r may go ahead under server.csrf. Reads always may.
+// Otherwise browsers say where a request comes from in Sec-Fetch-Site, or in Origin for
+// older ones; a request with neither is not from a browser and carries no cookies it was
+// not given on purpose.
+func sameSiteRequest(r *http.Request, cfg *env.Config) bool {
+	cs := cfg.App.Server.CSRF
+	switch r.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return true
+	}
+	if !cs.Enabled || csrfExempt(r, cs.ExemptAuth, cs.ExemptPaths) {
+		return true
+	}
+	origin := r.Header.Get("Origin")
+	allowed := func() bool {
+		return origin != "" && origin != "null" &&
+			(originAllowed(cfg.App.Server.CORSOrigins, origin) || originAllowed(cs.TrustedOrigins, origin))
+	}
+	ok := true
+	switch r.Header.Get("Sec-Fetch-Site") {
+	case "same-origin", "none": // "none": typed in or bookmarked by the user
+	case "":
+		host := originHost(origin)
+		ok = origin == "" || host != "" && (host == r.Host || host == forwardedHost(r, cs)) || allowed()
+	default: // "same-site" (another subdomain) or "cross-site"
+		ok = allowed()
+	}
+	if !ok {
+		slog.Warn("csrf: refused cross-site request", "method", r.Method, "path", r.URL.Path, "origin", origin, "ip", r.RemoteAddr)
+	}
+	return ok
+}
+
+// forwardedHost returns the host the client asked for according to X-Forwarded-Host, or
+// "" unless the request comes straight from one of server.csrf.trusted_proxies: anyone
+// else could name whatever host their Origin has.
+func forwardedHost(r *http.Request, cs config.CSRFConfig) string {
+	header := r.Header.Get("X-Forwarded-Host")
+	if header == "" {
+		return ""
+	}
+	if addr, ok := connAddr(r); !ok || !cs.Trusts(addr) {
+		return ""
+	}
+	host, _, _ := strings.Cut(header, ",") // The first proxy's, the one the browser reached
+	return strings.TrimSpace(host)
+}
+
+// csrfExempt reports whether r skips the check: it is under one of paths, or it carries
+// an Authorization header of a scheme listed in schemes. Browsers do not add Bearer
+// headers by themselves, and a page can only set one on a cross-origin request that CORS
+// allowed; they do replay Basic credentials, so "basic" is not exempt by default.
+func csrfExempt(r *http.Request, schemes, paths []string) bool {
+	for _, p := range paths {
+		if strings.HasPrefix(r.URL.Path, p) {
+			return true
+		}
+	}
+	scheme, token, _ := strings.Cut(r.Header.Get("Authorization"), " ")
+	kind := strings.ToLower(scheme)
+	if kind == "bearer" && auth.IsPersonalAccessToken(token) {
+		kind = "pat"
+	}
+	for _, s := range schemes {
+		if kind != "" && s == kind {
+			return true
+		}
+	}
+	return false
+}
+
+// originHost returns the host[:port] of an Origin header value.
+func originHost(origin string) string {
+	u, err := url.Parse(origin)
+	if err != nil {
+		return ""
+	}
+	return u.Host
+}
@@ -0,0 +1,154 @@
+package api
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/fridayflag/papaya/internal/auth"
+	"github.com/fridayflag/papaya/internal/config"
+	"github.com/fridayflag/papaya/internal/env"
+)
+
+func TestSameSiteRequest(t *testing.T) {
+	pat := "Bearer " + auth.PATPrefix + "abc"
+	tests := []struct {
+		name      string
+		method    string // POST when empty
+		path      string // /api/logout when empty
+		header    []string
+		remote    string // RemoteAddr when not httptest's 192.0.2.1:1234
+		configure func(cs *config.CSRFConfig, server *config.ServerConfig)
+		want      bool
+	}{
+		{"read from another site", http.MethodGet, "", []string{"Sec-Fetch-Site", "cross-site"}, "", nil, true},
+		{"script without browser headers", "", "", nil, "", nil, true},
+		{"disabled", "", "", []string{"Sec-Fetch-Site", "cross-site"}, "", func(cs *config.CSRFConfig, _ *config.ServerConfig) { cs.Enabled = false }, true},
+
+		// Browsers that send Sec-Fetch-Site.
+		{"same-origin", "", "", []string{"Sec-Fetch-Site", "same-origin"}, "", nil, true},
+		{"typed in", "", "", []string{"Sec-Fetch-Site", "none"}, "", nil, true},
+		{"same-site", "", "", []string{"Sec-Fetch-Site", "same-site", "Origin", "https://blog.example.com"}, "", nil, false},
+		{"cross-site", "", "", []string{"Sec-Fetch-Site", "cross-site", "Origin", "https://evil.example"}, "", nil, false},
+		{"cross-site without Origin", "", "", []string{"Sec-Fetch-Site", "cross-site"}, "", nil, false},
+		{"cross-site from null origin", "", "", []string{"Sec-Fetch-Site", "cross-site", "Origin", "null"}, "", func(cs *config.CSRFConfig, _ *config.ServerConfig) {
+			cs.TrustedOrigins = []string{"null"}
+		}, false},
+		{"same-site, trusted origin", "", "", []string{"Sec-Fetch-Site", "same-site", "Origin", "https://blog.example.com"}, "", func(cs *config.CSRFConfig, _ *config.ServerConfig) {
+			cs.TrustedOrigins = []string{"https://blog.example.com"}
+		}, true},
+		{"cross-site, CORS origin", "", "", []string{"Sec-Fetch-Site", "cross-site", "Origin", "https://app.example.net"}, "", func(_ *config.CSRFConfig, server *config.ServerConfig) {
+			server.CORSOrigins = []string{"https://app.example.net"}
+		}, true},
+		{"Sec-Fetch-Site wins over a same-host Origin", "", "", []string{"Sec-Fetch-Site", "cross-site", "Origin", "http://example.com"}, "", nil, false},
+
+		// Older browsers: Origin alone. httptest requests are for Host example.com.
+		{"Origin of this host", "", "", []string{"Origin", "http://example.com"}, "", nil, true},
+		{"Origin of another host", "", "", []string{"Origin", "http://evil.example"}, "", nil, false},
+		{"Origin of another port", "", "", []string{"Origin", "http://example.com:8080"}, "", nil, false},
+		{"null Origin", "", "", []string{"Origin", "null"}, "", nil, false},
+		{"Origin trusted", "", "", []string{"Origin", "https://papaya.example.com"}, "", func(cs *config.CSRFConfig, _ *config.ServerConfig) {
+			cs.TrustedOrigins = []string{"https://papaya.example.com"}
+		}, true},
+
+		// X-Forwarded-Host only counts from a trusted proxy.
+		{"forwarded host, no trusted proxies", "", "", []string{"Origin", "https://evil.example", "X-Forwarded-Host", "evil.example"}, "", nil, false},
+		{"forwarded host from an untrusted address", "", "", []string{"Origin", "https://evil.example", "X-Forwarded-Host", "evil.example"}, "198.51.100.7:4000", trustProxy, false},
+		{"forwarded host from a trusted proxy", "", "", []string{"Origin", "https://papaya.example.com", "X-Forwarded-Host", "papaya.example.com"}, "", trustProxy, true},
+		{"forwarded host list from a trusted proxy", "", "", []string{"Origin", "https://papaya.example.com", "X-Forwarded-Host", "papaya.example.com, papaya:8080"}, "", trustProxy, true},
+		{"other forwarded host from a trusted proxy", "", "", []string{"Origin", "https://evil.example", "X-Forwarded-Host", "papaya.example.com"}, "", trustProxy, false},
+		{"forwarded host from a trusted IPv4-mapped address", "", "", []string{"Origin", "https://papaya.example.com", "X-Forwarded-Host", "papaya.example.com"}, "[::ffff:192.0.2.1]:1234", trustProxy, true},
+
+		// Authorization schemes browsers do not add by themselves.
+		{"access token", "", "", []string{"Sec-Fetch-Site", "cross-site", "Authorization", "Bearer eyJ.x.y"}, "", nil, true},
+		{"personal access token", "", "", []string{"Sec-Fetch-Site", "cross-site", "Authorization", pat}, "", nil, true},
+		{"basic", "", "", []string{"Sec-Fetch-Site", "cross-site", "Authorization", basicAuth("alice", "pw")}, "", nil, false},
+		{"basic exempted", "", "", []string{"Sec-Fetch-Site", "cross-site", "Authorization", basicAuth("alice", "pw")}, "", func(cs *config.CSRFConfig, _ *config.ServerConfig) {
+			cs.ExemptAuth = []string{"basic"}
+		}, true},
+		{"only PATs exempted, access token", "", "", []string{"Sec-Fetch-Site", "cross-site", "Authorization", "Bearer eyJ.x.y"}, "", exemptPATs, false},
+		{"only PATs exempted, PAT", "", "", []string{"Sec-Fetch-Site", "cross-site", "Authorization", pat}, "", exemptPATs, true},
+		{"empty bearer", "", "", []string{"Sec-Fetch-Site", "cross-site", "Authorization", "Bearer"}, "", exemptPATs, false},
+
+		{"exempt path", "", "/api/hooks/import", []string{"Sec-Fetch-Site", "cross-site"}, "", func(cs *config.CSRFConfig, _ *config.ServerConfig) {
+			cs.ExemptPaths = []string{"/api/hooks/"}
+		}, true},
+		{"outside exempt path", "", "/api/logout", []string{"Sec-Fetch-Site", "cross-site"}, "", func(cs *config.CSRFConfig, _ *config.ServerConfig) {
+			cs.ExemptPaths = []string{"/api/hooks/"}
+		}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := &env.Config{App: config.Default()}
+			if tt.configure != nil {
+				tt.configure(&cfg.App.Server.CSRF, &cfg.App.Server)
+			}
+			method, path := tt.method, tt.path
+			if method == "" {
+				method = http.MethodPost
+			}
+			if path == "" {
+				path = "/api/logout"
+			}
+			r := httptest.NewRequest(method, path, nil)
+			if tt.remote != "" {
+				r.RemoteAddr = tt.remote
+			}
+			for i := 0; i+1 < len(tt.header); i += 2 {
+				r.Header.Set(tt.header[i], tt.header[i+1])
+			}
+			if got := sameSiteRequest(r, cfg); got != tt.want {
+				t.Errorf("sameSiteRequest(%s %s %v from %s) = %v, want %v", method, path, tt.header, r.RemoteAddr, got, tt.want)
+			}
+		})
+	}
+}
+
+// trustProxy trusts httptest's client address as a proxy.
+func trustProxy(cs *config.CSRFConfig, _ *config.ServerConfig) {
+	cs.TrustedProxies = []string{"192.0.2.0/24"}
+}
+
+func exemptPATs(cs *config.CSRFConfig, _ *config.ServerConfig) {
+	cs.ExemptAuth = []string{"pat"}
+}
+
+// TestCSRFRefused checks the check is in front of both /api and the /db proxy, and that
+// a refused write never reaches CouchDB.
+func TestCSRFRefused(t *testing.T) {
+	s := newTestServer(t, nil)
+	s.couch.addUser("alice", "pw")
+	browser := s.client()
+	s.login(browser, "alice", "pw")
+
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		site   string
+		want   int
+	}{
+		{"write to /db from another site", http.MethodPut, "/db/mydb/doc", "cross-site", http.StatusForbidden},
+		{"write to /db from the app", http.MethodPut, "/db/mydb/doc", "same-origin", http.StatusOK},
+		{"read of /db from another site", http.MethodGet, "/db/mydb/doc", "cross-site", http.StatusOK},
+		{"revoke sessions from another site", http.MethodPost, "/api/sessions/revoke-others", "cross-site", http.StatusForbidden},
+		{"revoke sessions from a sibling subdomain", http.MethodPost, "/api/sessions/revoke-others", "same-site", http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s.couch.mu.Lock()
+			before := s.couch.dbCalls
+			s.couch.mu.Unlock()
+			resp, body := s.do(browser, tt.method, tt.path, map[string]any{}, "Sec-Fetch-Site", tt.site)
+			if resp.StatusCode != tt.want {
+				t.Errorf("%s %s: %d %s, want %d", tt.method, tt.path, resp.StatusCode, body, tt.want)
+			}
+			s.couch.mu.Lock()
+			reached := s.couch.dbCalls > before
+			s.couch.mu.Unlock()
+			if refused := tt.want == http.StatusForbidden; refused && reached {
+				t.Errorf("%s %s reached CouchDB", tt.method, tt.path)
+			}
+		})
+	}
+}
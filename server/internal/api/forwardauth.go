@@ -0,0 +1,75 @@
+package api
+
+import (
+	"log/slog"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+
+	"github.com/fridayflag/papaya/internal/auth"
+	"github.com/fridayflag/papaya/internal/env"
+	"github.com/gin-gonic/gin"
+)
+
+// forwardedUser returns the user named in the auth.forward_auth.header of a request that
+// comes straight from one of auth.forward_auth.trusted_proxies, or "" when there is none.
+// The connection's own address is checked, not X-Forwarded-For, which anyone can send.
+func forwardedUser(c *gin.Context, cfg *env.Config) string {
+	fa := cfg.App.Auth.ForwardAuth
+	if len(fa.TrustedProxies) == 0 {
+		return ""
+	}
+	username := strings.TrimSpace(c.GetHeader(fa.Header))
+	if username == "" {
+		return ""
+	}
+	if addr, ok := connAddr(c.Request); !ok || !fa.Trusts(addr) {
+		slog.Debug("auth: ignored forward-auth header from untrusted address", "addr", c.Request.RemoteAddr)
+		return ""
+	}
+	if strings.Contains(username, ":") {
+		slog.Warn("auth: forward-auth header is not a valid CouchDB username", "user", username)
+		return ""
+	}
+	return username
+}
+
+// connAddr returns the address the request's connection comes from.
+func connAddr(r *http.Request) (netip.Addr, bool) {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return netip.Addr{}, false
+	}
+	addr, err := netip.ParseAddr(host)
+	return addr, err == nil
+}
+
+// cookieUser returns the user the request's auth cookies belong to, without rotating
+// anything, or "" when neither cookie is valid.
+func cookieUser(c *gin.Context, cfg *env.Config, keys *auth.Keys) string {
+	if access := readCookie(c, cfg, auth.CookieAccessToken); access != "" {
+		if claims, err := auth.ParseAccessToken(access, keys.Access); err == nil {
+			return claims.Subject
+		}
+	}
+	if refresh := readCookie(c, cfg, auth.CookieRefreshToken); refresh != "" {
+		if username, err := auth.ValidateRefreshToken(refresh, keys.Refresh); err == nil {
+			return username
+		}
+	}
+	return ""
+}
+
+// forwardAuthLogin starts a session for the user a trusted proxy vouched for, ending the
+// one in the request's cookies (which belongs to someone else, if anyone).
+func forwardAuthLogin(c *gin.Context, cfg *env.Config, store auth.Store, keys *auth.Keys, username, deviceLabel string) bool {
+	if refresh := readCookie(c, cfg, auth.CookieRefreshToken); refresh != "" {
+		_ = store.Revoke(auth.TokenHash(refresh))
+	}
+	if err := issueTokens(c, cfg, store, keys, username, deviceLabel, false); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to issue tokens"})
+		return false
+	}
+	return true
+}
@@ -0,0 +1,89 @@
+package api
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/fridayflag/papaya/internal/auth"
+	"github.com/fridayflag/papaya/internal/env"
+)
+
+// forwardAuthServer is a test server that takes auth.forward_auth's Remote-User header from
+// proxies, the test's own connections coming from 127.0.0.1.
+func forwardAuthServer(t *testing.T, proxies ...string) *testServer {
+	return newTestServer(t, func(cfg *env.Config) { cfg.App.Auth.ForwardAuth.TrustedProxies = proxies })
+}
+
+func TestForwardAuth(t *testing.T) {
+	tests := []struct {
+		name    string
+		proxies []string
+		user    string // Remote-User header
+		want    string // Signed-in user; "" for none
+	}{
+		{"trusted address", []string{"127.0.0.1"}, "alice", "alice"},
+		{"trusted CIDR", []string{"192.0.2.0/24", "127.0.0.0/8"}, "alice", "alice"},
+		{"untrusted address", []string{"192.0.2.0/24"}, "alice", ""},
+		{"no trusted proxies", nil, "alice", ""},
+		{"colon in username", []string{"127.0.0.1"}, "org.couchdb.user:alice", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := forwardAuthServer(t, tt.proxies...)
+			for _, path := range []string{"/api/login", "/api/session"} {
+				browser := s.client()
+				method := http.MethodPost
+				if path == "/api/session" {
+					method = http.MethodGet
+				}
+				resp, body := s.do(browser, method, path, nil, "Remote-User", tt.user)
+				access := s.cookie(browser, auth.CookieAccessToken)
+				if tt.want == "" {
+					if resp.StatusCode == http.StatusOK || access != "" {
+						t.Errorf("%s %s: %d %s, want the header ignored", method, path, resp.StatusCode, body)
+					}
+					continue
+				}
+				if resp.StatusCode != http.StatusOK {
+					t.Fatalf("%s %s: %d %s, want 200", method, path, resp.StatusCode, body)
+				}
+				if sub := claims(t, access)["sub"]; sub != tt.want {
+					t.Errorf("%s %s: access token sub = %v, want %s", method, path, sub, tt.want)
+				}
+			}
+		})
+	}
+}
+
+// TestForwardAuthReplacesSession checks that when the proxy names someone other than the
+// owner of the browser's cookies, that owner's session ends rather than staying usable.
+func TestForwardAuthReplacesSession(t *testing.T) {
+	s := forwardAuthServer(t, "127.0.0.1")
+	s.couch.addUser("bob", "pw")
+	browser := s.client()
+	s.login(browser, "bob", "pw")
+
+	// The proxy naming the cookies' owner keeps that session.
+	resp, body := s.do(browser, http.MethodGet, "/api/session", nil, "Remote-User", "bob")
+	if sessions, _ := s.store.Sessions("bob"); resp.StatusCode != http.StatusOK || len(sessions) != 1 {
+		t.Fatalf("session as bob: %d %s with sessions %+v, want bob's one session kept", resp.StatusCode, body, sessions)
+	}
+	bobRefresh := s.cookie(browser, auth.CookieRefreshToken)
+
+	resp, body = s.do(browser, http.MethodGet, "/api/session", nil, "Remote-User", "alice")
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("session as alice: %d %s, want 200", resp.StatusCode, body)
+	}
+	var got struct{ Username string }
+	decode(t, body, &got)
+	if got.Username != "alice" || claims(t, s.cookie(browser, auth.CookieAccessToken))["sub"] != "alice" {
+		t.Errorf("session = %s, want alice signed in", body)
+	}
+	if sessions, err := s.store.Sessions("bob"); err != nil || len(sessions) != 0 {
+		t.Errorf("Sessions(bob) = %+v, %v, want bob's session revoked", sessions, err)
+	}
+	cookie := auth.CookieName(auth.CookieRefreshToken, s.live.Get().App.Auth.Cookies.HostPrefix) + "=" + bobRefresh
+	if resp, body := s.do(s.client(), http.MethodPost, "/api/refresh", nil, "Cookie", cookie); resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("refresh with bob's old token: %d %s, want 401", resp.StatusCode, body)
+	}
+}
@@ -0,0 +1,149 @@
+package api
+
+import (
+	"crypto/tls"
+	"fmt"
+	"log/slog"
+	"net"
+	"slices"
+	"strings"
+
+	"github.com/fridayflag/papaya/internal/auth"
+	"github.com/fridayflag/papaya/internal/env"
+	"github.com/go-ldap/ldap/v3"
+)
+
+// ldapValidator checks passwords against auth.ldap: it finds the user's entry with the
+// service account, binds as that entry with the password, then maps the user's groups to
+// CouchDB roles and, with auth.ldap.provision, creates or updates them in _users.
+type ldapValidator struct {
+	cfg   *env.Config
+	store auth.EventStore
+}
+
+func (v *ldapValidator) Validate(username, password string) (string, error) {
+	l := v.cfg.App.Auth.LDAP
+	// Servers treat a bind with an empty password as anonymous and let it succeed.
+	if username == "" || password == "" || strings.Contains(username, ":") {
+		return "", errUnauthorized
+	}
+	conn, err := v.dial()
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+	if err := v.bindService(conn); err != nil {
+		return "", err
+	}
+	attr := l.UsernameAttribute
+	res, err := conn.Search(ldap.NewSearchRequest(
+		l.UserBaseDN, ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 2, int(l.Timeout.Seconds()), false,
+		fmt.Sprintf(l.UserFilter, ldap.EscapeFilter(username)), []string{attr}, nil,
+	))
+	if err != nil {
+		return "", fmt.Errorf("ldap: search user: %w", err)
+	}
+	if len(res.Entries) != 1 {
+		return "", errUnauthorized // Unknown, or the filter is ambiguous
+	}
+	entry := res.Entries[0]
+	if err := conn.Bind(entry.DN, password); err != nil {
+		if ldap.IsErrorWithCode(err, ldap.LDAPResultInvalidCredentials) {
+			return "", errUnauthorized
+		}
+		return "", fmt.Errorf("ldap: bind as user: %w", err)
+	}
+	if name := entry.GetAttributeValue(attr); name != "" {
+		username = name
+	}
+	if strings.Contains(username, ":") {
+		return "", errUnauthorized
+	}
+	if !l.Provision {
+		return username, nil
+	}
+	// Group entries may only be readable by the service account.
+	if err := v.bindService(conn); err != nil {
+		return "", err
+	}
+	roles, err := v.roles(conn, entry.DN)
+	if err != nil {
+		return "", err
+	}
+	managed := make([]string, 0, len(l.GroupRoles))
+	for _, role := range l.GroupRoles {
+		managed = append(managed, role)
+	}
+	created, err := provisionUser(v.cfg, username, roles, managed)
+	if err != nil {
+		return "", fmt.Errorf("provision user: %w", err)
+	}
+	if created {
+		if err := v.store.RecordEvent(auth.EventUserProvisioned, username, "", "ldap"); err != nil {
+			slog.Warn("auth: failed to record event", "err", err)
+		}
+	}
+	return username, nil
+}
+
+func (v *ldapValidator) dial() (*ldap.Conn, error) {
+	l := v.cfg.App.Auth.LDAP
+	conn, err := ldap.DialURL(l.URL, ldap.DialWithDialer(&net.Dialer{Timeout: l.Timeout}))
+	if err != nil {
+		return nil, fmt.Errorf("ldap: %w", err)
+	}
+	conn.SetTimeout(l.Timeout)
+	if l.StartTLS {
+		host := strings.TrimPrefix(strings.TrimPrefix(l.URL, "ldap://"), "ldaps://")
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		if err := conn.StartTLS(&tls.Config{ServerName: host}); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("ldap: starttls: %w", err)
+		}
+	}
+	return conn, nil
+}
+
+// bindService binds as auth.ldap.bind_dn, or anonymously when it is not set.
+func (v *ldapValidator) bindService(conn *ldap.Conn) error {
+	l := v.cfg.App.Auth.LDAP
+	var err error
+	if l.BindDN == "" {
+		err = conn.UnauthenticatedBind("")
+	} else {
+		err = conn.Bind(l.BindDN, v.cfg.AuthLDAPPassword)
+	}
+	if err != nil {
+		return fmt.Errorf("ldap: bind as service account: %w", err)
+	}
+	return nil
+}
+
+// roles returns the CouchDB roles auth.ldap.group_roles gives the groups userDN is in.
+// Groups are matched by DN (case-insensitively) or by cn.
+func (v *ldapValidator) roles(conn *ldap.Conn, userDN string) ([]string, error) {
+	l := v.cfg.App.Auth.LDAP
+	if l.GroupBaseDN == "" || len(l.GroupRoles) == 0 {
+		return nil, nil
+	}
+	res, err := conn.Search(ldap.NewSearchRequest(
+		l.GroupBaseDN, ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 0, int(l.Timeout.Seconds()), false,
+		fmt.Sprintf(l.GroupFilter, ldap.EscapeFilter(userDN)), []string{"cn"}, nil,
+	))
+	if err != nil {
+		return nil, fmt.Errorf("ldap: search groups: %w", err)
+	}
+	var roles []string
+	for _, g := range res.Entries {
+		cn := g.GetAttributeValue("cn")
+		for group, role := range l.GroupRoles {
+			matches := strings.EqualFold(group, g.DN) || (cn != "" && group == cn)
+			if matches && !slices.Contains(roles, role) {
+				roles = append(roles, role)
+			}
+		}
+	}
+	return roles, nil
+}
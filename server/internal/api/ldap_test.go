@@ -0,0 +1,352 @@
+package api
+
+import (
+	"errors"
+	"net"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/fridayflag/papaya/internal/auth"
+	"github.com/fridayflag/papaya/internal/env"
+	ber "github.com/go-asn1-ber/asn1-ber"
+	"github.com/go-ldap/ldap/v3"
+)
+
+// fakeLDAP is a directory server answering simple binds and searches with equality,
+// presence, AND and OR filters. Searches need the service account's bind.
+type fakeLDAP struct {
+	net.Listener
+	service   string            // Service account DN
+	passwords map[string]string // DN → password, the service account included
+	entries   []ldapEntry
+	mu        sync.Mutex
+	binds     []string // DNs binds were attempted as
+}
+
+type ldapEntry struct {
+	dn    string
+	attrs map[string][]string
+}
+
+func newFakeLDAP(t *testing.T) *fakeLDAP {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := &fakeLDAP{
+		Listener:  l,
+		service:   "cn=papaya,dc=example,dc=org",
+		passwords: map[string]string{"cn=papaya,dc=example,dc=org": "servicepw"},
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go f.serve(conn)
+		}
+	}()
+	return f
+}
+
+func (f *fakeLDAP) URL() string {
+	return "ldap://" + f.Addr().String()
+}
+
+// addUser adds a person entry under ou=people with uid and password.
+func (f *fakeLDAP) addUser(uid, password string) string {
+	dn := "uid=" + uid + ",ou=people,dc=example,dc=org"
+	f.passwords[dn] = password
+	f.entries = append(f.entries, ldapEntry{dn, map[string][]string{"objectClass": {"person"}, "uid": {uid}}})
+	return dn
+}
+
+// addGroup adds a group entry under ou=groups with cn and members.
+func (f *fakeLDAP) addGroup(cn string, members ...string) {
+	dn := "cn=" + cn + ",ou=groups,dc=example,dc=org"
+	f.entries = append(f.entries, ldapEntry{dn, map[string][]string{"objectClass": {"groupOfNames"}, "cn": {cn}, "member": members}})
+}
+
+func (f *fakeLDAP) bindsAs(dn string) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	n := 0
+	for _, b := range f.binds {
+		if b == dn {
+			n++
+		}
+	}
+	return n
+}
+
+func (f *fakeLDAP) serve(conn net.Conn) {
+	defer conn.Close()
+	var bound string
+	for {
+		p, err := ber.ReadPacket(conn)
+		if err != nil || len(p.Children) < 2 {
+			return
+		}
+		id, op := p.Children[0].Value.(int64), p.Children[1]
+		switch op.Tag {
+		case ldap.ApplicationBindRequest:
+			dn, _ := op.Children[1].Value.(string)
+			password := op.Children[2].Data.String()
+			f.mu.Lock()
+			f.binds = append(f.binds, dn)
+			f.mu.Unlock()
+			code := ldap.LDAPResultInvalidCredentials
+			if password == "" {
+				// An unauthenticated bind, which servers let through as anonymous.
+				code, bound = ldap.LDAPResultSuccess, ""
+			} else if pw, ok := f.passwords[dn]; ok && pw == password {
+				code, bound = ldap.LDAPResultSuccess, dn
+			}
+			f.reply(conn, id, ldap.ApplicationBindResponse, code)
+		case ldap.ApplicationSearchRequest:
+			if bound != f.service {
+				f.reply(conn, id, ldap.ApplicationSearchResultDone, ldap.LDAPResultInsufficientAccessRights)
+				continue
+			}
+			base, _ := op.Children[0].Value.(string)
+			for _, e := range f.entries {
+				if !strings.HasSuffix(strings.ToLower(e.dn), strings.ToLower(base)) || !e.matches(op.Children[6]) {
+					continue
+				}
+				entry := ber.Encode(ber.ClassApplication, ber.TypeConstructed, ldap.ApplicationSearchResultEntry, nil, "entry")
+				entry.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, e.dn, "dn"))
+				attrs := ber.NewSequence("attributes")
+				for name, values := range e.attrs {
+					attr := ber.NewSequence("attribute")
+					attr.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, name, "type"))
+					set := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSet, nil, "values")
+					for _, v := range values {
+						set.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, v, "value"))
+					}
+					attr.AppendChild(set)
+					attrs.AppendChild(attr)
+				}
+				entry.AppendChild(attrs)
+				f.send(conn, id, entry)
+			}
+			f.reply(conn, id, ldap.ApplicationSearchResultDone, ldap.LDAPResultSuccess)
+		case ldap.ApplicationUnbindRequest:
+			return
+		}
+	}
+}
+
+// matches evaluates the search filter packet against e.
+func (e ldapEntry) matches(filter *ber.Packet) bool {
+	switch filter.Tag {
+	case ldap.FilterAnd, ldap.FilterOr:
+		and := filter.Tag == ldap.FilterAnd
+		for _, c := range filter.Children {
+			if e.matches(c) != and {
+				return !and
+			}
+		}
+		return and
+	case ldap.FilterEqualityMatch:
+		name, value := filter.Children[0].Data.String(), filter.Children[1].Data.String()
+		if strings.EqualFold(name, "dn") {
+			return strings.EqualFold(e.dn, value)
+		}
+		return slices.ContainsFunc(e.attrs[name], func(v string) bool { return strings.EqualFold(v, value) })
+	case ldap.FilterPresent:
+		return len(e.attrs[filter.Data.String()]) > 0
+	}
+	return false
+}
+
+func (f *fakeLDAP) reply(conn net.Conn, id int64, tag ber.Tag, code int) {
+	res := ber.Encode(ber.ClassApplication, ber.TypeConstructed, tag, nil, "result")
+	res.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagEnumerated, int64(code), "resultCode"))
+	res.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", "matchedDN"))
+	res.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", "diagnosticMessage"))
+	f.send(conn, id, res)
+}
+
+func (f *fakeLDAP) send(conn net.Conn, id int64, op *ber.Packet) {
+	msg := ber.NewSequence("message")
+	msg.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, id, "id"))
+	msg.AppendChild(op)
+	_, _ = conn.Write(msg.Bytes())
+}
+
+// ldapServer returns a test server and a fakeLDAP it checks passwords against, with the
+// default auth.ldap settings.
+func ldapServer(t *testing.T, groupRoles map[string]string) (*testServer, *fakeLDAP) {
+	directory := newFakeLDAP(t)
+	s := newTestServer(t, func(cfg *env.Config) {
+		cfg.App.Auth.Backend = "ldap"
+		l := &cfg.App.Auth.LDAP
+		l.URL = directory.URL()
+		l.BindDN = directory.service
+		l.UserBaseDN = "ou=people,dc=example,dc=org"
+		l.GroupBaseDN = "ou=groups,dc=example,dc=org"
+		l.GroupRoles = groupRoles
+		cfg.AuthLDAPPassword = "servicepw"
+	})
+	return s, directory
+}
+
+func TestLDAPValidate(t *testing.T) {
+	s, directory := ldapServer(t, nil)
+	alice := directory.addUser("alice", "pw")
+	directory.addUser("dup", "pw")
+	directory.entries = append(directory.entries, ldapEntry{"uid=dup,ou=staff,ou=people,dc=example,dc=org", map[string][]string{"objectClass": {"person"}, "uid": {"dup"}}})
+	directory.passwords["uid=dup,ou=staff,ou=people,dc=example,dc=org"] = "pw"
+
+	tests := []struct {
+		name, username, password string
+		want                     string // Canonical username; "" for errUnauthorized
+		userBinds                int    // Binds attempted as alice
+	}{
+		{"right password", "alice", "pw", "alice", 1},
+		{"canonical name", "ALICE", "pw", "alice", 1},
+		{"wrong password", "alice", "wrong", "", 1},
+		{"empty password", "alice", "", "", 0}, // Would be an anonymous bind
+		{"unknown user", "bob", "pw", "", 0},
+		{"ambiguous filter", "dup", "pw", "", 0},
+		{"colon in name", "alice:x", "pw", "", 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			before := directory.bindsAs(alice)
+			v := credentialsFor(s.live.Get(), s.store)
+			got, err := v.Validate(tt.username, tt.password)
+			if tt.want == "" {
+				if !errors.Is(err, errUnauthorized) {
+					t.Errorf("Validate() = %q, %v; want errUnauthorized", got, err)
+				}
+			} else if err != nil || got != tt.want {
+				t.Errorf("Validate() = %q, %v; want %q", got, err, tt.want)
+			}
+			if n := directory.bindsAs(alice) - before; n != tt.userBinds {
+				t.Errorf("binds as alice = %d, want %d", n, tt.userBinds)
+			}
+		})
+	}
+	for _, dn := range []string{"uid=dup,ou=people,dc=example,dc=org", "uid=dup,ou=staff,ou=people,dc=example,dc=org"} {
+		if n := directory.bindsAs(dn); n != 0 {
+			t.Errorf("binds as %s = %d, want none for an ambiguous filter", dn, n)
+		}
+	}
+}
+
+func TestLDAPGroupRoles(t *testing.T) {
+	tests := []struct {
+		name     string
+		existing []string // Roles in _users before the login; nil when the user is new
+		want     []string
+	}{
+		{"provisioned", nil, []string{"editor", "family"}},
+		// admin is managed by group_roles and alice is not in that group any more; custom
+		// is not managed and stays.
+		{"reconciled", []string{"admin", "custom"}, []string{"custom", "editor", "family"}},
+		{"unchanged", []string{"editor", "family"}, []string{"editor", "family"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, directory := ldapServer(t, map[string]string{
+				"CN=Editors,OU=Groups,DC=example,DC=org": "editor", // By DN, in any case
+				"family":                                 "family", // By cn
+				"Family":                                 "kin",    // cn is matched exactly
+				"admins":                                 "admin",
+			})
+			alice := directory.addUser("alice", "pw")
+			directory.addGroup("editors", alice)
+			directory.addGroup("family", alice)
+			directory.addGroup("admins", "uid=bob,ou=people,dc=example,dc=org")
+			if tt.existing != nil {
+				s.couch.addUser("alice", "couchpw", tt.existing...)
+			}
+			rev := ""
+			if doc := s.couch.user("alice"); doc != nil {
+				rev, _ = doc["_rev"].(string)
+			}
+
+			if _, err := credentialsFor(s.live.Get(), s.store).Validate("alice", "pw"); err != nil {
+				t.Fatalf("Validate() error = %v", err)
+			}
+			doc := s.couch.user("alice")
+			if doc == nil {
+				t.Fatal("alice not in _users")
+			}
+			var got []string
+			for _, r := range doc["roles"].([]any) {
+				got = append(got, r.(string))
+			}
+			slices.Sort(got)
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("roles = %v, want %v", got, tt.want)
+			}
+			if tt.name == "unchanged" && doc["_rev"] != rev {
+				t.Errorf("_rev = %v, want %s: nothing to write", doc["_rev"], rev)
+			}
+			if tt.existing != nil && s.couch.passwords["alice"] != "couchpw" {
+				t.Error("reconciling roles changed the CouchDB password")
+			}
+		})
+	}
+}
+
+func TestProvisionUserConflict(t *testing.T) {
+	tests := []struct {
+		name      string
+		conflicts int
+		wantErr   error
+	}{
+		{"retried", provisionAttempts - 1, nil},
+		{"gives up", provisionAttempts, errConflict},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestServer(t, nil)
+			s.couch.addUser("alice", "pw", "custom")
+			s.couch.conflicts = tt.conflicts
+			_, err := provisionUser(s.live.Get(), "alice", []string{"editor"}, []string{"editor"})
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("provisionUser() error = %v, want %v", err, tt.wantErr)
+			}
+			if tt.wantErr != nil {
+				return
+			}
+			roles := s.couch.user("alice")["roles"].([]any)
+			if !slices.Equal(roles, []any{"custom", "editor"}) {
+				t.Errorf("roles = %v, want [custom editor]", roles)
+			}
+		})
+	}
+}
+
+// eventLog is an auth.EventStore that keeps the kinds of the events recorded.
+type eventLog []string
+
+func (l *eventLog) RecordEvent(kind, username, familyID, detail string) error {
+	*l = append(*l, kind)
+	return nil
+}
+
+func TestLDAPProvisioningEvent(t *testing.T) {
+	s, directory := ldapServer(t, nil)
+	directory.addUser("alice", "pw")
+	var events eventLog
+	v := &ldapValidator{cfg: s.live.Get(), store: &events}
+	for range 2 {
+		if _, err := v.Validate("alice", "pw"); err != nil {
+			t.Fatalf("Validate() error = %v", err)
+		}
+	}
+	if s.couch.user("alice") == nil {
+		t.Fatal("alice not in _users")
+	}
+	if !slices.Equal(events, eventLog{auth.EventUserProvisioned}) {
+		t.Errorf("events = %v, want one %s", events, auth.EventUserProvisioned)
+	}
+}
@@ -0,0 +1,283 @@
+package api
+
+import (
+	"errors"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fridayflag/papaya/internal/auth"
+	"github.com/fridayflag/papaya/internal/env"
+	"github.com/gin-gonic/gin"
+)
+
+// maxMFAAttempts is how many wrong codes one MFA token (one password login) may be used
+// with before the user has to enter the password again.
+const maxMFAAttempts = 5
+
+// mfaAttempts counts wrong codes per MFA token (by jti). It lives in memory: with several
+// replicas each allows maxMFAAttempts, which still bounds guessing to a handful per login.
+type mfaAttempts struct {
+	mu sync.Mutex
+	m  map[string]mfaAttempt
+}
+
+type mfaAttempt struct {
+	n       int
+	expires time.Time // When the MFA token expires and the entry can go
+}
+
+func newMFAAttempts() *mfaAttempts {
+	return &mfaAttempts{m: make(map[string]mfaAttempt)}
+}
+
+// allowed reports whether the token jti may still be tried.
+func (a *mfaAttempts) allowed(jti string) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.m[jti].n < maxMFAAttempts
+}
+
+// add counts n attempts against jti; maxMFAAttempts spends the token.
+func (a *mfaAttempts) add(jti string, expires time.Time, n int) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	now := time.Now()
+	for k, v := range a.m {
+		if v.expires.Before(now) {
+			delete(a.m, k)
+		}
+	}
+	a.m[jti] = mfaAttempt{n: a.m[jti].n + n, expires: expires}
+}
+
+type mfaLoginRequest struct {
+	MFAToken string `json:"mfaToken" binding:"required"`
+	Code     string `json:"code" binding:"required"` // TOTP code or recovery code
+}
+
+// loginMFAHandler completes a login that /api/login answered with mfaRequired: it checks
+// the TOTP (or recovery) code for the user in the MFA token and only then sets the cookies.
+// Wrong codes count as failed logins (see recordLoginFailure), so fresh MFA tokens from
+// new password logins do not buy more guesses than auth.login_throttle allows.
+func loginMFAHandler(live *env.Live, store auth.Store, keys *auth.Keys, attempts *mfaAttempts) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		cfg := live.Get()
+		var req mfaLoginRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "mfaToken and code required"})
+			return
+		}
+		claims, err := auth.ParseMFAToken(req.MFAToken, keys.Refresh)
+		if err != nil || !attempts.allowed(claims.ID) {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "invalid or expired MFA token; log in again"})
+			return
+		}
+		if loginThrottled(c, cfg, store, claims.Subject) {
+			return
+		}
+		enrollment, err := store.MFA(claims.Subject)
+		if err != nil {
+			if errors.Is(err, auth.ErrMFANotEnrolled) {
+				c.JSON(http.StatusUnauthorized, gin.H{"error": "invalid or expired MFA token; log in again"})
+				return
+			}
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to check code"})
+			return
+		}
+		ok, err := verifySecondFactor(store, keys, enrollment, req.Code, true)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to check code"})
+			return
+		}
+		if !ok {
+			attempts.add(claims.ID, claims.ExpiresAt.Time, 1)
+			recordLoginFailure(c, cfg, store, claims.Subject)
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "invalid code"})
+			return
+		}
+		attempts.add(claims.ID, claims.ExpiresAt.Time, maxMFAAttempts) // One login per MFA token
+		clearLoginFailures(c, cfg, store, claims.Subject)
+		if err := issueTokens(c, cfg, store, keys, claims.Subject, claims.DeviceLabel, claims.Short); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to issue tokens"})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"ok": true})
+	}
+}
+
+// verifySecondFactor checks code against the user's TOTP secret and, with allowRecovery,
+// their unused recovery codes. An accepted code cannot be used again.
+func verifySecondFactor(store auth.Store, keys *auth.Keys, e *auth.MFAEnrollment, code string, allowRecovery bool) (bool, error) {
+	code = strings.TrimSpace(code)
+	if auth.IsTOTPCode(code) {
+		secret, err := keys.OpenMFASecret(e.Username, e.SealedSecret)
+		if err != nil {
+			return false, err
+		}
+		step, ok := auth.VerifyTOTP(secret, code, time.Now(), e.LastStep)
+		if !ok {
+			return false, nil
+		}
+		return store.UseTOTPStep(e.Username, step)
+	}
+	if !allowRecovery || !e.Confirmed() {
+		return false, nil
+	}
+	ok, err := store.UseRecoveryCode(e.Username, auth.RecoveryCodeHash(code))
+	if ok {
+		if err := store.RecordEvent(auth.EventMFARecoveryUsed, e.Username, "", ""); err != nil {
+			slog.Warn("auth: failed to record event", "err", err)
+		}
+	}
+	return ok, err
+}
+
+// mfaStatusHandler reports whether the caller has two-factor authentication enabled.
+func mfaStatusHandler(store auth.MFAStore) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		e, err := store.MFA(getUserClaims(c).Subject)
+		if err != nil && !errors.Is(err, auth.ErrMFANotEnrolled) {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to read MFA status"})
+			return
+		}
+		resp := gin.H{"enabled": false, "recoveryCodesLeft": 0}
+		if e != nil && e.Confirmed() {
+			resp = gin.H{"enabled": true, "recoveryCodesLeft": e.RecoveryCodesLeft}
+		}
+		c.JSON(http.StatusOK, resp)
+	}
+}
+
+// mfaEnrollHandler starts TOTP enrollment: it stores a new secret and returns it with its
+// otpauth:// URI for the authenticator app. It is not required at login until confirmed
+// with mfaVerifyHandler.
+func mfaEnrollHandler(live *env.Live, store auth.MFAStore, keys *auth.Keys) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		cfg := live.Get()
+		username := getUserClaims(c).Subject
+		secret, err := auth.GenerateTOTPSecret()
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to create secret"})
+			return
+		}
+		sealed, err := keys.SealMFASecret(username, secret)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to create secret"})
+			return
+		}
+		if err := store.BeginMFA(username, sealed); err != nil {
+			if errors.Is(err, auth.ErrMFAEnrolled) {
+				c.JSON(http.StatusConflict, gin.H{"error": "two-factor authentication is already enabled"})
+				return
+			}
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to store secret"})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{
+			"secret": auth.TOTPSecretString(secret),
+			"uri":    auth.TOTPURI(cfg.App.Auth.MFAIssuer, username, secret),
+		})
+	}
+}
+
+type mfaCodeRequest struct {
+	Code string `json:"code" binding:"required"`
+}
+
+// mfaVerifyHandler confirms enrollment with a code from the app, which turns two-factor
+// authentication on, and returns the recovery codes (shown once).
+func mfaVerifyHandler(store auth.Store, keys *auth.Keys) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		e, ok := mfaEnrollmentWithCode(c, store, keys, false, false)
+		if !ok {
+			return
+		}
+		if e.Confirmed() {
+			c.JSON(http.StatusConflict, gin.H{"error": "two-factor authentication is already enabled"})
+			return
+		}
+		issueRecoveryCodes(c, store, e.Username, auth.EventMFAEnabled)
+	}
+}
+
+// mfaRecoveryCodesHandler replaces the caller's recovery codes; it takes a TOTP code.
+func mfaRecoveryCodesHandler(store auth.Store, keys *auth.Keys) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		e, ok := mfaEnrollmentWithCode(c, store, keys, true, false)
+		if !ok {
+			return
+		}
+		issueRecoveryCodes(c, store, e.Username, auth.EventMFACodesRenewed)
+	}
+}
+
+// mfaDisableHandler turns two-factor authentication off; it takes a TOTP or recovery code.
+func mfaDisableHandler(store auth.Store, keys *auth.Keys) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		e, ok := mfaEnrollmentWithCode(c, store, keys, true, true)
+		if !ok {
+			return
+		}
+		if err := store.DeleteMFA(e.Username); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to disable two-factor authentication"})
+			return
+		}
+		if err := store.RecordEvent(auth.EventMFADisabled, e.Username, "", ""); err != nil {
+			slog.Warn("auth: failed to record event", "err", err)
+		}
+		c.JSON(http.StatusOK, gin.H{"ok": true})
+	}
+}
+
+// mfaEnrollmentWithCode loads the caller's enrollment and checks the code in the request
+// body against it. With confirmed, the enrollment must be in force. On failure it writes
+// the error response and returns ok == false.
+func mfaEnrollmentWithCode(c *gin.Context, store auth.Store, keys *auth.Keys, confirmed, allowRecovery bool) (e *auth.MFAEnrollment, ok bool) {
+	var req mfaCodeRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "code required"})
+		return nil, false
+	}
+	e, err := store.MFA(getUserClaims(c).Subject)
+	if errors.Is(err, auth.ErrMFANotEnrolled) || (err == nil && confirmed && !e.Confirmed()) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "two-factor authentication is not enabled"})
+		return nil, false
+	}
+	if err == nil {
+		ok, err = verifySecondFactor(store, keys, e, req.Code, allowRecovery)
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to check code"})
+		return nil, false
+	}
+	if !ok {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "invalid code"})
+		return nil, false
+	}
+	return e, true
+}
+
+// issueRecoveryCodes generates recovery codes, confirms the enrollment with them and
+// returns them in the response; only their hashes are kept.
+func issueRecoveryCodes(c *gin.Context, store auth.Store, username, event string) {
+	codes, err := auth.GenerateRecoveryCodes()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to create recovery codes"})
+		return
+	}
+	hashes := make([]string, len(codes))
+	for i, code := range codes {
+		hashes[i] = auth.RecoveryCodeHash(code)
+	}
+	if err := store.ConfirmMFA(username, hashes); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to store recovery codes"})
+		return
+	}
+	if err := store.RecordEvent(event, username, "", ""); err != nil {
+		slog.Warn("auth: failed to record event", "err", err)
+	}
+	c.JSON(http.StatusOK, gin.H{"recoveryCodes": codes})
+}
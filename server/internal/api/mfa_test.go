@@ -0,0 +1,148 @@
+package api
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/binary"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/fridayflag/papaya/internal/auth"
+	"github.com/fridayflag/papaya/internal/env"
+	"github.com/gin-gonic/gin"
+)
+
+// enrollTOTP turns on two-factor authentication for username and returns the secret.
+func (s *testServer) enrollTOTP(username string) []byte {
+	s.t.Helper()
+	secret := []byte("12345678901234567890")
+	sealed, err := s.keys.SealMFASecret(username, secret)
+	if err != nil {
+		s.t.Fatal(err)
+	}
+	if err := s.store.BeginMFA(username, sealed); err != nil {
+		s.t.Fatal(err)
+	}
+	if err := s.store.ConfirmMFA(username, nil); err != nil {
+		s.t.Fatal(err)
+	}
+	return secret
+}
+
+// totpCode is the RFC 6238 code for secret at now (SHA-1, 30s, 6 digits).
+func totpCode(secret []byte, now time.Time) string {
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], uint64(now.Unix()/30))
+	mac := hmac.New(sha1.New, secret)
+	mac.Write(msg[:])
+	sum := mac.Sum(nil)
+	offset := sum[len(sum)-1] & 0x0f
+	return fmt.Sprintf("%06d", binary.BigEndian.Uint32(sum[offset:])&0x7fffffff%1_000_000)
+}
+
+// passwordStep logs in with the password and returns the MFA token.
+func (s *testServer) passwordStep(client *http.Client, username, password string) string {
+	s.t.Helper()
+	var resp struct {
+		MFARequired bool   `json:"mfaRequired"`
+		MFAToken    string `json:"mfaToken"`
+	}
+	r, body := s.do(client, http.MethodPost, "/api/login", map[string]any{"username": username, "password": password})
+	if r.StatusCode != http.StatusOK {
+		s.t.Fatalf("login as %s: %d %s", username, r.StatusCode, body)
+	}
+	decode(s.t, body, &resp)
+	if !resp.MFARequired || resp.MFAToken == "" {
+		s.t.Fatalf("login as %s = %s, want mfaRequired", username, body)
+	}
+	return resp.MFAToken
+}
+
+func TestWrongMFACodesThrottled(t *testing.T) {
+	s := newTestServer(t, func(cfg *env.Config) {
+		cfg.App.Auth.LoginThrottle.FreeAttempts = 5
+		cfg.App.Auth.LoginThrottle.LockoutAfter = 5
+	})
+	s.couch.addUser("alice", "pw")
+	secret := s.enrollTOTP("alice")
+	right := totpCode(secret, time.Now())
+	wrong := right[:5] + string('0'+(right[5]-'0'+1)%10) // Differs in the last digit
+	client := s.client()
+
+	// Five wrong codes spread over new password logins, each with a fresh MFA token.
+	var token string
+	for i := range 5 {
+		if i%2 == 0 {
+			token = s.passwordStep(client, "alice", "pw")
+		}
+		resp, body := s.do(client, http.MethodPost, "/api/login/mfa", map[string]any{"mfaToken": token, "code": wrong})
+		if resp.StatusCode != http.StatusUnauthorized {
+			t.Fatalf("wrong code %d: %d %s, want 401", i+1, resp.StatusCode, body)
+		}
+	}
+	// The sixth attempt is refused, even with the right code and a new MFA token.
+	resp, body := s.do(client, http.MethodPost, "/api/login/mfa", map[string]any{"mfaToken": token, "code": right})
+	if resp.StatusCode != http.StatusTooManyRequests {
+		t.Errorf("sixth code: %d %s, want 429", resp.StatusCode, body)
+	}
+	resp, body = s.do(client, http.MethodPost, "/api/login", map[string]any{"username": "alice", "password": "pw"})
+	if resp.StatusCode != http.StatusTooManyRequests {
+		t.Errorf("password login after five wrong codes: %d %s, want 429", resp.StatusCode, body)
+	}
+}
+
+func TestLoginFailuresClearedAfterMFA(t *testing.T) {
+	s := newTestServer(t, nil)
+	s.couch.addUser("alice", "pw")
+	secret := s.enrollTOTP("alice")
+	client := s.client()
+	failures := func() int {
+		t.Helper()
+		f, err := s.store.FailedLogins("user:alice")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return f.Count
+	}
+
+	for range 2 {
+		s.do(client, http.MethodPost, "/api/login", map[string]any{"username": "alice", "password": "wrong"})
+	}
+	token := s.passwordStep(client, "alice", "pw")
+	// The password alone does not clear the count.
+	if got := failures(); got != 2 {
+		t.Fatalf("failures after the password step = %d, want 2", got)
+	}
+	resp, body := s.do(client, http.MethodPost, "/api/login/mfa", map[string]any{"mfaToken": token, "code": totpCode(secret, time.Now())})
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("right code: %d %s", resp.StatusCode, body)
+	}
+	if got := failures(); got != 0 {
+		t.Errorf("failures after the whole login = %d, want 0", got)
+	}
+}
+
+// TestMFATokenNotARefreshToken checks that the token from the password step, which is
+// signed with the refresh key, does not pass for a session in the refresh cookie.
+func TestMFATokenNotARefreshToken(t *testing.T) {
+	s := newTestServer(t, nil)
+	s.couch.addUser("alice", "pw")
+	s.enrollTOTP("alice")
+	token := s.passwordStep(s.client(), "alice", "pw")
+	cookie := auth.CookieRefreshToken + "=" + token
+
+	for _, req := range [][2]string{{http.MethodGet, "/api/session"}, {http.MethodPost, "/api/refresh"}} {
+		if resp, body := s.do(http.DefaultClient, req[0], req[1], nil, "Cookie", cookie); resp.StatusCode != http.StatusUnauthorized {
+			t.Errorf("%s %s with the MFA token as refresh cookie: %d %s, want 401", req[0], req[1], resp.StatusCode, body)
+		}
+	}
+	c, _ := gin.CreateTestContext(httptest.NewRecorder())
+	c.Request = httptest.NewRequest(http.MethodGet, "/api/session", nil)
+	c.Request.Header.Set("Cookie", cookie)
+	if got := cookieUser(c, s.live.Get(), s.keys); got != "" {
+		t.Errorf("cookieUser() with the MFA token as refresh cookie = %q, want none", got)
+	}
+}
@@ -0,0 +1,234 @@
+package api
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+	"github.com/fridayflag/papaya/internal/auth"
+	"github.com/fridayflag/papaya/internal/env"
+	"github.com/gin-gonic/gin"
+	"golang.org/x/oauth2"
+)
+
+const (
+	// oidcFlowTTL bounds the time the user has to sign in at the provider.
+	oidcFlowTTL = 10 * time.Minute
+	// oidcTimeout bounds each request to the provider (discovery, keys, token exchange).
+	oidcTimeout = 10 * time.Second
+)
+
+// oidcMiddleware answers 404 while auth.oidc.issuer is not set.
+func oidcMiddleware(live *env.Live) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if live.Get().App.Auth.OIDC.Issuer == "" {
+			c.JSON(http.StatusNotFound, gin.H{"error": "not found"})
+			c.Abort()
+			return
+		}
+		c.Next()
+	}
+}
+
+// oidcProvider discovers the configured issuer once and keeps the result until the
+// issuer changes on reload. The provider fetches and refreshes the signing keys itself.
+type oidcProvider struct {
+	mu       sync.Mutex
+	issuer   string
+	provider *oidc.Provider
+}
+
+// oidcContext makes go-oidc and oauth2 use an HTTP client with oidcTimeout.
+func oidcContext(ctx context.Context) context.Context {
+	return oidc.ClientContext(ctx, &http.Client{Timeout: oidcTimeout})
+}
+
+func (p *oidcProvider) get(issuer string) (*oidc.Provider, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.provider != nil && p.issuer == issuer {
+		return p.provider, nil
+	}
+	// The key set keeps this context for later fetches, so it must not be a request's.
+	provider, err := oidc.NewProvider(oidcContext(context.Background()), issuer)
+	if err != nil {
+		return nil, err
+	}
+	p.issuer, p.provider = issuer, provider
+	return provider, nil
+}
+
+func oauth2Config(cfg *env.Config, provider *oidc.Provider) *oauth2.Config {
+	o := cfg.App.Auth.OIDC
+	return &oauth2.Config{
+		ClientID:     o.ClientID,
+		ClientSecret: cfg.AuthOIDCSecret,
+		RedirectURL:  o.RedirectURL,
+		Endpoint:     provider.Endpoint(),
+		Scopes:       append([]string{oidc.ScopeOpenID}, o.Scopes...),
+	}
+}
+
+// oidcFlow is what /api/oidc/login leaves in the sealed papaya_oidc cookie for the
+// callback.
+type oidcFlow struct {
+	State       string `json:"state"`
+	Nonce       string `json:"nonce"`
+	Verifier    string `json:"verifier"` // PKCE code verifier
+	DeviceLabel string `json:"deviceLabel,omitempty"`
+	Short       bool   `json:"short,omitempty"` // ?rememberMe=false
+	Next        string `json:"next"`            // Where to send the browser once signed in
+}
+
+// oidcLoginHandler starts a sign-in: it redirects the browser to the provider with a
+// fresh state, nonce and PKCE challenge. ?next= is a local path to return to afterwards,
+// ?deviceLabel= names the session and ?rememberMe=false makes it short (see issueTokens).
+func oidcLoginHandler(live *env.Live, providers *oidcProvider, keys *auth.Keys) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		cfg := live.Get()
+		provider, err := providers.get(cfg.App.Auth.OIDC.Issuer)
+		if err != nil {
+			slog.Warn("auth: OIDC discovery failed", "issuer", cfg.App.Auth.OIDC.Issuer, "err", err)
+			c.JSON(http.StatusBadGateway, gin.H{"error": "identity provider unavailable"})
+			return
+		}
+		flow := oidcFlow{
+			State:       randomURLToken(),
+			Nonce:       randomURLToken(),
+			Verifier:    oauth2.GenerateVerifier(),
+			DeviceLabel: c.Query("deviceLabel"),
+			Short:       c.Query("rememberMe") == "false",
+			Next:        localPath(c.Query("next")),
+		}
+		data, err := json.Marshal(flow)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to start sign-in"})
+			return
+		}
+		value, err := keys.SealCookie(auth.CookieOIDC, data)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to start sign-in"})
+			return
+		}
+		setCookie(c, cfg, auth.CookieOIDC, value, int(oidcFlowTTL.Seconds()), "/api/oidc")
+		url := oauth2Config(cfg, provider).AuthCodeURL(flow.State, oidc.Nonce(flow.Nonce), oauth2.S256ChallengeOption(flow.Verifier))
+		c.Redirect(http.StatusFound, url)
+	}
+}
+
+// oidcCallbackHandler finishes a sign-in: it exchanges the code, validates the ID token,
+// maps auth.oidc.username_claim to a CouchDB user (creating it when auth.oidc.provision
+// is on), sets the auth cookies and redirects to the flow's next path. The provider is
+// trusted to have authenticated the user, so no TOTP code is asked for.
+func oidcCallbackHandler(live *env.Live, providers *oidcProvider, store auth.Store, keys *auth.Keys) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		cfg := live.Get()
+		o := cfg.App.Auth.OIDC
+		value := readCookie(c, cfg, auth.CookieOIDC)
+		setCookie(c, cfg, auth.CookieOIDC, "", -1, "/api/oidc")
+		var flow oidcFlow
+		data, err := keys.OpenCookie(auth.CookieOIDC, value)
+		if err == nil {
+			err = json.Unmarshal(data, &flow)
+		}
+		if err != nil || flow.State == "" || c.Query("state") != flow.State {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "no sign-in in progress; start again"})
+			return
+		}
+		if e := c.Query("error"); e != "" {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "identity provider refused sign-in: " + e})
+			return
+		}
+		provider, err := providers.get(o.Issuer)
+		if err != nil {
+			slog.Warn("auth: OIDC discovery failed", "issuer", o.Issuer, "err", err)
+			c.JSON(http.StatusBadGateway, gin.H{"error": "identity provider unavailable"})
+			return
+		}
+		ctx := oidcContext(c.Request.Context())
+		token, err := oauth2Config(cfg, provider).Exchange(ctx, c.Query("code"), oauth2.VerifierOption(flow.Verifier))
+		if err != nil {
+			slog.Warn("auth: OIDC code exchange failed", "err", err)
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "sign-in failed"})
+			return
+		}
+		rawIDToken, _ := token.Extra("id_token").(string)
+		idToken, err := provider.Verifier(&oidc.Config{ClientID: o.ClientID}).Verify(ctx, rawIDToken)
+		if err != nil || idToken.Nonce != flow.Nonce {
+			slog.Warn("auth: OIDC ID token rejected", "err", err)
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "sign-in failed"})
+			return
+		}
+		username, err := oidcUsername(idToken, o.UsernameClaim)
+		if err != nil {
+			slog.Warn("auth: OIDC ID token has no usable username", "sub", idToken.Subject, "err", err)
+			c.JSON(http.StatusForbidden, gin.H{"error": "no Papaya user for this account"})
+			return
+		}
+		if o.Provision {
+			created, err := provisionUser(cfg, username, o.DefaultRoles, nil)
+			if err != nil {
+				slog.Error("auth: failed to provision OIDC user", "user", username, "err", err)
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to create user"})
+				return
+			}
+			if created {
+				if err := store.RecordEvent(auth.EventUserProvisioned, username, "", o.Issuer); err != nil {
+					slog.Warn("auth: failed to record event", "err", err)
+				}
+			}
+		}
+		if err := issueTokens(c, cfg, store, keys, username, flow.DeviceLabel, flow.Short); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to issue tokens"})
+			return
+		}
+		c.Redirect(http.StatusFound, flow.Next)
+	}
+}
+
+// oidcUsername reads the CouchDB username from the ID token claim. An "email" claim only
+// counts once the provider has verified the address.
+func oidcUsername(idToken *oidc.IDToken, claim string) (string, error) {
+	var claims map[string]any
+	if err := idToken.Claims(&claims); err != nil {
+		return "", err
+	}
+	username, _ := claims[claim].(string)
+	if username == "" || strings.Contains(username, ":") {
+		return "", fmt.Errorf("claim %q is missing or not a valid CouchDB username", claim)
+	}
+	if verified, ok := claims["email_verified"].(bool); claim == "email" && (!ok || !verified) {
+		return "", errors.New("email is not verified")
+	}
+	return username, nil
+}
+
+// localPath returns next if it is a path on this site, "/" otherwise, so the callback
+// cannot be used to redirect elsewhere. Control characters are refused outright: browsers
+// drop tabs and newlines from URLs, which would turn "/\t/evil.example" into "//evil.example".
+func localPath(next string) string {
+	if !strings.HasPrefix(next, "/") || strings.HasPrefix(next, "//") || strings.HasPrefix(next, "/\\") ||
+		strings.ContainsFunc(next, unicode.IsControl) {
+		return "/"
+	}
+	return next
+}
+
+// randomURLToken returns 256 random bits, base64url-encoded.
+func randomURLToken() string {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		panic(err) // crypto/rand does not fail on supported platforms
+	}
+	return base64.RawURLEncoding.EncodeToString(b)
+}
@@ -0,0 +1,335 @@
+package api
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/fridayflag/papaya/internal/auth"
+	"github.com/fridayflag/papaya/internal/env"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// fakeIssuer is an OpenID Connect provider: it serves discovery, its signing key and a
+// token endpoint that redeems the codes handed out by authorize, checking PKCE.
+type fakeIssuer struct {
+	*httptest.Server
+	t     *testing.T
+	key   *rsa.PrivateKey
+	mu    sync.Mutex
+	codes map[string]issuedCode // Authorization code → what redeeming it returns
+}
+
+type issuedCode struct {
+	challenge string        // PKCE S256 code challenge
+	claims    jwt.MapClaims // ID token claims
+}
+
+func newFakeIssuer(t *testing.T) *fakeIssuer {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := &fakeIssuer{t: t, key: key, codes: map[string]issuedCode{}}
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, map[string]any{
+			"issuer":                                f.URL,
+			"authorization_endpoint":                f.URL + "/authorize",
+			"token_endpoint":                        f.URL + "/token",
+			"jwks_uri":                              f.URL + "/keys",
+			"id_token_signing_alg_values_supported": []string{"RS256"},
+		})
+	})
+	mux.HandleFunc("GET /keys", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, map[string]any{"keys": []any{map[string]any{
+			"kty": "RSA", "alg": "RS256", "use": "sig", "kid": "k1",
+			"n": base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+			"e": base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+		}}})
+	})
+	mux.HandleFunc("POST /token", f.token)
+	f.Server = httptest.NewServer(mux)
+	t.Cleanup(f.Close)
+	return f
+}
+
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+// authorize plays the provider's login page for the redirect papaya sent the browser to:
+// the user signs in, and the provider returns the callback query. The ID token carries
+// claims, over defaults for iss, aud, sub, exp, iat and the request's nonce.
+func (f *fakeIssuer) authorize(redirect *url.URL, claims jwt.MapClaims) url.Values {
+	f.t.Helper()
+	q := redirect.Query()
+	if redirect.Path != "/authorize" || q.Get("response_type") != "code" || q.Get("client_id") != "papaya" ||
+		q.Get("code_challenge_method") != "S256" || q.Get("state") == "" || q.Get("nonce") == "" {
+		f.t.Fatalf("authorization request %s, want a code flow with state, nonce and PKCE", redirect)
+	}
+	now := time.Now()
+	all := jwt.MapClaims{
+		"iss": f.URL, "aud": "papaya", "sub": "s-1234",
+		"exp": now.Add(time.Hour).Unix(), "iat": now.Unix(), "nonce": q.Get("nonce"),
+	}
+	for k, v := range claims {
+		all[k] = v
+	}
+	code := randomURLToken()
+	f.mu.Lock()
+	f.codes[code] = issuedCode{challenge: q.Get("code_challenge"), claims: all}
+	f.mu.Unlock()
+	return url.Values{"code": {code}, "state": {q.Get("state")}}
+}
+
+func (f *fakeIssuer) token(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	issued, ok := f.codes[r.FormValue("code")]
+	delete(f.codes, r.FormValue("code"))
+	f.mu.Unlock()
+	verifier := sha256.Sum256([]byte(r.FormValue("code_verifier")))
+	if !ok || base64.RawURLEncoding.EncodeToString(verifier[:]) != issued.challenge {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		_ = json.NewEncoder(w).Encode(map[string]any{"error": "invalid_grant"})
+		return
+	}
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, issued.claims)
+	token.Header["kid"] = "k1"
+	idToken, err := token.SignedString(f.key)
+	if err != nil {
+		f.t.Error(err)
+	}
+	writeJSON(w, map[string]any{"access_token": "at", "token_type": "Bearer", "expires_in": 3600, "id_token": idToken})
+}
+
+// oidcServer is a test server signing in through a fakeIssuer, with the configuration as
+// changed by configure, which may be nil.
+func oidcServer(t *testing.T, configure func(cfg *env.Config)) (*testServer, *fakeIssuer) {
+	issuer := newFakeIssuer(t)
+	s := newTestServer(t, func(cfg *env.Config) {
+		o := &cfg.App.Auth.OIDC
+		o.Issuer = issuer.URL
+		o.ClientID = "papaya"
+		o.RedirectURL = "https://papaya.example.com/api/oidc/callback"
+		o.DefaultRoles = []string{"family"}
+		if configure != nil {
+			configure(cfg)
+		}
+	})
+	return s, issuer
+}
+
+// oidcStart sends client to /api/oidc/login with query and returns where it is redirected.
+func (s *testServer) oidcStart(client *http.Client, query string) *url.URL {
+	s.t.Helper()
+	resp, body := s.do(client, http.MethodGet, "/api/oidc/login?"+query, nil)
+	if resp.StatusCode != http.StatusFound {
+		s.t.Fatalf("GET /api/oidc/login: %d %s, want 302", resp.StatusCode, body)
+	}
+	u, err := url.Parse(resp.Header.Get("Location"))
+	if err != nil {
+		s.t.Fatal(err)
+	}
+	return u
+}
+
+// oidcSignIn goes through a whole sign-in on client with the ID token claims given and
+// returns the callback's response.
+func (s *testServer) oidcSignIn(client *http.Client, issuer *fakeIssuer, query string, claims jwt.MapClaims) (*http.Response, []byte) {
+	s.t.Helper()
+	callback := issuer.authorize(s.oidcStart(client, query), claims)
+	return s.do(client, http.MethodGet, "/api/oidc/callback?"+callback.Encode(), nil)
+}
+
+func TestOIDCSignIn(t *testing.T) {
+	s, issuer := oidcServer(t, nil)
+	browser := s.client()
+	resp, body := s.oidcSignIn(browser, issuer, "next=/budget%3Fmonth%3D3&deviceLabel=Work", jwt.MapClaims{"sub": "alice"})
+	if resp.StatusCode != http.StatusFound || resp.Header.Get("Location") != "/budget?month=3" {
+		t.Fatalf("callback: %d %s to %q, want 302 to /budget?month=3", resp.StatusCode, body, resp.Header.Get("Location"))
+	}
+	if sub := claims(t, s.cookie(browser, auth.CookieAccessToken))["sub"]; sub != "alice" {
+		t.Errorf("access token sub = %v, want alice", sub)
+	}
+	sessions, err := s.store.Sessions("alice")
+	if err != nil || len(sessions) != 1 || sessions[0].DeviceLabel != "Work" {
+		t.Errorf("Sessions(alice) = %+v, %v, want one on Work", sessions, err)
+	}
+
+	// The flow cookie is spent: the same callback cannot be replayed.
+	if resp, body := s.do(browser, http.MethodGet, "/api/oidc/callback?"+resp.Request.URL.RawQuery, nil); resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("callback again: %d %s, want 400", resp.StatusCode, body)
+	}
+}
+
+func TestOIDCProvisioning(t *testing.T) {
+	tests := []struct {
+		name      string
+		provision bool
+		existing  []string // alice's roles before, nil when she has no _users document
+		wantRoles []any    // After; nil for no document
+	}{
+		{"created", true, nil, []any{"family"}},
+		{"existing user kept as is", true, []string{"editor"}, []any{"editor"}},
+		{"provisioning off", false, nil, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, issuer := oidcServer(t, func(cfg *env.Config) { cfg.App.Auth.OIDC.Provision = tt.provision })
+			if tt.existing != nil {
+				s.couch.addUser("alice", "pw", tt.existing...)
+			}
+			resp, body := s.oidcSignIn(s.client(), issuer, "", jwt.MapClaims{"sub": "alice"})
+			if resp.StatusCode != http.StatusFound {
+				t.Fatalf("callback: %d %s, want 302", resp.StatusCode, body)
+			}
+			doc := s.couch.user("alice")
+			if tt.wantRoles == nil {
+				if doc != nil {
+					t.Errorf("_users has %v, want no document", doc)
+				}
+				return
+			}
+			if doc == nil {
+				t.Fatal("alice not in _users")
+			}
+			if roles, _ := doc["roles"].([]any); !slices.Equal(roles, tt.wantRoles) {
+				t.Errorf("roles = %v, want %v", doc["roles"], tt.wantRoles)
+			}
+		})
+	}
+}
+
+func TestOIDCCallbackRefused(t *testing.T) {
+	tests := []struct {
+		name      string
+		claim     string        // auth.oidc.username_claim; "" for the default
+		claims    jwt.MapClaims // In the ID token
+		tamper    func(q url.Values)
+		newClient bool // Finish in another browser, without the flow cookie
+		want      int
+	}{
+		{"state mismatch", "", jwt.MapClaims{"sub": "alice"}, func(q url.Values) { q.Set("state", "forged") }, false, http.StatusBadRequest},
+		{"no state", "", jwt.MapClaims{"sub": "alice"}, func(q url.Values) { q.Del("state") }, false, http.StatusBadRequest},
+		{"other browser", "", jwt.MapClaims{"sub": "alice"}, nil, true, http.StatusBadRequest},
+		{"provider error", "", nil, func(q url.Values) { q.Del("code"); q.Set("error", "access_denied") }, false, http.StatusUnauthorized},
+		{"unknown code", "", jwt.MapClaims{"sub": "alice"}, func(q url.Values) { q.Set("code", "guessed") }, false, http.StatusUnauthorized},
+		{"nonce mismatch", "", jwt.MapClaims{"sub": "alice", "nonce": "replayed"}, nil, false, http.StatusUnauthorized},
+		{"no nonce", "", jwt.MapClaims{"sub": "alice", "nonce": ""}, nil, false, http.StatusUnauthorized},
+		{"other audience", "", jwt.MapClaims{"sub": "alice", "aud": "someone-else"}, nil, false, http.StatusUnauthorized},
+		{"expired", "", jwt.MapClaims{"sub": "alice", "exp": time.Now().Add(-time.Hour).Unix()}, nil, false, http.StatusUnauthorized},
+		{"no username claim", "preferred_username", jwt.MapClaims{"name": "Alice"}, nil, false, http.StatusForbidden},
+		{"empty username", "preferred_username", jwt.MapClaims{"preferred_username": ""}, nil, false, http.StatusForbidden},
+		{"colon in username", "", jwt.MapClaims{"sub": "org.couchdb.user:alice"}, nil, false, http.StatusForbidden},
+		{"unverified email", "email", jwt.MapClaims{"email": "alice@example.com", "email_verified": false}, nil, false, http.StatusForbidden},
+		{"email without email_verified", "email", jwt.MapClaims{"email": "alice@example.com"}, nil, false, http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, issuer := oidcServer(t, func(cfg *env.Config) {
+				if tt.claim != "" {
+					cfg.App.Auth.OIDC.UsernameClaim = tt.claim
+				}
+			})
+			browser := s.client()
+			callback := issuer.authorize(s.oidcStart(browser, ""), tt.claims)
+			if tt.tamper != nil {
+				tt.tamper(callback)
+			}
+			if tt.newClient {
+				browser = s.client()
+			}
+			resp, body := s.do(browser, http.MethodGet, "/api/oidc/callback?"+callback.Encode(), nil)
+			if resp.StatusCode != tt.want {
+				t.Errorf("callback: %d %s, want %d", resp.StatusCode, body, tt.want)
+			}
+			if s.cookie(browser, auth.CookieAccessToken) != "" {
+				t.Error("refused sign-in set an access token")
+			}
+			if s.couch.user("alice") != nil || s.couch.user("alice@example.com") != nil {
+				t.Error("refused sign-in provisioned a user")
+			}
+		})
+	}
+}
+
+// TestOIDCDefaultClaim checks that by default the username is the provider's sub: a user
+// who names their provider account "admin" does not sign in as the local admin.
+func TestOIDCDefaultClaim(t *testing.T) {
+	s, issuer := oidcServer(t, nil)
+	s.couch.addUser("admin", "adminpw", "_admin")
+	browser := s.client()
+	resp, body := s.oidcSignIn(browser, issuer, "", jwt.MapClaims{"preferred_username": "admin"})
+	if resp.StatusCode != http.StatusFound {
+		t.Fatalf("callback: %d %s, want 302", resp.StatusCode, body)
+	}
+	if sub := claims(t, s.cookie(browser, auth.CookieAccessToken))["sub"]; sub != "s-1234" {
+		t.Errorf("access token sub = %v, want the provider's sub s-1234", sub)
+	}
+	if sessions, _ := s.store.Sessions("admin"); len(sessions) != 0 {
+		t.Errorf("Sessions(admin) = %+v, want none", sessions)
+	}
+}
+
+func TestOIDCEmailUsername(t *testing.T) {
+	s, issuer := oidcServer(t, func(cfg *env.Config) { cfg.App.Auth.OIDC.UsernameClaim = "email" })
+	browser := s.client()
+	resp, body := s.oidcSignIn(browser, issuer, "", jwt.MapClaims{"email": "alice@example.com", "email_verified": true})
+	if resp.StatusCode != http.StatusFound {
+		t.Fatalf("callback: %d %s, want 302", resp.StatusCode, body)
+	}
+	if sub := claims(t, s.cookie(browser, auth.CookieAccessToken))["sub"]; sub != "alice@example.com" {
+		t.Errorf("access token sub = %v, want alice@example.com", sub)
+	}
+}
+
+func TestOIDCOpenRedirect(t *testing.T) {
+	s, issuer := oidcServer(t, nil)
+	for _, next := range []string{"https://evil.example", "//evil.example", "/\\evil.example", "/\t/evil.example"} {
+		t.Run(next, func(t *testing.T) {
+			resp, body := s.oidcSignIn(s.client(), issuer, url.Values{"next": {next}}.Encode(), jwt.MapClaims{"sub": "alice"})
+			if resp.StatusCode != http.StatusFound || resp.Header.Get("Location") != "/" {
+				t.Errorf("callback: %d %s to %q, want 302 to /", resp.StatusCode, body, resp.Header.Get("Location"))
+			}
+		})
+	}
+}
+
+func TestLocalPath(t *testing.T) {
+	tests := []struct {
+		next, want string
+	}{
+		{"/", "/"},
+		{"/budget", "/budget"},
+		{"/budget?month=3#top", "/budget?month=3#top"},
+		{"/a//b", "/a//b"},
+		{"", "/"},
+		{"budget", "/"},
+		{"https://evil.example/", "/"},
+		{"javascript:alert(1)", "/"},
+		{"//evil.example", "/"},
+		{"///evil.example", "/"},
+		{"/\\evil.example", "/"},
+		{"/\t/evil.example", "/"}, // Browsers drop tabs and newlines from URLs
+		{"/\n/evil.example", "/"},
+		{"/\r\n/evil.example", "/"},
+	}
+	for _, tt := range tests {
+		if got := localPath(tt.next); got != tt.want {
+			t.Errorf("localPath(%q) = %q, want %q", tt.next, got, tt.want)
+		}
+	}
+}
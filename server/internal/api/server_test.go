@@ -0,0 +1,345 @@
+package api
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/fridayflag/papaya/internal/auth"
+	"github.com/fridayflag/papaya/internal/config"
+	"github.com/fridayflag/papaya/internal/env"
+	"github.com/fridayflag/papaya/internal/proxy"
+)
+
+// fakeCouch stands in for CouchDB: _session checks passwords, _users keeps user
+// documents, _node/_local/_config/admins lists the server admins, and every other path
+// (what the /db proxy forwards) answers 200 and is counted.
+type fakeCouch struct {
+	*httptest.Server
+	mu        sync.Mutex
+	passwords map[string]string         // Username → password, server admins included
+	admins    map[string]bool           // Server admins
+	users     map[string]map[string]any // _users document ID → document
+	conflicts int                       // The next PUTs to _users that answer 409
+	userReads int                       // GETs of _users documents
+	dbCalls   int                       // Requests outside the CouchDB APIs above
+	dbAuth    string                    // Authorization of the last of them
+}
+
+func newFakeCouch(t *testing.T) *fakeCouch {
+	f := &fakeCouch{
+		passwords: map[string]string{"admin": "adminpw"},
+		admins:    map[string]bool{"admin": true},
+		users:     map[string]map[string]any{},
+	}
+	f.Server = httptest.NewServer(http.HandlerFunc(f.serve))
+	t.Cleanup(f.Close)
+	return f
+}
+
+// addUser creates a _users document for username with password and roles.
+func (f *fakeCouch) addUser(username, password string, roles ...string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.passwords[username] = password
+	f.users[userDocPrefix+username] = map[string]any{
+		"_id": userDocPrefix + username, "_rev": "1-a", "name": username, "type": "user", "roles": toAny(roles),
+	}
+}
+
+// user returns a copy of username's _users document, or nil.
+func (f *fakeCouch) user(username string) map[string]any {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	doc, ok := f.users[userDocPrefix+username]
+	if !ok {
+		return nil
+	}
+	b, _ := json.Marshal(doc)
+	var out map[string]any
+	_ = json.Unmarshal(b, &out)
+	return out
+}
+
+func toAny(ss []string) []any {
+	out := []any{}
+	for _, s := range ss {
+		out = append(out, s)
+	}
+	return out
+}
+
+func (f *fakeCouch) serve(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	w.Header().Set("Content-Type", "application/json")
+	reply := func(status int, v any) {
+		w.WriteHeader(status)
+		_ = json.NewEncoder(w).Encode(v)
+	}
+	admin := func() bool {
+		name, pass, ok := r.BasicAuth()
+		return ok && f.admins[name] && f.passwords[name] == pass
+	}
+	switch {
+	case r.URL.Path == "/_session" && r.Method == http.MethodPost:
+		var body struct{ Name, Password string }
+		_ = json.NewDecoder(r.Body).Decode(&body)
+		if pw, ok := f.passwords[body.Name]; !ok || pw != body.Password {
+			reply(http.StatusUnauthorized, map[string]any{"error": "unauthorized"})
+			return
+		}
+		reply(http.StatusOK, map[string]any{"ok": true, "name": body.Name})
+	case strings.HasPrefix(r.URL.Path, "/_node/_local/_config/admins/"):
+		if !admin() {
+			reply(http.StatusUnauthorized, map[string]any{"error": "unauthorized"})
+		} else if f.admins[strings.TrimPrefix(r.URL.Path, "/_node/_local/_config/admins/")] {
+			reply(http.StatusOK, "-hashed-")
+		} else {
+			reply(http.StatusNotFound, map[string]any{"error": "not_found"})
+		}
+	case strings.HasPrefix(r.URL.Path, "/_users/"):
+		if !admin() {
+			reply(http.StatusUnauthorized, map[string]any{"error": "unauthorized"})
+			return
+		}
+		id := strings.TrimPrefix(r.URL.Path, "/_users/")
+		doc, exists := f.users[id]
+		switch r.Method {
+		case http.MethodGet:
+			f.userReads++
+			if !exists {
+				reply(http.StatusNotFound, map[string]any{"error": "not_found"})
+				return
+			}
+			reply(http.StatusOK, doc)
+		case http.MethodPut:
+			var next map[string]any
+			if err := json.NewDecoder(r.Body).Decode(&next); err != nil {
+				reply(http.StatusBadRequest, map[string]any{"error": "bad_request"})
+				return
+			}
+			if f.conflicts > 0 {
+				f.conflicts--
+				// Someone else updated the document in between.
+				if exists {
+					doc["_rev"] = bumpRev(doc["_rev"])
+				}
+				reply(http.StatusConflict, map[string]any{"error": "conflict"})
+				return
+			}
+			if exists && next["_rev"] != doc["_rev"] || !exists && next["_rev"] != nil {
+				reply(http.StatusConflict, map[string]any{"error": "conflict"})
+				return
+			}
+			name, _ := next["name"].(string)
+			if id != userDocPrefix+name {
+				reply(http.StatusBadRequest, map[string]any{"error": "doc.name must match _id"})
+				return
+			}
+			if pw, ok := next["password"].(string); ok {
+				f.passwords[name] = pw
+				delete(next, "password")
+			}
+			next["_rev"] = bumpRev(next["_rev"])
+			f.users[id] = next
+			status := http.StatusOK
+			if !exists {
+				status = http.StatusCreated
+			}
+			reply(status, map[string]any{"ok": true, "id": id, "rev": next["_rev"]})
+		default:
+			reply(http.StatusMethodNotAllowed, map[string]any{"error": "method_not_allowed"})
+		}
+	default:
+		f.dbCalls++
+		f.dbAuth = r.Header.Get("Authorization")
+		reply(http.StatusOK, map[string]any{"ok": true})
+	}
+}
+
+// bumpRev returns the revision after rev ("2-x" after "1-a", "1-x" after none).
+func bumpRev(rev any) string {
+	s, _ := rev.(string)
+	n, _, _ := strings.Cut(s, "-")
+	i, _ := strconv.Atoi(n)
+	return strconv.Itoa(i+1) + "-x"
+}
+
+// testServer is papaya's HTTP surface (/api and the /db proxy, as main wires them) in
+// front of a fakeCouch.
+type testServer struct {
+	*httptest.Server
+	t        *testing.T
+	couch    *fakeCouch
+	live     *env.Live
+	store    auth.Store
+	keys     *auth.Keys
+	denylist *auth.Denylist
+}
+
+// newTestServer starts a server with the default configuration as changed by configure,
+// which may be nil, and a memory store.
+func newTestServer(t *testing.T, configure func(cfg *env.Config)) *testServer {
+	t.Helper()
+	couch := newFakeCouch(t)
+	u, _ := url.Parse(couch.URL)
+	host, port, _ := net.SplitHostPort(u.Host)
+	cfg := &env.Config{
+		AuthTokenSecret:   "test-access-secret",
+		AuthRefreshSecret: "test-refresh-secret",
+		AuthTokenKid:      "test",
+		AuthKeyringPath:   filepath.Join(t.TempDir(), "jwt-keys.json"),
+		CouchDBHost:       host,
+		CouchDBProxiedURL: couch.URL,
+		CouchDBAdminUser:  "admin",
+		CouchDBAdminPass:  "adminpw",
+		App:               config.Default(),
+	}
+	cfg.CouchDBPort, _ = strconv.Atoi(port)
+	cfg.App.Features.Admin = true
+	if configure != nil {
+		configure(cfg)
+	}
+	live := env.NewLive(cfg, nil)
+
+	keys, err := auth.LoadKeys(cfg.AuthTokenKid, cfg.AuthTokenSecret, cfg.AuthRefreshSecret, cfg.AuthMFASecret, cfg.AuthSigningKey, cfg.AuthKeyringPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := auth.NewMemoryStore()
+	denylist, err := auth.NewDenylist(store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	roles := NewRolesCache()
+	accessCookie := auth.CookieName(auth.CookieAccessToken, cfg.App.Auth.Cookies.HostPrefix)
+	dbProxy, err := proxy.ReverseProxy("/db", cfg.CouchDBProxiedURL, cfg.App.CouchDB, accessCookie,
+		ExchangePersonalAccessToken(live, store, keys, roles), AccessTokenRevoked(keys, denylist))
+	if err != nil {
+		t.Fatal(err)
+	}
+	router, err := Router(live, store, keys, denylist, roles)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/db/", CSRFProtect(live, dbProxy))
+	mux.Handle("/api/", router)
+	s := &testServer{Server: httptest.NewServer(mux), t: t, couch: couch, live: live, store: store, keys: keys, denylist: denylist}
+	t.Cleanup(s.Close)
+	return s
+}
+
+// client returns a client with a cookie jar of its own: one browser.
+func (s *testServer) client() *http.Client {
+	jar, _ := cookiejar.New(nil)
+	return &http.Client{
+		Jar: jar,
+		// Keep redirects (single sign-on, passkeys) visible to the test.
+		CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse },
+	}
+}
+
+// do sends a request with a JSON body (unless body is nil) and returns the response with
+// its body read. header holds extra request headers as name, value pairs.
+func (s *testServer) do(client *http.Client, method, path string, body any, header ...string) (*http.Response, []byte) {
+	s.t.Helper()
+	var r io.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			s.t.Fatal(err)
+		}
+		r = bytes.NewReader(b)
+	}
+	req, err := http.NewRequest(method, s.URL+path, r)
+	if err != nil {
+		s.t.Fatal(err)
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	for i := 0; i+1 < len(header); i += 2 {
+		req.Header.Set(header[i], header[i+1])
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		s.t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		s.t.Fatal(err)
+	}
+	return resp, b
+}
+
+// login logs username in with password on client and fails the test unless it succeeds.
+func (s *testServer) login(client *http.Client, username, password string) {
+	s.t.Helper()
+	resp, body := s.do(client, http.MethodPost, "/api/login", map[string]any{"username": username, "password": password})
+	if resp.StatusCode != http.StatusOK {
+		s.t.Fatalf("login as %s: %d %s", username, resp.StatusCode, body)
+	}
+}
+
+// cookie returns the value of client's cookie called name (see auth.CookieName), or "".
+func (s *testServer) cookie(client *http.Client, name string) string {
+	u, _ := url.Parse(s.URL)
+	for _, c := range client.Jar.Cookies(u) {
+		if c.Name == auth.CookieName(name, s.live.Get().App.Auth.Cookies.HostPrefix) {
+			return c.Value
+		}
+	}
+	return ""
+}
+
+// decode unmarshals the JSON body into v.
+func decode(t *testing.T, body []byte, v any) {
+	t.Helper()
+	if err := json.Unmarshal(body, v); err != nil {
+		t.Fatalf("decoding %s: %v", body, err)
+	}
+}
+
+// claims decodes the payload of the JWT token without checking it.
+func claims(t *testing.T, token string) map[string]any {
+	t.Helper()
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		t.Fatalf("not a JWT: %q", token)
+	}
+	b, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	var m map[string]any
+	if err := json.Unmarshal(b, &m); err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
+
+// basicAuth returns an Authorization header value for HTTP Basic auth.
+func basicAuth(username, password string) string {
+	return "Basic " + base64.StdEncoding.EncodeToString([]byte(username+":"+password))
+}
+
+// dbStatus sends GET /db/mydb with access as the Bearer token and returns the status.
+func (s *testServer) dbStatus(access string) int {
+	s.t.Helper()
+	resp, _ := s.do(http.DefaultClient, http.MethodGet, "/db/mydb", nil, "Authorization", "Bearer "+access)
+	return resp.StatusCode
+}
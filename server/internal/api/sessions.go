@@ -0,0 +1,157 @@
+package api
+
+import (
+	"errors"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/fridayflag/papaya/internal/auth"
+	"github.com/fridayflag/papaya/internal/env"
+	"github.com/gin-gonic/gin"
+)
+
+// Context key for the caller's access-token claims (set by requireUser).
+type userContextKey string
+
+const userClaimsKey userContextKey = "user_claims"
+
+// requireUser validates the access-token cookie, refusing denylisted tokens, and stores its
+// claims in the context. Clients with an expired access token call /api/session first to
+// refresh it.
+func requireUser(live *env.Live, keys *auth.Keys, denylist *auth.Denylist) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		access := readCookie(c, live.Get(), auth.CookieAccessToken)
+		if access == "" {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "missing access token"})
+			c.Abort()
+			return
+		}
+		claims, err := auth.ParseAccessToken(access, keys.Access)
+		if err != nil || denylist.Denied(claims.ID, claims.SessionID) {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "invalid access token"})
+			c.Abort()
+			return
+		}
+		c.Set(string(userClaimsKey), claims)
+		c.Next()
+	}
+}
+
+func getUserClaims(c *gin.Context) *auth.AccessClaims {
+	v, _ := c.Get(string(userClaimsKey))
+	claims, _ := v.(*auth.AccessClaims)
+	return claims
+}
+
+// AccessTokenRevoked returns the check the /db proxy makes before handing on an access
+// token: whether it, or the session it was issued to, is on the denylist. Tokens that do
+// not parse are left for CouchDB to refuse.
+func AccessTokenRevoked(keys *auth.Keys, denylist *auth.Denylist) func(token string) bool {
+	return func(token string) bool {
+		claims, err := auth.ParseAccessToken(token, keys.Access)
+		return err == nil && denylist.Denied(claims.ID, claims.SessionID)
+	}
+}
+
+// denySessions denylists the access tokens issued to the given sessions, whose refresh
+// tokens were just revoked, for auth.access_token_ttl: no token issued to them before
+// outlives that. Callers only log a failure, since the tokens end by then anyway.
+func denySessions(cfg *env.Config, denylist *auth.Denylist, sessionIDs ...string) error {
+	return denylist.DenySessions(time.Now().Add(cfg.App.Auth.AccessTokenTTL), sessionIDs...)
+}
+
+// logOutEverywhere revokes all of the user's sessions and denylists their access tokens.
+func logOutEverywhere(cfg *env.Config, store auth.SessionStore, denylist *auth.Denylist, username string) error {
+	ended, err := store.RevokeAllForUser(username)
+	if err != nil {
+		return err
+	}
+	return denySessions(cfg, denylist, ended...)
+}
+
+// sessionResponse is a session as listed by GET /api/sessions.
+type sessionResponse struct {
+	auth.Session
+	Current bool `json:"current"` // The session making the request
+}
+
+// listSessionsHandler lists the caller's active sessions.
+func listSessionsHandler(store auth.SessionStore) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		claims := getUserClaims(c)
+		sessions, err := store.Sessions(claims.Subject)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to list sessions"})
+			return
+		}
+		resp := make([]sessionResponse, len(sessions))
+		for i, s := range sessions {
+			resp[i] = sessionResponse{Session: s, Current: s.ID == claims.SessionID}
+		}
+		c.JSON(http.StatusOK, gin.H{"sessions": resp})
+	}
+}
+
+// revokeSessionHandler logs one of the caller's sessions out and denylists its access
+// tokens.
+func revokeSessionHandler(live *env.Live, store auth.SessionStore, denylist *auth.Denylist) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		cfg := live.Get()
+		claims := getUserClaims(c)
+		id := c.Param("id")
+		if err := store.RevokeSession(claims.Subject, id); err != nil {
+			if errors.Is(err, auth.ErrSessionNotFound) {
+				c.JSON(http.StatusNotFound, gin.H{"error": "session not found"})
+				return
+			}
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to revoke session"})
+			return
+		}
+		if err := denySessions(cfg, denylist, id); err != nil {
+			slog.Warn("auth: failed to denylist access tokens", "err", err)
+		}
+		if id == claims.SessionID {
+			clearAuthCookies(c, cfg)
+		}
+		c.JSON(http.StatusOK, gin.H{"ok": true})
+	}
+}
+
+// revokeOtherSessionsHandler logs the caller out everywhere except the current session.
+func revokeOtherSessionsHandler(live *env.Live, store auth.SessionStore, denylist *auth.Denylist) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		claims := getUserClaims(c)
+		if claims.SessionID == "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "current session unknown; refresh the access token first"})
+			return
+		}
+		ended, err := store.RevokeOtherSessions(claims.Subject, claims.SessionID)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to revoke sessions"})
+			return
+		}
+		if err := denySessions(live.Get(), denylist, ended...); err != nil {
+			slog.Warn("auth: failed to denylist access tokens", "err", err)
+		}
+		c.JSON(http.StatusOK, gin.H{"ok": true})
+	}
+}
+
+// revokeAllSessionsHandler logs the caller out everywhere, including this session.
+func revokeAllSessionsHandler(live *env.Live, store auth.SessionStore, denylist *auth.Denylist) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		cfg := live.Get()
+		claims := getUserClaims(c)
+		ended, err := store.RevokeAllForUser(claims.Subject)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to revoke sessions"})
+			return
+		}
+		if err := denySessions(cfg, denylist, ended...); err != nil {
+			slog.Warn("auth: failed to denylist access tokens", "err", err)
+		}
+		clearAuthCookies(c, cfg)
+		c.JSON(http.StatusOK, gin.H{"ok": true})
+	}
+}
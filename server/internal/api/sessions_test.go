@@ -0,0 +1,112 @@
+package api
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/fridayflag/papaya/internal/auth"
+)
+
+func TestRevokedAccessTokenRefusedAtDB(t *testing.T) {
+	tests := []struct {
+		name   string
+		revoke func(s *testServer, client *http.Client)
+	}{
+		{"logout", func(s *testServer, client *http.Client) {
+			s.do(client, http.MethodPost, "/api/logout", nil)
+		}},
+		{"force logout", func(s *testServer, client *http.Client) {
+			resp, body := s.do(http.DefaultClient, http.MethodDelete, "/api/admin/users/org.couchdb.user:alice/sessions", nil,
+				"Authorization", basicAuth("admin", "adminpw"))
+			if resp.StatusCode != http.StatusOK {
+				t.Fatalf("force logout: %d %s", resp.StatusCode, body)
+			}
+		}},
+		{"password change", func(s *testServer, client *http.Client) {
+			// Identified by _id, as the admin UI does.
+			doc := map[string]any{"_id": "org.couchdb.user:alice", "name": "alice", "password": "new password"}
+			resp, body := s.do(http.DefaultClient, http.MethodPut, "/api/admin/users", doc,
+				"Authorization", basicAuth("admin", "adminpw"))
+			if resp.StatusCode != http.StatusOK {
+				t.Fatalf("password change: %d %s", resp.StatusCode, body)
+			}
+		}},
+		{"log out everywhere", func(s *testServer, client *http.Client) {
+			s.do(client, http.MethodDelete, "/api/sessions", nil)
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestServer(t, nil)
+			s.couch.addUser("alice", "pw")
+			s.couch.addUser("bob", "pw")
+			alice, laptop, bob := s.client(), s.client(), s.client()
+			s.login(alice, "alice", "pw")
+			s.login(laptop, "alice", "pw")
+			s.login(bob, "bob", "pw")
+			access, other, bobs := s.cookie(alice, auth.CookieAccessToken), s.cookie(laptop, auth.CookieAccessToken), s.cookie(bob, auth.CookieAccessToken)
+			if got := s.dbStatus(access); got != http.StatusOK {
+				t.Fatalf("GET /db before revoking = %d, want 200", got)
+			}
+			// Issuing tokens writes nothing to the denylist.
+			if list, _ := s.store.DeniedTokens(time.Now()); len(list) != 0 {
+				t.Fatalf("denylist after logging in = %+v, want empty", list)
+			}
+
+			tt.revoke(s, alice)
+
+			if got := s.dbStatus(access); got != http.StatusUnauthorized {
+				t.Errorf("GET /db with the old access token = %d, want 401", got)
+			}
+			if resp, _ := s.do(http.DefaultClient, http.MethodGet, "/api/sessions", nil, "Cookie", auth.CookieName(auth.CookieAccessToken, false)+"="+access); resp.StatusCode != http.StatusUnauthorized {
+				t.Errorf("GET /api/sessions with the old access token = %d, want 401", resp.StatusCode)
+			}
+			wantOther := http.StatusUnauthorized
+			if tt.name == "logout" {
+				wantOther = http.StatusOK // Only this session ends
+			}
+			if got := s.dbStatus(other); got != wantOther {
+				t.Errorf("GET /db with alice's other session = %d, want %d", got, wantOther)
+			}
+			if got := s.dbStatus(bobs); got != http.StatusOK {
+				t.Errorf("GET /db as bob = %d, want 200", got)
+			}
+
+			// A fresh denylist, as after a restart or on another replica, agrees.
+			fresh, err := auth.NewDenylist(s.store)
+			if err != nil {
+				t.Fatal(err)
+			}
+			claims, err := auth.ParseAccessToken(access, s.keys.Access)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !fresh.Denied(claims.ID, claims.SessionID) {
+				t.Error("reloaded denylist does not deny the old access token")
+			}
+		})
+	}
+}
+
+func TestRevokeOtherSessions(t *testing.T) {
+	s := newTestServer(t, nil)
+	s.couch.addUser("alice", "pw")
+	current, other := s.client(), s.client()
+	s.login(current, "alice", "pw")
+	s.login(other, "alice", "pw")
+
+	resp, body := s.do(current, http.MethodPost, "/api/sessions/revoke-others", nil)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("revoke-others: %d %s", resp.StatusCode, body)
+	}
+	if got := s.dbStatus(s.cookie(other, auth.CookieAccessToken)); got != http.StatusUnauthorized {
+		t.Errorf("GET /db from the other session = %d, want 401", got)
+	}
+	if got := s.dbStatus(s.cookie(current, auth.CookieAccessToken)); got != http.StatusOK {
+		t.Errorf("GET /db from the current session = %d, want 200", got)
+	}
+	if resp, _ := s.do(other, http.MethodGet, "/api/session", nil); resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("GET /api/session from the other session = %d, want 401", resp.StatusCode)
+	}
+}
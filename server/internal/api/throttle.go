@@ -0,0 +1,177 @@
+package api
+
+import (
+	"log/slog"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/fridayflag/papaya/internal/auth"
+	"github.com/fridayflag/papaya/internal/config"
+	"github.com/fridayflag/papaya/internal/env"
+	"github.com/gin-gonic/gin"
+)
+
+// throttleKeys returns the keys failed logins are counted under: the client's address
+// and the username (lowercased, so variants of a name share one count).
+func throttleKeys(c *gin.Context, username string) (ip, user string) {
+	return "ip:" + c.ClientIP(), "user:" + strings.ToLower(username)
+}
+
+// loginDelay returns how long after the last of f's failures the next attempt has to
+// wait, and whether that wait is a lockout.
+func loginDelay(t config.LoginThrottleConfig, f auth.FailedLogins) (wait time.Duration, locked bool) {
+	free, lockoutAfter := t.FreeAttempts, t.LockoutAfter
+	if strings.HasPrefix(f.Key, "ip:") {
+		free, lockoutAfter = t.IPFreeAttempts, t.IPLockoutAfter
+	}
+	switch {
+	case lockoutAfter > 0 && f.Count >= lockoutAfter:
+		return t.LockoutDuration, true
+	case f.Count <= free:
+		return 0, false
+	}
+	shift := min(f.Count-free-1, 30) // Far past MaxDelay; avoids overflow
+	wait = t.BaseDelay << shift
+	if wait > t.MaxDelay || wait < 0 {
+		wait = t.MaxDelay
+	}
+	return wait, false
+}
+
+// blockedUntil returns when f's key may try again (zero when it may now).
+func blockedUntil(t config.LoginThrottleConfig, f auth.FailedLogins, now time.Time) (until time.Time, locked bool) {
+	if f.Count == 0 || f.LastAt.Before(now.Add(-t.Window)) {
+		return time.Time{}, false
+	}
+	wait, locked := loginDelay(t, f)
+	if until = f.LastAt.Add(wait); !until.After(now) {
+		return time.Time{}, false
+	}
+	return until, locked
+}
+
+// loginThrottled checks the client's address and username against auth.login_throttle.
+// When either has to wait it answers 429 with Retry-After and returns true. Errors from
+// the store let the attempt through: a broken database should not lock everyone out.
+func loginThrottled(c *gin.Context, cfg *env.Config, store auth.LoginThrottleStore, username string) bool {
+	t := cfg.App.Auth.LoginThrottle
+	if t.Window == 0 {
+		return false
+	}
+	now := time.Now()
+	var until time.Time
+	var locked bool
+	ipKey, userKey := throttleKeys(c, username)
+	for _, key := range []string{ipKey, userKey} {
+		f, err := store.FailedLogins(key)
+		if err != nil {
+			slog.Warn("auth: failed to read login failures", "err", err)
+			continue
+		}
+		if u, l := blockedUntil(t, f, now); u.After(until) {
+			until, locked = u, l
+		}
+	}
+	if until.IsZero() {
+		return false
+	}
+	retryAfter := int(math.Ceil(until.Sub(now).Seconds()))
+	c.Header("Retry-After", strconv.Itoa(retryAfter))
+	msg := "too many failed logins; try again later"
+	if locked {
+		msg = "too many failed logins; temporarily locked"
+	}
+	c.JSON(http.StatusTooManyRequests, gin.H{"error": msg, "retryAfter": retryAfter})
+	return true
+}
+
+// recordLoginFailure counts a failed login against the client's address and the username,
+// and records an EventLoginLocked when that locks either.
+func recordLoginFailure(c *gin.Context, cfg *env.Config, store auth.Store, username string) {
+	t := cfg.App.Auth.LoginThrottle
+	if t.Window == 0 {
+		return
+	}
+	now := time.Now()
+	ipKey, userKey := throttleKeys(c, username)
+	for _, key := range []string{ipKey, userKey} {
+		f, err := store.RecordFailedLogin(key, now, t.Window)
+		if err != nil {
+			slog.Warn("auth: failed to record login failure", "err", err)
+			continue
+		}
+		if _, locked := loginDelay(t, f); !locked {
+			continue
+		}
+		prev := f
+		prev.Count--
+		if _, wasLocked := loginDelay(t, prev); wasLocked {
+			continue // Locked already; record the lockout once
+		}
+		slog.Warn("auth: too many failed logins; locked", "key", key, "failures", f.Count)
+		if err := store.RecordEvent(auth.EventLoginLocked, username, "", key); err != nil {
+			slog.Warn("auth: failed to record event", "err", err)
+		}
+	}
+}
+
+// clearLoginFailures forgets the failures counted against username after it logged in.
+// The address keeps its count, or an attacker could reset it with an account of their own.
+func clearLoginFailures(c *gin.Context, cfg *env.Config, store auth.LoginThrottleStore, username string) {
+	if cfg.App.Auth.LoginThrottle.Window == 0 {
+		return
+	}
+	_, userKey := throttleKeys(c, username)
+	if err := store.ClearFailedLogins(userKey); err != nil {
+		slog.Warn("auth: failed to clear login failures", "err", err)
+	}
+}
+
+// lockoutResponse is a throttled key as listed by GET /api/admin/lockouts.
+type lockoutResponse struct {
+	Key          string     `json:"key"` // "user:<name>" or "ip:<address>"
+	Failures     int        `json:"failures"`
+	LastFailure  time.Time  `json:"lastFailureAt"`
+	BlockedUntil *time.Time `json:"blockedUntil"` // null when the next attempt is allowed now
+	Locked       bool       `json:"locked"`
+}
+
+// adminListLockoutsHandler lists the addresses and usernames with recent failed logins.
+func adminListLockoutsHandler(live *env.Live, store auth.LoginThrottleStore) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		t := live.Get().App.Auth.LoginThrottle
+		now := time.Now()
+		list, err := store.ListFailedLogins(now.Add(-t.Window))
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to list lockouts"})
+			return
+		}
+		resp := make([]lockoutResponse, len(list))
+		for i, f := range list {
+			resp[i] = lockoutResponse{Key: f.Key, Failures: f.Count, LastFailure: f.LastAt}
+			if until, locked := blockedUntil(t, f, now); !until.IsZero() {
+				resp[i].BlockedUntil, resp[i].Locked = &until, locked
+			}
+		}
+		c.JSON(http.StatusOK, gin.H{"lockouts": resp})
+	}
+}
+
+// adminClearLockoutHandler forgets the failed logins of one key, lifting its lockout.
+func adminClearLockoutHandler(store auth.LoginThrottleStore) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		key := c.Param("key")
+		if !strings.HasPrefix(key, "user:") && !strings.HasPrefix(key, "ip:") {
+			c.JSON(http.StatusBadRequest, gin.H{"error": `key must start with "user:" or "ip:"`})
+			return
+		}
+		if err := store.ClearFailedLogins(key); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to clear lockout"})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"ok": true})
+	}
+}
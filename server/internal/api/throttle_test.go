@@ -0,0 +1,99 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/fridayflag/papaya/internal/env"
+)
+
+// throttleServer is a test server that delays a username's fourth login attempt by a
+// second and, when ipLockout is set, locks a client address after three failures.
+func throttleServer(t *testing.T, ipLockout bool, proxies ...string) *testServer {
+	return newTestServer(t, func(cfg *env.Config) {
+		cfg.App.Server.TrustedProxies = proxies
+		lt := &cfg.App.Auth.LoginThrottle
+		lt.FreeAttempts, lt.BaseDelay = 2, time.Second
+		if ipLockout {
+			lt.IPFreeAttempts, lt.IPLockoutAfter = 3, 3
+		}
+	})
+}
+
+// failLogin sends a wrong password for username with the header pairs given and returns
+// the response.
+func (s *testServer) failLogin(username string, header ...string) (*http.Response, []byte) {
+	s.t.Helper()
+	return s.do(http.DefaultClient, http.MethodPost, "/api/login", map[string]any{"username": username, "password": "wrong"}, header...)
+}
+
+func TestLoginThrottled(t *testing.T) {
+	tests := []struct {
+		name       string
+		ipLockout  bool
+		username   func(i int) string // Of the i-th attempt
+		wantRetry  int                // Retry-After of the refused attempt, in seconds
+		wantLocked bool
+	}{
+		{"username delayed", false, func(int) string { return "alice" }, 1, false},
+		{"address locked", true, func(i int) string { return fmt.Sprintf("user%d", i) }, 15 * 60, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := throttleServer(t, tt.ipLockout)
+			for i := range 3 {
+				if resp, body := s.failLogin(tt.username(i)); resp.StatusCode != http.StatusUnauthorized {
+					t.Fatalf("failure %d: %d %s, want 401", i+1, resp.StatusCode, body)
+				}
+			}
+			resp, body := s.failLogin(tt.username(3))
+			if resp.StatusCode != http.StatusTooManyRequests {
+				t.Fatalf("fourth attempt: %d %s, want 429", resp.StatusCode, body)
+			}
+			if got := resp.Header.Get("Retry-After"); got != strconv.Itoa(tt.wantRetry) {
+				t.Errorf("Retry-After = %q, want %d", got, tt.wantRetry)
+			}
+			var got struct {
+				Error      string
+				RetryAfter int
+			}
+			decode(t, body, &got)
+			if got.RetryAfter != tt.wantRetry || (got.Error == "too many failed logins; temporarily locked") != tt.wantLocked {
+				t.Errorf("body = %s, want retryAfter %d and locked %v", body, tt.wantRetry, tt.wantLocked)
+			}
+		})
+	}
+}
+
+// TestLoginThrottleForwardedFor checks that a client cannot dodge the per-address count
+// by sending its own X-Forwarded-For, while a trusted proxy's header is used.
+func TestLoginThrottleForwardedFor(t *testing.T) {
+	spoofed := func(i int) []string { return []string{"X-Forwarded-For", fmt.Sprintf("198.51.100.%d", i+1)} }
+
+	s := throttleServer(t, true)
+	for i := range 3 {
+		if resp, body := s.failLogin(fmt.Sprintf("user%d", i), spoofed(i)...); resp.StatusCode != http.StatusUnauthorized {
+			t.Fatalf("failure %d: %d %s, want 401", i+1, resp.StatusCode, body)
+		}
+	}
+	if resp, body := s.failLogin("user3", spoofed(3)...); resp.StatusCode != http.StatusTooManyRequests {
+		t.Errorf("fourth attempt with another X-Forwarded-For: %d %s, want 429", resp.StatusCode, body)
+	}
+	if f, err := s.store.FailedLogins("ip:198.51.100.1"); err != nil || f.Count != 0 {
+		t.Errorf("FailedLogins(ip:198.51.100.1) = %+v, %v, want the header ignored", f, err)
+	}
+
+	// Behind a trusted proxy each forwarded address has a count of its own.
+	s = throttleServer(t, true, "127.0.0.1")
+	for i := range 4 {
+		if resp, body := s.failLogin(fmt.Sprintf("user%d", i), spoofed(i)...); resp.StatusCode != http.StatusUnauthorized {
+			t.Fatalf("failure %d from its own address: %d %s, want 401", i+1, resp.StatusCode, body)
+		}
+	}
+	if f, err := s.store.FailedLogins("ip:198.51.100.1"); err != nil || f.Count != 1 {
+		t.Errorf("FailedLogins(ip:198.51.100.1) = %+v, %v, want one failure", f, err)
+	}
+}
@@ -0,0 +1,263 @@
+package api
+
+import (
+	"errors"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fridayflag/papaya/internal/auth"
+	"github.com/fridayflag/papaya/internal/env"
+	"github.com/gin-gonic/gin"
+)
+
+// patTouchInterval limits how often a token's last use is written: a replication makes
+// many requests in a row.
+const patTouchInterval = time.Minute
+
+// rolesTTL is how long a user's roles are reused before _users is read again, so role
+// changes reach tokens minted on refresh within a minute.
+const rolesTTL = time.Minute
+
+// RolesCache keeps users' roles for rolesTTL, so that refreshes and requests made with
+// personal access tokens do not each read _users.
+type RolesCache struct {
+	mu      sync.Mutex
+	entries map[string]cachedRoles
+}
+
+func NewRolesCache() *RolesCache {
+	return &RolesCache{entries: make(map[string]cachedRoles)}
+}
+
+type cachedRoles struct {
+	roles auth.Roles
+	at    time.Time
+}
+
+// get returns username's roles (see tokenRoles), from the cache while fresh.
+func (rc *RolesCache) get(cfg *env.Config, username string) auth.Roles {
+	now := time.Now()
+	rc.mu.Lock()
+	e, ok := rc.entries[username]
+	rc.mu.Unlock()
+	if ok && now.Sub(e.at) < rolesTTL && e.roles.Claim == cfg.App.CouchDB.RolesClaim {
+		return e.roles
+	}
+	roles := tokenRoles(cfg, username)
+	rc.mu.Lock()
+	for name, e := range rc.entries {
+		if now.Sub(e.at) >= rolesTTL {
+			delete(rc.entries, name)
+		}
+	}
+	rc.entries[username] = cachedRoles{roles: roles, at: now}
+	rc.mu.Unlock()
+	return roles
+}
+
+// forget drops username's roles, so the next get reads them again.
+func (rc *RolesCache) forget(username string) {
+	rc.mu.Lock()
+	delete(rc.entries, username)
+	rc.mu.Unlock()
+}
+
+// personalTokensMiddleware answers 404 while auth.personal_tokens.max_ttl is 0.
+func personalTokensMiddleware(live *env.Live) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if live.Get().App.Auth.PersonalTokens.MaxTTL == 0 {
+			c.JSON(http.StatusNotFound, gin.H{"error": "not found"})
+			c.Abort()
+			return
+		}
+		c.Next()
+	}
+}
+
+// usePersonalAccessToken looks up token and checks that it has not expired and carries
+// scope, recording the use. Unknown and expired tokens give auth.ErrPATNotFound and
+// auth.ErrTokenExpired, and a missing scope auth.ErrScopeMissing.
+func usePersonalAccessToken(cfg *env.Config, store auth.PATStore, token, scope string) (*auth.PersonalAccessToken, error) {
+	if cfg.App.Auth.PersonalTokens.MaxTTL == 0 {
+		return nil, auth.ErrPATNotFound
+	}
+	t, err := store.PersonalAccessTokenByHash(auth.TokenHash(token))
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	if !t.ExpiresAt.After(now) {
+		return nil, auth.ErrTokenExpired
+	}
+	if !t.Allows(scope) {
+		return nil, auth.ErrScopeMissing
+	}
+	if now.Sub(t.LastUsedAt) >= patTouchInterval {
+		if err := store.TouchPersonalAccessToken(t.ID); err != nil {
+			slog.Warn("auth: failed to record personal access token use", "err", err)
+		}
+	}
+	return t, nil
+}
+
+// ExchangePersonalAccessToken returns the proxy.TokenExchange for /db: it trades a
+// personal access token for an access token of its user, with their roles from roles
+// (the Router's, so role changes apply at once), valid for
+// auth.personal_tokens.access_token_ttl.
+func ExchangePersonalAccessToken(live *env.Live, store auth.Store, keys *auth.Keys, roles *RolesCache) func(token, scope string) (string, error) {
+	return func(token, scope string) (string, error) {
+		cfg := live.Get()
+		t, err := usePersonalAccessToken(cfg, store, token, scope)
+		if err != nil {
+			if !errors.Is(err, auth.ErrScopeMissing) && !errors.Is(err, auth.ErrPATNotFound) && !errors.Is(err, auth.ErrTokenExpired) {
+				slog.Warn("auth: failed to check personal access token", "err", err)
+			}
+			return "", err
+		}
+		access, _, err := auth.MintAccessToken(t.Username, "", time.Time{}, roles.get(cfg, t.Username), keys.Access.Active(), cfg.App.Auth.PersonalTokens.AccessTokenTTL)
+		return access, err
+	}
+}
+
+type createPATRequest struct {
+	Name      string     `json:"name" binding:"required"`
+	Scopes    []string   `json:"scopes" binding:"required"`
+	ExpiresAt *time.Time `json:"expiresAt"` // RFC 3339; defaults to auth.personal_tokens.max_ttl from now
+}
+
+// patResponse is a personal access token as listed by GET /api/tokens.
+type patResponse struct {
+	ID         string     `json:"id"`
+	Name       string     `json:"name"`
+	Scopes     []string   `json:"scopes"`
+	CreatedAt  time.Time  `json:"createdAt"`
+	ExpiresAt  time.Time  `json:"expiresAt"`
+	LastUsedAt *time.Time `json:"lastUsedAt"` // null until first used
+	Expired    bool       `json:"expired"`
+}
+
+func newPATResponse(t auth.PersonalAccessToken, now time.Time) patResponse {
+	resp := patResponse{ID: t.ID, Name: t.Name, Scopes: t.Scopes, CreatedAt: t.CreatedAt, ExpiresAt: t.ExpiresAt, Expired: !t.ExpiresAt.After(now)}
+	if !t.LastUsedAt.IsZero() {
+		resp.LastUsedAt = &t.LastUsedAt
+	}
+	return resp
+}
+
+// createPATHandler creates a personal access token for the caller. The token is in the
+// response only; the admin scope is only granted to CouchDB server admins.
+func createPATHandler(live *env.Live, store auth.Store) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		cfg := live.Get()
+		username := getUserClaims(c).Subject
+		var req createPATRequest
+		if err := c.ShouldBindJSON(&req); err != nil || strings.TrimSpace(req.Name) == "" || len(req.Scopes) == 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "name and scopes required"})
+			return
+		}
+		slices.Sort(req.Scopes)
+		req.Scopes = slices.Compact(req.Scopes)
+		for _, s := range req.Scopes {
+			if !auth.ValidScope(s) {
+				c.JSON(http.StatusBadRequest, gin.H{"error": `unknown scope "` + s + `"; use db:read, db:write or admin`})
+				return
+			}
+		}
+		now := time.Now().Truncate(time.Second) // Seconds, like the stores
+		maxExpiry := now.Add(cfg.App.Auth.PersonalTokens.MaxTTL)
+		expiresAt := maxExpiry
+		if req.ExpiresAt != nil {
+			expiresAt = *req.ExpiresAt
+		}
+		expiresAt = expiresAt.Truncate(time.Second)
+		if !expiresAt.After(now) || expiresAt.After(maxExpiry) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "expiresAt must be in the future and within auth.personal_tokens.max_ttl", "maxExpiresAt": maxExpiry})
+			return
+		}
+		if slices.Contains(req.Scopes, auth.ScopeAdmin) {
+			if status, msg := checkServerAdmin(cfg, username); status != http.StatusOK {
+				c.JSON(status, gin.H{"error": msg})
+				return
+			}
+		}
+		token, id := auth.NewPersonalAccessToken()
+		t := auth.PersonalAccessToken{
+			ID:        id,
+			Username:  username,
+			Name:      strings.TrimSpace(req.Name),
+			Scopes:    req.Scopes,
+			Hash:      auth.TokenHash(token),
+			ExpiresAt: expiresAt,
+		}
+		if err := store.AddPersonalAccessToken(t); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to create token"})
+			return
+		}
+		if err := store.RecordEvent(auth.EventPATCreated, username, "", id); err != nil {
+			slog.Warn("auth: failed to record event", "err", err)
+		}
+		t.CreatedAt = now
+		c.JSON(http.StatusCreated, gin.H{"token": token, "details": newPATResponse(t, now)})
+	}
+}
+
+// listPATsHandler lists the caller's personal access tokens, expired ones included until
+// they are pruned.
+func listPATsHandler(store auth.PATStore) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		list, err := store.PersonalAccessTokens(getUserClaims(c).Subject)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to list tokens"})
+			return
+		}
+		now := time.Now()
+		resp := make([]patResponse, len(list))
+		for i, t := range list {
+			resp[i] = newPATResponse(t, now)
+		}
+		c.JSON(http.StatusOK, gin.H{"tokens": resp})
+	}
+}
+
+// revokePATHandler deletes one of the caller's personal access tokens. /db looks the token
+// up on every request, so the next one made with it is refused.
+func revokePATHandler(store auth.Store) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		username := getUserClaims(c).Subject
+		id := c.Param("id")
+		err := store.DeletePersonalAccessToken(username, id)
+		if errors.Is(err, auth.ErrPATNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "token not found"})
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to revoke token"})
+			return
+		}
+		if err := store.RecordEvent(auth.EventPATRevoked, username, "", id); err != nil {
+			slog.Warn("auth: failed to record event", "err", err)
+		}
+		c.JSON(http.StatusOK, gin.H{"ok": true})
+	}
+}
+
+// checkServerAdmin asks CouchDB, as couchdb.admin_user, whether username is a server admin.
+// It returns http.StatusOK when they are, or the status and message to refuse with.
+func checkServerAdmin(cfg *env.Config, username string) (status int, msg string) {
+	if cfg.CouchDBAdminUser == "" {
+		return http.StatusForbidden, "the admin scope needs couchdb.admin_user to be configured"
+	}
+	ok, err := isServerAdmin(cfg, username)
+	if err != nil {
+		slog.Warn("auth: failed to check server admin", "user", username, "err", err)
+		return http.StatusBadGateway, "failed to check admin rights"
+	}
+	if !ok {
+		return http.StatusForbidden, "only CouchDB server admins can use the admin scope"
+	}
+	return http.StatusOK, ""
+}
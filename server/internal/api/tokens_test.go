@@ -0,0 +1,206 @@
+package api
+
+import (
+	"net/http"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/fridayflag/papaya/internal/auth"
+	"github.com/fridayflag/papaya/internal/env"
+)
+
+func TestSessionTokenRoles(t *testing.T) {
+	s := newTestServer(t, func(cfg *env.Config) { cfg.App.CouchDB.RolesClaim = "groups" })
+	s.couch.addUser("alice", "pw", "editor")
+	alice := s.client()
+	roles := func() []any {
+		t.Helper()
+		r, _ := claims(t, s.cookie(alice, auth.CookieAccessToken))["groups"].([]any)
+		return r
+	}
+	reads := func() int {
+		s.couch.mu.Lock()
+		defer s.couch.mu.Unlock()
+		return s.couch.userReads
+	}
+
+	s.login(alice, "alice", "pw")
+	if got := roles(); !slices.Equal(got, []any{"editor"}) {
+		t.Fatalf("roles after login = %v, want [editor]", got)
+	}
+	// Refreshes within rolesTTL reuse the roles read for the first one.
+	before := reads()
+	for range 3 {
+		if resp, body := s.do(alice, http.MethodPost, "/api/refresh", nil); resp.StatusCode != http.StatusOK {
+			t.Fatalf("refresh: %d %s", resp.StatusCode, body)
+		}
+	}
+	if got := reads() - before; got != 1 {
+		t.Errorf("_users read %d times for 3 refreshes, want 1", got)
+	}
+
+	// A role change through the admin API reaches the next refresh.
+	doc := s.couch.user("alice")
+	doc["roles"] = []string{"editor", "family"}
+	if resp, body := s.do(http.DefaultClient, http.MethodPut, "/api/admin/users", doc, "Authorization", basicAuth("admin", "adminpw")); resp.StatusCode != http.StatusOK {
+		t.Fatalf("changing roles: %d %s", resp.StatusCode, body)
+	}
+	if resp, body := s.do(alice, http.MethodPost, "/api/refresh", nil); resp.StatusCode != http.StatusOK {
+		t.Fatalf("refresh: %d %s", resp.StatusCode, body)
+	}
+	if got := roles(); !slices.Equal(got, []any{"editor", "family"}) {
+		t.Errorf("roles after the change = %v, want [editor family]", got)
+	}
+}
+
+// createPAT creates a personal access token with scopes on client's session and returns
+// it and its ID.
+func (s *testServer) createPAT(client *http.Client, scopes ...string) (token, id string) {
+	s.t.Helper()
+	resp, body := s.do(client, http.MethodPost, "/api/tokens", map[string]any{"name": "backup", "scopes": scopes})
+	if resp.StatusCode != http.StatusCreated {
+		s.t.Fatalf("creating a token: %d %s", resp.StatusCode, body)
+	}
+	var created struct {
+		Token   string
+		Details patResponse
+	}
+	decode(s.t, body, &created)
+	return created.Token, created.Details.ID
+}
+
+// listPATs returns the IDs GET /api/tokens lists for client.
+func (s *testServer) listPATs(client *http.Client) []string {
+	s.t.Helper()
+	resp, body := s.do(client, http.MethodGet, "/api/tokens", nil)
+	if resp.StatusCode != http.StatusOK {
+		s.t.Fatalf("listing tokens: %d %s", resp.StatusCode, body)
+	}
+	var list struct{ Tokens []patResponse }
+	decode(s.t, body, &list)
+	ids := []string{}
+	for _, t := range list.Tokens {
+		ids = append(ids, t.ID)
+	}
+	return ids
+}
+
+func TestPersonalAccessTokens(t *testing.T) {
+	s := newTestServer(t, nil)
+	s.couch.addUser("alice", "pw")
+	s.couch.addUser("bob", "pw")
+	alice, bob := s.client(), s.client()
+	s.login(alice, "alice", "pw")
+	s.login(bob, "bob", "pw")
+
+	token, id := s.createPAT(alice, auth.ScopeDBWrite, auth.ScopeDBRead, auth.ScopeDBWrite)
+	if !auth.IsPersonalAccessToken(token) {
+		t.Errorf("created token %q, want a pat_ token", token)
+	}
+	if pat, err := s.store.PersonalAccessTokenByHash(auth.TokenHash(token)); err != nil || pat.ID != id ||
+		!slices.Equal(pat.Scopes, []string{auth.ScopeDBRead, auth.ScopeDBWrite}) {
+		t.Errorf("stored token = %+v, %v, want %s with its scopes once each", pat, err, id)
+	}
+	if got := s.listPATs(alice); !slices.Equal(got, []string{id}) {
+		t.Errorf("alice's tokens = %v, want [%s]", got, id)
+	}
+	if got := s.listPATs(bob); len(got) != 0 {
+		t.Errorf("bob's tokens = %v, want none", got)
+	}
+
+	for _, tt := range []struct {
+		name string
+		body map[string]any
+		want int
+	}{
+		{"no scopes", map[string]any{"name": "backup", "scopes": []string{}}, http.StatusBadRequest},
+		{"blank name", map[string]any{"name": " ", "scopes": []string{auth.ScopeDBRead}}, http.StatusBadRequest},
+		{"unknown scope", map[string]any{"name": "backup", "scopes": []string{"db:delete"}}, http.StatusBadRequest},
+		{"past expiry", map[string]any{"name": "backup", "scopes": []string{auth.ScopeDBRead}, "expiresAt": time.Now().Add(-time.Hour)}, http.StatusBadRequest},
+		{"expiry past max_ttl", map[string]any{"name": "backup", "scopes": []string{auth.ScopeDBRead}, "expiresAt": time.Now().AddDate(2, 0, 0)}, http.StatusBadRequest},
+		{"admin scope for a user", map[string]any{"name": "backup", "scopes": []string{auth.ScopeAdmin}}, http.StatusForbidden},
+	} {
+		if resp, body := s.do(alice, http.MethodPost, "/api/tokens", tt.body); resp.StatusCode != tt.want {
+			t.Errorf("%s: %d %s, want %d", tt.name, resp.StatusCode, body, tt.want)
+		}
+	}
+	if resp, body := s.do(s.client(), http.MethodPost, "/api/tokens", map[string]any{"name": "backup", "scopes": []string{auth.ScopeDBRead}}); resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("creating a token signed out: %d %s, want 401", resp.StatusCode, body)
+	}
+
+	// Only the owner revokes a token, and only once.
+	if resp, body := s.do(bob, http.MethodDelete, "/api/tokens/"+id, nil); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("bob revoking alice's token: %d %s, want 404", resp.StatusCode, body)
+	}
+	if resp, body := s.do(alice, http.MethodDelete, "/api/tokens/"+id, nil); resp.StatusCode != http.StatusOK {
+		t.Fatalf("revoking: %d %s, want 200", resp.StatusCode, body)
+	}
+	if resp, body := s.do(alice, http.MethodDelete, "/api/tokens/"+id, nil); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("revoking again: %d %s, want 404", resp.StatusCode, body)
+	}
+	if got := s.listPATs(alice); len(got) != 0 {
+		t.Errorf("alice's tokens after revoking = %v, want none", got)
+	}
+}
+
+// TestPersonalAccessTokenOnDB checks the /db exchange: scopes decide what a token may do,
+// a revoked token stops working at once, and role changes reach the tokens minted for it.
+func TestPersonalAccessTokenOnDB(t *testing.T) {
+	s := newTestServer(t, nil)
+	s.couch.addUser("alice", "pw", "editor")
+	alice := s.client()
+	s.login(alice, "alice", "pw")
+	readToken, _ := s.createPAT(alice, auth.ScopeDBRead)
+	writeToken, writeID := s.createPAT(alice, auth.ScopeDBWrite)
+
+	db := func(method, token string) (status int, couchRoles []any) {
+		t.Helper()
+		s.couch.mu.Lock()
+		s.couch.dbAuth = ""
+		s.couch.mu.Unlock()
+		resp, _ := s.do(http.DefaultClient, method, "/db/budget/doc1", map[string]any{}, "Authorization", "Bearer "+token)
+		s.couch.mu.Lock()
+		access, _ := strings.CutPrefix(s.couch.dbAuth, "Bearer ")
+		s.couch.mu.Unlock()
+		if access == "" {
+			return resp.StatusCode, nil
+		}
+		if auth.IsPersonalAccessToken(access) {
+			t.Fatalf("CouchDB got the personal access token")
+		}
+		couch, _ := claims(t, access)["_couchdb.roles"].([]any)
+		return resp.StatusCode, couch
+	}
+
+	if status, roles := db(http.MethodGet, readToken); status != http.StatusOK || !slices.Equal(roles, []any{"editor"}) {
+		t.Errorf("GET with db:read = %d with roles %v, want 200 with [editor]", status, roles)
+	}
+	if status, roles := db(http.MethodPut, readToken); status != http.StatusForbidden || roles != nil {
+		t.Errorf("PUT with db:read = %d, reaching CouchDB %v; want 403 without reaching it", status, roles != nil)
+	}
+	if status, _ := db(http.MethodPut, writeToken); status != http.StatusOK {
+		t.Errorf("PUT with db:write = %d, want 200", status)
+	}
+
+	// A role change through the admin API reaches the next exchange, not after rolesTTL.
+	doc := s.couch.user("alice")
+	doc["roles"] = []string{"family"}
+	if resp, body := s.do(http.DefaultClient, http.MethodPut, "/api/admin/users", doc, "Authorization", basicAuth("admin", "adminpw")); resp.StatusCode != http.StatusOK {
+		t.Fatalf("changing roles: %d %s", resp.StatusCode, body)
+	}
+	if _, roles := db(http.MethodGet, writeToken); !slices.Equal(roles, []any{"family"}) {
+		t.Errorf("roles after the change = %v, want [family]", roles)
+	}
+
+	if resp, body := s.do(alice, http.MethodDelete, "/api/tokens/"+writeID, nil); resp.StatusCode != http.StatusOK {
+		t.Fatalf("revoking: %d %s", resp.StatusCode, body)
+	}
+	if status, roles := db(http.MethodGet, writeToken); status != http.StatusUnauthorized || roles != nil {
+		t.Errorf("GET with a revoked token = %d, reaching CouchDB %v; want 401 without reaching it", status, roles != nil)
+	}
+	if status, _ := db(http.MethodGet, readToken); status != http.StatusOK {
+		t.Errorf("GET with the other token = %d, want 200", status)
+	}
+}
@@ -0,0 +1,359 @@
+package api
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/fridayflag/papaya/internal/auth"
+	"github.com/fridayflag/papaya/internal/env"
+	"github.com/gin-gonic/gin"
+	"github.com/go-webauthn/webauthn/protocol"
+	"github.com/go-webauthn/webauthn/webauthn"
+)
+
+// webauthnCeremonyTTL bounds the time between a ceremony's begin and finish requests.
+const webauthnCeremonyTTL = 5 * time.Minute
+
+// passkeysMiddleware answers 404 while auth.webauthn_rp_id is not set.
+func passkeysMiddleware(live *env.Live) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if live.Get().App.Auth.WebAuthnRPID == "" {
+			c.JSON(http.StatusNotFound, gin.H{"error": "not found"})
+			c.Abort()
+			return
+		}
+		c.Next()
+	}
+}
+
+// newWebAuthn builds the relying party from the current settings. Passkeys are always
+// discoverable and require user verification (a PIN or biometric), so a passkey login
+// stands in for both the password and the second factor.
+func newWebAuthn(cfg *env.Config) (*webauthn.WebAuthn, error) {
+	a := cfg.App.Auth
+	timeout := webauthn.TimeoutConfig{Enforce: true, Timeout: webauthnCeremonyTTL, TimeoutUVD: webauthnCeremonyTTL}
+	return webauthn.New(&webauthn.Config{
+		RPID:          a.WebAuthnRPID,
+		RPDisplayName: a.WebAuthnRPName,
+		RPOrigins:     a.WebAuthnOrigins,
+		AuthenticatorSelection: protocol.AuthenticatorSelection{
+			ResidentKey:      protocol.ResidentKeyRequirementRequired,
+			UserVerification: protocol.VerificationRequired,
+		},
+		Timeouts: webauthn.TimeoutsConfig{Login: timeout, Registration: timeout},
+	})
+}
+
+// passkeyUser is a Papaya user and their passkeys as the WebAuthn library sees them.
+type passkeyUser struct {
+	name   string
+	handle []byte
+	creds  []webauthn.Credential
+}
+
+func (u *passkeyUser) WebAuthnID() []byte                         { return u.handle }
+func (u *passkeyUser) WebAuthnName() string                       { return u.name }
+func (u *passkeyUser) WebAuthnDisplayName() string                { return u.name }
+func (u *passkeyUser) WebAuthnCredentials() []webauthn.Credential { return u.creds }
+
+// newPasskeyUser decodes stored passkeys, which must all belong to username. Without any,
+// the user gets a new random handle.
+func newPasskeyUser(username string, stored []auth.WebAuthnCredential) (*passkeyUser, error) {
+	u := &passkeyUser{name: username}
+	for _, s := range stored {
+		var cred webauthn.Credential
+		if err := json.Unmarshal(s.Data, &cred); err != nil {
+			return nil, err
+		}
+		u.handle = s.UserHandle
+		u.creds = append(u.creds, cred)
+	}
+	if u.handle == nil {
+		u.handle = make([]byte, 64)
+		if _, err := rand.Read(u.handle); err != nil {
+			return nil, err
+		}
+	}
+	return u, nil
+}
+
+// ceremonyState is what a ceremony's begin request leaves in the sealed papaya_webauthn
+// cookie for its finish request.
+type ceremonyState struct {
+	Kind     string               `json:"kind"`               // "register" or "login"
+	Username string               `json:"username,omitempty"` // Who is registering
+	Session  webauthn.SessionData `json:"session"`
+}
+
+func setCeremony(c *gin.Context, cfg *env.Config, keys *auth.Keys, state ceremonyState) error {
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	value, err := keys.SealCookie(auth.CookieWebAuthn, data)
+	if err != nil {
+		return err
+	}
+	setCookie(c, cfg, auth.CookieWebAuthn, value, int(webauthnCeremonyTTL.Seconds()), "/api/webauthn")
+	return nil
+}
+
+// takeCeremony reads and clears the ceremony cookie. A client may have kept a copy of
+// the cookie, so the challenge is also spent in the store, which refuses it from then on:
+// a ceremony can be finished once. On failure it writes the error response and returns
+// ok == false.
+func takeCeremony(c *gin.Context, cfg *env.Config, store auth.DenylistStore, keys *auth.Keys, kind string) (state *ceremonyState, ok bool) {
+	value := readCookie(c, cfg, auth.CookieWebAuthn)
+	setCookie(c, cfg, auth.CookieWebAuthn, "", -1, "/api/webauthn")
+	data, err := keys.OpenCookie(auth.CookieWebAuthn, value)
+	if err == nil {
+		state = &ceremonyState{}
+		err = json.Unmarshal(data, state)
+	}
+	if err != nil || state.Kind != kind || state.Session.Challenge == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "no " + kind + " in progress; start again"})
+		return nil, false
+	}
+	// Past Session.Expires the WebAuthn library refuses the ceremony by itself.
+	expires := state.Session.Expires
+	if expires.IsZero() {
+		expires = time.Now().Add(webauthnCeremonyTTL)
+	}
+	added, err := store.DenyOnce(auth.DeniedToken{Kind: auth.DeniedChallenge, ID: state.Session.Challenge, ExpiresAt: expires})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to check the " + kind})
+		return nil, false
+	}
+	if !added {
+		slog.Warn("auth: passkey ceremony replayed", "kind", kind, "ip", c.ClientIP())
+		c.JSON(http.StatusBadRequest, gin.H{"error": "no " + kind + " in progress; start again"})
+		return nil, false
+	}
+	return state, true
+}
+
+// passkeyRegisterBeginHandler returns the options for navigator.credentials.create.
+func passkeyRegisterBeginHandler(live *env.Live, store auth.WebAuthnStore, keys *auth.Keys) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		cfg := live.Get()
+		username := getUserClaims(c).Subject
+		wa, err := newWebAuthn(cfg)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		stored, err := store.WebAuthnCredentials(username)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to load passkeys"})
+			return
+		}
+		user, err := newPasskeyUser(username, stored)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to load passkeys"})
+			return
+		}
+		exclude := webauthn.Credentials(user.creds).CredentialDescriptors()
+		options, session, err := wa.BeginRegistration(user, webauthn.WithExclusions(exclude))
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to start registration"})
+			return
+		}
+		if err := setCeremony(c, cfg, keys, ceremonyState{Kind: "register", Username: username, Session: *session}); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to start registration"})
+			return
+		}
+		c.JSON(http.StatusOK, options)
+	}
+}
+
+// passkeyRegisterFinishHandler verifies the authenticator's response and stores the new
+// passkey under the name in ?name=.
+func passkeyRegisterFinishHandler(live *env.Live, store auth.Store, keys *auth.Keys) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		cfg := live.Get()
+		username := getUserClaims(c).Subject
+		state, ok := takeCeremony(c, cfg, store, keys, "register")
+		if !ok {
+			return
+		}
+		if state.Username != username {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "no register in progress; start again"})
+			return
+		}
+		wa, err := newWebAuthn(cfg)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		parsed, err := protocol.ParseCredentialCreationResponseBody(c.Request.Body)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid registration response"})
+			return
+		}
+		user := &passkeyUser{name: username, handle: state.Session.UserID}
+		cred, err := wa.CreateCredential(user, state.Session, parsed)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "passkey not accepted"})
+			return
+		}
+		data, err := json.Marshal(cred)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to store passkey"})
+			return
+		}
+		name := c.Query("name")
+		err = store.AddWebAuthnCredential(auth.WebAuthnCredential{
+			ID: cred.ID, Username: username, UserHandle: user.handle, Name: name, Data: data,
+		})
+		if errors.Is(err, auth.ErrDuplicateCredential) {
+			c.JSON(http.StatusConflict, gin.H{"error": "passkey already registered"})
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to store passkey"})
+			return
+		}
+		if err := store.RecordEvent(auth.EventPasskeyAdded, username, "", name); err != nil {
+			slog.Warn("auth: failed to record event", "err", err)
+		}
+		c.JSON(http.StatusOK, gin.H{"id": base64.RawURLEncoding.EncodeToString(cred.ID), "name": name})
+	}
+}
+
+// passkeyLoginBeginHandler returns the options for navigator.credentials.get. The login
+// is discoverable: the browser offers the user's passkeys without asking for a username.
+func passkeyLoginBeginHandler(live *env.Live, keys *auth.Keys) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		cfg := live.Get()
+		wa, err := newWebAuthn(cfg)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		options, session, err := wa.BeginDiscoverableLogin(webauthn.WithUserVerification(protocol.VerificationRequired))
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to start login"})
+			return
+		}
+		if err := setCeremony(c, cfg, keys, ceremonyState{Kind: "login", Session: *session}); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to start login"})
+			return
+		}
+		c.JSON(http.StatusOK, options)
+	}
+}
+
+// passkeyLoginFinishHandler verifies the assertion and, like loginHandler, starts a
+// session labelled ?deviceLabel= (short with ?rememberMe=false) and sets the cookies.
+func passkeyLoginFinishHandler(live *env.Live, store auth.Store, keys *auth.Keys) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		cfg := live.Get()
+		state, ok := takeCeremony(c, cfg, store, keys, "login")
+		if !ok {
+			return
+		}
+		wa, err := newWebAuthn(cfg)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		parsed, err := protocol.ParseCredentialRequestResponseBody(c.Request.Body)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid login response"})
+			return
+		}
+		var user *passkeyUser
+		findUser := func(_, handle []byte) (webauthn.User, error) {
+			stored, err := store.WebAuthnCredentialsByHandle(handle)
+			if err != nil {
+				return nil, err
+			}
+			if len(stored) == 0 {
+				return nil, auth.ErrCredentialNotFound
+			}
+			user, err = newPasskeyUser(stored[0].Username, stored)
+			return user, err
+		}
+		_, cred, err := wa.ValidatePasskeyLogin(findUser, state.Session, parsed)
+		if err != nil {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "passkey not accepted"})
+			return
+		}
+		if cred.Authenticator.CloneWarning {
+			slog.Warn("auth: passkey signature counter went backwards; refused login", "user", user.name, "ip", c.ClientIP())
+			if err := store.RecordEvent(auth.EventPasskeyCloned, user.name, "", base64.RawURLEncoding.EncodeToString(cred.ID)); err != nil {
+				slog.Warn("auth: failed to record event", "err", err)
+			}
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "passkey not accepted"})
+			return
+		}
+		if data, err := json.Marshal(cred); err == nil {
+			err = store.UpdateWebAuthnCredential(cred.ID, data)
+			if err != nil {
+				slog.Warn("auth: failed to update passkey", "err", err)
+			}
+		}
+		if err := issueTokens(c, cfg, store, keys, user.name, c.Query("deviceLabel"), c.Query("rememberMe") == "false"); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to issue tokens"})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"ok": true})
+	}
+}
+
+// passkeyResponse is a passkey as listed by GET /api/webauthn/credentials.
+type passkeyResponse struct {
+	ID         string     `json:"id"` // base64url, as in the browser's PublicKeyCredential.id
+	Name       string     `json:"name"`
+	CreatedAt  time.Time  `json:"createdAt"`
+	LastUsedAt *time.Time `json:"lastUsedAt"` // null until first used
+}
+
+// listPasskeysHandler lists the caller's passkeys.
+func listPasskeysHandler(store auth.WebAuthnStore) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		stored, err := store.WebAuthnCredentials(getUserClaims(c).Subject)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to list passkeys"})
+			return
+		}
+		resp := make([]passkeyResponse, len(stored))
+		for i, s := range stored {
+			resp[i] = passkeyResponse{ID: base64.RawURLEncoding.EncodeToString(s.ID), Name: s.Name, CreatedAt: s.CreatedAt}
+			if !s.LastUsedAt.IsZero() {
+				resp[i].LastUsedAt = &stored[i].LastUsedAt
+			}
+		}
+		c.JSON(http.StatusOK, gin.H{"credentials": resp})
+	}
+}
+
+// deletePasskeyHandler removes one of the caller's passkeys. Sessions started with it stay.
+func deletePasskeyHandler(store auth.Store) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		username := getUserClaims(c).Subject
+		id, err := base64.RawURLEncoding.DecodeString(c.Param("id"))
+		if err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "passkey not found"})
+			return
+		}
+		err = store.DeleteWebAuthnCredential(username, id)
+		if errors.Is(err, auth.ErrCredentialNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "passkey not found"})
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to delete passkey"})
+			return
+		}
+		if err := store.RecordEvent(auth.EventPasskeyRemoved, username, "", c.Param("id")); err != nil {
+			slog.Warn("auth: failed to record event", "err", err)
+		}
+		c.JSON(http.StatusOK, gin.H{"ok": true})
+	}
+}
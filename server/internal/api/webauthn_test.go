@@ -0,0 +1,393 @@
+package api
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/fridayflag/papaya/internal/auth"
+	"github.com/fridayflag/papaya/internal/env"
+	"github.com/go-webauthn/webauthn/protocol/webauthncbor"
+	"github.com/go-webauthn/webauthn/protocol/webauthncose"
+	"github.com/go-webauthn/webauthn/webauthn"
+)
+
+const (
+	passkeyRPID   = "localhost"
+	passkeyOrigin = "https://localhost"
+)
+
+// softPasskey is a passkey held by a software authenticator: a P-256 key that signs
+// whatever the test asks it to, with the signature counter the test chooses.
+type softPasskey struct {
+	id     []byte
+	key    *ecdsa.PrivateKey
+	handle []byte // The WebAuthn user handle the server gave at registration
+}
+
+// passkeyServer is a test server with passkeys turned on for passkeyOrigin.
+func passkeyServer(t *testing.T) *testServer {
+	return newTestServer(t, func(cfg *env.Config) {
+		cfg.App.Auth.WebAuthnRPID = passkeyRPID
+		cfg.App.Auth.WebAuthnOrigins = []string{passkeyOrigin}
+	})
+}
+
+// ceremonyOptions is the part of a begin response the authenticator needs.
+type ceremonyOptions struct {
+	PublicKey struct {
+		Challenge string `json:"challenge"`
+		User      struct {
+			ID string `json:"id"`
+		} `json:"user"`
+	} `json:"publicKey"`
+}
+
+// beginCeremony starts a ceremony on client and returns its options.
+func (s *testServer) beginCeremony(client *http.Client, path string) ceremonyOptions {
+	s.t.Helper()
+	resp, body := s.do(client, http.MethodPost, path, nil)
+	if resp.StatusCode != http.StatusOK {
+		s.t.Fatalf("POST %s: %d %s", path, resp.StatusCode, body)
+	}
+	var options ceremonyOptions
+	decode(s.t, body, &options)
+	return options
+}
+
+// clientData is the clientDataJSON a browser at passkeyOrigin would send.
+func clientData(kind, challenge string) []byte {
+	b, _ := json.Marshal(map[string]any{"type": kind, "challenge": challenge, "origin": passkeyOrigin})
+	return b
+}
+
+// authenticatorData is the authenticator data for passkeyRPID with the user present and
+// verified, followed by attested (which sets the AT flag) if there is any.
+func authenticatorData(count uint32, attested []byte) []byte {
+	rpIDHash := sha256.Sum256([]byte(passkeyRPID))
+	flags := byte(flagUserPresent | flagUserVerified)
+	if attested != nil {
+		flags |= flagAttested
+	}
+	data := append(rpIDHash[:], flags)
+	data = binary.BigEndian.AppendUint32(data, count)
+	return append(data, attested...)
+}
+
+// Authenticator data flags (WebAuthn §6.1).
+const (
+	flagUserPresent  = 0x01
+	flagUserVerified = 0x04
+	flagAttested     = 0x40 // Attested credential data follows
+)
+
+func b64(b []byte) string { return base64.RawURLEncoding.EncodeToString(b) }
+
+// register creates a passkey named name for the user logged in on client.
+func (s *testServer) register(client *http.Client, name string) *softPasskey {
+	s.t.Helper()
+	options := s.beginCeremony(client, "/api/webauthn/register/begin")
+	p := newSoftPasskey(s.t)
+	var err error
+	p.handle, err = base64.RawURLEncoding.DecodeString(options.PublicKey.User.ID)
+	if err != nil {
+		s.t.Fatalf("user.id %q: %v", options.PublicKey.User.ID, err)
+	}
+	if resp, body := s.finishRegistration(client, name, p, options.PublicKey.Challenge); resp.StatusCode != http.StatusOK {
+		s.t.Fatalf("registering %s: %d %s", name, resp.StatusCode, body)
+	}
+	return p
+}
+
+// newSoftPasskey creates a key with a random credential ID.
+func newSoftPasskey(t *testing.T) *softPasskey {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &softPasskey{id: make([]byte, 16), key: key}
+	_, _ = rand.Read(p.id)
+	return p
+}
+
+// finishRegistration sends p's attestation (format "none") for challenge.
+func (s *testServer) finishRegistration(client *http.Client, name string, p *softPasskey, challenge string) (*http.Response, []byte) {
+	s.t.Helper()
+	pub, err := p.key.PublicKey.ECDH()
+	if err != nil {
+		s.t.Fatal(err)
+	}
+	point := pub.Bytes() // 0x04 || x || y
+	coseKey, err := webauthncbor.Marshal(webauthncose.EC2PublicKeyData{
+		PublicKeyData: webauthncose.PublicKeyData{
+			KeyType:   int64(webauthncose.EllipticKey),
+			Algorithm: int64(webauthncose.AlgES256),
+		},
+		Curve:  int64(webauthncose.P256),
+		XCoord: point[1:33],
+		YCoord: point[33:],
+	})
+	if err != nil {
+		s.t.Fatal(err)
+	}
+	attested := make([]byte, 16) // AAGUID: none
+	attested = binary.BigEndian.AppendUint16(attested, uint16(len(p.id)))
+	attested = append(append(attested, p.id...), coseKey...)
+	object, err := webauthncbor.Marshal(map[string]any{
+		"fmt":      "none",
+		"attStmt":  map[string]any{},
+		"authData": authenticatorData(0, attested),
+	})
+	if err != nil {
+		s.t.Fatal(err)
+	}
+	return s.do(client, http.MethodPost, "/api/webauthn/register/finish?name="+name, map[string]any{
+		"id": b64(p.id), "rawId": b64(p.id), "type": "public-key",
+		"response": map[string]any{
+			"clientDataJSON":    b64(clientData("webauthn.create", challenge)),
+			"attestationObject": b64(object),
+		},
+	})
+}
+
+// passkeyLogin signs in on client with p, claiming user handle handle and signature counter
+// count, and returns the finish response.
+func (s *testServer) passkeyLogin(client *http.Client, p *softPasskey, handle []byte, count uint32) (*http.Response, []byte) {
+	s.t.Helper()
+	options := s.beginCeremony(client, "/api/webauthn/login/begin")
+	return s.do(client, http.MethodPost, "/api/webauthn/login/finish", s.assertion(p, handle, count, options.PublicKey.Challenge))
+}
+
+// assertion is the finish request body of a login with p for challenge.
+func (s *testServer) assertion(p *softPasskey, handle []byte, count uint32, challenge string) map[string]any {
+	s.t.Helper()
+	data := clientData("webauthn.get", challenge)
+	authData := authenticatorData(count, nil)
+	dataHash := sha256.Sum256(data)
+	signed := sha256.Sum256(append(authData, dataHash[:]...))
+	sig, err := ecdsa.SignASN1(rand.Reader, p.key, signed[:])
+	if err != nil {
+		s.t.Fatal(err)
+	}
+	return map[string]any{
+		"id": b64(p.id), "rawId": b64(p.id), "type": "public-key",
+		"response": map[string]any{
+			"clientDataJSON":    b64(data),
+			"authenticatorData": b64(authData),
+			"signature":         b64(sig),
+			"userHandle":        b64(handle),
+		},
+	}
+}
+
+// signCount returns the signature counter stored with username's passkey p.
+func (s *testServer) signCount(username string, p *softPasskey) uint32 {
+	s.t.Helper()
+	stored, err := s.store.WebAuthnCredentials(username)
+	if err != nil {
+		s.t.Fatal(err)
+	}
+	for _, c := range stored {
+		if string(c.ID) == string(p.id) {
+			var cred webauthn.Credential
+			if err := json.Unmarshal(c.Data, &cred); err != nil {
+				s.t.Fatal(err)
+			}
+			return cred.Authenticator.SignCount
+		}
+	}
+	s.t.Fatalf("%s has no passkey %s", username, b64(p.id))
+	return 0
+}
+
+func TestPasskeyRegisterAndLogin(t *testing.T) {
+	s := passkeyServer(t)
+	s.couch.addUser("alice", "pw")
+	browser := s.client()
+	s.login(browser, "alice", "pw")
+	laptop := s.register(browser, "Laptop")
+	phone := s.register(browser, "Phone")
+	if string(phone.handle) != string(laptop.handle) {
+		t.Errorf("second passkey's user handle = %x, want alice's %x", phone.handle, laptop.handle)
+	}
+
+	resp, body := s.do(browser, http.MethodGet, "/api/webauthn/credentials", nil)
+	var list struct {
+		Credentials []passkeyResponse `json:"credentials"`
+	}
+	decode(t, body, &list)
+	if resp.StatusCode != http.StatusOK || len(list.Credentials) != 2 ||
+		list.Credentials[0].ID != b64(laptop.id) || list.Credentials[0].Name != "Laptop" || list.Credentials[1].Name != "Phone" {
+		t.Fatalf("GET /api/webauthn/credentials = %d %s, want Laptop and Phone", resp.StatusCode, body)
+	}
+
+	// A fresh browser logs in with the passkey alone.
+	other := s.client()
+	if resp, body := s.passkeyLogin(other, laptop, laptop.handle, 1); resp.StatusCode != http.StatusOK {
+		t.Fatalf("passkey login: %d %s", resp.StatusCode, body)
+	}
+	access := s.cookie(other, auth.CookieAccessToken)
+	if access == "" {
+		t.Fatal("passkey login set no access token")
+	}
+	if sub := claims(t, access)["sub"]; sub != "alice" {
+		t.Errorf("access token sub = %v, want alice", sub)
+	}
+	if got := s.signCount("alice", laptop); got != 1 {
+		t.Errorf("stored sign count = %d, want 1", got)
+	}
+}
+
+func TestPasskeyRegistrationRefused(t *testing.T) {
+	s := passkeyServer(t)
+	s.couch.addUser("alice", "pw")
+	browser := s.client()
+	s.login(browser, "alice", "pw")
+
+	t.Run("finished twice", func(t *testing.T) {
+		options := s.beginCeremony(browser, "/api/webauthn/register/begin")
+		p := newSoftPasskey(t)
+		if resp, body := s.finishRegistration(browser, "Laptop", p, options.PublicKey.Challenge); resp.StatusCode != http.StatusOK {
+			t.Fatalf("first finish: %d %s", resp.StatusCode, body)
+		}
+		if resp, body := s.finishRegistration(browser, "Laptop", p, options.PublicKey.Challenge); resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("second finish: %d %s, want 400", resp.StatusCode, body)
+		}
+	})
+	t.Run("wrong challenge", func(t *testing.T) {
+		s.beginCeremony(browser, "/api/webauthn/register/begin")
+		p := newSoftPasskey(t)
+		if resp, body := s.finishRegistration(browser, "Laptop", p, b64([]byte("not the challenge"))); resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("finish: %d %s, want 400", resp.StatusCode, body)
+		}
+	})
+	t.Run("not logged in", func(t *testing.T) {
+		if resp, body := s.do(s.client(), http.MethodPost, "/api/webauthn/register/begin", nil); resp.StatusCode != http.StatusUnauthorized {
+			t.Errorf("begin: %d %s, want 401", resp.StatusCode, body)
+		}
+	})
+}
+
+// TestPasskeyUserHandle checks that a discoverable login finds the account by the user
+// handle the authenticator returns, and only accepts a passkey registered under it.
+func TestPasskeyUserHandle(t *testing.T) {
+	s := passkeyServer(t)
+	passkeys := map[string]*softPasskey{}
+	for _, name := range []string{"alice", "bob"} {
+		s.couch.addUser(name, "pw")
+		browser := s.client()
+		s.login(browser, name, "pw")
+		passkeys[name] = s.register(browser, "Laptop")
+	}
+	alice, bob := passkeys["alice"], passkeys["bob"]
+
+	tests := []struct {
+		name    string
+		passkey *softPasskey
+		handle  []byte
+		want    string // Who is logged in; "" for refused
+	}{
+		{"alice", alice, alice.handle, "alice"},
+		{"bob", bob, bob.handle, "bob"},
+		{"bob's passkey, alice's handle", bob, alice.handle, ""},
+		{"unknown handle", alice, []byte("nobody"), ""},
+	}
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := s.client()
+			resp, body := s.passkeyLogin(client, tt.passkey, tt.handle, uint32(i+1))
+			if tt.want == "" {
+				if resp.StatusCode != http.StatusUnauthorized {
+					t.Errorf("passkey login: %d %s, want 401", resp.StatusCode, body)
+				}
+				if s.cookie(client, auth.CookieAccessToken) != "" {
+					t.Error("refused passkey login set an access token")
+				}
+				return
+			}
+			if resp.StatusCode != http.StatusOK {
+				t.Fatalf("passkey login: %d %s", resp.StatusCode, body)
+			}
+			if sub := claims(t, s.cookie(client, auth.CookieAccessToken))["sub"]; sub != tt.want {
+				t.Errorf("access token sub = %v, want %s", sub, tt.want)
+			}
+		})
+	}
+}
+
+// TestPasskeySignCount checks that a counter that does not go up (a cloned
+// authenticator) is refused, except for authenticators that always report zero.
+func TestPasskeySignCount(t *testing.T) {
+	tests := []struct {
+		name   string
+		counts []uint32 // One login each
+		want   []int    // Statuses
+		stored uint32   // The counter kept afterwards
+	}{
+		{"increasing", []uint32{1, 2, 7}, []int{200, 200, 200}, 7},
+		{"repeated", []uint32{5, 5}, []int{200, 401}, 5},
+		{"backwards", []uint32{5, 3, 6}, []int{200, 401, 200}, 6},
+		{"never counts", []uint32{0, 0, 0}, []int{200, 200, 200}, 0},
+		{"stops counting", []uint32{4, 0}, []int{200, 401}, 4},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := passkeyServer(t)
+			s.couch.addUser("alice", "pw")
+			browser := s.client()
+			s.login(browser, "alice", "pw")
+			p := s.register(browser, "Laptop")
+			for i, count := range tt.counts {
+				client := s.client()
+				resp, body := s.passkeyLogin(client, p, p.handle, count)
+				if resp.StatusCode != tt.want[i] {
+					t.Errorf("login %d with counter %d: %d %s, want %d", i+1, count, resp.StatusCode, body, tt.want[i])
+				}
+				if resp.StatusCode != http.StatusOK && s.cookie(client, auth.CookieAccessToken) != "" {
+					t.Errorf("refused login %d set an access token", i+1)
+				}
+			}
+			if got := s.signCount("alice", p); got != tt.stored {
+				t.Errorf("stored sign count = %d, want %d", got, tt.stored)
+			}
+		})
+	}
+}
+
+// TestPasskeyCeremonyReplay finishes a login twice with a saved copy of the ceremony
+// cookie. The authenticator never counts, so only the spent challenge stops the replay.
+func TestPasskeyCeremonyReplay(t *testing.T) {
+	s := passkeyServer(t)
+	s.couch.addUser("alice", "pw")
+	browser := s.client()
+	s.login(browser, "alice", "pw")
+	p := s.register(browser, "Laptop")
+
+	resp, body := s.do(http.DefaultClient, http.MethodPost, "/api/webauthn/login/begin", nil)
+	ceremony := setCookies(resp)[auth.CookieWebAuthn]
+	if resp.StatusCode != http.StatusOK || ceremony == nil {
+		t.Fatalf("POST /api/webauthn/login/begin: %d %s", resp.StatusCode, body)
+	}
+	var options ceremonyOptions
+	decode(t, body, &options)
+	assertion := s.assertion(p, p.handle, 0, options.PublicKey.Challenge)
+	cookie := []string{"Cookie", ceremony.Name + "=" + ceremony.Value}
+
+	if resp, body := s.do(http.DefaultClient, http.MethodPost, "/api/webauthn/login/finish", assertion, cookie...); resp.StatusCode != http.StatusOK {
+		t.Fatalf("first finish: %d %s", resp.StatusCode, body)
+	}
+	resp, body = s.do(http.DefaultClient, http.MethodPost, "/api/webauthn/login/finish", assertion, cookie...)
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("replayed finish: %d %s, want 400", resp.StatusCode, body)
+	}
+	if setCookies(resp)[auth.CookieAccessToken] != nil {
+		t.Error("replayed finish set an access token")
+	}
+}
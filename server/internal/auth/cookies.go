@@ -3,4 +3,18 @@ package auth
 const (
 	CookieAccessToken  = "papaya_token"
 	CookieRefreshToken = "papaya_refresh"
+	CookieWebAuthn     = "papaya_webauthn" // Sealed passkey ceremony state between begin and finish
+	CookieOIDC         = "papaya_oidc"     // Sealed OIDC state, nonce and PKCE verifier between login and callback
 )
+
+// HostPrefix starts cookie names with auth.cookies.host_prefix. Browsers only accept such
+// cookies from a secure origin, with Path=/ and no Domain, so a subdomain cannot plant one.
+const HostPrefix = "__Host-"
+
+// CookieName returns the name the cookie called name is sent under.
+func CookieName(name string, hostPrefix bool) string {
+	if hostPrefix {
+		return HostPrefix + name
+	}
+	return name
+}
@@ -0,0 +1,135 @@
+package auth
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// denylistReload is how often a Denylist picks up tokens denied by other replicas sharing
+// its store.
+const denylistReload = 10 * time.Second
+
+// Denylist holds the revoked access tokens in memory, so that every /db request can be
+// checked without a database query. Single tokens are denied by jti (logout) and whole
+// sessions by sid (ending a session, logging a user out everywhere), so nothing is
+// written for the tokens issued meanwhile. Entries are stored first, so the denylist
+// survives restarts, and are dropped once the tokens they cover have expired.
+type Denylist struct {
+	store    DenylistStore
+	mu       sync.RWMutex
+	tokens   map[string]time.Time // jti → expiry
+	sessions map[string]time.Time // sid → expiry of the last token issued to it
+}
+
+// NewDenylist returns the denylist kept in store, loaded.
+func NewDenylist(store DenylistStore) (*Denylist, error) {
+	d := &Denylist{store: store, tokens: make(map[string]time.Time), sessions: make(map[string]time.Time)}
+	return d, d.Load()
+}
+
+// Load merges the unexpired entries in the store into those in memory, keeping the later
+// expiry of each, and drops the expired ones. Merging rather than replacing keeps entries
+// denied here while the store was being read.
+func (d *Denylist) Load() error {
+	list, err := d.store.DeniedTokens(time.Now())
+	if err != nil {
+		return err
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.add(list...)
+	now := time.Now()
+	for _, m := range []map[string]time.Time{d.tokens, d.sessions} {
+		for id, exp := range m {
+			if !now.Before(exp) {
+				delete(m, id)
+			}
+		}
+	}
+	return nil
+}
+
+// Run reloads the denylist periodically until ctx is done.
+func (d *Denylist) Run(ctx context.Context) {
+	t := time.NewTicker(denylistReload)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+		if err := d.Load(); err != nil {
+			slog.Warn("auth: failed to reload access-token denylist", "err", err)
+		}
+	}
+}
+
+// Denied reports whether the access token with the given jti and sid claims is
+// denylisted, itself or through its session.
+func (d *Denylist) Denied(jti, sessionID string) bool {
+	now := time.Now()
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	if exp, ok := d.tokens[jti]; ok && jti != "" && now.Before(exp) {
+		return true
+	}
+	exp, ok := d.sessions[sessionID]
+	return ok && sessionID != "" && now.Before(exp)
+}
+
+// DenyToken denylists one access token until it expires.
+func (d *Denylist) DenyToken(jti string, expiresAt time.Time) error {
+	if jti == "" || !expiresAt.After(time.Now()) {
+		return nil
+	}
+	return d.deny(DeniedToken{Kind: DeniedByJTI, ID: jti, ExpiresAt: expiresAt})
+}
+
+// DenySessions denylists the access tokens issued to the given sessions until the given
+// time, when the last of them has expired. The sessions must have been revoked, so that
+// no more tokens are issued to them.
+func (d *Denylist) DenySessions(until time.Time, sessionIDs ...string) error {
+	var entries []DeniedToken
+	for _, id := range sessionIDs {
+		if id != "" {
+			entries = append(entries, DeniedToken{Kind: DeniedBySession, ID: id, ExpiresAt: until})
+		}
+	}
+	if len(entries) == 0 {
+		return nil
+	}
+	return d.deny(entries...)
+}
+
+func (d *Denylist) deny(entries ...DeniedToken) error {
+	if err := d.store.Deny(entries...); err != nil {
+		return err
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.add(entries...)
+	return nil
+}
+
+// add puts entries in memory, keeping the later expiry of an entry already there. Only
+// jti and sid entries are kept; other kinds are not checked per request. d.mu must be
+// held.
+func (d *Denylist) add(entries ...DeniedToken) {
+	for _, e := range entries {
+		var m map[string]time.Time
+		switch e.Kind {
+		case DeniedByJTI:
+			m = d.tokens
+		case DeniedBySession:
+			m = d.sessions
+		default:
+			continue
+		}
+		if e.ExpiresAt.After(m[e.ID]) {
+			m[e.ID] = e.ExpiresAt
+		}
+	}
+}
@@ -0,0 +1,71 @@
+package auth
+
+import (
+	"testing"
+	"time"
+)
+
+// racingStore is a DenylistStore that runs during once, after taking the snapshot
+// DeniedTokens returns: a deny that lands while a reload is under way.
+type racingStore struct {
+	DenylistStore
+	during func()
+}
+
+func (s *racingStore) DeniedTokens(now time.Time) ([]DeniedToken, error) {
+	list, err := s.DenylistStore.DeniedTokens(now)
+	if during := s.during; during != nil {
+		s.during = nil
+		during()
+	}
+	return list, err
+}
+
+// TestDenylistLoadKeepsLocalDenies checks that a reload merges the store's entries in
+// rather than replacing what is in memory.
+func TestDenylistLoadKeepsLocalDenies(t *testing.T) {
+	store := &racingStore{DenylistStore: NewMemoryStore()}
+	d, err := NewDenylist(store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+
+	// Another replica sharing the store denies a session.
+	if err := store.Deny(DeniedToken{Kind: DeniedBySession, ID: "s-other", ExpiresAt: now.Add(time.Hour)}); err != nil {
+		t.Fatal(err)
+	}
+	store.during = func() {
+		if err := d.DenyToken("j-local", now.Add(time.Hour)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := d.Load(); err != nil {
+		t.Fatalf("Load() error = %v", err)
+	}
+	if !d.Denied("j-local", "") {
+		t.Error("token denied during Load() is not denied after it")
+	}
+	if !d.Denied("", "s-other") {
+		t.Error("session denied by another replica is not denied after Load()")
+	}
+}
+
+func TestDenylistLoadDropsExpired(t *testing.T) {
+	d, err := NewDenylist(NewMemoryStore())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := d.DenySessions(time.Now().Add(50*time.Millisecond), "s1"); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(60 * time.Millisecond)
+	if err := d.Load(); err != nil {
+		t.Fatal(err)
+	}
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	if len(d.sessions) != 0 {
+		t.Errorf("sessions after Load() = %v, want the expired entry dropped", d.sessions)
+	}
+}
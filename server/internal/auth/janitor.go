@@ -0,0 +1,73 @@
+package auth
+
+import (
+	"context"
+	"expvar"
+	"log/slog"
+	"time"
+)
+
+// janitorMetrics is published with the other expvars (see /api/admin/metrics).
+var janitorMetrics = expvar.NewMap("papaya_auth_janitor")
+
+// janitorIdle is how often a disabled janitor checks whether it was enabled by a reload.
+const janitorIdle = time.Minute
+
+// Janitor deletes spent refresh tokens in the background (see Store.Prune).
+type Janitor struct {
+	store    Store
+	settings func() (interval, retention time.Duration)
+	now      func() time.Time // time.Now; tests replace it
+}
+
+// NewJanitor returns a janitor for store. settings is called before every run, so reloaded
+// values apply; an interval of 0 pauses the janitor.
+func NewJanitor(store Store, settings func() (interval, retention time.Duration)) *Janitor {
+	return &Janitor{store: store, settings: settings, now: time.Now}
+}
+
+// Run prunes once per interval until ctx is done. A prune that is under way when ctx is
+// cancelled finishes first, so the store can be closed once Run returns.
+func (j *Janitor) Run(ctx context.Context) {
+	for {
+		interval, _ := j.settings()
+		wait := interval
+		if wait <= 0 {
+			wait = janitorIdle
+		}
+		t := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			return
+		case <-t.C:
+		}
+		if interval, retention := j.settings(); interval > 0 {
+			_, _ = j.Prune(retention)
+		}
+	}
+}
+
+// Prune deletes what has been spent or expired for longer than retention (see
+// Store.Prune) and updates the metrics.
+func (j *Janitor) Prune(retention time.Duration) (PruneResult, error) {
+	start := j.now()
+	r, err := j.store.Prune(start.Add(-retention))
+	janitorMetrics.Add("runs", 1)
+	if err != nil {
+		janitorMetrics.Add("errors", 1)
+		slog.Error("auth: pruning the auth store failed", "err", err)
+		return r, err
+	}
+	janitorMetrics.Add("tokens_removed", r.Tokens)
+	janitorMetrics.Add("sessions_removed", r.Sessions)
+	janitorMetrics.Add("pats_removed", r.PATs)
+	janitorMetrics.Add("failed_logins_removed", r.FailedLogins)
+	janitorMetrics.Add("denylist_removed", r.Denylist)
+	last := new(expvar.Int)
+	last.Set(start.Unix())
+	janitorMetrics.Set("last_run_unix", last)
+	slog.Debug("auth: pruned the auth store", "tokens", r.Tokens, "sessions", r.Sessions, "pats", r.PATs,
+		"failed_logins", r.FailedLogins, "denylist", r.Denylist, "took", j.now().Sub(start))
+	return r, nil
+}
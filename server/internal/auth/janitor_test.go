@@ -0,0 +1,66 @@
+package auth
+
+import (
+	"expvar"
+	"testing"
+	"time"
+)
+
+func TestJanitorPrune(t *testing.T) {
+	store := NewMemoryStore()
+	now := time.Now()
+	day := 24 * time.Hour
+	add := func(hash, username string, expires time.Time) {
+		t.Helper()
+		tok := RefreshToken{Hash: hash, Username: username, FamilyID: hash, ExpiresAt: expires}
+		if err := store.Store(tok, Session{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	add("old", "alice", now.Add(time.Hour))
+	add("new", "bob", now.Add(30*day))
+	if err := store.AddPersonalAccessToken(PersonalAccessToken{ID: "p1", Username: "alice", Hash: "h1", ExpiresAt: now.Add(time.Hour)}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.RecordFailedLogin("ip:192.0.2.1", now, time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Deny(DeniedToken{Kind: DeniedByJTI, ID: "j1", ExpiresAt: now.Add(time.Minute)}); err != nil {
+		t.Fatal(err)
+	}
+
+	metric := func(name string) int64 {
+		if v, ok := janitorMetrics.Get(name).(*expvar.Int); ok {
+			return v.Value()
+		}
+		return 0
+	}
+	names := []string{"runs", "tokens_removed", "sessions_removed", "pats_removed", "failed_logins_removed", "denylist_removed"}
+	before := map[string]int64{}
+	for _, name := range names {
+		before[name] = metric(name)
+	}
+
+	// Eight days on with a week's retention, everything but bob's session is spent.
+	j := NewJanitor(store, nil)
+	clock := now.Add(8 * day)
+	j.now = func() time.Time { return clock }
+	r, err := j.Prune(7 * day)
+	if err != nil {
+		t.Fatalf("Prune() error = %v", err)
+	}
+	if want := (PruneResult{Tokens: 1, Sessions: 1, PATs: 1, FailedLogins: 1, Denylist: 1}); r != want {
+		t.Errorf("Prune() = %+v, want %+v", r, want)
+	}
+	for _, name := range names {
+		if got := metric(name) - before[name]; got != 1 {
+			t.Errorf("janitor metric %s went up by %d, want 1", name, got)
+		}
+	}
+	if got := metric("last_run_unix"); got != clock.Unix() {
+		t.Errorf("last_run_unix = %d, want %d", got, clock.Unix())
+	}
+	if list, _ := store.Sessions("bob"); len(list) != 1 {
+		t.Errorf("Sessions(bob) = %+v, want one", list)
+	}
+}
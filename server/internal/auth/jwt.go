@@ -1,92 +1,239 @@
 package auth
 
 import (
+	"encoding/json"
 	"errors"
 	"time"
 
 	"github.com/golang-jwt/jwt/v5"
 )
 
-const (
-	AccessTokenDuration  = 15 * time.Minute
-	RefreshTokenDuration = 7 * 24 * time.Hour
-)
-
-const (
-	accessTokenDuration  = AccessTokenDuration
-	refreshTokenDuration = RefreshTokenDuration
-)
-
 // AccessClaims holds JWT claims for the access token.
 type AccessClaims struct {
 	jwt.RegisteredClaims
+	SessionID string           `json:"sid,omitempty"`       // Refresh-token family the token was issued for
+	AuthTime  *jwt.NumericDate `json:"auth_time,omitempty"` // When the session's user logged in
+	Roles     Roles            `json:"-"`                   // Added by MarshalJSON; not read back by ParseAccessToken
 }
 
-// RefreshClaims holds JWT claims for the refresh token.
+// Roles are the CouchDB roles an access token carries, under the claim CouchDB's JWT
+// handler reads them from (its jwt_auth roles_claim_name, "_couchdb.roles" by default).
+// Without a Claim the token carries none.
+type Roles struct {
+	Claim string
+	Names []string
+}
+
+// MarshalJSON encodes the claims with the roles under c.Roles.Claim, which is configured
+// and so cannot be a struct tag.
+func (c AccessClaims) MarshalJSON() ([]byte, error) {
+	type plain AccessClaims // Without this method
+	b, err := json.Marshal(plain(c))
+	if err != nil || c.Roles.Claim == "" {
+		return b, err
+	}
+	var m map[string]any
+	if err := json.Unmarshal(b, &m); err != nil {
+		return nil, err
+	}
+	names := c.Roles.Names
+	if names == nil {
+		names = []string{}
+	}
+	m[c.Roles.Claim] = names
+	return json.Marshal(m)
+}
+
+// RefreshClaims holds JWT claims for the refresh token. AuthTime and Short are copied from
+// the login that started the session into every token it is rotated into.
 type RefreshClaims struct {
 	jwt.RegisteredClaims
+	AuthTime *jwt.NumericDate `json:"auth_time,omitempty"` // When the user logged in
+	Short    bool             `json:"short,omitempty"`     // Logged in without "remember me"
+}
+
+// LoginTime returns when the user logged in. Tokens minted before auth_time was added
+// count from their own issue time.
+func (c *RefreshClaims) LoginTime() time.Time {
+	if c.AuthTime != nil {
+		return c.AuthTime.Time
+	}
+	if c.IssuedAt != nil {
+		return c.IssuedAt.Time
+	}
+	return time.Time{}
+}
+
+// LoginTime returns when the user logged in, or the token's issue time for tokens without
+// auth_time.
+func (c *AccessClaims) LoginTime() time.Time {
+	if c.AuthTime != nil {
+		return c.AuthTime.Time
+	}
+	if c.IssuedAt != nil {
+		return c.IssuedAt.Time
+	}
+	return time.Time{}
+}
+
+// MFAClaims holds JWT claims for the token that stands for a login waiting for its second
+// factor (see MintMFAToken).
+type MFAClaims struct {
+	jwt.RegisteredClaims
+	DeviceLabel string `json:"dl,omitempty"`    // From the login request, for the session started later
+	Short       bool   `json:"short,omitempty"` // The login asked not to be remembered
 }
 
-// MintAccessToken creates a new JWT access token for the given username.
-// If kid is non-empty, it is set as the JWT "kid" header (key ID).
-func MintAccessToken(username, secret, kid string) (string, error) {
+// mfaAudience marks MFA tokens, so neither they nor refresh tokens (same key) pass for the other.
+const mfaAudience = "papaya-mfa"
+
+// Keys are the keys the server signs with. Access tokens are verified by CouchDB (and
+// anyone reading /api/.well-known/jwks.json for key pairs) and are signed with the
+// keyring's active key; refresh tokens never leave the server and are always HMAC.
+type Keys struct {
+	Access  *Keyring
+	Refresh *SigningKey
+	mfa     string // Seals TOTP secrets; see SealMFASecret
+}
+
+// LoadKeys builds the signing keys from configuration. The access keyring is read from
+// keyringPath; the key from tokenSecret (or privateKeyFile, when set) is its fallback.
+// mfaSecret seals TOTP secrets; refreshSecret does when it is empty.
+func LoadKeys(kid, tokenSecret, refreshSecret, mfaSecret, privateKeyFile, keyringPath string) (*Keys, error) {
+	access, err := NewAccessKey(kid, tokenSecret, privateKeyFile)
+	if err != nil {
+		return nil, err
+	}
+	ring, err := LoadKeyring(keyringPath, access)
+	if err != nil {
+		return nil, err
+	}
+	return &Keys{Access: ring, Refresh: HMACKey(kid, refreshSecret), mfa: mfaSecret}, nil
+}
+
+// MintAccessToken creates a new JWT access token for the given username and session
+// (see Session; may be empty) that the user logged in to at authTime (zero for tokens
+// outside a session) and who has roles, valid for ttl. It also returns the token's random jti, by which it
+// can be denylisted (see Denylist).
+// The key's kid, if non-empty, is set as the JWT "kid" header (key ID).
+func MintAccessToken(username, sessionID string, authTime time.Time, roles Roles, key *SigningKey, ttl time.Duration) (token, jti string, err error) {
 	claims := AccessClaims{
 		RegisteredClaims: jwt.RegisteredClaims{
+			ID:        randomID(),
 			Subject:   username,
-			ExpiresAt: jwt.NewNumericDate(time.Now().Add(accessTokenDuration)),
+			ExpiresAt: jwt.NewNumericDate(time.Now().Add(ttl)),
 			IssuedAt:  jwt.NewNumericDate(time.Now()),
 		},
+		SessionID: sessionID,
+		Roles:     roles,
 	}
-	t := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-	if kid != "" {
-		t.Header["kid"] = kid
+	if !authTime.IsZero() {
+		claims.AuthTime = jwt.NewNumericDate(authTime)
 	}
-	return t.SignedString([]byte(secret))
+	token, err = sign(claims, key)
+	return token, claims.ID, err
 }
 
-// MintRefreshToken creates a new refresh token for the given username.
-// If kid is non-empty, it is set as the JWT "kid" header (key ID).
-func MintRefreshToken(username, secret, kid string) (string, error) {
+// MintRefreshToken creates a new refresh token for the given username, who logged in at
+// authTime (without "remember me" when short), valid until expiresAt.
+// The key's kid, if non-empty, is set as the JWT "kid" header (key ID). A random jti keeps
+// tokens minted in the same second distinct, since they are stored by hash.
+func MintRefreshToken(username string, key *SigningKey, authTime, expiresAt time.Time, short bool) (string, error) {
 	claims := RefreshClaims{
 		RegisteredClaims: jwt.RegisteredClaims{
+			ID:        randomID(),
 			Subject:   username,
-			ExpiresAt: jwt.NewNumericDate(time.Now().Add(refreshTokenDuration)),
+			ExpiresAt: jwt.NewNumericDate(expiresAt),
 			IssuedAt:  jwt.NewNumericDate(time.Now()),
 		},
+		AuthTime: jwt.NewNumericDate(authTime),
+		Short:    short,
 	}
-	t := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-	if kid != "" {
-		t.Header["kid"] = kid
+	return sign(claims, key)
+}
+
+// MintMFAToken creates the short-lived token /api/login returns instead of cookies when the
+// user has two-factor authentication enabled. It proves the password was checked and is
+// exchanged for the real tokens at /api/login/mfa. It is signed with the refresh key,
+// which never leaves the server.
+func MintMFAToken(username, deviceLabel string, short bool, key *SigningKey, ttl time.Duration) (string, error) {
+	claims := MFAClaims{
+		RegisteredClaims: jwt.RegisteredClaims{
+			ID:        randomID(),
+			Subject:   username,
+			Audience:  jwt.ClaimStrings{mfaAudience},
+			ExpiresAt: jwt.NewNumericDate(time.Now().Add(ttl)),
+			IssuedAt:  jwt.NewNumericDate(time.Now()),
+		},
+		DeviceLabel: deviceLabel,
+		Short:       short,
 	}
-	return t.SignedString([]byte(secret))
+	return sign(claims, key)
+}
+
+// ParseMFAToken parses and validates a token from MintMFAToken and returns its claims.
+func ParseMFAToken(tokenStr string, keys KeySet) (*MFAClaims, error) {
+	t, err := jwt.ParseWithClaims(tokenStr, &MFAClaims{}, keyFunc(keys), jwt.WithAudience(mfaAudience))
+	if err != nil {
+		return nil, err
+	}
+	claims, ok := t.Claims.(*MFAClaims)
+	if !ok || !t.Valid {
+		return nil, errors.New("invalid MFA token")
+	}
+	return claims, nil
+}
+
+func sign(claims jwt.Claims, key *SigningKey) (string, error) {
+	t := jwt.NewWithClaims(key.Method, claims)
+	if key.Kid != "" {
+		t.Header["kid"] = key.Kid
+	}
+	return t.SignedString(key.sign)
 }
 
 // ValidateAccessToken parses and validates the access token; returns the username.
-func ValidateAccessToken(tokenStr, secret string) (username string, err error) {
-	t, err := jwt.ParseWithClaims(tokenStr, &AccessClaims{}, func(t *jwt.Token) (interface{}, error) {
-		return []byte(secret), nil
-	})
+func ValidateAccessToken(tokenStr string, keys KeySet) (username string, err error) {
+	claims, err := ParseAccessToken(tokenStr, keys)
 	if err != nil {
 		return "", err
 	}
+	return claims.Subject, nil
+}
+
+// ParseAccessToken parses and validates the access token and returns its claims.
+func ParseAccessToken(tokenStr string, keys KeySet) (*AccessClaims, error) {
+	t, err := jwt.ParseWithClaims(tokenStr, &AccessClaims{}, keyFunc(keys))
+	if err != nil {
+		return nil, err
+	}
 	claims, ok := t.Claims.(*AccessClaims)
 	if !ok || !t.Valid {
-		return "", errors.New("invalid access token")
+		return nil, errors.New("invalid access token")
 	}
-	return claims.Subject, nil
+	return claims, nil
 }
 
 // ValidateRefreshToken parses and validates the refresh token; returns the username.
-func ValidateRefreshToken(tokenStr, secret string) (username string, err error) {
-	t, err := jwt.ParseWithClaims(tokenStr, &RefreshClaims{}, func(t *jwt.Token) (interface{}, error) {
-		return []byte(secret), nil
-	})
+func ValidateRefreshToken(tokenStr string, keys KeySet) (username string, err error) {
+	claims, err := ParseRefreshToken(tokenStr, keys)
 	if err != nil {
 		return "", err
 	}
+	return claims.Subject, nil
+}
+
+// ParseRefreshToken parses and validates the refresh token and returns its claims.
+// Refresh tokens have no audience; a token with one (an MFA token, signed with the same
+// key) is refused, or the password alone would pass for a session.
+func ParseRefreshToken(tokenStr string, keys KeySet) (*RefreshClaims, error) {
+	t, err := jwt.ParseWithClaims(tokenStr, &RefreshClaims{}, keyFunc(keys))
+	if err != nil {
+		return nil, err
+	}
 	claims, ok := t.Claims.(*RefreshClaims)
-	if !ok || !t.Valid {
-		return "", errors.New("invalid refresh token")
+	if !ok || !t.Valid || len(claims.Audience) > 0 {
+		return nil, errors.New("invalid refresh token")
 	}
-	return claims.Subject, nil
+	return claims, nil
 }
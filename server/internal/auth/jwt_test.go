@@ -0,0 +1,82 @@
+package auth
+
+import (
+	"encoding/json"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+func TestAccessClaimsMarshalJSON(t *testing.T) {
+	tests := []struct {
+		name  string
+		roles Roles
+		claim string // Where the roles should be; "" for nowhere
+		want  []any
+	}{
+		{"couchdb default", Roles{Claim: "_couchdb.roles", Names: []string{"editor", "family"}}, "_couchdb.roles", []any{"editor", "family"}},
+		{"custom claim", Roles{Claim: "groups", Names: []string{"editor"}}, "groups", []any{"editor"}},
+		{"no roles", Roles{Claim: "_couchdb.roles"}, "_couchdb.roles", []any{}},
+		{"no claim", Roles{Names: []string{"editor"}}, "", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := AccessClaims{RegisteredClaims: jwt.RegisteredClaims{Subject: "alice", ID: "j1"}, SessionID: "s1", Roles: tt.roles}
+			b, err := json.Marshal(c)
+			if err != nil {
+				t.Fatalf("MarshalJSON() error = %v", err)
+			}
+			var m map[string]any
+			if err := json.Unmarshal(b, &m); err != nil {
+				t.Fatal(err)
+			}
+			if m["sub"] != "alice" || m["jti"] != "j1" || m["sid"] != "s1" {
+				t.Errorf("MarshalJSON() = %s, want sub, jti and sid kept", b)
+			}
+			for _, k := range []string{"_couchdb.roles", "groups", "Roles"} {
+				if _, ok := m[k]; ok && k != tt.claim {
+					t.Errorf("MarshalJSON() = %s, has %q", b, k)
+				}
+			}
+			if tt.claim == "" {
+				return
+			}
+			got, ok := m[tt.claim].([]any)
+			if !ok || !slices.Equal(got, tt.want) {
+				t.Errorf("MarshalJSON() %s = %v, want %v", tt.claim, m[tt.claim], tt.want)
+			}
+		})
+	}
+}
+
+// TestRefreshAndMFATokensDistinct checks that neither an MFA token nor a refresh token,
+// both signed with the refresh key, passes for the other.
+func TestRefreshAndMFATokensDistinct(t *testing.T) {
+	key := HMACKey("k1", "refresh-secret")
+	mfa, err := MintMFAToken("alice", "", false, key, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	refresh, err := MintRefreshToken("alice", key, time.Now(), time.Now().Add(time.Hour), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := ParseRefreshToken(refresh, key); err != nil {
+		t.Errorf("ParseRefreshToken(refresh token) error = %v", err)
+	}
+	if _, err := ParseMFAToken(mfa, key); err != nil {
+		t.Errorf("ParseMFAToken(MFA token) error = %v", err)
+	}
+	if claims, err := ParseRefreshToken(mfa, key); err == nil {
+		t.Errorf("ParseRefreshToken(MFA token) = %+v, want an error", claims)
+	}
+	if username, err := ValidateRefreshToken(mfa, key); err == nil {
+		t.Errorf("ValidateRefreshToken(MFA token) = %q, want an error", username)
+	}
+	if claims, err := ParseMFAToken(refresh, key); err == nil {
+		t.Errorf("ParseMFAToken(refresh token) = %+v, want an error", claims)
+	}
+}
@@ -0,0 +1,249 @@
+package auth
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"time"
+)
+
+// Keyring holds the access-token keys: one active key that signs new tokens and any number
+// of older keys that are still accepted until they are retired. Validation picks the key by
+// the token's kid header, so rotating the active key does not invalidate existing sessions.
+//
+// The keyring is persisted as JSON (jwt-keys.json in PAPAYA_CONFIG_DIR, written by
+// `papaya keys rotate`). Without that file it holds only the key from configuration
+// (PAPAYA_AUTH_TOKEN_SECRET or the signing key file).
+// A Keyring is safe for concurrent use.
+type Keyring struct {
+	mu       sync.RWMutex
+	keys     []ringKey
+	active   string
+	retired  []string // Kids retired from configuration, so the fallback is not added back
+	path     string
+	fallback *SigningKey
+}
+
+type ringKey struct {
+	key       *SigningKey
+	createdAt time.Time
+}
+
+// keyringJSON is the on-disk form of a Keyring.
+type keyringJSON struct {
+	Active  string         `json:"active"`
+	Keys    []keyringEntry `json:"keys"`
+	Retired []string       `json:"retired,omitempty"`
+}
+
+type keyringEntry struct {
+	Kid        string    `json:"kid"`
+	Secret     string    `json:"secret,omitempty"`      // HMAC secret, base64
+	PrivateKey string    `json:"private_key,omitempty"` // PKCS#8 PEM
+	CreatedAt  time.Time `json:"created_at"`
+}
+
+// LoadKeyring reads the keyring at path. fallback is the key from configuration: it is the
+// only (and active) key when path does not exist, and stays accepted for validation when the
+// file does not list its kid, so moving from a single secret to a keyring logs nobody out.
+func LoadKeyring(path string, fallback *SigningKey) (*Keyring, error) {
+	r := &Keyring{path: path, fallback: fallback}
+	if err := r.Reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Reload re-reads the keyring file (e.g. after `papaya keys rotate` and SIGHUP).
+// On error the current keys are kept.
+func (r *Keyring) Reload() error {
+	f, keys, err := readKeyring(r.path)
+	if err != nil {
+		return err
+	}
+	active := f.Active
+	if r.fallback != nil && findKey(keys, r.fallback.Kid) < 0 && !slices.Contains(f.Retired, r.fallback.Kid) {
+		keys = append(keys, ringKey{key: r.fallback})
+		if active == "" {
+			active = r.fallback.Kid
+		}
+	}
+	if findKey(keys, active) < 0 {
+		return fmt.Errorf("%s: active key %q is not in the keyring", r.path, active)
+	}
+	r.mu.Lock()
+	r.keys, r.active, r.retired = keys, active, f.Retired
+	r.mu.Unlock()
+	return nil
+}
+
+func readKeyring(path string) (f keyringJSON, keys []ringKey, err error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return f, nil, nil
+	}
+	if err != nil {
+		return f, nil, err
+	}
+	if err := json.Unmarshal(data, &f); err != nil {
+		return f, nil, fmt.Errorf("%s: %w", path, err)
+	}
+	for _, e := range f.Keys {
+		var k *SigningKey
+		switch {
+		case e.PrivateKey != "":
+			k, err = ParsePrivateKeyPEM(e.Kid, []byte(e.PrivateKey))
+		case e.Secret != "":
+			var secret []byte
+			secret, err = base64.StdEncoding.DecodeString(e.Secret)
+			k = HMACKey(e.Kid, string(secret))
+		default:
+			err = errors.New("no secret or private_key")
+		}
+		if err != nil {
+			return f, nil, fmt.Errorf("%s: key %q: %w", path, e.Kid, err)
+		}
+		if findKey(keys, e.Kid) >= 0 {
+			return f, nil, fmt.Errorf("%s: duplicate key %q", path, e.Kid)
+		}
+		keys = append(keys, ringKey{key: k, createdAt: e.CreatedAt})
+	}
+	return f, keys, nil
+}
+
+// Save writes the keyring file (mode 0600) atomically.
+func (r *Keyring) Save() error {
+	r.mu.RLock()
+	f := keyringJSON{Active: r.active, Retired: r.retired}
+	for _, rk := range r.keys {
+		e := keyringEntry{Kid: rk.key.Kid, CreatedAt: rk.createdAt}
+		if secret, ok := rk.key.sign.([]byte); ok {
+			e.Secret = base64.StdEncoding.EncodeToString(secret)
+		} else {
+			pemBytes, err := rk.key.PrivateKeyPEM()
+			if err != nil {
+				r.mu.RUnlock()
+				return err
+			}
+			e.PrivateKey = string(pemBytes)
+		}
+		f.Keys = append(f.Keys, e)
+	}
+	r.mu.RUnlock()
+
+	data, err := json.MarshalIndent(f, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(r.path), ".jwt-keys-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(append(data, '\n')); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), r.path)
+}
+
+// Active returns the key new access tokens are signed with.
+func (r *Keyring) Active() *SigningKey {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.keys[findKey(r.keys, r.active)].key
+}
+
+// Keys returns all keys accepted for validation, oldest first.
+func (r *Keyring) Keys() []*SigningKey {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	out := make([]*SigningKey, len(r.keys))
+	for i, rk := range r.keys {
+		out[i] = rk.key
+	}
+	return out
+}
+
+// VerificationKey implements KeySet. A token without a kid is checked against the active key.
+func (r *Keyring) VerificationKey(kid string) (*SigningKey, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if kid == "" {
+		kid = r.active
+	}
+	i := findKey(r.keys, kid)
+	if i < 0 {
+		return nil, fmt.Errorf("%w %q", ErrUnknownKey, kid)
+	}
+	return r.keys[i].key, nil
+}
+
+// Rotate adds k and makes it the active key.
+func (r *Keyring) Rotate(k *SigningKey) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if findKey(r.keys, k.Kid) >= 0 {
+		return fmt.Errorf("key %q already exists", k.Kid)
+	}
+	r.keys = append(r.keys, ringKey{key: k, createdAt: time.Now().UTC()})
+	r.active = k.Kid
+	return nil
+}
+
+// Retire removes a key so tokens signed with it are no longer accepted. The active key
+// cannot be retired. It returns the removed key.
+func (r *Keyring) Retire(kid string) (*SigningKey, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	i := findKey(r.keys, kid)
+	if i < 0 {
+		return nil, fmt.Errorf("%w %q", ErrUnknownKey, kid)
+	}
+	if kid == r.active {
+		return nil, fmt.Errorf("key %q is active; rotate to a new key first", kid)
+	}
+	k := r.keys[i].key
+	r.keys = slices.Delete(r.keys, i, i+1)
+	if r.fallback != nil && r.fallback.Kid == kid {
+		r.retired = append(r.retired, kid) // Do not bring it back on Reload
+	}
+	return k, nil
+}
+
+// IsActive reports whether kid is the active key.
+func (r *Keyring) IsActive(kid string) bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.active == kid
+}
+
+func findKey(keys []ringKey, kid string) int {
+	for i, rk := range keys {
+		if rk.key.Kid == kid {
+			return i
+		}
+	}
+	return -1
+}
+
+// GenerateHMACKey returns an HS256 key with a random 256-bit secret.
+func GenerateHMACKey(kid string) (*SigningKey, error) {
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return nil, err
+	}
+	return HMACKey(kid, string(secret)), nil
+}
@@ -0,0 +1,233 @@
+package auth
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// kids returns the kids of the keys r accepts, oldest first.
+func kids(r *Keyring) []string {
+	var out []string
+	for _, k := range r.Keys() {
+		out = append(out, k.Kid)
+	}
+	return out
+}
+
+// mint returns an access token for alice signed with key.
+func mint(t *testing.T, key *SigningKey) string {
+	t.Helper()
+	token, _, err := MintAccessToken("alice", "", time.Time{}, Roles{}, key, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
+
+// kidHeader returns the kid header of token.
+func kidHeader(t *testing.T, token string) string {
+	t.Helper()
+	parsed, _, err := jwt.NewParser().ParseUnverified(token, &AccessClaims{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	kid, _ := parsed.Header["kid"].(string)
+	return kid
+}
+
+func TestKeyringWithoutFile(t *testing.T) {
+	fallback := HMACKey("k1", "secret")
+	r, err := LoadKeyring(filepath.Join(t.TempDir(), "jwt-keys.json"), fallback)
+	if err != nil {
+		t.Fatalf("LoadKeyring() error = %v", err)
+	}
+	if r.Active() != fallback || !slices.Equal(kids(r), []string{"k1"}) {
+		t.Errorf("LoadKeyring() = active %q, keys %v; want only the configured key", r.Active().Kid, kids(r))
+	}
+	roundTrip(t, r.Active(), r)
+}
+
+// TestKeyringRotate rotates twice, with a key pair and an HMAC key, and checks that
+// tokens signed with every earlier key stay valid, also after the keyring is saved and
+// read back.
+func TestKeyringRotate(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "jwt-keys.json")
+	fallback := HMACKey("k1", "secret")
+	r, err := LoadKeyring(path, fallback)
+	if err != nil {
+		t.Fatal(err)
+	}
+	old := mint(t, r.Active())
+
+	ecKey, _, err := GenerateKey("k2", "ec")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Rotate(ecKey); err != nil {
+		t.Fatalf("Rotate() error = %v", err)
+	}
+	hmacKey, err := GenerateHMACKey("k3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Rotate(hmacKey); err != nil {
+		t.Fatalf("Rotate() error = %v", err)
+	}
+	if err := r.Rotate(HMACKey("k2", "other")); err == nil {
+		t.Error("Rotate() to an existing kid succeeded, want an error")
+	}
+	if r.Active().Kid != "k3" || !r.IsActive("k3") || r.IsActive("k1") {
+		t.Errorf("after Rotate() active = %q, want k3", r.Active().Kid)
+	}
+	if err := r.Save(); err != nil {
+		t.Fatalf("Save() error = %v", err)
+	}
+	if info, err := os.Stat(path); err != nil || info.Mode().Perm() != 0o600 {
+		t.Errorf("Save() wrote %v, %v; want mode 0600", info, err)
+	}
+
+	loaded, err := LoadKeyring(path, fallback)
+	if err != nil {
+		t.Fatalf("LoadKeyring() error = %v", err)
+	}
+	if loaded.Active().Kid != "k3" || !slices.Equal(kids(loaded), []string{"k1", "k2", "k3"}) {
+		t.Errorf("LoadKeyring() = active %q, keys %v; want k3 of k1, k2, k3", loaded.Active().Kid, kids(loaded))
+	}
+	for _, token := range []string{old, mint(t, ecKey), mint(t, hmacKey)} {
+		if _, err := ValidateAccessToken(token, loaded); err != nil {
+			t.Errorf("ValidateAccessToken() after reload error = %v", err)
+		}
+	}
+	// New tokens name the active key, so CouchDB can pick it from [jwt_keys].
+	if kid := kidHeader(t, mint(t, loaded.Active())); kid != "k3" {
+		t.Errorf("new token kid = %q, want k3", kid)
+	}
+}
+
+func TestKeyringRetire(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "jwt-keys.json")
+	fallback := HMACKey("k1", "secret")
+	r, err := LoadKeyring(path, fallback)
+	if err != nil {
+		t.Fatal(err)
+	}
+	old := mint(t, fallback)
+	next, err := GenerateHMACKey("k2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Rotate(next); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := r.Retire("k2"); err == nil {
+		t.Error("Retire() of the active key succeeded, want an error")
+	}
+	if _, err := r.Retire("k9"); !errors.Is(err, ErrUnknownKey) {
+		t.Errorf("Retire() of an unknown key error = %v, want ErrUnknownKey", err)
+	}
+	// Tokens signed with a key still in the keyring pass until it is retired.
+	if _, err := ValidateAccessToken(old, r); err != nil {
+		t.Errorf("ValidateAccessToken() with the previous key error = %v", err)
+	}
+	if k, err := r.Retire("k1"); err != nil || k != fallback {
+		t.Fatalf("Retire(k1) = %v, %v; want the configured key", k, err)
+	}
+	if _, err := ValidateAccessToken(old, r); !errors.Is(err, ErrUnknownKey) {
+		t.Errorf("ValidateAccessToken() with a retired key error = %v, want ErrUnknownKey", err)
+	}
+
+	// The configured key is still in configuration, but must not come back on reload.
+	if err := r.Save(); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Reload(); err != nil {
+		t.Fatalf("Reload() error = %v", err)
+	}
+	loaded, err := LoadKeyring(path, fallback)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, ring := range []*Keyring{r, loaded} {
+		if !slices.Equal(kids(ring), []string{"k2"}) {
+			t.Errorf("keys after retiring k1 and reloading = %v, want [k2]", kids(ring))
+		}
+		if _, err := ValidateAccessToken(old, ring); err == nil {
+			t.Error("ValidateAccessToken() with a retired key succeeded after reload")
+		}
+	}
+}
+
+// TestKeyringKeepsConfiguredKey checks that moving from a single secret to a keyring whose
+// file does not list that secret's kid logs nobody out: the configured key stays accepted.
+func TestKeyringKeepsConfiguredKey(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "jwt-keys.json")
+	other, err := LoadKeyring(path, HMACKey("k2", "other"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := other.Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	fallback := HMACKey("k1", "secret")
+	r, err := LoadKeyring(path, fallback)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Active().Kid != "k2" || !slices.Equal(kids(r), []string{"k2", "k1"}) {
+		t.Errorf("LoadKeyring() = active %q, keys %v; want k2 of k2, k1", r.Active().Kid, kids(r))
+	}
+	if _, err := ValidateAccessToken(mint(t, fallback), r); err != nil {
+		t.Errorf("ValidateAccessToken() with the configured key error = %v", err)
+	}
+}
+
+func TestKeyringReloadErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		data    string
+		wantErr string
+	}{
+		{"not JSON", "{", "unexpected end"},
+		{"active key missing", `{"active": "k9", "keys": [{"kid": "k2", "secret": "c2VjcmV0"}]}`, `active key "k9" is not in the keyring`},
+		{"duplicate key", `{"active": "k2", "keys": [{"kid": "k2", "secret": "c2VjcmV0"}, {"kid": "k2", "secret": "c2VjcmV0"}]}`, `duplicate key "k2"`},
+		{"empty key", `{"active": "k2", "keys": [{"kid": "k2"}]}`, "no secret or private_key"},
+		{"bad secret", `{"active": "k2", "keys": [{"kid": "k2", "secret": "%%"}]}`, `key "k2"`},
+		{"bad private key", `{"active": "k2", "keys": [{"kid": "k2", "private_key": "secret"}]}`, "no PEM block"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "jwt-keys.json")
+			if err := os.WriteFile(path, []byte(tt.data), 0o600); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := LoadKeyring(path, HMACKey("k1", "secret")); err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("LoadKeyring() error = %v, want one mentioning %q", err, tt.wantErr)
+			}
+		})
+	}
+
+	// A bad file on reload keeps the keys already loaded.
+	path := filepath.Join(t.TempDir(), "jwt-keys.json")
+	r, err := LoadKeyring(path, HMACKey("k1", "secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, []byte("{"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Reload(); err == nil {
+		t.Error("Reload() of a corrupt file succeeded")
+	}
+	if r.Active().Kid != "k1" || !slices.Equal(kids(r), []string{"k1"}) {
+		t.Errorf("after a failed Reload() keys = %v, want [k1]", kids(r))
+	}
+}
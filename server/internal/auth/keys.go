@@ -0,0 +1,279 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"strings"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// SigningKey signs and verifies JWTs under one key ID (the "kid" header).
+// It is either an HMAC secret (HS256) or an asymmetric private key (RS256, ES256/384/512, EdDSA).
+type SigningKey struct {
+	Kid    string
+	Method jwt.SigningMethod
+	sign   any // []byte for HMAC, otherwise the private key
+	verify any // []byte for HMAC, otherwise the public key
+}
+
+// KeySet finds the key that verifies a token with the given kid header (possibly empty).
+type KeySet interface {
+	VerificationKey(kid string) (*SigningKey, error)
+}
+
+var ErrUnknownKey = errors.New("unknown signing key")
+
+// HMACKey returns an HS256 key for secret.
+func HMACKey(kid, secret string) *SigningKey {
+	return &SigningKey{Kid: kid, Method: jwt.SigningMethodHS256, sign: []byte(secret), verify: []byte(secret)}
+}
+
+// NewKey wraps an RSA, ECDSA (P-256/384/521) or Ed25519 private key; the JWT algorithm
+// follows from the key type.
+func NewKey(kid string, priv crypto.Signer) (*SigningKey, error) {
+	k := &SigningKey{Kid: kid, sign: priv, verify: priv.Public()}
+	switch p := priv.(type) {
+	case *rsa.PrivateKey:
+		if p.N.BitLen() < 2048 {
+			return nil, fmt.Errorf("RSA key is %d bits; use at least 2048", p.N.BitLen())
+		}
+		k.Method = jwt.SigningMethodRS256
+	case *ecdsa.PrivateKey:
+		switch p.Curve {
+		case elliptic.P256():
+			k.Method = jwt.SigningMethodES256
+		case elliptic.P384():
+			k.Method = jwt.SigningMethodES384
+		case elliptic.P521():
+			k.Method = jwt.SigningMethodES512
+		default:
+			return nil, errors.New("unsupported EC curve; use P-256, P-384 or P-521")
+		}
+	case ed25519.PrivateKey:
+		k.Method = jwt.SigningMethodEdDSA
+	default:
+		return nil, fmt.Errorf("unsupported private key type %T", priv)
+	}
+	return k, nil
+}
+
+// ParsePrivateKeyPEM parses a PEM private key in PKCS#8, PKCS#1 (RSA) or SEC 1 (EC) form.
+func ParsePrivateKeyPEM(kid string, data []byte) (*SigningKey, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("no PEM block found")
+	}
+	var priv any
+	var err error
+	switch block.Type {
+	case "PRIVATE KEY":
+		priv, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	case "RSA PRIVATE KEY":
+		priv, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "EC PRIVATE KEY":
+		priv, err = x509.ParseECPrivateKey(block.Bytes)
+	default:
+		return nil, fmt.Errorf("unsupported PEM block %q; expected a private key", block.Type)
+	}
+	if err != nil {
+		return nil, err
+	}
+	signer, ok := priv.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("unsupported private key type %T", priv)
+	}
+	return NewKey(kid, signer)
+}
+
+// LoadPrivateKeyFile reads a PEM private key file (see ParsePrivateKeyPEM).
+func LoadPrivateKeyFile(kid, path string) (*SigningKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	k, err := ParsePrivateKeyPEM(kid, data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return k, nil
+}
+
+// GenerateKey creates a new private key of the given type ("rsa", "ec" or "ed25519") and
+// returns it with its PKCS#8 PEM encoding.
+func GenerateKey(kid, keyType string) (*SigningKey, []byte, error) {
+	var priv crypto.Signer
+	var err error
+	switch keyType {
+	case "rsa":
+		priv, err = rsa.GenerateKey(rand.Reader, 2048)
+	case "ec":
+		priv, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	case "ed25519":
+		_, priv, err = ed25519.GenerateKey(rand.Reader)
+	default:
+		return nil, nil, fmt.Errorf("unknown key type %q; use rsa, ec or ed25519", keyType)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	k, err := NewKey(kid, priv)
+	if err != nil {
+		return nil, nil, err
+	}
+	pemBytes, err := k.PrivateKeyPEM()
+	if err != nil {
+		return nil, nil, err
+	}
+	return k, pemBytes, nil
+}
+
+// PrivateKeyPEM returns the private key in PKCS#8 PEM form. HMAC keys return an error.
+func (k *SigningKey) PrivateKeyPEM() ([]byte, error) {
+	if k.IsHMAC() {
+		return nil, errors.New("HMAC keys have no private key")
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(k.sign)
+	if err != nil {
+		return nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), nil
+}
+
+// NewAccessKey returns the key access tokens are signed with: the private key in
+// privateKeyFile when set, otherwise an HMAC key for secret.
+func NewAccessKey(kid, secret, privateKeyFile string) (*SigningKey, error) {
+	if privateKeyFile != "" {
+		return LoadPrivateKeyFile(kid, privateKeyFile)
+	}
+	return HMACKey(kid, secret), nil
+}
+
+// IsHMAC reports whether k is a shared secret rather than a key pair.
+func (k *SigningKey) IsHMAC() bool {
+	_, ok := k.sign.([]byte)
+	return ok
+}
+
+// VerificationKey implements KeySet for a single key: it matches its own kid or an empty one.
+func (k *SigningKey) VerificationKey(kid string) (*SigningKey, error) {
+	if kid != "" && kid != k.Kid {
+		return nil, fmt.Errorf("%w %q", ErrUnknownKey, kid)
+	}
+	return k, nil
+}
+
+// keyFunc returns a jwt.Keyfunc that picks the key by kid and rejects tokens whose alg
+// differs from that key's (no alg confusion between HMAC and public keys).
+func keyFunc(keys KeySet) jwt.Keyfunc {
+	return func(t *jwt.Token) (interface{}, error) {
+		kid, _ := t.Header["kid"].(string)
+		k, err := keys.VerificationKey(kid)
+		if err != nil {
+			return nil, err
+		}
+		if t.Method.Alg() != k.Method.Alg() {
+			return nil, fmt.Errorf("unexpected signing method %s", t.Method.Alg())
+		}
+		return k.verify, nil
+	}
+}
+
+// CouchDBEntry returns the line for CouchDB's [jwt_keys] section that lets it verify tokens
+// signed with k, e.g. "rsa:papaya_rsa = -----BEGIN PUBLIC KEY-----\n...". CouchDB has no
+// EdDSA support, so Ed25519 keys return an error.
+func (k *SigningKey) CouchDBEntry() (string, error) {
+	kid := k.Kid
+	if kid == "" {
+		kid = "_default"
+	}
+	if secret, ok := k.sign.([]byte); ok {
+		return fmt.Sprintf("hmac:%s = %s", kid, base64.StdEncoding.EncodeToString(secret)), nil
+	}
+	var prefix string
+	switch k.verify.(type) {
+	case *rsa.PublicKey:
+		prefix = "rsa"
+	case *ecdsa.PublicKey:
+		prefix = "ec"
+	default:
+		return "", fmt.Errorf("CouchDB cannot verify %s tokens; use an rsa or ec key", k.Method.Alg())
+	}
+	der, err := x509.MarshalPKIXPublicKey(k.verify)
+	if err != nil {
+		return "", err
+	}
+	pemText := string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}))
+	return fmt.Sprintf("%s:%s = %s", prefix, kid, strings.ReplaceAll(pemText, "\n", `\n`)), nil
+}
+
+// JWK is a public key in JSON Web Key form (RFC 7517).
+type JWK struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid,omitempty"`
+	Alg string `json:"alg"`
+	Use string `json:"use"`
+	N   string `json:"n,omitempty"`
+	E   string `json:"e,omitempty"`
+	Crv string `json:"crv,omitempty"`
+	X   string `json:"x,omitempty"`
+	Y   string `json:"y,omitempty"`
+}
+
+// JWKS is a JSON Web Key Set, as served at /api/.well-known/jwks.json.
+type JWKS struct {
+	Keys []JWK `json:"keys"`
+}
+
+// PublicJWKS returns the public halves of keys. HMAC keys are secret and are left out.
+func PublicJWKS(keys ...*SigningKey) JWKS {
+	set := JWKS{Keys: []JWK{}}
+	for _, k := range keys {
+		if jwk, ok := k.JWK(); ok {
+			set.Keys = append(set.Keys, jwk)
+		}
+	}
+	return set
+}
+
+// JWK returns the public key as a JWK; ok is false for HMAC keys.
+func (k *SigningKey) JWK() (jwk JWK, ok bool) {
+	b64 := base64.RawURLEncoding.EncodeToString
+	jwk = JWK{Kid: k.Kid, Alg: k.Method.Alg(), Use: "sig"}
+	switch pub := k.verify.(type) {
+	case *rsa.PublicKey:
+		jwk.Kty = "RSA"
+		jwk.N = b64(pub.N.Bytes())
+		jwk.E = b64(big.NewInt(int64(pub.E)).Bytes())
+	case *ecdsa.PublicKey:
+		ecdh, err := pub.ECDH()
+		if err != nil {
+			return JWK{}, false
+		}
+		// Uncompressed point: 0x04 || X || Y, each padded to the curve size.
+		point := ecdh.Bytes()[1:]
+		size := len(point) / 2
+		jwk.Kty = "EC"
+		jwk.Crv = pub.Curve.Params().Name
+		jwk.X = b64(point[:size])
+		jwk.Y = b64(point[size:])
+	case ed25519.PublicKey:
+		jwk.Kty = "OKP"
+		jwk.Crv = "Ed25519"
+		jwk.X = b64(pub)
+	default:
+		return JWK{}, false
+	}
+	return jwk, true
+}
@@ -0,0 +1,337 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// pemKey encodes priv as a PEM block of the given type: "PRIVATE KEY" (PKCS#8),
+// "RSA PRIVATE KEY" (PKCS#1) or "EC PRIVATE KEY" (SEC 1).
+func pemKey(t *testing.T, blockType string, priv crypto.Signer) []byte {
+	t.Helper()
+	var der []byte
+	var err error
+	switch blockType {
+	case "PRIVATE KEY":
+		der, err = x509.MarshalPKCS8PrivateKey(priv)
+	case "RSA PRIVATE KEY":
+		der = x509.MarshalPKCS1PrivateKey(priv.(*rsa.PrivateKey))
+	case "EC PRIVATE KEY":
+		der, err = x509.MarshalECPrivateKey(priv.(*ecdsa.PrivateKey))
+	default:
+		t.Fatalf("unknown block type %q", blockType)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der})
+}
+
+func mustSigner(t *testing.T) func(crypto.Signer, error) crypto.Signer {
+	return func(s crypto.Signer, err error) crypto.Signer {
+		t.Helper()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return s
+	}
+}
+
+// roundTrip mints an access token with key and checks that verify accepts it.
+func roundTrip(t *testing.T, key *SigningKey, verify KeySet) {
+	t.Helper()
+	token, _, err := MintAccessToken("alice", "", time.Time{}, Roles{}, key, time.Minute)
+	if err != nil {
+		t.Fatalf("MintAccessToken() error = %v", err)
+	}
+	if username, err := ValidateAccessToken(token, verify); err != nil || username != "alice" {
+		t.Errorf("ValidateAccessToken() = %q, %v; want alice", username, err)
+	}
+}
+
+func TestParsePrivateKeyPEM(t *testing.T) {
+	must := mustSigner(t)
+	rsaKey := must(rsa.GenerateKey(rand.Reader, 2048))
+	p256 := must(ecdsa.GenerateKey(elliptic.P256(), rand.Reader))
+	p384 := must(ecdsa.GenerateKey(elliptic.P384(), rand.Reader))
+	p521 := must(ecdsa.GenerateKey(elliptic.P521(), rand.Reader))
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		pem  []byte
+		alg  string
+	}{
+		{"RSA PKCS#8", pemKey(t, "PRIVATE KEY", rsaKey), "RS256"},
+		{"RSA PKCS#1", pemKey(t, "RSA PRIVATE KEY", rsaKey), "RS256"},
+		{"P-256 PKCS#8", pemKey(t, "PRIVATE KEY", p256), "ES256"},
+		{"P-256 SEC 1", pemKey(t, "EC PRIVATE KEY", p256), "ES256"},
+		{"P-384", pemKey(t, "EC PRIVATE KEY", p384), "ES384"},
+		{"P-521", pemKey(t, "PRIVATE KEY", p521), "ES512"},
+		{"Ed25519", pemKey(t, "PRIVATE KEY", edKey), "EdDSA"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			k, err := ParsePrivateKeyPEM("k1", tt.pem)
+			if err != nil {
+				t.Fatalf("ParsePrivateKeyPEM() error = %v", err)
+			}
+			if k.Kid != "k1" || k.Method.Alg() != tt.alg || k.IsHMAC() {
+				t.Errorf("ParsePrivateKeyPEM() = kid %q, alg %s, HMAC %v; want k1, %s, key pair", k.Kid, k.Method.Alg(), k.IsHMAC(), tt.alg)
+			}
+			roundTrip(t, k, k)
+			// The PKCS#8 form written to the keyring parses back to the same key.
+			out, err := k.PrivateKeyPEM()
+			if err != nil {
+				t.Fatalf("PrivateKeyPEM() error = %v", err)
+			}
+			again, err := ParsePrivateKeyPEM("k1", out)
+			if err != nil {
+				t.Fatalf("ParsePrivateKeyPEM(PrivateKeyPEM()) error = %v", err)
+			}
+			roundTrip(t, k, again)
+		})
+	}
+}
+
+func TestParsePrivateKeyPEMErrors(t *testing.T) {
+	must := mustSigner(t)
+	smallRSA := must(rsa.GenerateKey(rand.Reader, 1024))
+	p224 := must(ecdsa.GenerateKey(elliptic.P224(), rand.Reader))
+	pub, err := x509.MarshalPKIXPublicKey(smallRSA.Public())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		pem     []byte
+		wantErr string
+	}{
+		{"not PEM", []byte("secret"), "no PEM block"},
+		{"public key", pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: pub}), `unsupported PEM block "PUBLIC KEY"`},
+		{"corrupt", pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: []byte("garbage")}), "asn1"},
+		{"short RSA key", pemKey(t, "RSA PRIVATE KEY", smallRSA), "1024 bits"},
+		{"P-224", pemKey(t, "EC PRIVATE KEY", p224), "unsupported EC curve"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := ParsePrivateKeyPEM("k1", tt.pem); err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("ParsePrivateKeyPEM() error = %v, want one mentioning %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestNewAccessKey(t *testing.T) {
+	k, err := NewAccessKey("k1", "secret", "")
+	if err != nil || !k.IsHMAC() || k.Method.Alg() != "HS256" {
+		t.Fatalf("NewAccessKey() without a key file = %+v, %v; want an HS256 key", k, err)
+	}
+	roundTrip(t, k, HMACKey("k1", "secret"))
+
+	_, pemBytes, err := GenerateKey("k1", "ec")
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "key.pem")
+	if err := os.WriteFile(path, pemBytes, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if k, err = NewAccessKey("k1", "secret", path); err != nil || k.Method.Alg() != "ES256" {
+		t.Fatalf("NewAccessKey() with a key file = %+v, %v; want the file's ES256 key", k, err)
+	}
+
+	if _, err := NewAccessKey("k1", "secret", filepath.Join(t.TempDir(), "missing.pem")); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("NewAccessKey() with a missing key file error = %v, want ErrNotExist", err)
+	}
+	bad := filepath.Join(t.TempDir(), "bad.pem")
+	if err := os.WriteFile(bad, []byte("secret"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewAccessKey("k1", "secret", bad); err == nil || !strings.HasPrefix(err.Error(), bad+":") {
+		t.Errorf("NewAccessKey() with a bad key file error = %v, want it to name the file", err)
+	}
+}
+
+func TestGenerateKey(t *testing.T) {
+	for keyType, alg := range map[string]string{"rsa": "RS256", "ec": "ES256", "ed25519": "EdDSA"} {
+		t.Run(keyType, func(t *testing.T) {
+			k, pemBytes, err := GenerateKey("k1", keyType)
+			if err != nil {
+				t.Fatalf("GenerateKey() error = %v", err)
+			}
+			if k.Method.Alg() != alg {
+				t.Errorf("GenerateKey() alg = %s, want %s", k.Method.Alg(), alg)
+			}
+			parsed, err := ParsePrivateKeyPEM("k1", pemBytes)
+			if err != nil {
+				t.Fatalf("ParsePrivateKeyPEM() error = %v", err)
+			}
+			roundTrip(t, k, parsed)
+		})
+	}
+	if _, _, err := GenerateKey("k1", "dsa"); err == nil {
+		t.Error("GenerateKey(dsa) succeeded, want an error")
+	}
+}
+
+// TestAlgorithmConfusion checks that a token is only verified with the algorithm of the
+// key its kid names: an HS256 token "signed" with an RSA public key must not pass.
+func TestAlgorithmConfusion(t *testing.T) {
+	rsaKey, _, err := GenerateKey("rsa1", "rsa")
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalPKIXPublicKey(rsaKey.verify)
+	if err != nil {
+		t.Fatal(err)
+	}
+	forged := HMACKey("rsa1", string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})))
+	token, _, err := MintAccessToken("mallory", "", time.Time{}, Roles{}, forged, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ValidateAccessToken(token, rsaKey); err == nil {
+		t.Error("ValidateAccessToken() accepted an HS256 token for an RS256 key")
+	}
+
+	// Nor the other way round, with the same kid.
+	other, _, err := GenerateKey("k1", "ec")
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, _, err = MintAccessToken("mallory", "", time.Time{}, Roles{}, other, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ValidateAccessToken(token, HMACKey("k1", "secret")); err == nil {
+		t.Error("ValidateAccessToken() accepted an ES256 token for an HS256 key")
+	}
+}
+
+func TestPublicJWKS(t *testing.T) {
+	rsaKey, _, err := GenerateKey("rsa1", "rsa")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, _, err := GenerateKey("ec1", "ec")
+	if err != nil {
+		t.Fatal(err)
+	}
+	edKey, _, err := GenerateKey("ed1", "ed25519")
+	if err != nil {
+		t.Fatal(err)
+	}
+	set := PublicJWKS(HMACKey("hmac1", "secret"), rsaKey, ecKey, edKey)
+	if len(set.Keys) != 3 {
+		t.Fatalf("PublicJWKS() = %+v, want the three key pairs and no HMAC key", set)
+	}
+	b64 := func(s string) []byte {
+		t.Helper()
+		b, err := base64.RawURLEncoding.DecodeString(s)
+		if err != nil {
+			t.Fatalf("%q is not unpadded base64url: %v", s, err)
+		}
+		return b
+	}
+
+	rsaJWK := set.Keys[0]
+	pub := rsaKey.verify.(*rsa.PublicKey)
+	if rsaJWK.Kty != "RSA" || rsaJWK.Kid != "rsa1" || rsaJWK.Alg != "RS256" || rsaJWK.Use != "sig" ||
+		new(big.Int).SetBytes(b64(rsaJWK.N)).Cmp(pub.N) != 0 || new(big.Int).SetBytes(b64(rsaJWK.E)).Int64() != int64(pub.E) {
+		t.Errorf("RSA JWK = %+v, want kty RSA, kid rsa1, alg RS256, use sig and the key's n and e", rsaJWK)
+	}
+
+	ecJWK := set.Keys[1]
+	ecPub := ecKey.verify.(*ecdsa.PublicKey)
+	x, y := b64(ecJWK.X), b64(ecJWK.Y)
+	if ecJWK.Kty != "EC" || ecJWK.Crv != "P-256" || ecJWK.Alg != "ES256" || len(x) != 32 || len(y) != 32 ||
+		new(big.Int).SetBytes(x).Cmp(ecPub.X) != 0 || new(big.Int).SetBytes(y).Cmp(ecPub.Y) != 0 {
+		t.Errorf("EC JWK = %+v, want kty EC, crv P-256, alg ES256 and the key's 32-byte x and y", ecJWK)
+	}
+
+	edJWK := set.Keys[2]
+	if edJWK.Kty != "OKP" || edJWK.Crv != "Ed25519" || edJWK.Alg != "EdDSA" || string(b64(edJWK.X)) != string(edKey.verify.(ed25519.PublicKey)) {
+		t.Errorf("Ed25519 JWK = %+v, want kty OKP, crv Ed25519, alg EdDSA and the public key as x", edJWK)
+	}
+
+	b, err := json.Marshal(PublicJWKS(HMACKey("hmac1", "secret")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != `{"keys":[]}` {
+		t.Errorf("PublicJWKS(HMAC key) = %s, want an empty key list", b)
+	}
+}
+
+func TestCouchDBEntry(t *testing.T) {
+	rsaKey, _, err := GenerateKey("rsa1", "rsa")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, _, err := GenerateKey("ec1", "ec")
+	if err != nil {
+		t.Fatal(err)
+	}
+	edKey, _, err := GenerateKey("ed1", "ed25519")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		key     *SigningKey
+		prefix  string
+		wantErr bool
+	}{
+		{HMACKey("", "secret"), "hmac:_default = " + base64.StdEncoding.EncodeToString([]byte("secret")), false},
+		{HMACKey("h1", "secret"), "hmac:h1 = ", false},
+		{rsaKey, `rsa:rsa1 = -----BEGIN PUBLIC KEY-----\n`, false},
+		{ecKey, `ec:ec1 = -----BEGIN PUBLIC KEY-----\n`, false},
+		{edKey, "", true},
+	}
+	for _, tt := range tests {
+		got, err := tt.key.CouchDBEntry()
+		if (err != nil) != tt.wantErr || !strings.HasPrefix(got, tt.prefix) || strings.Contains(got, "\n") {
+			t.Errorf("CouchDBEntry() for %s %q = %q, %v; want prefix %q on one line", tt.key.Method.Alg(), tt.key.Kid, got, err, tt.prefix)
+		}
+	}
+}
+
+// TestUnknownKid checks that a token naming a kid the verifier does not know is refused.
+func TestUnknownKid(t *testing.T) {
+	token, _, err := MintAccessToken("alice", "", time.Time{}, Roles{}, HMACKey("k2", "secret"), time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ValidateAccessToken(token, HMACKey("k1", "secret")); !errors.Is(err, ErrUnknownKey) {
+		t.Errorf("ValidateAccessToken() error = %v, want ErrUnknownKey", err)
+	}
+	// A token without a kid is checked against the single key.
+	token, err = sign(AccessClaims{RegisteredClaims: jwt.RegisteredClaims{Subject: "alice", ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Minute))}}, HMACKey("", "secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ValidateAccessToken(token, HMACKey("k1", "secret")); err != nil {
+		t.Errorf("ValidateAccessToken() of a token without a kid error = %v", err)
+	}
+}
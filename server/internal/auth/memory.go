@@ -0,0 +1,536 @@
+package auth
+
+import (
+	"bytes"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+)
+
+// MemoryStore is a Store that keeps everything in memory, for tests and
+// throwaway setups: every session ends when the process exits.
+type MemoryStore struct {
+	mu       sync.Mutex
+	tokens   map[string]*memToken
+	sessions map[string]*Session
+	events   []memEvent
+	mfa      map[string]*memMFA
+	passkeys []WebAuthnCredential // Oldest first
+	failed   map[string]FailedLogins
+	pats     []PersonalAccessToken    // Oldest first
+	denied   map[memDenyKey]time.Time // → expiry
+}
+
+type memDenyKey struct{ kind, id string }
+
+type memMFA struct {
+	MFAEnrollment
+	codes map[string]bool // Recovery code hash → used
+}
+
+type memToken struct {
+	RefreshToken
+	usedAt, revokedAt time.Time // Zero while unused / not revoked
+	successorSealed   []byte
+}
+
+type memEvent struct {
+	at                               time.Time
+	kind, username, familyID, detail string
+}
+
+// NewMemoryStore returns an empty MemoryStore.
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		tokens:   make(map[string]*memToken),
+		sessions: make(map[string]*Session),
+		mfa:      make(map[string]*memMFA),
+		failed:   make(map[string]FailedLogins),
+		denied:   make(map[memDenyKey]time.Time),
+	}
+}
+
+// seconds truncates t to whole seconds, the precision the SQL stores keep, so that times
+// compare the same way in every store.
+func seconds(t time.Time) time.Time {
+	return t.Truncate(time.Second)
+}
+
+// Store implements SessionStore.
+func (s *MemoryStore) Store(t RefreshToken, sess Session) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.tokens[t.Hash]; ok {
+		return ErrDuplicateToken
+	}
+	now := seconds(time.Now())
+	t.ExpiresAt = seconds(t.ExpiresAt)
+	s.tokens[t.Hash] = &memToken{RefreshToken: t}
+	sess.ID, sess.Username = t.FamilyID, t.Username
+	sess.CreatedAt, sess.LastUsedAt = now, now
+	s.sessions[t.FamilyID] = &sess
+	return nil
+}
+
+// Rotate implements SessionStore.
+func (s *MemoryStore) Rotate(parentHash string, next RefreshToken, sealed []byte, grace time.Duration) (*RefreshToken, []byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := seconds(time.Now())
+	p, ok := s.tokens[parentHash]
+	if !ok {
+		return nil, nil, ErrTokenNotFound
+	}
+	parent := p.RefreshToken
+	if !p.ExpiresAt.After(now) {
+		return nil, nil, ErrTokenExpired
+	}
+	if !p.revokedAt.IsZero() {
+		return nil, nil, ErrTokenRevoked
+	}
+	if !p.usedAt.IsZero() {
+		if grace > 0 && p.successorSealed != nil && time.Since(p.usedAt) <= grace {
+			return &parent, p.successorSealed, nil
+		}
+		s.revokeFamily(p.FamilyID, now)
+		s.events = append(s.events, memEvent{now, EventTokenReuse, p.Username, p.FamilyID, "used refresh token presented again; family revoked"})
+		return &parent, nil, ErrTokenUsed
+	}
+	if _, ok := s.tokens[next.Hash]; ok {
+		return nil, nil, ErrDuplicateToken
+	}
+	p.usedAt, p.successorSealed = now, sealed
+	next.FamilyID, next.ParentHash, next.ExpiresAt = p.FamilyID, p.Hash, seconds(next.ExpiresAt)
+	s.tokens[next.Hash] = &memToken{RefreshToken: next}
+	return &parent, nil, nil
+}
+
+func (s *MemoryStore) revokeFamily(familyID string, now time.Time) {
+	for _, t := range s.tokens {
+		if t.FamilyID == familyID && t.revokedAt.IsZero() {
+			t.revokedAt = now
+		}
+	}
+}
+
+// Revoke implements SessionStore.
+func (s *MemoryStore) Revoke(tokenHash string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if t, ok := s.tokens[tokenHash]; ok {
+		s.revokeFamily(t.FamilyID, seconds(time.Now()))
+	}
+	return nil
+}
+
+// RevokeAllForUser implements SessionStore.
+func (s *MemoryStore) RevokeAllForUser(username string) ([]string, error) {
+	return s.revokeWhere(func(t *memToken) bool { return t.Username == username }), nil
+}
+
+// revokeWhere revokes the tokens matching match and returns the sessions they belong to.
+func (s *MemoryStore) revokeWhere(match func(*memToken) bool) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now, ids := seconds(time.Now()), []string{}
+	for _, t := range s.tokens {
+		if t.revokedAt.IsZero() && match(t) {
+			t.revokedAt = now
+			if !slices.Contains(ids, t.FamilyID) {
+				ids = append(ids, t.FamilyID)
+			}
+		}
+	}
+	return ids
+}
+
+// RecordEvent implements EventStore.
+func (s *MemoryStore) RecordEvent(kind, username, familyID, detail string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.events = append(s.events, memEvent{seconds(time.Now()), kind, username, familyID, detail})
+	return nil
+}
+
+// Sessions implements SessionStore.
+func (s *MemoryStore) Sessions(username string) ([]Session, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := seconds(time.Now())
+	sessions := []Session{}
+	for _, t := range s.tokens {
+		if t.Username != username || !t.usedAt.IsZero() || !t.revokedAt.IsZero() || !t.ExpiresAt.After(now) {
+			continue
+		}
+		sess := Session{ID: t.FamilyID, Username: username}
+		if stored, ok := s.sessions[t.FamilyID]; ok {
+			sess = *stored
+		}
+		sess.ExpiresAt = t.ExpiresAt
+		sessions = append(sessions, sess)
+	}
+	sort.Slice(sessions, func(i, j int) bool { return sessions[i].LastUsedAt.After(sessions[j].LastUsedAt) })
+	return sessions, nil
+}
+
+// Touch implements SessionStore.
+func (s *MemoryStore) Touch(sessionID, userAgent, ip string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if sess, ok := s.sessions[sessionID]; ok {
+		sess.LastUsedAt, sess.UserAgent, sess.IP = seconds(time.Now()), userAgent, ip
+	}
+	return nil
+}
+
+// RevokeSession implements SessionStore.
+func (s *MemoryStore) RevokeSession(username, sessionID string) error {
+	ids := s.revokeWhere(func(t *memToken) bool { return t.Username == username && t.FamilyID == sessionID })
+	if len(ids) == 0 {
+		return ErrSessionNotFound
+	}
+	return nil
+}
+
+// RevokeOtherSessions implements SessionStore.
+func (s *MemoryStore) RevokeOtherSessions(username, keepID string) ([]string, error) {
+	return s.revokeWhere(func(t *memToken) bool { return t.Username == username && t.FamilyID != keepID }), nil
+}
+
+// Prune implements Store.
+func (s *MemoryStore) Prune(cutoff time.Time) (PruneResult, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var r PruneResult
+	cutoff = seconds(cutoff)
+	spent := func(at time.Time) bool { return !at.IsZero() && at.Before(cutoff) }
+	families := make(map[string]bool)
+	for hash, t := range s.tokens {
+		if t.ExpiresAt.Before(cutoff) || spent(t.usedAt) || spent(t.revokedAt) {
+			delete(s.tokens, hash)
+			r.Tokens++
+		} else {
+			families[t.FamilyID] = true
+		}
+	}
+	for id := range s.sessions {
+		if !families[id] {
+			delete(s.sessions, id)
+			r.Sessions++
+		}
+	}
+	for key, f := range s.failed {
+		if f.LastAt.Before(cutoff) {
+			delete(s.failed, key)
+			r.FailedLogins++
+		}
+	}
+	n := len(s.pats)
+	s.pats = slices.DeleteFunc(s.pats, func(t PersonalAccessToken) bool { return t.ExpiresAt.Before(cutoff) })
+	r.PATs = int64(n - len(s.pats))
+	for k, exp := range s.denied {
+		if exp.Before(cutoff) {
+			delete(s.denied, k)
+			r.Denylist++
+		}
+	}
+	return r, nil
+}
+
+// MFA implements MFAStore.
+func (s *MemoryStore) MFA(username string) (*MFAEnrollment, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	m, ok := s.mfa[username]
+	if !ok {
+		return nil, ErrMFANotEnrolled
+	}
+	e := m.MFAEnrollment
+	e.RecoveryCodesLeft = 0
+	for _, used := range m.codes {
+		if !used {
+			e.RecoveryCodesLeft++
+		}
+	}
+	return &e, nil
+}
+
+// BeginMFA implements MFAStore.
+func (s *MemoryStore) BeginMFA(username string, sealedSecret []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if m, ok := s.mfa[username]; ok && m.Confirmed() {
+		return ErrMFAEnrolled
+	}
+	s.mfa[username] = &memMFA{MFAEnrollment: MFAEnrollment{Username: username, SealedSecret: sealedSecret}}
+	return nil
+}
+
+// ConfirmMFA implements MFAStore.
+func (s *MemoryStore) ConfirmMFA(username string, codeHashes []string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	m, ok := s.mfa[username]
+	if !ok {
+		return ErrMFANotEnrolled
+	}
+	if !m.Confirmed() {
+		m.ConfirmedAt = seconds(time.Now())
+	}
+	m.codes = make(map[string]bool, len(codeHashes))
+	for _, h := range codeHashes {
+		m.codes[h] = false
+	}
+	return nil
+}
+
+// UseTOTPStep implements MFAStore.
+func (s *MemoryStore) UseTOTPStep(username string, step int64) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	m, ok := s.mfa[username]
+	if !ok || m.LastStep >= step {
+		return false, nil
+	}
+	m.LastStep = step
+	return true, nil
+}
+
+// UseRecoveryCode implements MFAStore.
+func (s *MemoryStore) UseRecoveryCode(username, codeHash string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	m, ok := s.mfa[username]
+	if !ok {
+		return false, nil
+	}
+	if used, ok := m.codes[codeHash]; !ok || used {
+		return false, nil
+	}
+	m.codes[codeHash] = true
+	return true, nil
+}
+
+// DeleteMFA implements MFAStore.
+func (s *MemoryStore) DeleteMFA(username string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.mfa, username)
+	return nil
+}
+
+// AddWebAuthnCredential implements WebAuthnStore.
+func (s *MemoryStore) AddWebAuthnCredential(c WebAuthnCredential) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.findPasskey(c.ID) >= 0 {
+		return ErrDuplicateCredential
+	}
+	c.CreatedAt, c.LastUsedAt = seconds(time.Now()), time.Time{}
+	s.passkeys = append(s.passkeys, c)
+	return nil
+}
+
+func (s *MemoryStore) findPasskey(id []byte) int {
+	for i, c := range s.passkeys {
+		if bytes.Equal(c.ID, id) {
+			return i
+		}
+	}
+	return -1
+}
+
+// WebAuthnCredentials implements WebAuthnStore.
+func (s *MemoryStore) WebAuthnCredentials(username string) ([]WebAuthnCredential, error) {
+	return s.passkeysWhere(func(c WebAuthnCredential) bool { return c.Username == username }), nil
+}
+
+// WebAuthnCredentialsByHandle implements WebAuthnStore.
+func (s *MemoryStore) WebAuthnCredentialsByHandle(handle []byte) ([]WebAuthnCredential, error) {
+	return s.passkeysWhere(func(c WebAuthnCredential) bool { return bytes.Equal(c.UserHandle, handle) }), nil
+}
+
+func (s *MemoryStore) passkeysWhere(match func(WebAuthnCredential) bool) []WebAuthnCredential {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	creds := []WebAuthnCredential{}
+	for _, c := range s.passkeys {
+		if match(c) {
+			creds = append(creds, c)
+		}
+	}
+	return creds
+}
+
+// UpdateWebAuthnCredential implements WebAuthnStore.
+func (s *MemoryStore) UpdateWebAuthnCredential(id, data []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if i := s.findPasskey(id); i >= 0 {
+		s.passkeys[i].Data, s.passkeys[i].LastUsedAt = data, seconds(time.Now())
+	}
+	return nil
+}
+
+// DeleteWebAuthnCredential implements WebAuthnStore.
+func (s *MemoryStore) DeleteWebAuthnCredential(username string, id []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	i := s.findPasskey(id)
+	if i < 0 || s.passkeys[i].Username != username {
+		return ErrCredentialNotFound
+	}
+	s.passkeys = slices.Delete(s.passkeys, i, i+1)
+	return nil
+}
+
+// FailedLogins implements LoginThrottleStore.
+func (s *MemoryStore) FailedLogins(key string) (FailedLogins, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if f, ok := s.failed[key]; ok {
+		return f, nil
+	}
+	return FailedLogins{Key: key}, nil
+}
+
+// RecordFailedLogin implements LoginThrottleStore.
+func (s *MemoryStore) RecordFailedLogin(key string, at time.Time, window time.Duration) (FailedLogins, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	f := s.failed[key]
+	if f.LastAt.Before(seconds(at.Add(-window))) {
+		f.Count = 0
+	}
+	f.Key, f.Count, f.LastAt = key, f.Count+1, seconds(at)
+	s.failed[key] = f
+	return f, nil
+}
+
+// ClearFailedLogins implements LoginThrottleStore.
+func (s *MemoryStore) ClearFailedLogins(key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.failed, key)
+	return nil
+}
+
+// ListFailedLogins implements LoginThrottleStore.
+func (s *MemoryStore) ListFailedLogins(since time.Time) ([]FailedLogins, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var list []FailedLogins
+	since = seconds(since)
+	for _, f := range s.failed {
+		if !f.LastAt.Before(since) {
+			list = append(list, f)
+		}
+	}
+	slices.SortFunc(list, func(a, b FailedLogins) int { return b.LastAt.Compare(a.LastAt) })
+	return list, nil
+}
+
+// AddPersonalAccessToken implements PATStore.
+func (s *MemoryStore) AddPersonalAccessToken(t PersonalAccessToken) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	t.Scopes = slices.Clone(t.Scopes)
+	t.CreatedAt, t.LastUsedAt, t.ExpiresAt = seconds(time.Now()), time.Time{}, seconds(t.ExpiresAt)
+	s.pats = append(s.pats, t)
+	return nil
+}
+
+// PersonalAccessTokenByHash implements PATStore.
+func (s *MemoryStore) PersonalAccessTokenByHash(hash string) (*PersonalAccessToken, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, t := range s.pats {
+		if t.Hash == hash {
+			t.Scopes = slices.Clone(t.Scopes)
+			return &t, nil
+		}
+	}
+	return nil, ErrPATNotFound
+}
+
+// PersonalAccessTokens implements PATStore.
+func (s *MemoryStore) PersonalAccessTokens(username string) ([]PersonalAccessToken, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	list := []PersonalAccessToken{}
+	for _, t := range s.pats {
+		if t.Username == username {
+			t.Scopes = slices.Clone(t.Scopes)
+			list = append(list, t)
+		}
+	}
+	return list, nil
+}
+
+// TouchPersonalAccessToken implements PATStore.
+func (s *MemoryStore) TouchPersonalAccessToken(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i := range s.pats {
+		if s.pats[i].ID == id {
+			s.pats[i].LastUsedAt = seconds(time.Now())
+		}
+	}
+	return nil
+}
+
+// DeletePersonalAccessToken implements PATStore.
+func (s *MemoryStore) DeletePersonalAccessToken(username, id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	i := slices.IndexFunc(s.pats, func(t PersonalAccessToken) bool { return t.ID == id && t.Username == username })
+	if i < 0 {
+		return ErrPATNotFound
+	}
+	s.pats = slices.Delete(s.pats, i, i+1)
+	return nil
+}
+
+// Deny implements DenylistStore.
+func (s *MemoryStore) Deny(entries ...DeniedToken) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, e := range entries {
+		k := memDenyKey{e.Kind, e.ID}
+		if exp := seconds(e.ExpiresAt); exp.After(s.denied[k]) {
+			s.denied[k] = exp
+		}
+	}
+	return nil
+}
+
+// DenyOnce implements DenylistStore.
+func (s *MemoryStore) DenyOnce(e DeniedToken) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	k := memDenyKey{e.Kind, e.ID}
+	if _, ok := s.denied[k]; ok {
+		return false, nil
+	}
+	s.denied[k] = seconds(e.ExpiresAt)
+	return true, nil
+}
+
+// DeniedTokens implements DenylistStore.
+func (s *MemoryStore) DeniedTokens(now time.Time) ([]DeniedToken, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	list := []DeniedToken{}
+	for k, exp := range s.denied {
+		if exp.After(seconds(now)) {
+			list = append(list, DeniedToken{Kind: k.kind, ID: k.id, ExpiresAt: exp})
+		}
+	}
+	return list, nil
+}
+
+// Close implements Store.
+func (s *MemoryStore) Close() error {
+	return nil
+}
@@ -0,0 +1,335 @@
+package auth
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+)
+
+// migration is one step of an auth store schema. Versions start at 1 and follow the
+// order of the backend's migrations list; a migration is never changed once released,
+// only followed by a new one.
+type migration struct {
+	name string
+	up   func(tx *sql.Tx) error
+}
+
+// schema is a backend's migration history and the SQL to track it.
+type schema struct {
+	migrations  []migration
+	createTable string // Creates schema_migrations if missing
+	tableExists string // Counts schema_migrations tables (0 or 1)
+	insert      string // Records (version, name, applied_at)
+	// lock and unlock, when set, take and release a lock held by the connection that
+	// migrates, from before schema_migrations is created until the last step is recorded,
+	// so replicas starting at once migrate one after the other.
+	lock, unlock string
+}
+
+var sqliteSchema = schema{
+	migrations: sqliteMigrations,
+	createTable: `
+CREATE TABLE IF NOT EXISTS schema_migrations (
+  version INTEGER PRIMARY KEY,
+  name TEXT NOT NULL,
+  applied_at INTEGER NOT NULL
+);
+`,
+	tableExists: `SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = 'schema_migrations'`,
+	insert:      `INSERT INTO schema_migrations (version, name, applied_at) VALUES (?, ?, ?)`,
+}
+
+// sqliteMigrations is the SQLite schema history. Databases created before versioning
+// have no schema_migrations table; every step is idempotent, so they are brought up to
+// date the same way as new ones.
+var sqliteMigrations = []migration{
+	{"refresh_tokens", execAll(`
+CREATE TABLE IF NOT EXISTS refresh_tokens (
+  token_hash TEXT PRIMARY KEY,
+  username TEXT NOT NULL,
+  expires_at INTEGER NOT NULL,
+  used_at INTEGER,
+  revoked_at INTEGER
+);
+CREATE INDEX IF NOT EXISTS idx_refresh_tokens_username ON refresh_tokens(username);
+`)},
+	// Rows from before family tracking have no family_id and count as a family of one.
+	{"refresh_token_families", func(tx *sql.Tx) error {
+		if err := addColumn(tx, "refresh_tokens", "family_id", "TEXT"); err != nil {
+			return err
+		}
+		if err := addColumn(tx, "refresh_tokens", "parent_hash", "TEXT"); err != nil {
+			return err
+		}
+		return execAll(`
+CREATE INDEX IF NOT EXISTS idx_refresh_tokens_family ON refresh_tokens(family_id);
+CREATE TABLE IF NOT EXISTS auth_events (
+  id INTEGER PRIMARY KEY AUTOINCREMENT,
+  at INTEGER NOT NULL,
+  kind TEXT NOT NULL,
+  username TEXT NOT NULL,
+  family_id TEXT,
+  detail TEXT
+);
+`)(tx)
+	}},
+	{"refresh_token_successors", func(tx *sql.Tx) error {
+		if err := addColumn(tx, "refresh_tokens", "successor_hash", "TEXT"); err != nil {
+			return err
+		}
+		return addColumn(tx, "refresh_tokens", "successor_sealed", "BLOB") // See SealSuccessor
+	}},
+	{"sessions", execAll(`
+CREATE TABLE IF NOT EXISTS sessions (
+  family_id TEXT PRIMARY KEY,
+  username TEXT NOT NULL,
+  device_label TEXT NOT NULL DEFAULT '',
+  user_agent TEXT NOT NULL DEFAULT '',
+  ip TEXT NOT NULL DEFAULT '',
+  created_at INTEGER NOT NULL,
+  last_used_at INTEGER NOT NULL
+);
+CREATE INDEX IF NOT EXISTS idx_sessions_username ON sessions(username);
+`)},
+	// TOTP secrets are sealed (Keys.SealMFASecret); recovery codes are stored as hashes.
+	{"mfa", execAll(`
+CREATE TABLE IF NOT EXISTS mfa_totp (
+  username TEXT PRIMARY KEY,
+  secret_sealed BLOB NOT NULL,
+  created_at INTEGER NOT NULL,
+  confirmed_at INTEGER,
+  last_step INTEGER NOT NULL DEFAULT 0
+);
+CREATE TABLE IF NOT EXISTS mfa_recovery_codes (
+  username TEXT NOT NULL,
+  code_hash TEXT NOT NULL,
+  used_at INTEGER,
+  PRIMARY KEY (username, code_hash)
+);
+`)},
+	{"webauthn_credentials", execAll(`
+CREATE TABLE IF NOT EXISTS webauthn_credentials (
+  id BLOB PRIMARY KEY,
+  username TEXT NOT NULL,
+  user_handle BLOB NOT NULL,
+  name TEXT NOT NULL DEFAULT '',
+  data BLOB NOT NULL,
+  created_at INTEGER NOT NULL,
+  last_used_at INTEGER
+);
+CREATE INDEX IF NOT EXISTS idx_webauthn_credentials_username ON webauthn_credentials(username);
+CREATE INDEX IF NOT EXISTS idx_webauthn_credentials_handle ON webauthn_credentials(user_handle);
+`)},
+	{"failed_logins", execAll(`
+CREATE TABLE IF NOT EXISTS failed_logins (
+  throttle_key TEXT PRIMARY KEY,
+  failures INTEGER NOT NULL,
+  last_at INTEGER NOT NULL
+);
+CREATE INDEX IF NOT EXISTS idx_failed_logins_last_at ON failed_logins(last_at);
+`)},
+	{"personal_access_tokens", execAll(`
+CREATE TABLE IF NOT EXISTS personal_access_tokens (
+  id TEXT PRIMARY KEY,
+  username TEXT NOT NULL,
+  name TEXT NOT NULL,
+  scopes TEXT NOT NULL,
+  token_hash TEXT NOT NULL UNIQUE,
+  created_at INTEGER NOT NULL,
+  expires_at INTEGER NOT NULL,
+  last_used_at INTEGER
+);
+CREATE INDEX IF NOT EXISTS idx_personal_access_tokens_username ON personal_access_tokens(username);
+`)},
+	{"denied_tokens", execAll(`
+CREATE TABLE IF NOT EXISTS denied_tokens (
+  kind TEXT NOT NULL,
+  id TEXT NOT NULL,
+  expires_at INTEGER NOT NULL,
+  PRIMARY KEY (kind, id)
+);
+CREATE INDEX IF NOT EXISTS idx_denied_tokens_expires_at ON denied_tokens(expires_at);
+`)},
+}
+
+// ErrSchemaTooNew means the database was migrated by a newer papaya than this one.
+var ErrSchemaTooNew = errors.New("auth database schema is newer than this papaya; upgrade papaya")
+
+// MigrationStatus is one migration and when it was applied (zero while pending).
+type MigrationStatus struct {
+	Version   int
+	Name      string
+	AppliedAt time.Time
+}
+
+// Pending reports whether the migration has not been applied yet.
+func (m MigrationStatus) Pending() bool {
+	return m.AppliedAt.IsZero()
+}
+
+// Migrations reports every known migration for the SQLite database at dbPath, without
+// changing it. Versions the database has but this papaya does not know are included as
+// recorded, and ErrSchemaTooNew is returned with them.
+func Migrations(dbPath string) ([]MigrationStatus, error) {
+	if _, err := os.Stat(dbPath); errors.Is(err, os.ErrNotExist) {
+		return migrationStatus(nil, sqliteSchema)
+	}
+	db, err := openDB(dbPath)
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+	return migrationStatus(db, sqliteSchema)
+}
+
+// migrationStatus implements Migrations; a nil db has nothing applied.
+func migrationStatus(db *sql.DB, sc schema) ([]MigrationStatus, error) {
+	status := make([]MigrationStatus, len(sc.migrations))
+	for i, m := range sc.migrations {
+		status[i] = MigrationStatus{Version: i + 1, Name: m.name}
+	}
+	if db == nil {
+		return status, nil
+	}
+	applied, err := appliedMigrations(context.Background(), db, sc)
+	if err != nil {
+		return nil, err
+	}
+	var tooNew bool
+	for _, a := range applied {
+		if a.Version > len(sc.migrations) {
+			status = append(status, a)
+			tooNew = true
+		} else {
+			status[a.Version-1].AppliedAt = a.AppliedAt
+		}
+	}
+	if tooNew {
+		return status, ErrSchemaTooNew
+	}
+	return status, nil
+}
+
+// MigrateUp applies all pending migrations to the SQLite database at dbPath (creating it
+// if needed) and returns the ones it applied. OpenSQLite does the same, so this is only
+// needed to migrate ahead of starting the server.
+func MigrateUp(dbPath string) ([]MigrationStatus, error) {
+	db, err := openDB(dbPath)
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+	return migrateUp(db, sqliteSchema)
+}
+
+func migrateUp(db *sql.DB, sc schema) ([]MigrationStatus, error) {
+	ctx := context.Background()
+	conn, err := db.Conn(ctx) // The lock belongs to one connection
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if sc.lock != "" {
+		if _, err := conn.ExecContext(ctx, sc.lock); err != nil {
+			return nil, err
+		}
+		defer conn.ExecContext(ctx, sc.unlock)
+	}
+	if _, err := conn.ExecContext(ctx, sc.createTable); err != nil {
+		return nil, err
+	}
+	applied, err := appliedMigrations(ctx, conn, sc)
+	if err != nil {
+		return nil, err
+	}
+	done := make(map[int]bool, len(applied))
+	for _, a := range applied {
+		if a.Version > len(sc.migrations) {
+			return nil, fmt.Errorf("%w (database at version %d, papaya knows %d)", ErrSchemaTooNew, a.Version, len(sc.migrations))
+		}
+		done[a.Version] = true
+	}
+	var ran []MigrationStatus
+	for i, m := range sc.migrations {
+		version := i + 1
+		if done[version] {
+			continue
+		}
+		now := time.Now()
+		if err := applyMigration(ctx, conn, sc, version, m, now); err != nil {
+			return ran, fmt.Errorf("migration %d (%s): %w", version, m.name, err)
+		}
+		ran = append(ran, MigrationStatus{Version: version, Name: m.name, AppliedAt: now})
+	}
+	return ran, nil
+}
+
+// applyMigration runs one migration and records it in the same transaction, so a failed
+// migration leaves no trace.
+func applyMigration(ctx context.Context, conn *sql.Conn, sc schema, version int, m migration, now time.Time) error {
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if err := m.up(tx); err != nil {
+		return err
+	}
+	_, err = tx.Exec(sc.insert, version, m.name, now.Unix())
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// queryer is a *sql.DB or a *sql.Conn.
+type queryer interface {
+	QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row
+}
+
+func appliedMigrations(ctx context.Context, db queryer, sc schema) ([]MigrationStatus, error) {
+	var exists int
+	err := db.QueryRowContext(ctx, sc.tableExists).Scan(&exists)
+	if err != nil || exists == 0 {
+		return nil, err
+	}
+	rows, err := db.QueryContext(ctx, `SELECT version, name, applied_at FROM schema_migrations ORDER BY version`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var applied []MigrationStatus
+	for rows.Next() {
+		var m MigrationStatus
+		var at int64
+		if err := rows.Scan(&m.Version, &m.Name, &at); err != nil {
+			return nil, err
+		}
+		m.AppliedAt = time.Unix(at, 0)
+		applied = append(applied, m)
+	}
+	return applied, rows.Err()
+}
+
+// execAll returns a migration step that runs the given SQL statements.
+func execAll(statements string) func(tx *sql.Tx) error {
+	return func(tx *sql.Tx) error {
+		_, err := tx.Exec(statements)
+		return err
+	}
+}
+
+// addColumn adds a column unless it exists (databases that predate versioning may have it).
+func addColumn(tx *sql.Tx, table, column, def string) error {
+	var n int
+	err := tx.QueryRow(`SELECT COUNT(*) FROM pragma_table_info(?) WHERE name = ?`, table, column).Scan(&n)
+	if err != nil || n > 0 {
+		return err
+	}
+	_, err = tx.Exec(fmt.Sprintf(`ALTER TABLE %s ADD COLUMN %s %s`, table, column, def))
+	return err
+}
@@ -0,0 +1,122 @@
+package auth_test
+
+import (
+	"database/sql"
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/fridayflag/papaya/internal/auth"
+)
+
+// TestSQLiteUpgrade opens databases from earlier schemas (testdata/sqlite, named after
+// the schema version) and checks they are migrated without losing alice's session: v0 is
+// the unversioned database papaya used to create, and v4 one with migrations already
+// recorded, from which only the later ones run.
+func TestSQLiteUpgrade(t *testing.T) {
+	tests := []struct {
+		fixture   string
+		sessionID string // COALESCE(family_id, token_hash): tokens without a family are their own
+		device    string
+	}{
+		{"v0", "h-alice", ""},
+		{"v4-sessions", "f-alice", "Firefox on Linux"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.fixture, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "papaya.db")
+			fixture, err := os.ReadFile(filepath.Join("testdata", "sqlite", tt.fixture+".sql"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			db, err := sql.Open("sqlite", path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := db.Exec(string(fixture)); err != nil {
+				t.Fatalf("loading %s: %v", tt.fixture, err)
+			}
+			db.Close()
+
+			// Twice: the second open finds nothing to do.
+			for range 2 {
+				s, err := auth.OpenSQLite(path)
+				if err != nil {
+					t.Fatalf("OpenSQLite() error = %v", err)
+				}
+				s.Close()
+			}
+			status, err := auth.Migrations(path)
+			if err != nil {
+				t.Fatalf("Migrations() error = %v", err)
+			}
+			for _, m := range status {
+				if m.Pending() {
+					t.Errorf("migration %d (%s) pending after upgrade", m.Version, m.Name)
+				}
+			}
+
+			s, err := auth.OpenSQLite(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer s.Close()
+			sessions, err := s.Sessions("alice")
+			if err != nil {
+				t.Fatalf("Sessions() error = %v", err)
+			}
+			if len(sessions) != 1 || sessions[0].ID != tt.sessionID || sessions[0].DeviceLabel != tt.device {
+				t.Fatalf("Sessions(alice) = %+v, want %s on %q", sessions, tt.sessionID, tt.device)
+			}
+			// The old token still rotates, and the session carries on.
+			next := auth.RefreshToken{Hash: "h-next", Username: "alice", ExpiresAt: time.Now().Add(time.Hour)}
+			if _, _, err := s.Rotate("h-alice", next, nil, 0); err != nil {
+				t.Fatalf("Rotate(h-alice) error = %v", err)
+			}
+			if sessions, _ := s.Sessions("alice"); len(sessions) != 1 || sessions[0].ID != tt.sessionID {
+				t.Errorf("Sessions(alice) after Rotate = %+v, want %s", sessions, tt.sessionID)
+			}
+			if _, _, err := s.Rotate("h-alice", next, nil, 0); !errors.Is(err, auth.ErrTokenUsed) {
+				t.Errorf("Rotate(h-alice) again error = %v, want %v", err, auth.ErrTokenUsed)
+			}
+		})
+	}
+}
+
+// TestPostgresConcurrentMigrate starts several replicas against an empty database at
+// once; one migrates and the others wait for it.
+func TestPostgresConcurrentMigrate(t *testing.T) {
+	url := postgresFixture(t)
+	var wg sync.WaitGroup
+	errs := make(chan error, 4)
+	for range cap(errs) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s, err := auth.OpenPostgres(url)
+			if err == nil {
+				s.Close()
+			}
+			errs <- err
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Errorf("OpenPostgres() error = %v", err)
+		}
+	}
+	status, err := auth.PostgresMigrations(url)
+	if err != nil {
+		t.Fatalf("PostgresMigrations() error = %v", err)
+	}
+	for _, m := range status {
+		if m.Pending() {
+			t.Errorf("migration %d (%s) pending", m.Version, m.Name)
+		}
+	}
+}
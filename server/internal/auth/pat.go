@@ -0,0 +1,68 @@
+package auth
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"slices"
+	"strings"
+	"time"
+)
+
+// PATPrefix starts every personal access token, so they are told apart from access-token
+// JWTs in an Authorization header (and spotted by secret scanners).
+const PATPrefix = "pat_"
+
+// Scopes a personal access token can carry.
+const (
+	ScopeDBRead  = "db:read"  // Read the user's databases through /db
+	ScopeDBWrite = "db:write" // Read and write them; implies ScopeDBRead
+	ScopeAdmin   = "admin"    // Call /api/admin, for server admins only
+)
+
+// PersonalAccessToken is a long-lived token a user created for scripts and automation.
+// Only its hash is stored; the token itself is shown once, when it is created.
+type PersonalAccessToken struct {
+	ID         string
+	Username   string
+	Name       string // Chosen by the user, e.g. "Backup script"
+	Scopes     []string
+	Hash       string // TokenHash of the token
+	CreatedAt  time.Time
+	ExpiresAt  time.Time
+	LastUsedAt time.Time // Zero until first used
+}
+
+// NewPersonalAccessToken returns a new random token and its ID.
+func NewPersonalAccessToken() (token, id string) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		panic(err) // crypto/rand does not fail on supported platforms
+	}
+	return PATPrefix + base64.RawURLEncoding.EncodeToString(b), randomID()
+}
+
+// ErrScopeMissing means a personal access token does not carry the scope a request needs.
+var ErrScopeMissing = errors.New("personal access token lacks the required scope")
+
+// IsPersonalAccessToken reports whether token looks like a personal access token.
+func IsPersonalAccessToken(token string) bool {
+	return strings.HasPrefix(token, PATPrefix)
+}
+
+// ValidScope reports whether scope is one of the Scope constants.
+func ValidScope(scope string) bool {
+	switch scope {
+	case ScopeDBRead, ScopeDBWrite, ScopeAdmin:
+		return true
+	}
+	return false
+}
+
+// Allows reports whether the token carries scope (or one that implies it).
+func (t *PersonalAccessToken) Allows(scope string) bool {
+	if scope == ScopeDBRead && slices.Contains(t.Scopes, ScopeDBWrite) {
+		return true
+	}
+	return slices.Contains(t.Scopes, scope)
+}
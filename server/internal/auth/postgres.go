@@ -0,0 +1,742 @@
+package auth
+
+import (
+	"database/sql"
+	"errors"
+	"strings"
+	"time"
+
+	_ "github.com/jackc/pgx/v5/stdlib"
+)
+
+// PostgresStore is the Store in PostgreSQL, for several server replicas
+// sharing one database (auth.store: postgres). The schema matches SQLiteStore's.
+type PostgresStore struct {
+	db *sql.DB
+}
+
+var postgresSchema = schema{
+	migrations: []migration{
+		{"initial", execAll(`
+CREATE TABLE IF NOT EXISTS refresh_tokens (
+  token_hash TEXT PRIMARY KEY,
+  username TEXT NOT NULL,
+  expires_at BIGINT NOT NULL,
+  used_at BIGINT,
+  revoked_at BIGINT,
+  family_id TEXT NOT NULL,
+  parent_hash TEXT,
+  successor_hash TEXT,
+  successor_sealed BYTEA
+);
+CREATE INDEX IF NOT EXISTS idx_refresh_tokens_username ON refresh_tokens(username);
+CREATE INDEX IF NOT EXISTS idx_refresh_tokens_family ON refresh_tokens(family_id);
+CREATE TABLE IF NOT EXISTS sessions (
+  family_id TEXT PRIMARY KEY,
+  username TEXT NOT NULL,
+  device_label TEXT NOT NULL DEFAULT '',
+  user_agent TEXT NOT NULL DEFAULT '',
+  ip TEXT NOT NULL DEFAULT '',
+  created_at BIGINT NOT NULL,
+  last_used_at BIGINT NOT NULL
+);
+CREATE INDEX IF NOT EXISTS idx_sessions_username ON sessions(username);
+CREATE TABLE IF NOT EXISTS auth_events (
+  id BIGSERIAL PRIMARY KEY,
+  at BIGINT NOT NULL,
+  kind TEXT NOT NULL,
+  username TEXT NOT NULL,
+  family_id TEXT,
+  detail TEXT
+);
+`)},
+		{"mfa", execAll(`
+CREATE TABLE IF NOT EXISTS mfa_totp (
+  username TEXT PRIMARY KEY,
+  secret_sealed BYTEA NOT NULL,
+  created_at BIGINT NOT NULL,
+  confirmed_at BIGINT,
+  last_step BIGINT NOT NULL DEFAULT 0
+);
+CREATE TABLE IF NOT EXISTS mfa_recovery_codes (
+  username TEXT NOT NULL,
+  code_hash TEXT NOT NULL,
+  used_at BIGINT,
+  PRIMARY KEY (username, code_hash)
+);
+`)},
+		{"webauthn_credentials", execAll(`
+CREATE TABLE IF NOT EXISTS webauthn_credentials (
+  id BYTEA PRIMARY KEY,
+  username TEXT NOT NULL,
+  user_handle BYTEA NOT NULL,
+  name TEXT NOT NULL DEFAULT '',
+  data BYTEA NOT NULL,
+  created_at BIGINT NOT NULL,
+  last_used_at BIGINT
+);
+CREATE INDEX IF NOT EXISTS idx_webauthn_credentials_username ON webauthn_credentials(username);
+CREATE INDEX IF NOT EXISTS idx_webauthn_credentials_handle ON webauthn_credentials(user_handle);
+`)},
+		{"failed_logins", execAll(`
+CREATE TABLE IF NOT EXISTS failed_logins (
+  throttle_key TEXT PRIMARY KEY,
+  failures INTEGER NOT NULL,
+  last_at BIGINT NOT NULL
+);
+CREATE INDEX IF NOT EXISTS idx_failed_logins_last_at ON failed_logins(last_at);
+`)},
+		{"personal_access_tokens", execAll(`
+CREATE TABLE IF NOT EXISTS personal_access_tokens (
+  id TEXT PRIMARY KEY,
+  username TEXT NOT NULL,
+  name TEXT NOT NULL,
+  scopes TEXT NOT NULL,
+  token_hash TEXT NOT NULL UNIQUE,
+  created_at BIGINT NOT NULL,
+  expires_at BIGINT NOT NULL,
+  last_used_at BIGINT
+);
+CREATE INDEX IF NOT EXISTS idx_personal_access_tokens_username ON personal_access_tokens(username);
+`)},
+		{"denied_tokens", execAll(`
+CREATE TABLE IF NOT EXISTS denied_tokens (
+  kind TEXT NOT NULL,
+  id TEXT NOT NULL,
+  expires_at BIGINT NOT NULL,
+  PRIMARY KEY (kind, id)
+);
+CREATE INDEX IF NOT EXISTS idx_denied_tokens_expires_at ON denied_tokens(expires_at);
+`)},
+	},
+	createTable: `
+CREATE TABLE IF NOT EXISTS schema_migrations (
+  version INTEGER PRIMARY KEY,
+  name TEXT NOT NULL,
+  applied_at BIGINT NOT NULL
+);
+`,
+	tableExists: `SELECT COUNT(*) FROM information_schema.tables WHERE table_schema = current_schema() AND table_name = 'schema_migrations'`,
+	insert:      `INSERT INTO schema_migrations (version, name, applied_at) VALUES ($1, $2, $3)`,
+	lock:        `SELECT pg_advisory_lock(7270727972)`, // Arbitrary key for papaya migrations
+	unlock:      `SELECT pg_advisory_unlock(7270727972)`,
+}
+
+// OpenPostgres connects to the database at url (e.g. postgres://papaya:secret@db/papaya),
+// applies pending migrations and returns a PostgresStore.
+func OpenPostgres(url string) (*PostgresStore, error) {
+	db, err := openPostgresDB(url)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := migrateUp(db, postgresSchema); err != nil {
+		_ = db.Close()
+		return nil, err
+	}
+	return &PostgresStore{db: db}, nil
+}
+
+func openPostgresDB(url string) (*sql.DB, error) {
+	if url == "" {
+		return nil, errors.New("auth.postgres_url (PAPAYA_AUTH_POSTGRES_URL) is not set")
+	}
+	db, err := sql.Open("pgx", url)
+	if err != nil {
+		return nil, err
+	}
+	if err := db.Ping(); err != nil {
+		_ = db.Close()
+		return nil, err
+	}
+	return db, nil
+}
+
+// PostgresMigrations is Migrations for the PostgreSQL database at url.
+func PostgresMigrations(url string) ([]MigrationStatus, error) {
+	db, err := openPostgresDB(url)
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+	return migrationStatus(db, postgresSchema)
+}
+
+// PostgresMigrateUp is MigrateUp for the PostgreSQL database at url.
+func PostgresMigrateUp(url string) ([]MigrationStatus, error) {
+	db, err := openPostgresDB(url)
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+	return migrateUp(db, postgresSchema)
+}
+
+// Close implements Store.
+func (s *PostgresStore) Close() error {
+	return s.db.Close()
+}
+
+// Store implements SessionStore.
+func (s *PostgresStore) Store(t RefreshToken, sess Session) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	_, err = tx.Exec(
+		`INSERT INTO refresh_tokens (token_hash, username, expires_at, family_id, parent_hash)
+		 VALUES ($1, $2, $3, $4, NULLIF($5, ''))`,
+		t.Hash, t.Username, t.ExpiresAt.Unix(), t.FamilyID, t.ParentHash,
+	)
+	if err != nil {
+		return err
+	}
+	now := time.Now().Unix()
+	_, err = tx.Exec(
+		`INSERT INTO sessions (family_id, username, device_label, user_agent, ip, created_at, last_used_at)
+		 VALUES ($1, $2, $3, $4, $5, $6, $6)`,
+		t.FamilyID, t.Username, sess.DeviceLabel, sess.UserAgent, sess.IP, now,
+	)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// Rotate implements SessionStore. The parent row is locked (SELECT ... FOR UPDATE),
+// so concurrent rotations of one token, from any replica, are serialized.
+func (s *PostgresStore) Rotate(parentHash string, next RefreshToken, sealed []byte, grace time.Duration) (*RefreshToken, []byte, error) {
+	now := time.Now()
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, nil, err
+	}
+	defer tx.Rollback()
+
+	t := &RefreshToken{Hash: parentHash}
+	var usedAt, revokedAt sql.NullInt64
+	var parentOfParent sql.NullString
+	var prior []byte
+	var expAt int64
+	err = tx.QueryRow(
+		`SELECT username, expires_at, used_at, revoked_at, family_id, parent_hash, successor_sealed
+		 FROM refresh_tokens WHERE token_hash = $1 FOR UPDATE`,
+		parentHash,
+	).Scan(&t.Username, &expAt, &usedAt, &revokedAt, &t.FamilyID, &parentOfParent, &prior)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, nil, ErrTokenNotFound
+		}
+		return nil, nil, err
+	}
+	t.ParentHash = parentOfParent.String
+	t.ExpiresAt = time.Unix(expAt, 0)
+	if expAt <= now.Unix() {
+		return nil, nil, ErrTokenExpired
+	}
+	if revokedAt.Valid {
+		return nil, nil, ErrTokenRevoked
+	}
+	if usedAt.Valid {
+		if grace > 0 && prior != nil && now.Sub(time.Unix(usedAt.Int64, 0)) <= grace {
+			return t, prior, nil
+		}
+		_, err := tx.Exec(
+			`UPDATE refresh_tokens SET revoked_at = $1 WHERE family_id = $2 AND revoked_at IS NULL`,
+			now.Unix(), t.FamilyID,
+		)
+		if err != nil {
+			return nil, nil, err
+		}
+		_, err = tx.Exec(
+			`INSERT INTO auth_events (at, kind, username, family_id, detail) VALUES ($1, $2, $3, $4, $5)`,
+			now.Unix(), EventTokenReuse, t.Username, t.FamilyID, "used refresh token presented again; family revoked",
+		)
+		if err != nil {
+			return nil, nil, err
+		}
+		if err := tx.Commit(); err != nil {
+			return nil, nil, err
+		}
+		return t, nil, ErrTokenUsed
+	}
+
+	_, err = tx.Exec(
+		`UPDATE refresh_tokens SET used_at = $1, successor_hash = $2, successor_sealed = $3 WHERE token_hash = $4`,
+		now.Unix(), next.Hash, sealed, parentHash,
+	)
+	if err != nil {
+		return nil, nil, err
+	}
+	_, err = tx.Exec(
+		`INSERT INTO refresh_tokens (token_hash, username, expires_at, family_id, parent_hash)
+		 VALUES ($1, $2, $3, $4, $5)`,
+		next.Hash, next.Username, next.ExpiresAt.Unix(), t.FamilyID, t.Hash,
+	)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, nil, err
+	}
+	return t, nil, nil
+}
+
+// Revoke implements SessionStore.
+func (s *PostgresStore) Revoke(tokenHash string) error {
+	_, err := s.db.Exec(
+		`UPDATE refresh_tokens SET revoked_at = $1
+		 WHERE family_id = (SELECT family_id FROM refresh_tokens WHERE token_hash = $2) AND revoked_at IS NULL`,
+		time.Now().Unix(), tokenHash,
+	)
+	return err
+}
+
+// RevokeAllForUser implements SessionStore.
+func (s *PostgresStore) RevokeAllForUser(username string) ([]string, error) {
+	rows, err := s.db.Query(
+		`UPDATE refresh_tokens SET revoked_at = $1 WHERE username = $2 AND revoked_at IS NULL RETURNING family_id`,
+		time.Now().Unix(), username,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return collectSessionIDs(rows)
+}
+
+// RecordEvent implements EventStore.
+func (s *PostgresStore) RecordEvent(kind, username, familyID, detail string) error {
+	_, err := s.db.Exec(
+		`INSERT INTO auth_events (at, kind, username, family_id, detail) VALUES ($1, $2, $3, NULLIF($4, ''), $5)`,
+		time.Now().Unix(), kind, username, familyID, detail,
+	)
+	return err
+}
+
+// Sessions implements SessionStore.
+func (s *PostgresStore) Sessions(username string) ([]Session, error) {
+	rows, err := s.db.Query(
+		`SELECT t.family_id, COALESCE(s.device_label, ''), COALESCE(s.user_agent, ''),
+		        COALESCE(s.ip, ''), COALESCE(s.created_at, 0), COALESCE(s.last_used_at, 0), t.expires_at
+		 FROM refresh_tokens t LEFT JOIN sessions s ON s.family_id = t.family_id
+		 WHERE t.username = $1 AND t.used_at IS NULL AND t.revoked_at IS NULL AND t.expires_at > $2
+		 ORDER BY COALESCE(s.last_used_at, 0) DESC`,
+		username, time.Now().Unix(),
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	sessions := []Session{}
+	for rows.Next() {
+		sess := Session{Username: username}
+		var created, lastUsed, expires int64
+		if err := rows.Scan(&sess.ID, &sess.DeviceLabel, &sess.UserAgent, &sess.IP, &created, &lastUsed, &expires); err != nil {
+			return nil, err
+		}
+		if created != 0 {
+			sess.CreatedAt, sess.LastUsedAt = time.Unix(created, 0), time.Unix(lastUsed, 0)
+		}
+		sess.ExpiresAt = time.Unix(expires, 0)
+		sessions = append(sessions, sess)
+	}
+	return sessions, rows.Err()
+}
+
+// Touch implements SessionStore.
+func (s *PostgresStore) Touch(sessionID, userAgent, ip string) error {
+	_, err := s.db.Exec(
+		`UPDATE sessions SET last_used_at = $1, user_agent = $2, ip = $3 WHERE family_id = $4`,
+		time.Now().Unix(), userAgent, ip, sessionID,
+	)
+	return err
+}
+
+// RevokeSession implements SessionStore.
+func (s *PostgresStore) RevokeSession(username, sessionID string) error {
+	res, err := s.db.Exec(
+		`UPDATE refresh_tokens SET revoked_at = $1 WHERE username = $2 AND family_id = $3 AND revoked_at IS NULL`,
+		time.Now().Unix(), username, sessionID,
+	)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return ErrSessionNotFound
+	}
+	return nil
+}
+
+// RevokeOtherSessions implements SessionStore.
+func (s *PostgresStore) RevokeOtherSessions(username, keepID string) ([]string, error) {
+	rows, err := s.db.Query(
+		`UPDATE refresh_tokens SET revoked_at = $1 WHERE username = $2 AND family_id != $3 AND revoked_at IS NULL
+		 RETURNING family_id`,
+		time.Now().Unix(), username, keepID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return collectSessionIDs(rows)
+}
+
+// Prune implements Store.
+func (s *PostgresStore) Prune(cutoff time.Time) (PruneResult, error) {
+	var r PruneResult
+	tx, err := s.db.Begin()
+	if err != nil {
+		return r, err
+	}
+	defer tx.Rollback()
+	c := cutoff.Unix()
+	res, err := tx.Exec(`DELETE FROM refresh_tokens WHERE expires_at < $1 OR used_at < $1 OR revoked_at < $1`, c)
+	if err != nil {
+		return r, err
+	}
+	if r.Tokens, err = res.RowsAffected(); err != nil {
+		return r, err
+	}
+	res, err = tx.Exec(
+		`DELETE FROM sessions WHERE NOT EXISTS (SELECT 1 FROM refresh_tokens t WHERE t.family_id = sessions.family_id)`,
+	)
+	if err != nil {
+		return r, err
+	}
+	if r.Sessions, err = res.RowsAffected(); err != nil {
+		return r, err
+	}
+	for _, d := range []struct {
+		n     *int64
+		query string
+	}{
+		{&r.FailedLogins, `DELETE FROM failed_logins WHERE last_at < $1`},
+		{&r.PATs, `DELETE FROM personal_access_tokens WHERE expires_at < $1`},
+		{&r.Denylist, `DELETE FROM denied_tokens WHERE expires_at < $1`},
+	} {
+		res, err := tx.Exec(d.query, c)
+		if err != nil {
+			return r, err
+		}
+		if *d.n, err = res.RowsAffected(); err != nil {
+			return r, err
+		}
+	}
+	return r, tx.Commit()
+}
+
+// MFA implements MFAStore.
+func (s *PostgresStore) MFA(username string) (*MFAEnrollment, error) {
+	e := &MFAEnrollment{Username: username}
+	var confirmed sql.NullInt64
+	err := s.db.QueryRow(
+		`SELECT secret_sealed, confirmed_at, last_step,
+		        (SELECT COUNT(*) FROM mfa_recovery_codes WHERE username = $1 AND used_at IS NULL)
+		 FROM mfa_totp WHERE username = $1`,
+		username,
+	).Scan(&e.SealedSecret, &confirmed, &e.LastStep, &e.RecoveryCodesLeft)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrMFANotEnrolled
+	}
+	if err != nil {
+		return nil, err
+	}
+	if confirmed.Valid {
+		e.ConfirmedAt = time.Unix(confirmed.Int64, 0)
+	}
+	return e, nil
+}
+
+// BeginMFA implements MFAStore.
+func (s *PostgresStore) BeginMFA(username string, sealedSecret []byte) error {
+	res, err := s.db.Exec(
+		`INSERT INTO mfa_totp (username, secret_sealed, created_at) VALUES ($1, $2, $3)
+		 ON CONFLICT (username) DO UPDATE SET secret_sealed = excluded.secret_sealed, created_at = excluded.created_at, last_step = 0
+		 WHERE mfa_totp.confirmed_at IS NULL`,
+		username, sealedSecret, time.Now().Unix(),
+	)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return ErrMFAEnrolled
+	}
+	return nil
+}
+
+// ConfirmMFA implements MFAStore.
+func (s *PostgresStore) ConfirmMFA(username string, codeHashes []string) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	res, err := tx.Exec(
+		`UPDATE mfa_totp SET confirmed_at = COALESCE(confirmed_at, $1) WHERE username = $2`,
+		time.Now().Unix(), username,
+	)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return ErrMFANotEnrolled
+	}
+	if _, err := tx.Exec(`DELETE FROM mfa_recovery_codes WHERE username = $1`, username); err != nil {
+		return err
+	}
+	for _, h := range codeHashes {
+		if _, err := tx.Exec(`INSERT INTO mfa_recovery_codes (username, code_hash) VALUES ($1, $2)`, username, h); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// UseTOTPStep implements MFAStore.
+func (s *PostgresStore) UseTOTPStep(username string, step int64) (bool, error) {
+	res, err := s.db.Exec(
+		`UPDATE mfa_totp SET last_step = $1 WHERE username = $2 AND last_step < $1`,
+		step, username,
+	)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n == 1, err
+}
+
+// UseRecoveryCode implements MFAStore.
+func (s *PostgresStore) UseRecoveryCode(username, codeHash string) (bool, error) {
+	res, err := s.db.Exec(
+		`UPDATE mfa_recovery_codes SET used_at = $1 WHERE username = $2 AND code_hash = $3 AND used_at IS NULL`,
+		time.Now().Unix(), username, codeHash,
+	)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n == 1, err
+}
+
+// DeleteMFA implements MFAStore.
+func (s *PostgresStore) DeleteMFA(username string) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec(`DELETE FROM mfa_recovery_codes WHERE username = $1`, username); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`DELETE FROM mfa_totp WHERE username = $1`, username); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// AddWebAuthnCredential implements WebAuthnStore.
+func (s *PostgresStore) AddWebAuthnCredential(c WebAuthnCredential) error {
+	res, err := s.db.Exec(
+		`INSERT INTO webauthn_credentials (id, username, user_handle, name, data, created_at)
+		 VALUES ($1, $2, $3, $4, $5, $6) ON CONFLICT (id) DO NOTHING`,
+		c.ID, c.Username, c.UserHandle, c.Name, c.Data, time.Now().Unix(),
+	)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return ErrDuplicateCredential
+	}
+	return nil
+}
+
+// WebAuthnCredentials implements WebAuthnStore.
+func (s *PostgresStore) WebAuthnCredentials(username string) ([]WebAuthnCredential, error) {
+	return s.queryWebAuthnCredentials(`username = $1`, username)
+}
+
+// WebAuthnCredentialsByHandle implements WebAuthnStore.
+func (s *PostgresStore) WebAuthnCredentialsByHandle(handle []byte) ([]WebAuthnCredential, error) {
+	return s.queryWebAuthnCredentials(`user_handle = $1`, handle)
+}
+
+func (s *PostgresStore) queryWebAuthnCredentials(where string, arg any) ([]WebAuthnCredential, error) {
+	rows, err := s.db.Query(
+		`SELECT id, username, user_handle, name, data, created_at, COALESCE(last_used_at, 0)
+		 FROM webauthn_credentials WHERE `+where+` ORDER BY created_at`,
+		arg,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	creds := []WebAuthnCredential{}
+	for rows.Next() {
+		var c WebAuthnCredential
+		var created, lastUsed int64
+		if err := rows.Scan(&c.ID, &c.Username, &c.UserHandle, &c.Name, &c.Data, &created, &lastUsed); err != nil {
+			return nil, err
+		}
+		c.CreatedAt = time.Unix(created, 0)
+		if lastUsed != 0 {
+			c.LastUsedAt = time.Unix(lastUsed, 0)
+		}
+		creds = append(creds, c)
+	}
+	return creds, rows.Err()
+}
+
+// UpdateWebAuthnCredential implements WebAuthnStore.
+func (s *PostgresStore) UpdateWebAuthnCredential(id, data []byte) error {
+	_, err := s.db.Exec(
+		`UPDATE webauthn_credentials SET data = $1, last_used_at = $2 WHERE id = $3`,
+		data, time.Now().Unix(), id,
+	)
+	return err
+}
+
+// DeleteWebAuthnCredential implements WebAuthnStore.
+func (s *PostgresStore) DeleteWebAuthnCredential(username string, id []byte) error {
+	res, err := s.db.Exec(`DELETE FROM webauthn_credentials WHERE username = $1 AND id = $2`, username, id)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return ErrCredentialNotFound
+	}
+	return nil
+}
+
+// FailedLogins implements LoginThrottleStore.
+func (s *PostgresStore) FailedLogins(key string) (FailedLogins, error) {
+	return scanFailedLogins(key, s.db.QueryRow(`SELECT failures, last_at FROM failed_logins WHERE throttle_key = $1`, key))
+}
+
+// RecordFailedLogin implements LoginThrottleStore.
+func (s *PostgresStore) RecordFailedLogin(key string, at time.Time, window time.Duration) (FailedLogins, error) {
+	return scanFailedLogins(key, s.db.QueryRow(
+		`INSERT INTO failed_logins (throttle_key, failures, last_at) VALUES ($1, 1, $2)
+		 ON CONFLICT (throttle_key) DO UPDATE SET
+		   failures = CASE WHEN failed_logins.last_at < $3 THEN 1 ELSE failed_logins.failures + 1 END,
+		   last_at = excluded.last_at
+		 RETURNING failures, last_at`,
+		key, at.Unix(), at.Add(-window).Unix(),
+	))
+}
+
+// ClearFailedLogins implements LoginThrottleStore.
+func (s *PostgresStore) ClearFailedLogins(key string) error {
+	_, err := s.db.Exec(`DELETE FROM failed_logins WHERE throttle_key = $1`, key)
+	return err
+}
+
+// ListFailedLogins implements LoginThrottleStore.
+func (s *PostgresStore) ListFailedLogins(since time.Time) ([]FailedLogins, error) {
+	rows, err := s.db.Query(
+		`SELECT throttle_key, failures, last_at FROM failed_logins WHERE last_at >= $1 ORDER BY last_at DESC`,
+		since.Unix(),
+	)
+	if err != nil {
+		return nil, err
+	}
+	return collectFailedLogins(rows)
+}
+
+// AddPersonalAccessToken implements PATStore.
+func (s *PostgresStore) AddPersonalAccessToken(t PersonalAccessToken) error {
+	_, err := s.db.Exec(
+		`INSERT INTO personal_access_tokens (id, username, name, scopes, token_hash, created_at, expires_at)
+		 VALUES ($1, $2, $3, $4, $5, $6, $7)`,
+		t.ID, t.Username, t.Name, strings.Join(t.Scopes, " "), t.Hash, time.Now().Unix(), t.ExpiresAt.Unix(),
+	)
+	return err
+}
+
+// PersonalAccessTokenByHash implements PATStore.
+func (s *PostgresStore) PersonalAccessTokenByHash(hash string) (*PersonalAccessToken, error) {
+	rows, err := s.db.Query(`SELECT `+patColumns+` FROM personal_access_tokens WHERE token_hash = $1`, hash)
+	if err != nil {
+		return nil, err
+	}
+	return firstPersonalAccessToken(rows)
+}
+
+// PersonalAccessTokens implements PATStore.
+func (s *PostgresStore) PersonalAccessTokens(username string) ([]PersonalAccessToken, error) {
+	rows, err := s.db.Query(`SELECT `+patColumns+` FROM personal_access_tokens WHERE username = $1 ORDER BY created_at`, username)
+	if err != nil {
+		return nil, err
+	}
+	return collectPersonalAccessTokens(rows)
+}
+
+// TouchPersonalAccessToken implements PATStore.
+func (s *PostgresStore) TouchPersonalAccessToken(id string) error {
+	_, err := s.db.Exec(`UPDATE personal_access_tokens SET last_used_at = $1 WHERE id = $2`, time.Now().Unix(), id)
+	return err
+}
+
+// DeletePersonalAccessToken implements PATStore.
+func (s *PostgresStore) DeletePersonalAccessToken(username, id string) error {
+	res, err := s.db.Exec(`DELETE FROM personal_access_tokens WHERE username = $1 AND id = $2`, username, id)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return ErrPATNotFound
+	}
+	return nil
+}
+
+// Deny implements DenylistStore.
+func (s *PostgresStore) Deny(entries ...DeniedToken) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for _, e := range entries {
+		_, err := tx.Exec(
+			`INSERT INTO denied_tokens (kind, id, expires_at) VALUES ($1, $2, $3)
+			 ON CONFLICT (kind, id) DO UPDATE SET expires_at = GREATEST(denied_tokens.expires_at, excluded.expires_at)`,
+			e.Kind, e.ID, e.ExpiresAt.Unix(),
+		)
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// DenyOnce implements DenylistStore.
+func (s *PostgresStore) DenyOnce(e DeniedToken) (bool, error) {
+	res, err := s.db.Exec(
+		`INSERT INTO denied_tokens (kind, id, expires_at) VALUES ($1, $2, $3) ON CONFLICT (kind, id) DO NOTHING`,
+		e.Kind, e.ID, e.ExpiresAt.Unix(),
+	)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n == 1, err
+}
+
+// DeniedTokens implements DenylistStore.
+func (s *PostgresStore) DeniedTokens(now time.Time) ([]DeniedToken, error) {
+	rows, err := s.db.Query(`SELECT kind, id, expires_at FROM denied_tokens WHERE expires_at > $1`, now.Unix())
+	if err != nil {
+		return nil, err
+	}
+	return collectDeniedTokens(rows)
+}
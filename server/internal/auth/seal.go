@@ -0,0 +1,129 @@
+package auth
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+)
+
+// SealSuccessor encrypts the refresh token that replaced parent so it can be stored next
+// to parent's hash and handed out again during the refresh grace window. The key is
+// derived from parent itself: only a client still holding parent can open it, and the
+// database alone never reveals a usable token.
+func SealSuccessor(parent, successor string) ([]byte, error) {
+	return seal("papaya successor", parent, []byte(successor), nil)
+}
+
+// OpenSuccessor decrypts a value from SealSuccessor.
+func OpenSuccessor(parent string, sealed []byte) (string, error) {
+	plain, err := open("papaya successor", parent, sealed, nil)
+	return string(plain), err
+}
+
+// SealMFASecret encrypts a user's TOTP secret for storage. The key is derived from
+// auth.mfa_secret, or the refresh-token secret while that is not set, which only the
+// server holds; the username is bound in as associated data, so a sealed secret cannot
+// be moved to another account.
+func (k *Keys) SealMFASecret(username string, secret []byte) ([]byte, error) {
+	key := k.mfa
+	if key == "" {
+		var err error
+		if key, err = k.refreshSecret(); err != nil {
+			return nil, err
+		}
+	}
+	return seal("papaya mfa", key, secret, []byte(username))
+}
+
+// OpenMFASecret decrypts a value from SealMFASecret. Secrets sealed with the refresh-token
+// secret, before auth.mfa_secret was set, still open.
+func (k *Keys) OpenMFASecret(username string, sealed []byte) ([]byte, error) {
+	if k.mfa != "" {
+		plain, err := open("papaya mfa", k.mfa, sealed, []byte(username))
+		if err == nil {
+			return plain, nil
+		}
+	}
+	key, err := k.refreshSecret()
+	if err != nil {
+		return nil, err
+	}
+	return open("papaya mfa", key, sealed, []byte(username))
+}
+
+// SealCookie encrypts state the server hands to the browser in the cookie name and reads
+// back on a later request (e.g. a WebAuthn challenge), so no server-side storage is needed.
+// The key is derived from the refresh-token secret and the cookie name is bound in, so the
+// value is only accepted in the cookie it was made for.
+func (k *Keys) SealCookie(name string, state []byte) (string, error) {
+	key, err := k.refreshSecret()
+	if err != nil {
+		return "", err
+	}
+	sealed, err := seal("papaya cookie", key, state, []byte(name))
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(sealed), nil
+}
+
+// OpenCookie decrypts a value from SealCookie.
+func (k *Keys) OpenCookie(name, value string) ([]byte, error) {
+	sealed, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil {
+		return nil, err
+	}
+	key, err := k.refreshSecret()
+	if err != nil {
+		return nil, err
+	}
+	return open("papaya cookie", key, sealed, []byte(name))
+}
+
+// refreshSecret returns the refresh-token HMAC secret, from which sealing keys are derived.
+func (k *Keys) refreshSecret() (string, error) {
+	secret, ok := k.Refresh.sign.([]byte)
+	if !ok {
+		return "", errors.New("refresh-token key is not an HMAC secret")
+	}
+	return string(secret), nil
+}
+
+func seal(label, key string, plain, ad []byte) ([]byte, error) {
+	gcm, err := newAEAD(label, key)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return gcm.Seal(nonce, nonce, plain, ad), nil
+}
+
+func open(label, key string, sealed, ad []byte) ([]byte, error) {
+	gcm, err := newAEAD(label, key)
+	if err != nil {
+		return nil, err
+	}
+	if len(sealed) < gcm.NonceSize() {
+		return nil, errors.New("sealed value too short")
+	}
+	nonce, ciphertext := sealed[:gcm.NonceSize()], sealed[gcm.NonceSize():]
+	return gcm.Open(nil, nonce, ciphertext, ad)
+}
+
+// newAEAD returns AES-256-GCM keyed with SHA-256 of label and key. TokenHash (stored in
+// the database) is SHA-256 of the bare token; the label prefix makes these keys unrelated
+// to it and to each other.
+func newAEAD(label, key string) (cipher.AEAD, error) {
+	k := sha256.Sum256([]byte(label + "\x00" + key))
+	block, err := aes.NewCipher(k[:])
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
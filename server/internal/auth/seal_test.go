@@ -0,0 +1,59 @@
+package auth
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"testing"
+)
+
+func TestMFASecretSealing(t *testing.T) {
+	secret := []byte("12345678901234567890")
+	legacy := &Keys{Refresh: HMACKey("k", "refresh secret")}
+	keys := &Keys{Refresh: HMACKey("k", "refresh secret"), mfa: "mfa secret"}
+
+	sealed, err := keys.SealMFASecret("alice", secret)
+	if err != nil {
+		t.Fatalf("SealMFASecret() error = %v", err)
+	}
+	if got, err := keys.OpenMFASecret("alice", sealed); err != nil || !bytes.Equal(got, secret) {
+		t.Errorf("OpenMFASecret() = %q, %v; want the secret", got, err)
+	}
+	// Sealed with auth.mfa_secret, so the refresh secret alone cannot open it.
+	if _, err := legacy.OpenMFASecret("alice", sealed); err == nil {
+		t.Error("OpenMFASecret() without auth.mfa_secret succeeded")
+	}
+	if _, err := keys.OpenMFASecret("bob", sealed); err == nil {
+		t.Error("OpenMFASecret() for another user succeeded")
+	}
+
+	// Sealed before auth.mfa_secret was set.
+	old, err := legacy.SealMFASecret("alice", secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := keys.OpenMFASecret("alice", old); err != nil || !bytes.Equal(got, secret) {
+		t.Errorf("OpenMFASecret() of a secret sealed with the refresh secret = %q, %v; want the secret", got, err)
+	}
+}
+
+func TestSealingNeedsHMACRefreshKey(t *testing.T) {
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := NewKey("k", priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys := &Keys{Refresh: key}
+	if _, err := keys.SealMFASecret("alice", []byte("secret")); err == nil {
+		t.Error("SealMFASecret() with an Ed25519 refresh key succeeded, want an error")
+	}
+	if _, err := keys.SealCookie("papaya_webauthn", []byte("state")); err == nil {
+		t.Error("SealCookie() with an Ed25519 refresh key succeeded, want an error")
+	}
+	if _, err := keys.OpenCookie("papaya_webauthn", "AAAA"); err == nil {
+		t.Error("OpenCookie() with an Ed25519 refresh key succeeded, want an error")
+	}
+}
@@ -0,0 +1,744 @@
+package auth
+
+import (
+	"database/sql"
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	_ "modernc.org/sqlite"
+)
+
+// SQLiteStore is the Store in a local SQLite file (papaya.db in the config
+// directory). It suits a single server; see PostgresStore for several replicas.
+type SQLiteStore struct {
+	db *sql.DB
+}
+
+// OpenSQLite opens the SQLite database at dbPath, applies pending migrations (see MigrateUp), and
+// returns a SQLiteStore. It fails with ErrSchemaTooNew for a database written by a newer
+// version of papaya.
+// Creates the parent directory of dbPath if it does not exist (e.g. so /etc/papaya/papaya.db works in Docker).
+func OpenSQLite(dbPath string) (*SQLiteStore, error) {
+	db, err := openDB(dbPath)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := migrateUp(db, sqliteSchema); err != nil {
+		_ = db.Close()
+		return nil, err
+	}
+	return &SQLiteStore{db: db}, nil
+}
+
+func openDB(dbPath string) (*sql.DB, error) {
+	dir := filepath.Dir(dbPath)
+	if dir != "." {
+		if err := os.MkdirAll(dir, 0750); err != nil {
+			return nil, err
+		}
+	}
+	// Concurrent refreshes must not fail with SQLITE_BUSY: transactions are serialized on
+	// one connection, and other processes (papaya doctor, CLI commands) are waited for.
+	db, err := sql.Open("sqlite", "file:"+dbPath+"?_pragma=busy_timeout(5000)")
+	if err != nil {
+		return nil, err
+	}
+	db.SetMaxOpenConns(1)
+	return db, nil
+}
+
+// Close closes the database connection.
+func (s *SQLiteStore) Close() error {
+	return s.db.Close()
+}
+
+// Store implements SessionStore.
+func (s *SQLiteStore) Store(t RefreshToken, sess Session) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if err := store(tx, t); err != nil {
+		return err
+	}
+	now := time.Now().Unix()
+	_, err = tx.Exec(
+		`INSERT INTO sessions (family_id, username, device_label, user_agent, ip, created_at, last_used_at)
+		 VALUES (?, ?, ?, ?, ?, ?, ?)`,
+		t.FamilyID, t.Username, sess.DeviceLabel, sess.UserAgent, sess.IP, now, now,
+	)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func store(db execer, t RefreshToken) error {
+	_, err := db.Exec(
+		`INSERT INTO refresh_tokens (token_hash, username, expires_at, used_at, revoked_at, family_id, parent_hash)
+		 VALUES (?, ?, ?, NULL, NULL, ?, NULLIF(?, ''))`,
+		t.Hash, t.Username, t.ExpiresAt.Unix(), t.FamilyID, t.ParentHash,
+	)
+	return err
+}
+
+// Rotate implements SessionStore. The parent is updated and its successor inserted
+// in one transaction.
+func (s *SQLiteStore) Rotate(parentHash string, next RefreshToken, sealed []byte, grace time.Duration) (parent *RefreshToken, prior []byte, err error) {
+	now := time.Now()
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, nil, err
+	}
+	defer tx.Rollback()
+
+	t := &RefreshToken{Hash: parentHash}
+	var usedAt, revokedAt sql.NullInt64
+	var parentOfParent sql.NullString
+	var expAt int64
+	err = tx.QueryRow(
+		`SELECT username, expires_at, used_at, revoked_at, COALESCE(family_id, token_hash), parent_hash, successor_sealed
+		 FROM refresh_tokens WHERE token_hash = ?`,
+		parentHash,
+	).Scan(&t.Username, &expAt, &usedAt, &revokedAt, &t.FamilyID, &parentOfParent, &prior)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, nil, ErrTokenNotFound
+		}
+		return nil, nil, err
+	}
+	t.ParentHash = parentOfParent.String
+	t.ExpiresAt = time.Unix(expAt, 0)
+	if expAt <= now.Unix() {
+		return nil, nil, ErrTokenExpired
+	}
+	if revokedAt.Valid {
+		return nil, nil, ErrTokenRevoked
+	}
+	if usedAt.Valid {
+		if grace > 0 && prior != nil && now.Sub(time.Unix(usedAt.Int64, 0)) <= grace {
+			return t, prior, nil
+		}
+		if err := revokeFamily(tx, t.FamilyID, now.Unix()); err != nil {
+			return nil, nil, err
+		}
+		if err := recordEvent(tx, now.Unix(), EventTokenReuse, t.Username, t.FamilyID, "used refresh token presented again; family revoked"); err != nil {
+			return nil, nil, err
+		}
+		if err := tx.Commit(); err != nil {
+			return nil, nil, err
+		}
+		return t, nil, ErrTokenUsed
+	}
+
+	_, err = tx.Exec(
+		`UPDATE refresh_tokens SET used_at = ?, successor_hash = ?, successor_sealed = ? WHERE token_hash = ?`,
+		now.Unix(), next.Hash, sealed, parentHash,
+	)
+	if err != nil {
+		return nil, nil, err
+	}
+	next.FamilyID, next.ParentHash = t.FamilyID, t.Hash
+	if err := store(tx, next); err != nil {
+		return nil, nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, nil, err
+	}
+	return t, nil, nil
+}
+
+// Revoke implements SessionStore.
+func (s *SQLiteStore) Revoke(tokenHash string) error {
+	var family string
+	err := s.db.QueryRow(
+		`SELECT COALESCE(family_id, token_hash) FROM refresh_tokens WHERE token_hash = ?`,
+		tokenHash,
+	).Scan(&family)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return revokeFamily(s.db, family, time.Now().Unix())
+}
+
+// execer is implemented by *sql.DB and *sql.Tx.
+type execer interface {
+	Exec(query string, args ...any) (sql.Result, error)
+}
+
+func revokeFamily(db execer, familyID string, now int64) error {
+	_, err := db.Exec(
+		`UPDATE refresh_tokens SET revoked_at = ?
+		 WHERE COALESCE(family_id, token_hash) = ? AND revoked_at IS NULL`,
+		now, familyID,
+	)
+	return err
+}
+
+// RecordEvent implements EventStore.
+func (s *SQLiteStore) RecordEvent(kind, username, familyID, detail string) error {
+	return recordEvent(s.db, time.Now().Unix(), kind, username, familyID, detail)
+}
+
+func recordEvent(db execer, at int64, kind, username, familyID, detail string) error {
+	_, err := db.Exec(
+		`INSERT INTO auth_events (at, kind, username, family_id, detail) VALUES (?, ?, ?, NULLIF(?, ''), ?)`,
+		at, kind, username, familyID, detail,
+	)
+	return err
+}
+
+// RevokeAllForUser implements SessionStore.
+func (s *SQLiteStore) RevokeAllForUser(username string) ([]string, error) {
+	rows, err := s.db.Query(
+		`UPDATE refresh_tokens SET revoked_at = ? WHERE username = ? AND revoked_at IS NULL
+		 RETURNING COALESCE(family_id, token_hash)`,
+		time.Now().Unix(), username,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return collectSessionIDs(rows)
+}
+
+// Prune implements Store.
+func (s *SQLiteStore) Prune(cutoff time.Time) (PruneResult, error) {
+	var r PruneResult
+	tx, err := s.db.Begin()
+	if err != nil {
+		return r, err
+	}
+	defer tx.Rollback()
+	c := cutoff.Unix()
+	res, err := tx.Exec(
+		`DELETE FROM refresh_tokens WHERE expires_at < ? OR used_at < ? OR revoked_at < ?`,
+		c, c, c,
+	)
+	if err != nil {
+		return r, err
+	}
+	if r.Tokens, err = res.RowsAffected(); err != nil {
+		return r, err
+	}
+	res, err = tx.Exec(
+		`DELETE FROM sessions WHERE NOT EXISTS (SELECT 1 FROM refresh_tokens t WHERE t.family_id = sessions.family_id)`,
+	)
+	if err != nil {
+		return r, err
+	}
+	if r.Sessions, err = res.RowsAffected(); err != nil {
+		return r, err
+	}
+	for _, d := range []struct {
+		n     *int64
+		query string
+	}{
+		{&r.FailedLogins, `DELETE FROM failed_logins WHERE last_at < ?`},
+		{&r.PATs, `DELETE FROM personal_access_tokens WHERE expires_at < ?`},
+		{&r.Denylist, `DELETE FROM denied_tokens WHERE expires_at < ?`},
+	} {
+		res, err := tx.Exec(d.query, c)
+		if err != nil {
+			return r, err
+		}
+		if *d.n, err = res.RowsAffected(); err != nil {
+			return r, err
+		}
+	}
+	return r, tx.Commit()
+}
+
+// Sessions implements SessionStore.
+func (s *SQLiteStore) Sessions(username string) ([]Session, error) {
+	rows, err := s.db.Query(
+		`SELECT COALESCE(t.family_id, t.token_hash), COALESCE(s.device_label, ''), COALESCE(s.user_agent, ''),
+		        COALESCE(s.ip, ''), COALESCE(s.created_at, 0), COALESCE(s.last_used_at, 0), t.expires_at
+		 FROM refresh_tokens t LEFT JOIN sessions s ON s.family_id = t.family_id
+		 WHERE t.username = ? AND t.used_at IS NULL AND t.revoked_at IS NULL AND t.expires_at > ?
+		 ORDER BY COALESCE(s.last_used_at, 0) DESC`,
+		username, time.Now().Unix(),
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	sessions := []Session{}
+	for rows.Next() {
+		sess := Session{Username: username}
+		var created, lastUsed, expires int64
+		if err := rows.Scan(&sess.ID, &sess.DeviceLabel, &sess.UserAgent, &sess.IP, &created, &lastUsed, &expires); err != nil {
+			return nil, err
+		}
+		if created != 0 {
+			sess.CreatedAt, sess.LastUsedAt = time.Unix(created, 0), time.Unix(lastUsed, 0)
+		}
+		sess.ExpiresAt = time.Unix(expires, 0)
+		sessions = append(sessions, sess)
+	}
+	return sessions, rows.Err()
+}
+
+// Touch implements SessionStore.
+func (s *SQLiteStore) Touch(sessionID, userAgent, ip string) error {
+	_, err := s.db.Exec(
+		`UPDATE sessions SET last_used_at = ?, user_agent = ?, ip = ? WHERE family_id = ?`,
+		time.Now().Unix(), userAgent, ip, sessionID,
+	)
+	return err
+}
+
+// RevokeSession implements SessionStore.
+func (s *SQLiteStore) RevokeSession(username, sessionID string) error {
+	res, err := s.db.Exec(
+		`UPDATE refresh_tokens SET revoked_at = ?
+		 WHERE username = ? AND COALESCE(family_id, token_hash) = ? AND revoked_at IS NULL`,
+		time.Now().Unix(), username, sessionID,
+	)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return ErrSessionNotFound
+	}
+	return nil
+}
+
+// RevokeOtherSessions implements SessionStore.
+func (s *SQLiteStore) RevokeOtherSessions(username, keepID string) ([]string, error) {
+	rows, err := s.db.Query(
+		`UPDATE refresh_tokens SET revoked_at = ?
+		 WHERE username = ? AND COALESCE(family_id, token_hash) != ? AND revoked_at IS NULL
+		 RETURNING COALESCE(family_id, token_hash)`,
+		time.Now().Unix(), username, keepID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return collectSessionIDs(rows)
+}
+
+// MFA implements MFAStore.
+func (s *SQLiteStore) MFA(username string) (*MFAEnrollment, error) {
+	e := &MFAEnrollment{Username: username}
+	var confirmed sql.NullInt64
+	err := s.db.QueryRow(
+		`SELECT secret_sealed, confirmed_at, last_step,
+		        (SELECT COUNT(*) FROM mfa_recovery_codes WHERE username = ? AND used_at IS NULL)
+		 FROM mfa_totp WHERE username = ?`,
+		username, username,
+	).Scan(&e.SealedSecret, &confirmed, &e.LastStep, &e.RecoveryCodesLeft)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrMFANotEnrolled
+	}
+	if err != nil {
+		return nil, err
+	}
+	if confirmed.Valid {
+		e.ConfirmedAt = time.Unix(confirmed.Int64, 0)
+	}
+	return e, nil
+}
+
+// BeginMFA implements MFAStore.
+func (s *SQLiteStore) BeginMFA(username string, sealedSecret []byte) error {
+	res, err := s.db.Exec(
+		`INSERT INTO mfa_totp (username, secret_sealed, created_at) VALUES (?, ?, ?)
+		 ON CONFLICT (username) DO UPDATE SET secret_sealed = excluded.secret_sealed, created_at = excluded.created_at, last_step = 0
+		 WHERE mfa_totp.confirmed_at IS NULL`,
+		username, sealedSecret, time.Now().Unix(),
+	)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return ErrMFAEnrolled
+	}
+	return nil
+}
+
+// ConfirmMFA implements MFAStore.
+func (s *SQLiteStore) ConfirmMFA(username string, codeHashes []string) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	res, err := tx.Exec(
+		`UPDATE mfa_totp SET confirmed_at = COALESCE(confirmed_at, ?) WHERE username = ?`,
+		time.Now().Unix(), username,
+	)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return ErrMFANotEnrolled
+	}
+	if _, err := tx.Exec(`DELETE FROM mfa_recovery_codes WHERE username = ?`, username); err != nil {
+		return err
+	}
+	for _, h := range codeHashes {
+		if _, err := tx.Exec(`INSERT INTO mfa_recovery_codes (username, code_hash) VALUES (?, ?)`, username, h); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// UseTOTPStep implements MFAStore.
+func (s *SQLiteStore) UseTOTPStep(username string, step int64) (bool, error) {
+	res, err := s.db.Exec(
+		`UPDATE mfa_totp SET last_step = ? WHERE username = ? AND last_step < ?`,
+		step, username, step,
+	)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n == 1, err
+}
+
+// UseRecoveryCode implements MFAStore.
+func (s *SQLiteStore) UseRecoveryCode(username, codeHash string) (bool, error) {
+	res, err := s.db.Exec(
+		`UPDATE mfa_recovery_codes SET used_at = ? WHERE username = ? AND code_hash = ? AND used_at IS NULL`,
+		time.Now().Unix(), username, codeHash,
+	)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n == 1, err
+}
+
+// DeleteMFA implements MFAStore.
+func (s *SQLiteStore) DeleteMFA(username string) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec(`DELETE FROM mfa_recovery_codes WHERE username = ?`, username); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`DELETE FROM mfa_totp WHERE username = ?`, username); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// AddWebAuthnCredential implements WebAuthnStore.
+func (s *SQLiteStore) AddWebAuthnCredential(c WebAuthnCredential) error {
+	res, err := s.db.Exec(
+		`INSERT INTO webauthn_credentials (id, username, user_handle, name, data, created_at)
+		 VALUES (?, ?, ?, ?, ?, ?) ON CONFLICT (id) DO NOTHING`,
+		c.ID, c.Username, c.UserHandle, c.Name, c.Data, time.Now().Unix(),
+	)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return ErrDuplicateCredential
+	}
+	return nil
+}
+
+// WebAuthnCredentials implements WebAuthnStore.
+func (s *SQLiteStore) WebAuthnCredentials(username string) ([]WebAuthnCredential, error) {
+	return s.queryWebAuthnCredentials(`username = ?`, username)
+}
+
+// WebAuthnCredentialsByHandle implements WebAuthnStore.
+func (s *SQLiteStore) WebAuthnCredentialsByHandle(handle []byte) ([]WebAuthnCredential, error) {
+	return s.queryWebAuthnCredentials(`user_handle = ?`, handle)
+}
+
+func (s *SQLiteStore) queryWebAuthnCredentials(where string, arg any) ([]WebAuthnCredential, error) {
+	rows, err := s.db.Query(
+		`SELECT id, username, user_handle, name, data, created_at, COALESCE(last_used_at, 0)
+		 FROM webauthn_credentials WHERE `+where+` ORDER BY created_at`,
+		arg,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	creds := []WebAuthnCredential{}
+	for rows.Next() {
+		var c WebAuthnCredential
+		var created, lastUsed int64
+		if err := rows.Scan(&c.ID, &c.Username, &c.UserHandle, &c.Name, &c.Data, &created, &lastUsed); err != nil {
+			return nil, err
+		}
+		c.CreatedAt = time.Unix(created, 0)
+		if lastUsed != 0 {
+			c.LastUsedAt = time.Unix(lastUsed, 0)
+		}
+		creds = append(creds, c)
+	}
+	return creds, rows.Err()
+}
+
+// UpdateWebAuthnCredential implements WebAuthnStore.
+func (s *SQLiteStore) UpdateWebAuthnCredential(id, data []byte) error {
+	_, err := s.db.Exec(
+		`UPDATE webauthn_credentials SET data = ?, last_used_at = ? WHERE id = ?`,
+		data, time.Now().Unix(), id,
+	)
+	return err
+}
+
+// DeleteWebAuthnCredential implements WebAuthnStore.
+func (s *SQLiteStore) DeleteWebAuthnCredential(username string, id []byte) error {
+	res, err := s.db.Exec(`DELETE FROM webauthn_credentials WHERE username = ? AND id = ?`, username, id)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return ErrCredentialNotFound
+	}
+	return nil
+}
+
+// FailedLogins implements LoginThrottleStore.
+func (s *SQLiteStore) FailedLogins(key string) (FailedLogins, error) {
+	return scanFailedLogins(key, s.db.QueryRow(`SELECT failures, last_at FROM failed_logins WHERE throttle_key = ?`, key))
+}
+
+// RecordFailedLogin implements LoginThrottleStore.
+func (s *SQLiteStore) RecordFailedLogin(key string, at time.Time, window time.Duration) (FailedLogins, error) {
+	return scanFailedLogins(key, s.db.QueryRow(
+		`INSERT INTO failed_logins (throttle_key, failures, last_at) VALUES (?, 1, ?)
+		 ON CONFLICT (throttle_key) DO UPDATE SET
+		   failures = CASE WHEN failed_logins.last_at < ? THEN 1 ELSE failed_logins.failures + 1 END,
+		   last_at = excluded.last_at
+		 RETURNING failures, last_at`,
+		key, at.Unix(), at.Add(-window).Unix(),
+	))
+}
+
+// ClearFailedLogins implements LoginThrottleStore.
+func (s *SQLiteStore) ClearFailedLogins(key string) error {
+	_, err := s.db.Exec(`DELETE FROM failed_logins WHERE throttle_key = ?`, key)
+	return err
+}
+
+// ListFailedLogins implements LoginThrottleStore.
+func (s *SQLiteStore) ListFailedLogins(since time.Time) ([]FailedLogins, error) {
+	rows, err := s.db.Query(
+		`SELECT throttle_key, failures, last_at FROM failed_logins WHERE last_at >= ? ORDER BY last_at DESC`,
+		since.Unix(),
+	)
+	if err != nil {
+		return nil, err
+	}
+	return collectFailedLogins(rows)
+}
+
+// scanFailedLogins reads the failures and last_at columns of key's row; no row means no
+// failures.
+func scanFailedLogins(key string, row *sql.Row) (FailedLogins, error) {
+	f := FailedLogins{Key: key}
+	var lastAt int64
+	err := row.Scan(&f.Count, &lastAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return f, nil
+	}
+	if err != nil {
+		return f, err
+	}
+	f.LastAt = time.Unix(lastAt, 0)
+	return f, nil
+}
+
+// collectFailedLogins reads rows of throttle_key, failures and last_at, and closes rows.
+func collectFailedLogins(rows *sql.Rows) ([]FailedLogins, error) {
+	defer rows.Close()
+	var list []FailedLogins
+	for rows.Next() {
+		var f FailedLogins
+		var lastAt int64
+		if err := rows.Scan(&f.Key, &f.Count, &lastAt); err != nil {
+			return nil, err
+		}
+		f.LastAt = time.Unix(lastAt, 0)
+		list = append(list, f)
+	}
+	return list, rows.Err()
+}
+
+// AddPersonalAccessToken implements PATStore.
+func (s *SQLiteStore) AddPersonalAccessToken(t PersonalAccessToken) error {
+	_, err := s.db.Exec(
+		`INSERT INTO personal_access_tokens (id, username, name, scopes, token_hash, created_at, expires_at)
+		 VALUES (?, ?, ?, ?, ?, ?, ?)`,
+		t.ID, t.Username, t.Name, strings.Join(t.Scopes, " "), t.Hash, time.Now().Unix(), t.ExpiresAt.Unix(),
+	)
+	return err
+}
+
+// PersonalAccessTokenByHash implements PATStore.
+func (s *SQLiteStore) PersonalAccessTokenByHash(hash string) (*PersonalAccessToken, error) {
+	rows, err := s.db.Query(`SELECT `+patColumns+` FROM personal_access_tokens WHERE token_hash = ?`, hash)
+	if err != nil {
+		return nil, err
+	}
+	return firstPersonalAccessToken(rows)
+}
+
+// PersonalAccessTokens implements PATStore.
+func (s *SQLiteStore) PersonalAccessTokens(username string) ([]PersonalAccessToken, error) {
+	rows, err := s.db.Query(`SELECT `+patColumns+` FROM personal_access_tokens WHERE username = ? ORDER BY created_at`, username)
+	if err != nil {
+		return nil, err
+	}
+	return collectPersonalAccessTokens(rows)
+}
+
+// TouchPersonalAccessToken implements PATStore.
+func (s *SQLiteStore) TouchPersonalAccessToken(id string) error {
+	_, err := s.db.Exec(`UPDATE personal_access_tokens SET last_used_at = ? WHERE id = ?`, time.Now().Unix(), id)
+	return err
+}
+
+// DeletePersonalAccessToken implements PATStore.
+func (s *SQLiteStore) DeletePersonalAccessToken(username, id string) error {
+	res, err := s.db.Exec(`DELETE FROM personal_access_tokens WHERE username = ? AND id = ?`, username, id)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return ErrPATNotFound
+	}
+	return nil
+}
+
+// Deny implements DenylistStore.
+func (s *SQLiteStore) Deny(entries ...DeniedToken) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for _, e := range entries {
+		_, err := tx.Exec(
+			`INSERT INTO denied_tokens (kind, id, expires_at) VALUES (?, ?, ?)
+			 ON CONFLICT (kind, id) DO UPDATE SET expires_at = MAX(denied_tokens.expires_at, excluded.expires_at)`,
+			e.Kind, e.ID, e.ExpiresAt.Unix(),
+		)
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// DenyOnce implements DenylistStore.
+func (s *SQLiteStore) DenyOnce(e DeniedToken) (bool, error) {
+	res, err := s.db.Exec(
+		`INSERT INTO denied_tokens (kind, id, expires_at) VALUES (?, ?, ?) ON CONFLICT (kind, id) DO NOTHING`,
+		e.Kind, e.ID, e.ExpiresAt.Unix(),
+	)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n == 1, err
+}
+
+// DeniedTokens implements DenylistStore.
+func (s *SQLiteStore) DeniedTokens(now time.Time) ([]DeniedToken, error) {
+	rows, err := s.db.Query(`SELECT kind, id, expires_at FROM denied_tokens WHERE expires_at > ?`, now.Unix())
+	if err != nil {
+		return nil, err
+	}
+	return collectDeniedTokens(rows)
+}
+
+// collectDeniedTokens reads rows of kind, id and expires_at and closes rows.
+func collectDeniedTokens(rows *sql.Rows) ([]DeniedToken, error) {
+	defer rows.Close()
+	list := []DeniedToken{}
+	for rows.Next() {
+		var e DeniedToken
+		var expires int64
+		if err := rows.Scan(&e.Kind, &e.ID, &expires); err != nil {
+			return nil, err
+		}
+		e.ExpiresAt = time.Unix(expires, 0)
+		list = append(list, e)
+	}
+	return list, rows.Err()
+}
+
+// collectSessionIDs reads a column of session IDs, dropping repeats, and closes rows.
+func collectSessionIDs(rows *sql.Rows) ([]string, error) {
+	defer rows.Close()
+	ids := []string{}
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		if !slices.Contains(ids, id) {
+			ids = append(ids, id)
+		}
+	}
+	return ids, rows.Err()
+}
+
+// patColumns are the personal_access_tokens columns collectPersonalAccessTokens reads.
+const patColumns = `id, username, name, scopes, token_hash, created_at, expires_at, COALESCE(last_used_at, 0)`
+
+// collectPersonalAccessTokens reads rows of patColumns and closes rows.
+func collectPersonalAccessTokens(rows *sql.Rows) ([]PersonalAccessToken, error) {
+	defer rows.Close()
+	list := []PersonalAccessToken{}
+	for rows.Next() {
+		var t PersonalAccessToken
+		var scopes string
+		var created, expires, lastUsed int64
+		if err := rows.Scan(&t.ID, &t.Username, &t.Name, &scopes, &t.Hash, &created, &expires, &lastUsed); err != nil {
+			return nil, err
+		}
+		t.Scopes = strings.Fields(scopes)
+		t.CreatedAt, t.ExpiresAt = time.Unix(created, 0), time.Unix(expires, 0)
+		if lastUsed != 0 {
+			t.LastUsedAt = time.Unix(lastUsed, 0)
+		}
+		list = append(list, t)
+	}
+	return list, rows.Err()
+}
+
+// firstPersonalAccessToken returns the first of rows (see collectPersonalAccessTokens), or
+// ErrPATNotFound.
+func firstPersonalAccessToken(rows *sql.Rows) (*PersonalAccessToken, error) {
+	list, err := collectPersonalAccessTokens(rows)
+	if err != nil {
+		return nil, err
+	}
+	if len(list) == 0 {
+		return nil, ErrPATNotFound
+	}
+	return &list[0], nil
+}
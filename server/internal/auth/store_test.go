@@ -0,0 +1,71 @@
+package auth_test
+
+import (
+	"database/sql"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/fridayflag/papaya/internal/auth"
+	"github.com/fridayflag/papaya/internal/auth/storetest"
+)
+
+func TestMemoryStore(t *testing.T) {
+	storetest.Run(t, func(t *testing.T) auth.Store {
+		return auth.NewMemoryStore()
+	})
+}
+
+func TestSQLiteStore(t *testing.T) {
+	storetest.Run(t, func(t *testing.T) auth.Store {
+		s, err := auth.OpenSQLite(filepath.Join(t.TempDir(), "papaya.db"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return s
+	})
+}
+
+func TestPostgresStore(t *testing.T) {
+	storetest.Run(t, func(t *testing.T) auth.Store {
+		s, err := auth.OpenPostgres(postgresFixture(t))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return s
+	})
+}
+
+// postgresFixture returns the URL of an empty schema in the database at
+// $PAPAYA_TEST_POSTGRES_URL, dropped when the test ends. It skips the test when the
+// variable is not set.
+func postgresFixture(t *testing.T) string {
+	t.Helper()
+	base := os.Getenv("PAPAYA_TEST_POSTGRES_URL")
+	if base == "" {
+		t.Skip("PAPAYA_TEST_POSTGRES_URL not set")
+	}
+	db, err := sql.Open("pgx", base)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	schema := "papaya_test_" + auth.NewFamilyID()
+	if _, err := db.Exec(`CREATE SCHEMA ` + schema); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		if _, err := db.Exec(`DROP SCHEMA ` + schema + ` CASCADE`); err != nil {
+			t.Errorf("dropping %s: %v", schema, err)
+		}
+	})
+	u, err := url.Parse(base)
+	if err != nil {
+		t.Fatal(err)
+	}
+	q := u.Query()
+	q.Set("search_path", schema)
+	u.RawQuery = q.Encode()
+	return u.String()
+}
@@ -0,0 +1,724 @@
+// Package storetest checks that an auth.Store behaves like the others. Each backend's
+// tests call Run with a function that opens an empty store.
+package storetest
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/fridayflag/papaya/internal/auth"
+)
+
+// Run runs the conformance suite against the stores returned by open, which must be empty
+// and are closed by Run.
+func Run(t *testing.T, open func(t *testing.T) auth.Store) {
+	tests := []struct {
+		name string
+		fn   func(t *testing.T, s auth.Store)
+	}{
+		{"Sessions", testSessions},
+		{"Rotate", testRotate},
+		{"RotateGrace", testRotateGrace},
+		{"RotateReuse", testRotateReuse},
+		{"RotateConcurrent", testRotateConcurrent},
+		{"RevokeSessions", testRevokeSessions},
+		{"MFA", testMFA},
+		{"WebAuthn", testWebAuthn},
+		{"FailedLogins", testFailedLogins},
+		{"PersonalAccessTokens", testPersonalAccessTokens},
+		{"Denylist", testDenylist},
+		{"DenyOnce", testDenyOnce},
+		{"Prune", testPrune},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := open(t)
+			t.Cleanup(func() {
+				if err := s.Close(); err != nil {
+					t.Errorf("Close() error = %v", err)
+				}
+			})
+			tt.fn(t, s)
+		})
+	}
+}
+
+// inAnHour returns the time an hour from now, in seconds like the SQL stores keep it.
+func inAnHour() time.Time {
+	return time.Now().Add(time.Hour).Truncate(time.Second)
+}
+
+// login stores the first refresh token of a new session for username and returns it.
+func login(t *testing.T, s auth.Store, username, deviceLabel string) auth.RefreshToken {
+	t.Helper()
+	rt := auth.RefreshToken{Hash: auth.TokenHash(auth.NewFamilyID()), Username: username, FamilyID: auth.NewFamilyID(), ExpiresAt: inAnHour()}
+	if err := s.Store(rt, auth.Session{DeviceLabel: deviceLabel, UserAgent: "test", IP: "192.0.2.1"}); err != nil {
+		t.Fatalf("Store() error = %v", err)
+	}
+	return rt
+}
+
+// successor returns a new refresh token to rotate to.
+func successor(username string) auth.RefreshToken {
+	return auth.RefreshToken{Hash: auth.TokenHash(auth.NewFamilyID()), Username: username, ExpiresAt: inAnHour()}
+}
+
+func wholeSeconds(t time.Time) bool {
+	return t.Equal(t.Truncate(time.Second))
+}
+
+func sessionIDs(t *testing.T, s auth.Store, username string) []string {
+	t.Helper()
+	sessions, err := s.Sessions(username)
+	if err != nil {
+		t.Fatalf("Sessions() error = %v", err)
+	}
+	ids := []string{}
+	for _, sess := range sessions {
+		ids = append(ids, sess.ID)
+	}
+	slices.Sort(ids)
+	return ids
+}
+
+func sorted(ids ...string) []string {
+	slices.Sort(ids)
+	return ids
+}
+
+func testSessions(t *testing.T, s auth.Store) {
+	rt := login(t, s, "alice", "laptop")
+	login(t, s, "bob", "")
+
+	sessions, err := s.Sessions("alice")
+	if err != nil {
+		t.Fatalf("Sessions() error = %v", err)
+	}
+	if len(sessions) != 1 {
+		t.Fatalf("Sessions() = %d sessions, want 1", len(sessions))
+	}
+	got := sessions[0]
+	if got.ID != rt.FamilyID || got.Username != "alice" || got.DeviceLabel != "laptop" || got.UserAgent != "test" || got.IP != "192.0.2.1" {
+		t.Errorf("Sessions() = %+v", got)
+	}
+	if !got.ExpiresAt.Equal(rt.ExpiresAt) {
+		t.Errorf("ExpiresAt = %v, want %v", got.ExpiresAt, rt.ExpiresAt)
+	}
+	if got.CreatedAt.IsZero() || got.LastUsedAt.Before(got.CreatedAt) {
+		t.Errorf("CreatedAt = %v, LastUsedAt = %v", got.CreatedAt, got.LastUsedAt)
+	}
+	if !wholeSeconds(got.CreatedAt) || !wholeSeconds(got.LastUsedAt) {
+		t.Errorf("CreatedAt = %v, LastUsedAt = %v; want whole seconds like the SQL stores", got.CreatedAt, got.LastUsedAt)
+	}
+
+	if err := s.Touch(rt.FamilyID, "other", "192.0.2.2"); err != nil {
+		t.Fatalf("Touch() error = %v", err)
+	}
+	sessions, _ = s.Sessions("alice")
+	if sessions[0].UserAgent != "other" || sessions[0].IP != "192.0.2.2" {
+		t.Errorf("after Touch() session = %+v", sessions[0])
+	}
+	if err := s.Touch("unknown", "ua", "ip"); err != nil {
+		t.Errorf("Touch(unknown) error = %v", err)
+	}
+	if ids := sessionIDs(t, s, "carol"); len(ids) != 0 {
+		t.Errorf("Sessions(carol) = %v, want none", ids)
+	}
+}
+
+func testRotate(t *testing.T, s auth.Store) {
+	rt := login(t, s, "alice", "")
+	next := successor("alice")
+	parent, prior, err := s.Rotate(rt.Hash, next, []byte("sealed"), 0)
+	if err != nil {
+		t.Fatalf("Rotate() error = %v", err)
+	}
+	if prior != nil {
+		t.Errorf("Rotate() prior = %q, want nil", prior)
+	}
+	if parent.Username != "alice" || parent.FamilyID != rt.FamilyID || parent.Hash != rt.Hash || !parent.ExpiresAt.Equal(rt.ExpiresAt) {
+		t.Errorf("Rotate() parent = %+v, want %+v", parent, rt)
+	}
+	if ids := sessionIDs(t, s, "alice"); !slices.Equal(ids, []string{rt.FamilyID}) {
+		t.Errorf("Sessions() = %v, want the rotated session only", ids)
+	}
+
+	// The successor carries on the family.
+	third := successor("alice")
+	parent, _, err = s.Rotate(next.Hash, third, []byte("sealed"), 0)
+	if err != nil {
+		t.Fatalf("Rotate(successor) error = %v", err)
+	}
+	if parent.FamilyID != rt.FamilyID || parent.ParentHash != rt.Hash {
+		t.Errorf("Rotate(successor) parent = %+v, want family %s and parent %s", parent, rt.FamilyID, rt.Hash)
+	}
+
+	if _, _, err := s.Rotate(auth.TokenHash("unknown"), successor("alice"), nil, 0); !errors.Is(err, auth.ErrTokenNotFound) {
+		t.Errorf("Rotate(unknown) error = %v, want ErrTokenNotFound", err)
+	}
+
+	expired := auth.RefreshToken{Hash: auth.TokenHash(auth.NewFamilyID()), Username: "alice", FamilyID: auth.NewFamilyID(), ExpiresAt: time.Now().Add(-time.Minute)}
+	if err := s.Store(expired, auth.Session{}); err != nil {
+		t.Fatalf("Store(expired) error = %v", err)
+	}
+	if _, _, err := s.Rotate(expired.Hash, successor("alice"), nil, 0); !errors.Is(err, auth.ErrTokenExpired) {
+		t.Errorf("Rotate(expired) error = %v, want ErrTokenExpired", err)
+	}
+
+	if err := s.Revoke(third.Hash); err != nil {
+		t.Fatalf("Revoke() error = %v", err)
+	}
+	if _, _, err := s.Rotate(third.Hash, successor("alice"), nil, 0); !errors.Is(err, auth.ErrTokenRevoked) {
+		t.Errorf("Rotate(revoked) error = %v, want ErrTokenRevoked", err)
+	}
+	if err := s.Revoke(auth.TokenHash("unknown")); err != nil {
+		t.Errorf("Revoke(unknown) error = %v", err)
+	}
+	if ids := sessionIDs(t, s, "alice"); len(ids) != 0 {
+		t.Errorf("Sessions() after Revoke() = %v, want none", ids)
+	}
+}
+
+func testRotateGrace(t *testing.T, s auth.Store) {
+	rt := login(t, s, "alice", "")
+	next := successor("alice")
+	if _, _, err := s.Rotate(rt.Hash, next, []byte("sealed next"), time.Minute); err != nil {
+		t.Fatalf("Rotate() error = %v", err)
+	}
+	// A second tab presenting the same token within the grace period gets the same successor.
+	parent, prior, err := s.Rotate(rt.Hash, successor("alice"), []byte("sealed other"), time.Minute)
+	if err != nil {
+		t.Fatalf("Rotate() within grace error = %v", err)
+	}
+	if string(prior) != "sealed next" || parent.FamilyID != rt.FamilyID {
+		t.Errorf("Rotate() within grace = %+v, %q; want the first successor", parent, prior)
+	}
+	if ids := sessionIDs(t, s, "alice"); !slices.Equal(ids, []string{rt.FamilyID}) {
+		t.Errorf("Sessions() = %v, want one session", ids)
+	}
+	if _, _, err := s.Rotate(next.Hash, successor("alice"), nil, time.Minute); err != nil {
+		t.Errorf("Rotate(successor) error = %v", err)
+	}
+}
+
+func testRotateReuse(t *testing.T, s auth.Store) {
+	// Stores keep whole seconds, so a sub-second expiry comes back truncated.
+	expires := time.Now().Add(time.Hour)
+	rt := auth.RefreshToken{Hash: auth.TokenHash(auth.NewFamilyID()), Username: "alice", FamilyID: auth.NewFamilyID(), ExpiresAt: expires}
+	if err := s.Store(rt, auth.Session{}); err != nil {
+		t.Fatalf("Store() error = %v", err)
+	}
+	next := successor("alice")
+	parent, _, err := s.Rotate(rt.Hash, next, []byte("sealed"), 0)
+	if err != nil {
+		t.Fatalf("Rotate() error = %v", err)
+	}
+	if want := expires.Truncate(time.Second); !parent.ExpiresAt.Equal(want) {
+		t.Errorf("Rotate() parent ExpiresAt = %v, want %v", parent.ExpiresAt, want)
+	}
+	other := login(t, s, "alice", "")
+
+	// Presenting the used token again, here after the grace period, revokes its family.
+	parent, prior, err := s.Rotate(rt.Hash, successor("alice"), []byte("sealed again"), time.Nanosecond)
+	if !errors.Is(err, auth.ErrTokenUsed) {
+		t.Fatalf("Rotate(used) error = %v, want ErrTokenUsed", err)
+	}
+	if parent == nil || parent.Username != "alice" || parent.FamilyID != rt.FamilyID || prior != nil {
+		t.Errorf("Rotate(used) = %+v, %q; want the parent and no prior", parent, prior)
+	}
+	if _, _, err := s.Rotate(next.Hash, successor("alice"), nil, 0); !errors.Is(err, auth.ErrTokenRevoked) {
+		t.Errorf("Rotate(successor) after reuse error = %v, want ErrTokenRevoked", err)
+	}
+	if ids := sessionIDs(t, s, "alice"); !slices.Equal(ids, []string{other.FamilyID}) {
+		t.Errorf("Sessions() = %v, want only the other session", ids)
+	}
+}
+
+// testRotateConcurrent presents one refresh token from several goroutines at once, as
+// tabs refreshing together do.
+func testRotateConcurrent(t *testing.T, s auth.Store) {
+	const n = 8
+	rotate := func(parentHash string, grace time.Duration) (priors [][]byte, sealed []string, errs []error) {
+		priors, sealed, errs = make([][]byte, n), make([]string, n), make([]error, n)
+		var wg sync.WaitGroup
+		for i := range n {
+			sealed[i] = auth.NewFamilyID()
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				_, priors[i], errs[i] = s.Rotate(parentHash, successor("alice"), []byte(sealed[i]), grace)
+			}()
+		}
+		wg.Wait()
+		return priors, sealed, errs
+	}
+
+	t.Run("grace", func(t *testing.T) {
+		rt := login(t, s, "alice", "")
+		priors, sealed, errs := rotate(rt.Hash, time.Minute)
+		winner := -1
+		for i := range n {
+			if errs[i] != nil {
+				t.Fatalf("Rotate() error = %v", errs[i])
+			}
+			if priors[i] == nil {
+				if winner >= 0 {
+					t.Fatal("Rotate() rotated the same token twice")
+				}
+				winner = i
+			}
+		}
+		if winner < 0 {
+			t.Fatal("Rotate() never rotated the token")
+		}
+		for i := range n {
+			if i != winner && string(priors[i]) != sealed[winner] {
+				t.Errorf("Rotate() prior = %q, want the winner's %q", priors[i], sealed[winner])
+			}
+		}
+		if ids := sessionIDs(t, s, "alice"); !slices.Equal(ids, []string{rt.FamilyID}) {
+			t.Errorf("Sessions() = %v, want the one session", ids)
+		}
+		if _, err := s.RevokeAllForUser("alice"); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	t.Run("no grace", func(t *testing.T) {
+		rt := login(t, s, "alice", "")
+		_, _, errs := rotate(rt.Hash, 0)
+		ok := 0
+		for _, err := range errs {
+			switch {
+			case err == nil:
+				ok++
+			case !errors.Is(err, auth.ErrTokenUsed) && !errors.Is(err, auth.ErrTokenRevoked):
+				t.Errorf("Rotate() error = %v, want ErrTokenUsed or ErrTokenRevoked", err)
+			}
+		}
+		if ok != 1 {
+			t.Errorf("Rotate() succeeded %d times, want once", ok)
+		}
+		// The losers are replays, so the family is revoked.
+		if ids := sessionIDs(t, s, "alice"); len(ids) != 0 {
+			t.Errorf("Sessions() = %v, want none", ids)
+		}
+	})
+}
+
+func testRevokeSessions(t *testing.T, s auth.Store) {
+	a := login(t, s, "alice", "a")
+	b := login(t, s, "alice", "b")
+	c := login(t, s, "alice", "c")
+	bob := login(t, s, "bob", "")
+
+	if err := s.RevokeSession("alice", bob.FamilyID); !errors.Is(err, auth.ErrSessionNotFound) {
+		t.Errorf("RevokeSession(other user's) error = %v, want ErrSessionNotFound", err)
+	}
+	if err := s.RevokeSession("alice", a.FamilyID); err != nil {
+		t.Fatalf("RevokeSession() error = %v", err)
+	}
+	if ids, want := sessionIDs(t, s, "alice"), sorted(b.FamilyID, c.FamilyID); !slices.Equal(ids, want) {
+		t.Errorf("Sessions() = %v, want %v", ids, want)
+	}
+	// A rotated session still counts once.
+	if _, _, err := s.Rotate(c.Hash, successor("alice"), nil, 0); err != nil {
+		t.Fatal(err)
+	}
+	ended, err := s.RevokeOtherSessions("alice", b.FamilyID)
+	if err != nil {
+		t.Fatalf("RevokeOtherSessions() error = %v", err)
+	}
+	if slices.Sort(ended); !slices.Equal(ended, []string{c.FamilyID}) {
+		t.Errorf("RevokeOtherSessions() = %v, want %v", ended, []string{c.FamilyID})
+	}
+	if ids := sessionIDs(t, s, "alice"); !slices.Equal(ids, []string{b.FamilyID}) {
+		t.Errorf("Sessions() = %v, want %v", ids, []string{b.FamilyID})
+	}
+	ended, err = s.RevokeAllForUser("alice")
+	if err != nil {
+		t.Fatalf("RevokeAllForUser() error = %v", err)
+	}
+	if !slices.Equal(ended, []string{b.FamilyID}) {
+		t.Errorf("RevokeAllForUser() = %v, want %v", ended, []string{b.FamilyID})
+	}
+	if ended, _ = s.RevokeAllForUser("alice"); len(ended) != 0 {
+		t.Errorf("RevokeAllForUser() again = %v, want none", ended)
+	}
+	if ids := sessionIDs(t, s, "alice"); len(ids) != 0 {
+		t.Errorf("Sessions() = %v, want none", ids)
+	}
+	if ids := sessionIDs(t, s, "bob"); !slices.Equal(ids, []string{bob.FamilyID}) {
+		t.Errorf("Sessions(bob) = %v, want untouched", ids)
+	}
+}
+
+func testMFA(t *testing.T, s auth.Store) {
+	if _, err := s.MFA("alice"); !errors.Is(err, auth.ErrMFANotEnrolled) {
+		t.Fatalf("MFA() error = %v, want ErrMFANotEnrolled", err)
+	}
+	if err := s.ConfirmMFA("alice", nil); !errors.Is(err, auth.ErrMFANotEnrolled) {
+		t.Errorf("ConfirmMFA() before BeginMFA() error = %v, want ErrMFANotEnrolled", err)
+	}
+	if err := s.BeginMFA("alice", []byte("first")); err != nil {
+		t.Fatalf("BeginMFA() error = %v", err)
+	}
+	if err := s.BeginMFA("alice", []byte("second")); err != nil {
+		t.Fatalf("BeginMFA() again before confirming error = %v", err)
+	}
+	e, err := s.MFA("alice")
+	if err != nil {
+		t.Fatalf("MFA() error = %v", err)
+	}
+	if e.Confirmed() || string(e.SealedSecret) != "second" {
+		t.Errorf("MFA() = %+v, want the unconfirmed second secret", e)
+	}
+
+	if err := s.ConfirmMFA("alice", []string{"h1", "h2"}); err != nil {
+		t.Fatalf("ConfirmMFA() error = %v", err)
+	}
+	if e, _ = s.MFA("alice"); !e.Confirmed() || e.RecoveryCodesLeft != 2 {
+		t.Errorf("MFA() = %+v, want confirmed with 2 codes", e)
+	}
+	if err := s.BeginMFA("alice", []byte("third")); !errors.Is(err, auth.ErrMFAEnrolled) {
+		t.Errorf("BeginMFA() when confirmed error = %v, want ErrMFAEnrolled", err)
+	}
+
+	for _, step := range []struct {
+		step int64
+		want bool
+	}{{100, true}, {100, false}, {99, false}, {101, true}} {
+		if ok, err := s.UseTOTPStep("alice", step.step); err != nil || ok != step.want {
+			t.Errorf("UseTOTPStep(%d) = %v, %v; want %v", step.step, ok, err, step.want)
+		}
+	}
+	if ok, _ := s.UseTOTPStep("bob", 1); ok {
+		t.Error("UseTOTPStep() for a user without MFA = true")
+	}
+
+	if ok, err := s.UseRecoveryCode("alice", "h1"); err != nil || !ok {
+		t.Errorf("UseRecoveryCode() = %v, %v; want true", ok, err)
+	}
+	if ok, _ := s.UseRecoveryCode("alice", "h1"); ok {
+		t.Error("UseRecoveryCode() of a used code = true")
+	}
+	if ok, _ := s.UseRecoveryCode("alice", "unknown"); ok {
+		t.Error("UseRecoveryCode() of an unknown code = true")
+	}
+	if e, _ = s.MFA("alice"); e.RecoveryCodesLeft != 1 || e.LastStep != 101 {
+		t.Errorf("MFA() = %+v, want 1 code left and last step 101", e)
+	}
+
+	// Confirming again regenerates the codes.
+	if err := s.ConfirmMFA("alice", []string{"h3", "h4", "h5"}); err != nil {
+		t.Fatalf("ConfirmMFA() again error = %v", err)
+	}
+	if e, _ = s.MFA("alice"); e.RecoveryCodesLeft != 3 {
+		t.Errorf("RecoveryCodesLeft = %d, want 3", e.RecoveryCodesLeft)
+	}
+	if ok, _ := s.UseRecoveryCode("alice", "h2"); ok {
+		t.Error("UseRecoveryCode() of a replaced code = true")
+	}
+
+	if err := s.DeleteMFA("alice"); err != nil {
+		t.Fatalf("DeleteMFA() error = %v", err)
+	}
+	if _, err := s.MFA("alice"); !errors.Is(err, auth.ErrMFANotEnrolled) {
+		t.Errorf("MFA() after DeleteMFA() error = %v, want ErrMFANotEnrolled", err)
+	}
+}
+
+func testWebAuthn(t *testing.T, s auth.Store) {
+	handle := []byte("alice-handle")
+	key := auth.WebAuthnCredential{ID: []byte{1}, Username: "alice", UserHandle: handle, Name: "key", Data: []byte("data")}
+	phone := auth.WebAuthnCredential{ID: []byte{2}, Username: "alice", UserHandle: handle, Name: "phone", Data: []byte("data")}
+	bob := auth.WebAuthnCredential{ID: []byte{3}, Username: "bob", UserHandle: []byte("bob-handle"), Name: "key", Data: []byte("data")}
+	for _, c := range []auth.WebAuthnCredential{key, phone, bob} {
+		if err := s.AddWebAuthnCredential(c); err != nil {
+			t.Fatalf("AddWebAuthnCredential(%s) error = %v", c.Name, err)
+		}
+	}
+	if err := s.AddWebAuthnCredential(auth.WebAuthnCredential{ID: []byte{1}, Username: "bob", UserHandle: []byte("bob-handle"), Data: []byte("x")}); !errors.Is(err, auth.ErrDuplicateCredential) {
+		t.Errorf("AddWebAuthnCredential(duplicate) error = %v, want ErrDuplicateCredential", err)
+	}
+
+	creds, err := s.WebAuthnCredentials("alice")
+	if err != nil {
+		t.Fatalf("WebAuthnCredentials() error = %v", err)
+	}
+	if len(creds) != 2 {
+		t.Fatalf("WebAuthnCredentials() = %d passkeys, want 2", len(creds))
+	}
+	for _, c := range creds {
+		if c.Username != "alice" || !bytes.Equal(c.UserHandle, handle) || c.CreatedAt.IsZero() || !c.LastUsedAt.IsZero() {
+			t.Errorf("WebAuthnCredentials() passkey = %+v", c)
+		}
+	}
+	creds, err = s.WebAuthnCredentialsByHandle(handle)
+	if err != nil || len(creds) != 2 {
+		t.Errorf("WebAuthnCredentialsByHandle() = %d passkeys, %v; want 2", len(creds), err)
+	}
+	if creds, _ = s.WebAuthnCredentialsByHandle([]byte("unknown")); len(creds) != 0 {
+		t.Errorf("WebAuthnCredentialsByHandle(unknown) = %d passkeys, want 0", len(creds))
+	}
+
+	if err := s.UpdateWebAuthnCredential(key.ID, []byte("counter 2")); err != nil {
+		t.Fatalf("UpdateWebAuthnCredential() error = %v", err)
+	}
+	creds, _ = s.WebAuthnCredentials("alice")
+	i := slices.IndexFunc(creds, func(c auth.WebAuthnCredential) bool { return bytes.Equal(c.ID, key.ID) })
+	if i < 0 || string(creds[i].Data) != "counter 2" || creds[i].LastUsedAt.IsZero() {
+		t.Errorf("after UpdateWebAuthnCredential() passkeys = %+v", creds)
+	}
+
+	if err := s.DeleteWebAuthnCredential("bob", key.ID); !errors.Is(err, auth.ErrCredentialNotFound) {
+		t.Errorf("DeleteWebAuthnCredential(other user's) error = %v, want ErrCredentialNotFound", err)
+	}
+	if err := s.DeleteWebAuthnCredential("alice", key.ID); err != nil {
+		t.Fatalf("DeleteWebAuthnCredential() error = %v", err)
+	}
+	if creds, _ = s.WebAuthnCredentials("alice"); len(creds) != 1 || creds[0].Name != "phone" {
+		t.Errorf("WebAuthnCredentials() after delete = %+v, want the phone", creds)
+	}
+}
+
+func testFailedLogins(t *testing.T, s auth.Store) {
+	now := time.Now().Truncate(time.Second)
+	if f, err := s.FailedLogins("user:alice"); err != nil || f.Count != 0 || f.Key != "user:alice" {
+		t.Errorf("FailedLogins() = %+v, %v; want a zero count", f, err)
+	}
+	for i := 1; i <= 3; i++ {
+		f, err := s.RecordFailedLogin("user:alice", now, time.Minute)
+		if err != nil || f.Count != i || !f.LastAt.Equal(now) {
+			t.Errorf("RecordFailedLogin() = %+v, %v; want count %d at %v", f, err, i, now)
+		}
+	}
+	// A failure after the window starts the count over.
+	later := now.Add(2 * time.Minute)
+	if f, _ := s.RecordFailedLogin("user:alice", later, time.Minute); f.Count != 1 {
+		t.Errorf("RecordFailedLogin() after the window count = %d, want 1", f.Count)
+	}
+	if f, _ := s.FailedLogins("user:alice"); f.Count != 1 || !f.LastAt.Equal(later) {
+		t.Errorf("FailedLogins() = %+v, want 1 at %v", f, later)
+	}
+
+	if _, err := s.RecordFailedLogin("ip:192.0.2.1", now, time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	list, err := s.ListFailedLogins(now.Add(-time.Second))
+	if err != nil {
+		t.Fatalf("ListFailedLogins() error = %v", err)
+	}
+	if len(list) != 2 || list[0].Key != "user:alice" || list[1].Key != "ip:192.0.2.1" {
+		t.Errorf("ListFailedLogins() = %+v, want alice then the address", list)
+	}
+	if list, _ = s.ListFailedLogins(now.Add(time.Minute)); len(list) != 1 {
+		t.Errorf("ListFailedLogins(since a minute later) = %+v, want alice only", list)
+	}
+
+	if err := s.ClearFailedLogins("user:alice"); err != nil {
+		t.Fatalf("ClearFailedLogins() error = %v", err)
+	}
+	if f, _ := s.FailedLogins("user:alice"); f.Count != 0 {
+		t.Errorf("FailedLogins() after clearing = %+v", f)
+	}
+}
+
+func testPersonalAccessTokens(t *testing.T, s auth.Store) {
+	expires := inAnHour()
+	pat := auth.PersonalAccessToken{ID: "id1", Username: "alice", Name: "backup", Scopes: []string{"db:read", "db:write"}, Hash: auth.TokenHash("t1"), ExpiresAt: expires}
+	if err := s.AddPersonalAccessToken(pat); err != nil {
+		t.Fatalf("AddPersonalAccessToken() error = %v", err)
+	}
+	if err := s.AddPersonalAccessToken(auth.PersonalAccessToken{ID: "id2", Username: "bob", Name: "ci", Scopes: []string{"db:read"}, Hash: auth.TokenHash("t2"), ExpiresAt: expires}); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := s.PersonalAccessTokenByHash(pat.Hash)
+	if err != nil {
+		t.Fatalf("PersonalAccessTokenByHash() error = %v", err)
+	}
+	if got.ID != "id1" || got.Username != "alice" || got.Name != "backup" || !slices.Equal(got.Scopes, pat.Scopes) ||
+		!got.ExpiresAt.Equal(expires) || got.CreatedAt.IsZero() || !got.LastUsedAt.IsZero() {
+		t.Errorf("PersonalAccessTokenByHash() = %+v", got)
+	}
+	if _, err := s.PersonalAccessTokenByHash(auth.TokenHash("unknown")); !errors.Is(err, auth.ErrPATNotFound) {
+		t.Errorf("PersonalAccessTokenByHash(unknown) error = %v, want ErrPATNotFound", err)
+	}
+
+	if err := s.TouchPersonalAccessToken("id1"); err != nil {
+		t.Fatalf("TouchPersonalAccessToken() error = %v", err)
+	}
+	list, err := s.PersonalAccessTokens("alice")
+	if err != nil || len(list) != 1 || list[0].LastUsedAt.IsZero() {
+		t.Errorf("PersonalAccessTokens() = %+v, %v; want one used token", list, err)
+	}
+
+	if err := s.DeletePersonalAccessToken("bob", "id1"); !errors.Is(err, auth.ErrPATNotFound) {
+		t.Errorf("DeletePersonalAccessToken(other user's) error = %v, want ErrPATNotFound", err)
+	}
+	if err := s.DeletePersonalAccessToken("alice", "id1"); err != nil {
+		t.Fatalf("DeletePersonalAccessToken() error = %v", err)
+	}
+	if list, _ = s.PersonalAccessTokens("alice"); len(list) != 0 {
+		t.Errorf("PersonalAccessTokens() after delete = %+v", list)
+	}
+	if list, _ = s.PersonalAccessTokens("bob"); len(list) != 1 {
+		t.Errorf("PersonalAccessTokens(bob) = %+v, want untouched", list)
+	}
+}
+
+func testDenylist(t *testing.T, s auth.Store) {
+	expires := inAnHour()
+	denied := func(now time.Time) []string {
+		t.Helper()
+		list, err := s.DeniedTokens(now)
+		if err != nil {
+			t.Fatalf("DeniedTokens() error = %v", err)
+		}
+		entries := []string{}
+		for _, e := range list {
+			entries = append(entries, e.Kind+":"+e.ID+"@"+e.ExpiresAt.Sub(expires).String())
+		}
+		slices.Sort(entries)
+		return entries
+	}
+	if entries := denied(time.Now()); len(entries) != 0 {
+		t.Fatalf("DeniedTokens() = %v, want none", entries)
+	}
+	err := s.Deny(
+		auth.DeniedToken{Kind: auth.DeniedByJTI, ID: "a", ExpiresAt: expires},
+		auth.DeniedToken{Kind: auth.DeniedBySession, ID: "a", ExpiresAt: expires.Add(-time.Minute)},
+	)
+	if err != nil {
+		t.Fatalf("Deny() error = %v", err)
+	}
+	if err := s.Deny(); err != nil {
+		t.Errorf("Deny() with no entries error = %v", err)
+	}
+	if got, want := denied(time.Now()), []string{"jti:a@0s", "sid:a@-1m0s"}; !slices.Equal(got, want) {
+		t.Errorf("DeniedTokens() = %v, want %v", got, want)
+	}
+
+	// Denying again keeps the later expiry.
+	err = s.Deny(
+		auth.DeniedToken{Kind: auth.DeniedByJTI, ID: "a", ExpiresAt: expires.Add(-time.Hour)},
+		auth.DeniedToken{Kind: auth.DeniedBySession, ID: "a", ExpiresAt: expires},
+	)
+	if err != nil {
+		t.Fatalf("Deny() again error = %v", err)
+	}
+	if got, want := denied(time.Now()), []string{"jti:a@0s", "sid:a@0s"}; !slices.Equal(got, want) {
+		t.Errorf("DeniedTokens() = %v, want %v", got, want)
+	}
+	if got := denied(expires); len(got) != 0 {
+		t.Errorf("DeniedTokens(at expiry) = %v, want none", got)
+	}
+}
+
+func testDenyOnce(t *testing.T, s auth.Store) {
+	e := auth.DeniedToken{Kind: auth.DeniedChallenge, ID: "c1", ExpiresAt: inAnHour()}
+	if added, err := s.DenyOnce(e); err != nil || !added {
+		t.Fatalf("DenyOnce() = %v, %v; want added", added, err)
+	}
+	if added, err := s.DenyOnce(e); err != nil || added {
+		t.Errorf("DenyOnce() again = %v, %v; want not added", added, err)
+	}
+	// Concurrent callers (replicas finishing the same ceremony): exactly one adds it.
+	e.ID = "c2"
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	wins := 0
+	for range 8 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			added, err := s.DenyOnce(e)
+			if err != nil {
+				t.Errorf("DenyOnce() error = %v", err)
+			}
+			if added {
+				mu.Lock()
+				wins++
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	if wins != 1 {
+		t.Errorf("concurrent DenyOnce() added %d times, want once", wins)
+	}
+	// Another kind with the same ID is a different entry.
+	if added, err := s.DenyOnce(auth.DeniedToken{Kind: auth.DeniedByJTI, ID: "c1", ExpiresAt: inAnHour()}); err != nil || !added {
+		t.Errorf("DenyOnce() of another kind = %v, %v; want added", added, err)
+	}
+}
+
+func testPrune(t *testing.T, s auth.Store) {
+	used := login(t, s, "alice", "")
+	next := successor("alice")
+	if _, _, err := s.Rotate(used.Hash, next, nil, 0); err != nil {
+		t.Fatal(err)
+	}
+	revoked := login(t, s, "alice", "")
+	if err := s.Revoke(revoked.Hash); err != nil {
+		t.Fatal(err)
+	}
+	live := login(t, s, "bob", "")
+	now := time.Now()
+	if _, err := s.RecordFailedLogin("user:alice", now, time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	for i, expires := range []time.Time{now.Add(time.Second), inAnHour()} {
+		pat := auth.PersonalAccessToken{ID: fmt.Sprint("pat", i), Username: "alice", Name: "ci", Hash: auth.TokenHash(fmt.Sprint("pat", i)), CreatedAt: now, ExpiresAt: expires}
+		if err := s.AddPersonalAccessToken(pat); err != nil {
+			t.Fatal(err)
+		}
+	}
+	err := s.Deny(
+		auth.DeniedToken{Kind: auth.DeniedByJTI, ID: "a", ExpiresAt: now.Add(time.Second)},
+		auth.DeniedToken{Kind: auth.DeniedBySession, ID: "b", ExpiresAt: inAnHour()},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Nothing is old enough yet.
+	r, err := s.Prune(now.Add(-time.Minute))
+	if err != nil {
+		t.Fatalf("Prune() error = %v", err)
+	}
+	if r != (auth.PruneResult{}) {
+		t.Errorf("Prune(a minute ago) = %+v, want nothing removed", r)
+	}
+
+	// Two seconds on, the used and revoked tokens, the revoked session, the failed login
+	// and whatever expired in a second are spent; each kind is counted.
+	r, err = s.Prune(now.Add(2 * time.Second))
+	if err != nil {
+		t.Fatalf("Prune() error = %v", err)
+	}
+	if want := (auth.PruneResult{Tokens: 2, Sessions: 1, PATs: 1, FailedLogins: 1, Denylist: 1}); r != want {
+		t.Errorf("Prune() = %+v, want %+v", r, want)
+	}
+	if pats, _ := s.PersonalAccessTokens("alice"); len(pats) != 1 || pats[0].ID != "pat1" {
+		t.Errorf("PersonalAccessTokens(alice) after Prune = %+v, want pat1 only", pats)
+	}
+	if f, _ := s.FailedLogins("user:alice"); f.Count != 0 {
+		t.Errorf("FailedLogins(user:alice) after Prune = %+v, want none", f)
+	}
+	if list, _ := s.DeniedTokens(now); len(list) != 1 || list[0].ID != "b" {
+		t.Errorf("DeniedTokens() after Prune = %+v, want the session entry only", list)
+	}
+	if ids := sessionIDs(t, s, "alice"); !slices.Equal(ids, []string{used.FamilyID}) {
+		t.Errorf("Sessions(alice) = %v, want the rotated session", ids)
+	}
+	if ids := sessionIDs(t, s, "bob"); !slices.Equal(ids, []string{live.FamilyID}) {
+		t.Errorf("Sessions(bob) = %v, want untouched", ids)
+	}
+}
@@ -0,0 +1,15 @@
+-- An auth database as left by papaya before schema versioning: refresh_tokens only, no families.
+-- Alice has one live refresh token, h-alice, after a used one, h-used.
+
+CREATE TABLE IF NOT EXISTS refresh_tokens (
+  token_hash TEXT PRIMARY KEY,
+  username TEXT NOT NULL,
+  expires_at INTEGER NOT NULL,
+  used_at INTEGER,
+  revoked_at INTEGER
+);
+CREATE INDEX IF NOT EXISTS idx_refresh_tokens_username ON refresh_tokens(username);
+
+INSERT INTO refresh_tokens (token_hash, username, expires_at, used_at, revoked_at) VALUES
+  ('h-used', 'alice', 4102444800, 1700000000, NULL),
+  ('h-alice', 'alice', 4102444800, NULL, NULL);
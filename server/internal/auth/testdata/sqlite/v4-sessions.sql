@@ -0,0 +1,51 @@
+-- An auth database at schema version 4 (sessions), with the first four migrations recorded in schema_migrations.
+-- Alice has one live refresh token, h-alice, after a used one, h-used.
+
+CREATE TABLE IF NOT EXISTS refresh_tokens (
+  token_hash TEXT PRIMARY KEY,
+  username TEXT NOT NULL,
+  expires_at INTEGER NOT NULL,
+  used_at INTEGER,
+  revoked_at INTEGER
+);
+CREATE INDEX IF NOT EXISTS idx_refresh_tokens_username ON refresh_tokens(username);
+CREATE TABLE IF NOT EXISTS sessions (
+  family_id TEXT PRIMARY KEY,
+  username TEXT NOT NULL,
+  device_label TEXT NOT NULL DEFAULT '',
+  user_agent TEXT NOT NULL DEFAULT '',
+  ip TEXT NOT NULL DEFAULT '',
+  created_at INTEGER NOT NULL,
+  last_used_at INTEGER NOT NULL
+);
+CREATE INDEX IF NOT EXISTS idx_sessions_username ON sessions(username);
+CREATE TABLE IF NOT EXISTS auth_events (
+  id INTEGER PRIMARY KEY AUTOINCREMENT,
+  at INTEGER NOT NULL,
+  kind TEXT NOT NULL,
+  username TEXT NOT NULL,
+  family_id TEXT,
+  detail TEXT
+);
+ALTER TABLE refresh_tokens ADD COLUMN family_id TEXT;
+ALTER TABLE refresh_tokens ADD COLUMN parent_hash TEXT;
+ALTER TABLE refresh_tokens ADD COLUMN successor_hash TEXT;
+ALTER TABLE refresh_tokens ADD COLUMN successor_sealed BLOB;
+CREATE INDEX IF NOT EXISTS idx_refresh_tokens_family ON refresh_tokens(family_id);
+
+INSERT INTO refresh_tokens (token_hash, username, expires_at, used_at, revoked_at, family_id, parent_hash) VALUES
+  ('h-used', 'alice', 4102444800, 1700000000, NULL, 'f-alice', NULL),
+  ('h-alice', 'alice', 4102444800, NULL, NULL, 'f-alice', 'h-used');
+INSERT INTO auth_events (at, kind, username, family_id, detail) VALUES (1700000000, 'token_reuse', 'bob', 'f-bob', '');
+INSERT INTO sessions (family_id, username, device_label, user_agent, ip, created_at, last_used_at) VALUES
+  ('f-alice', 'alice', 'Firefox on Linux', 'Mozilla/5.0 (X11; Linux x86_64) Firefox/120.0', '192.0.2.1', 1700000000, 1700000000);
+CREATE TABLE IF NOT EXISTS schema_migrations (
+  version INTEGER PRIMARY KEY,
+  name TEXT NOT NULL,
+  applied_at INTEGER NOT NULL
+);
+INSERT INTO schema_migrations (version, name, applied_at) VALUES
+  (1, 'refresh_tokens', 1700000000),
+  (2, 'refresh_token_families', 1700000000),
+  (3, 'refresh_token_successors', 1700000000),
+  (4, 'sessions', 1700000000);
@@ -0,0 +1,341 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Store persists everything papaya's auth keeps besides CouchDB's _users database: one
+// interface per feature, so that code needing only one of them can say so.
+// Implementations: SQLiteStore (the default), PostgresStore for several replicas sharing
+// one database, and MemoryStore. They must behave identically, including under
+// concurrent calls; storetest.Run checks that.
+type Store interface {
+	SessionStore
+	EventStore
+	MFAStore
+	WebAuthnStore
+	LoginThrottleStore
+	PATStore
+	DenylistStore
+
+	// Prune deletes refresh tokens that expired, were used or were revoked before cutoff,
+	// sessions with no tokens left, failed-login counts last updated before cutoff,
+	// personal access tokens that expired before cutoff and denylist entries that expired
+	// before cutoff. A used token is what reveals a replay (see Rotate), so cutoff should
+	// be at least the refresh-token lifetime ago.
+	Prune(cutoff time.Time) (PruneResult, error)
+
+	Close() error
+}
+
+// SessionStore keeps refresh tokens for one-time use and revocation, and the sessions
+// (token families) they belong to.
+type SessionStore interface {
+	// Store records the first refresh token of a family and the session it starts (see
+	// Rotate for the other tokens). t.Hash is the hash from TokenHash(token); sess.ID and
+	// sess.Username are taken from t.
+	Store(t RefreshToken, sess Session) error
+
+	// Rotate consumes the refresh token parentHash and stores next as its successor in the
+	// same family, atomically. next.FamilyID and next.ParentHash are set from the parent.
+	// sealed is next's token sealed with SealSuccessor.
+	//
+	// If the parent was already rotated less than grace ago (two tabs refreshing at once),
+	// next is discarded and the successor sealed at that time is returned as prior, so both
+	// callers end up with the same refresh token.
+	//
+	// Otherwise a token that was already used has been replayed, which usually means it was
+	// stolen: Rotate then revokes its whole family, so whoever holds the newer token is
+	// logged out too, records an EventTokenReuse and returns ErrTokenUsed along with the
+	// parent. Unknown, expired and revoked tokens give ErrTokenNotFound, ErrTokenExpired and
+	// ErrTokenRevoked.
+	Rotate(parentHash string, next RefreshToken, sealed []byte, grace time.Duration) (parent *RefreshToken, prior []byte, err error)
+
+	// Revoke revokes the family of the given token (by hash), ending that session (e.g. on
+	// logout). Unknown tokens are ignored.
+	Revoke(tokenHash string) error
+
+	// RevokeAllForUser revokes all refresh tokens for the given user (e.g. logout all
+	// devices) and returns the IDs of the sessions it ended, so that their access tokens
+	// can be denylisted too.
+	RevokeAllForUser(username string) (sessionIDs []string, err error)
+
+	// Sessions lists the user's active sessions (those with a refresh token that is not
+	// used, revoked or expired), most recently used first. Sessions started before device
+	// tracking have empty device fields and zero times.
+	Sessions(username string) ([]Session, error)
+
+	// Touch records that a session was just used (its refresh token rotated) from ip.
+	Touch(sessionID, userAgent, ip string) error
+
+	// RevokeSession revokes one of the user's sessions. It returns ErrSessionNotFound when
+	// the user has no session with that ID.
+	RevokeSession(username, sessionID string) error
+
+	// RevokeOtherSessions revokes all of the user's sessions except keepID ("log out
+	// everywhere else") and returns the IDs of the sessions it ended.
+	RevokeOtherSessions(username, keepID string) (sessionIDs []string, err error)
+}
+
+// EventStore is the audit log of security events.
+type EventStore interface {
+	// RecordEvent appends a security event (e.g. EventTokenReuse) to the audit log.
+	RecordEvent(kind, username, familyID, detail string) error
+}
+
+// MFAStore keeps users' TOTP second factors and recovery codes.
+type MFAStore interface {
+	// MFA returns the user's TOTP enrollment, or ErrMFANotEnrolled.
+	MFA(username string) (*MFAEnrollment, error)
+
+	// BeginMFA stores a new, unconfirmed TOTP secret (sealed with Keys.SealMFASecret) for
+	// the user, replacing any earlier unconfirmed one. It returns ErrMFAEnrolled when the
+	// user already has a confirmed enrollment.
+	BeginMFA(username string, sealedSecret []byte) error
+
+	// ConfirmMFA confirms the user's enrollment and replaces their recovery codes with
+	// codeHashes (from RecoveryCodeHash); calling it again regenerates the codes. It returns
+	// ErrMFANotEnrolled when BeginMFA was not called.
+	ConfirmMFA(username string, codeHashes []string) error
+
+	// UseTOTPStep records that the TOTP code for step was accepted. It returns false when a
+	// code for this or a later step was already accepted (a replay).
+	UseTOTPStep(username string, step int64) (bool, error)
+
+	// UseRecoveryCode consumes one of the user's recovery codes. It returns false when the
+	// code is unknown or was already used.
+	UseRecoveryCode(username, codeHash string) (bool, error)
+
+	// DeleteMFA removes the user's enrollment and recovery codes.
+	DeleteMFA(username string) error
+}
+
+// WebAuthnStore keeps users' passkeys.
+type WebAuthnStore interface {
+	// AddWebAuthnCredential stores a newly registered passkey. It returns
+	// ErrDuplicateCredential when the credential ID is already registered.
+	AddWebAuthnCredential(c WebAuthnCredential) error
+
+	// WebAuthnCredentials lists the user's passkeys, oldest first.
+	WebAuthnCredentials(username string) ([]WebAuthnCredential, error)
+
+	// WebAuthnCredentialsByHandle lists the passkeys registered under a WebAuthn user
+	// handle (what a discoverable login identifies the user by).
+	WebAuthnCredentialsByHandle(handle []byte) ([]WebAuthnCredential, error)
+
+	// UpdateWebAuthnCredential replaces a passkey's Data after a login (its signature
+	// counter changes) and records the use.
+	UpdateWebAuthnCredential(id, data []byte) error
+
+	// DeleteWebAuthnCredential removes one of the user's passkeys. It returns
+	// ErrCredentialNotFound when the user has no passkey with that ID.
+	DeleteWebAuthnCredential(username string, id []byte) error
+}
+
+// LoginThrottleStore counts failed logins per username and per address (see
+// auth.login_throttle).
+type LoginThrottleStore interface {
+	// FailedLogins returns the failed logins counted against key ("user:<name>" or
+	// "ip:<address>"). A key with none has a zero Count.
+	FailedLogins(key string) (FailedLogins, error)
+
+	// RecordFailedLogin counts a failed login against key at the given time and returns the
+	// new count. Earlier failures are forgotten when the last one is older than window.
+	RecordFailedLogin(key string, at time.Time, window time.Duration) (FailedLogins, error)
+
+	// ClearFailedLogins forgets the failures counted against key.
+	ClearFailedLogins(key string) error
+
+	// ListFailedLogins lists the keys with a failure since the given time, most recent
+	// first.
+	ListFailedLogins(since time.Time) ([]FailedLogins, error)
+}
+
+// PATStore keeps personal access tokens.
+type PATStore interface {
+	// AddPersonalAccessToken stores a new personal access token; CreatedAt is set by the
+	// store.
+	AddPersonalAccessToken(t PersonalAccessToken) error
+
+	// PersonalAccessTokenByHash returns the token whose TokenHash is hash, expired or not.
+	// It returns ErrPATNotFound when there is none.
+	PersonalAccessTokenByHash(hash string) (*PersonalAccessToken, error)
+
+	// PersonalAccessTokens lists the user's personal access tokens, including expired
+	// ones, oldest first.
+	PersonalAccessTokens(username string) ([]PersonalAccessToken, error)
+
+	// TouchPersonalAccessToken records that a personal access token was just used.
+	TouchPersonalAccessToken(id string) error
+
+	// DeletePersonalAccessToken revokes one of the user's personal access tokens. It
+	// returns ErrPATNotFound when the user has no token with that ID.
+	DeletePersonalAccessToken(username, id string) error
+}
+
+// DenylistStore keeps the access tokens revoked before they expire (see Denylist). Entries
+// are only written when something is revoked, not for every token issued.
+type DenylistStore interface {
+	// Deny adds entries to the denylist. An entry that is already there keeps the later
+	// expiry.
+	Deny(entries ...DeniedToken) error
+
+	// DenyOnce adds e unless the denylist has an entry of its kind and ID, and reports
+	// whether it did. One-time values (DeniedChallenge) are spent this way, so that of
+	// two replicas sharing the store only one accepts them.
+	DenyOnce(e DeniedToken) (added bool, err error)
+
+	// DeniedTokens lists the denylist entries that expire after now.
+	DeniedTokens(now time.Time) ([]DeniedToken, error)
+}
+
+// OpenStore opens the refresh-token store selected by auth.store: "sqlite" (the file at
+// sqlitePath), "postgres" (postgresURL) or "memory". Pending schema migrations are applied.
+func OpenStore(kind, sqlitePath, postgresURL string) (Store, error) {
+	switch kind {
+	case "sqlite":
+		return OpenSQLite(sqlitePath)
+	case "postgres":
+		return OpenPostgres(postgresURL)
+	case "memory":
+		return NewMemoryStore(), nil
+	default:
+		return nil, fmt.Errorf("unknown token store %q", kind)
+	}
+}
+
+// TokenHash returns the SHA256 hex-encoded hash of the token string (for storage/lookup).
+func TokenHash(token string) string {
+	h := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(h[:])
+}
+
+// RefreshToken is a stored refresh token. Every token issued by rotating another one
+// belongs to the same family as its parent; a login starts a new family.
+type RefreshToken struct {
+	Hash       string // TokenHash of the token
+	Username   string
+	FamilyID   string
+	ParentHash string // Empty for the first token of a family
+	ExpiresAt  time.Time
+}
+
+// NewFamilyID returns a random ID for a new token family (one login session).
+func NewFamilyID() string {
+	return randomID()
+}
+
+// randomID returns 128 random bits, hex-encoded.
+func randomID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		panic(err) // crypto/rand does not fail on supported platforms
+	}
+	return hex.EncodeToString(b)
+}
+
+// Session is one login: a refresh-token family and the device it was started from.
+// Its ID is the family ID, which access tokens carry in their "sid" claim.
+type Session struct {
+	ID          string    `json:"id"`
+	Username    string    `json:"-"`
+	DeviceLabel string    `json:"deviceLabel"` // Chosen by the client at login; may be empty
+	UserAgent   string    `json:"userAgent"`
+	IP          string    `json:"ip"` // Last address the session was used from
+	CreatedAt   time.Time `json:"createdAt"`
+	LastUsedAt  time.Time `json:"lastUsedAt"`
+	ExpiresAt   time.Time `json:"expiresAt"` // When the current refresh token expires
+}
+
+// MFAEnrollment is a user's TOTP second factor.
+type MFAEnrollment struct {
+	Username          string
+	SealedSecret      []byte    // See Keys.OpenMFASecret
+	ConfirmedAt       time.Time // Zero until the user proved their app works; only then is it required at login
+	LastStep          int64     // TOTP time step of the last accepted code
+	RecoveryCodesLeft int
+}
+
+// Confirmed reports whether the enrollment is in force.
+func (e *MFAEnrollment) Confirmed() bool {
+	return !e.ConfirmedAt.IsZero()
+}
+
+// WebAuthnCredential is a registered passkey. Data is the credential as the WebAuthn
+// library keeps it (public key, signature counter, flags); the store does not look inside.
+type WebAuthnCredential struct {
+	ID         []byte
+	Username   string
+	UserHandle []byte // The same for all of a user's passkeys
+	Name       string // Chosen by the user, e.g. "iPhone"
+	Data       []byte
+	CreatedAt  time.Time
+	LastUsedAt time.Time // Zero until first used
+}
+
+// DeniedToken is a denylist entry: one access token, by its jti claim, or every access
+// token issued to a session, by its sid claim. It is kept until ExpiresAt, when the tokens
+// it covers have all expired.
+type DeniedToken struct {
+	Kind      string // DeniedByJTI, DeniedBySession or DeniedChallenge
+	ID        string // The jti or sid claim, or the challenge
+	ExpiresAt time.Time
+}
+
+// Kinds of DeniedToken.
+const (
+	DeniedByJTI     = "jti"
+	DeniedBySession = "sid"
+	DeniedChallenge = "challenge" // A finished passkey ceremony, until its challenge expires; not loaded by Denylist
+)
+
+// FailedLogins counts the recent failed logins from one address or for one username.
+type FailedLogins struct {
+	Key    string
+	Count  int
+	LastAt time.Time // Zero when Count is 0
+}
+
+var (
+	ErrTokenNotFound       = errors.New("token not found")
+	ErrTokenUsed           = errors.New("token already used")
+	ErrTokenRevoked        = errors.New("token revoked")
+	ErrTokenExpired        = errors.New("token expired")
+	ErrSessionNotFound     = errors.New("session not found")
+	ErrDuplicateToken      = errors.New("refresh token already stored")
+	ErrMFANotEnrolled      = errors.New("two-factor authentication not enrolled")
+	ErrMFAEnrolled         = errors.New("two-factor authentication already enabled")
+	ErrCredentialNotFound  = errors.New("passkey not found")
+	ErrDuplicateCredential = errors.New("passkey already registered")
+	ErrPATNotFound         = errors.New("personal access token not found")
+)
+
+// Security events recorded with RecordEvent.
+const (
+	EventTokenReuse      = "refresh_token_reuse" // A refresh token that was already rotated was presented again
+	EventMFAEnabled      = "mfa_enabled"
+	EventMFADisabled     = "mfa_disabled"
+	EventMFARecoveryUsed = "mfa_recovery_code_used"
+	EventMFACodesRenewed = "mfa_recovery_codes_renewed"
+	EventPasskeyAdded    = "passkey_added"
+	EventPasskeyRemoved  = "passkey_removed"
+	EventPasskeyCloned   = "passkey_clone_warning" // Signature counter went backwards; the login was refused
+	EventUserProvisioned = "user_provisioned"      // Created in _users on first single sign-on; detail is the issuer
+	EventLoginLocked     = "login_locked"          // Too many failed logins; detail is the throttle key
+	EventPATCreated      = "pat_created"           // Detail is the token's ID
+	EventPATRevoked      = "pat_revoked"           // Detail is the token's ID
+)
+
+// PruneResult counts the rows removed by Prune.
+type PruneResult struct {
+	Tokens       int64 // Refresh tokens
+	Sessions     int64
+	PATs         int64 // Personal access tokens
+	FailedLogins int64 // Throttle keys
+	Denylist     int64 // Revoked access tokens and sessions, and spent passkey challenges
+}
@@ -1,16 +1,714 @@
 package config
 
-// TODO: Implement reading config.yaml from configDir at startup.
-// The file lets users configure the app. Do not implement reading this file here; stub the method(s)
-// that the server will call at startup so that the integration point is clear.
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
 
-// Load reads the app configuration from disk (e.g. config.yaml in configDir).
-// configDir is set from env PAPAYA_CONFIG_DIR at runtime.
-// Returns (nil, nil) until implemented.
+	"gopkg.in/yaml.v3"
+)
+
+// FileName is the name of the app config file inside PAPAYA_CONFIG_DIR.
+const FileName = "config.yaml"
+
+// AppConfig is the in-memory representation of config.yaml.
+// Every section is optional; missing keys keep the values from Default.
+//
+// Keys that mirror an environment variable (server.port, auth.token_secret, couchdb.host, ...)
+// are only one source for that setting; env.Load resolves them with flags and the environment
+// taking precedence. Read those through env.Config, not from here.
+type AppConfig struct {
+	Server   ServerConfig   `yaml:"server"`
+	Auth     AuthConfig     `yaml:"auth"`
+	CouchDB  CouchDBConfig  `yaml:"couchdb"`
+	Static   StaticConfig   `yaml:"static"`
+	Features FeaturesConfig `yaml:"features"`
+
+	set map[string]bool // Dotted paths of the keys present in the file
+}
+
+// ServerConfig controls the HTTP listener.
+type ServerConfig struct {
+	Address           string        `yaml:"address"` // Host/IP to bind; empty binds all interfaces
+	Port              int           `yaml:"port"`    // PAPAYA_SERVER_PORT
+	ReadHeaderTimeout time.Duration `yaml:"read_header_timeout"`
+	IdleTimeout       time.Duration `yaml:"idle_timeout"`
+	Preflight         string        `yaml:"preflight"`       // Startup checks: "strict" (refuse to start on failure), "warn" or "off"
+	LogLevel          string        `yaml:"log_level"`       // "debug", "info", "warn" or "error"
+	CORSOrigins       []string      `yaml:"cors_origins"`    // Origins allowed to call /api with credentials; "*" allows any
+	TrustedProxies    []string      `yaml:"trusted_proxies"` // CIDRs or addresses whose X-Forwarded-For names the client; empty uses the connection's address
+	CSRF              CSRFConfig    `yaml:"csrf"`            // Refusing cross-site writes to /api and /db; see CSRFConfig
+}
+
+// CSRFConfig guards cookie-authenticated requests against cross-site request forgery.
+// Requests other than GET, HEAD and OPTIONS must come from the app's own origin, going by
+// the browser's Sec-Fetch-Site and Origin headers, or from server.cors_origins or
+// TrustedOrigins. Clients that send neither header (scripts) are let through.
+type CSRFConfig struct {
+	Enabled        bool     `yaml:"enabled"`
+	TrustedOrigins []string `yaml:"trusted_origins"` // Further origins allowed to write, e.g. the public URL when a proxy rewrites Host
+	TrustedProxies []string `yaml:"trusted_proxies"` // CIDRs or addresses whose X-Forwarded-Host names the app's own host; empty ignores the header
+	ExemptAuth     []string `yaml:"exempt_auth"`     // Authorization schemes that skip the check: "bearer" (access tokens), "pat", "basic"
+	ExemptPaths    []string `yaml:"exempt_paths"`    // Path prefixes that skip the check
+}
+
+// Trusts reports whether X-Forwarded-Host may be taken from a request whose connection
+// comes from addr.
+func (c CSRFConfig) Trusts(addr netip.Addr) bool {
+	return containsAddr(c.TrustedProxies, addr)
+}
+
+// AuthConfig controls token signing and lifetimes.
+type AuthConfig struct {
+	TokenSecret     string               `yaml:"token_secret"`     // PAPAYA_AUTH_TOKEN_SECRET
+	RefreshSecret   string               `yaml:"refresh_secret"`   // PAPAYA_AUTH_REFRESH_SECRET
+	MFASecret       string               `yaml:"mfa_secret"`       // PAPAYA_AUTH_MFA_SECRET
+	TokenKid        string               `yaml:"token_kid"`        // PAPAYA_AUTH_TOKEN_KID
+	SigningKeyFile  string               `yaml:"signing_key_file"` // PAPAYA_AUTH_SIGNING_KEY_FILE
+	AccessTokenTTL  time.Duration        `yaml:"access_token_ttl"`
+	RefreshTokenTTL time.Duration        `yaml:"refresh_token_ttl"`
+	ShortRefreshTTL time.Duration        `yaml:"short_refresh_token_ttl"` // Refresh-token lifetime for logins without "remember me"
+	SessionMaxAge   time.Duration        `yaml:"session_max_age"`         // How long after login a session ends however often it is refreshed; 0 means never
+	RefreshGrace    time.Duration        `yaml:"refresh_grace"`           // How long a just-rotated refresh token still yields its successor
+	PruneInterval   time.Duration        `yaml:"prune_interval"`          // How often spent refresh tokens are deleted; 0 disables
+	PruneRetention  time.Duration        `yaml:"prune_retention"`         // How long expired, used or revoked tokens are kept
+	MFAIssuer       string               `yaml:"mfa_issuer"`              // Account issuer shown in authenticator apps
+	MFAPendingTTL   time.Duration        `yaml:"mfa_pending_ttl"`         // How long after the password step the TOTP code may be entered
+	WebAuthnRPID    string               `yaml:"webauthn_rp_id"`          // Passkey relying party ID: the app's domain, e.g. papaya.example.com; empty disables passkeys
+	WebAuthnRPName  string               `yaml:"webauthn_rp_name"`        // Name shown when creating a passkey
+	WebAuthnOrigins []string             `yaml:"webauthn_origins"`        // Origins passkey ceremonies may come from, e.g. https://papaya.example.com
+	Backend         string               `yaml:"backend"`                 // Where /api/login checks passwords: "couchdb" or "ldap"
+	LoginThrottle   LoginThrottleConfig  `yaml:"login_throttle"`          // Backoff and lockout after failed logins
+	PersonalTokens  PersonalTokensConfig `yaml:"personal_tokens"`         // Personal access tokens for scripts
+	Cookies         CookiesConfig        `yaml:"cookies"`                 // Attributes of the cookies the server sets
+	LDAP            LDAPConfig           `yaml:"ldap"`                    // Used when Backend is "ldap"
+	OIDC            OIDCConfig           `yaml:"oidc"`                    // Single sign-on; see OIDCConfig
+	ForwardAuth     ForwardAuthConfig    `yaml:"forward_auth"`            // Trusting an authenticating reverse proxy; see ForwardAuthConfig
+	Store           string               `yaml:"store"`                   // Refresh-token store: "sqlite", "postgres" or "memory"
+	PostgresURL     string               `yaml:"postgres_url"`            // PAPAYA_AUTH_POSTGRES_URL
+}
+
+// CookiesConfig sets the attributes of every cookie the server sets: the auth cookies and
+// the short-lived passkey and single sign-on state.
+type CookiesConfig struct {
+	Secure     string `yaml:"secure"`      // "auto" (when the request came over TLS or X-Forwarded-Proto is https), "always" or "never"
+	SameSite   string `yaml:"same_site"`   // "lax", "strict" or "none" (for apps on another site; needs secure: always)
+	Domain     string `yaml:"domain"`      // Share the cookies with subdomains of this domain; empty keeps them to the host
+	HostPrefix bool   `yaml:"host_prefix"` // Name the cookies "__Host-..." so subdomains cannot set them; implies Secure, needs no domain
+}
+
+// PersonalTokensConfig limits the personal access tokens users create for scripts and
+// automation. Each request made with one is handed on with an access token of its own,
+// valid for AccessTokenTTL.
+type PersonalTokensConfig struct {
+	MaxTTL         time.Duration `yaml:"max_ttl"`          // Longest expiry a token may be created with; 0 disables personal access tokens
+	AccessTokenTTL time.Duration `yaml:"access_token_ttl"` // Lifetime of the CouchDB tokens a personal access token is exchanged for
+}
+
+// LoginThrottleConfig slows down password guessing at /api/login and the admin Basic
+// auth. Failures are counted per client address and per username; after FreeAttempts
+// (IPFreeAttempts for an address) each further attempt has to wait BaseDelay, doubling up
+// to MaxDelay, and after LockoutAfter (IPLockoutAfter) attempts are refused for
+// LockoutDuration.
+type LoginThrottleConfig struct {
+	Window          time.Duration `yaml:"window"`           // Failures are forgotten this long after the last one; 0 disables throttling
+	FreeAttempts    int           `yaml:"free_attempts"`    // Failures allowed before delays start
+	IPFreeAttempts  int           `yaml:"ip_free_attempts"` // The same for one address, which several users may share
+	BaseDelay       time.Duration `yaml:"base_delay"`       // First delay
+	MaxDelay        time.Duration `yaml:"max_delay"`        // Longest delay before a lockout
+	LockoutAfter    int           `yaml:"lockout_after"`    // Failures for one username that lock it; 0 never locks
+	IPLockoutAfter  int           `yaml:"ip_lockout_after"` // Failures from one address that lock it; 0 never locks
+	LockoutDuration time.Duration `yaml:"lockout_duration"` // How long a lockout lasts after the last failure
+}
+
+// LDAPConfig configures password checks against an LDAP directory: the user is looked up
+// with a search, their password checked with a bind as them, and their groups mapped to
+// CouchDB roles.
+type LDAPConfig struct {
+	URL               string            `yaml:"url"`                // ldap://host:389 or ldaps://host:636
+	StartTLS          bool              `yaml:"start_tls"`          // Upgrade ldap:// connections with StartTLS
+	BindDN            string            `yaml:"bind_dn"`            // Service account for searches; empty searches anonymously
+	BindPassword      string            `yaml:"bind_password"`      // PAPAYA_AUTH_LDAP_BIND_PASSWORD
+	UserBaseDN        string            `yaml:"user_base_dn"`       // e.g. ou=people,dc=example,dc=org
+	UserFilter        string            `yaml:"user_filter"`        // %s is the escaped username
+	UsernameAttribute string            `yaml:"username_attribute"` // Holds the CouchDB username, e.g. uid
+	GroupBaseDN       string            `yaml:"group_base_dn"`      // Empty skips the group lookup
+	GroupFilter       string            `yaml:"group_filter"`       // %s is the escaped DN of the user
+	GroupRoles        map[string]string `yaml:"group_roles"`        // Group DN or cn → CouchDB role
+	Provision         bool              `yaml:"provision"`          // Create and update users in _users (needs couchdb.admin_user)
+	Timeout           time.Duration     `yaml:"timeout"`            // For connecting and each request
+}
+
+// OIDCConfig configures single sign-on through an OpenID Connect provider (/api/oidc).
+//
+// UsernameClaim defaults to "sub", which the provider assigns and never reuses. Claims such
+// as preferred_username are picked by the user at many providers and are not verified, so
+// an account named after an existing CouchDB user (admin, say) would sign in as that user.
+type OIDCConfig struct {
+	Issuer        string   `yaml:"issuer"`         // Provider URL, discovered via /.well-known/openid-configuration; empty disables OIDC
+	ClientID      string   `yaml:"client_id"`      // As registered with the provider
+	ClientSecret  string   `yaml:"client_secret"`  // PAPAYA_AUTH_OIDC_CLIENT_SECRET; empty for public clients (PKCE only)
+	RedirectURL   string   `yaml:"redirect_url"`   // Papaya's /api/oidc/callback as registered with the provider
+	Scopes        []string `yaml:"scopes"`         // Requested in addition to "openid"
+	UsernameClaim string   `yaml:"username_claim"` // ID token claim that holds the CouchDB username
+	Provision     bool     `yaml:"provision"`      // Create unknown users in _users (needs couchdb.admin_user)
+	DefaultRoles  []string `yaml:"default_roles"`  // Roles given to provisioned users
+}
+
+// ForwardAuthConfig lets an authenticating reverse proxy (Authelia, oauth2-proxy) vouch
+// for the user in a request header.
+type ForwardAuthConfig struct {
+	Header         string   `yaml:"header"`          // Carries the CouchDB username
+	TrustedProxies []string `yaml:"trusted_proxies"` // CIDRs or addresses the header is accepted from; empty disables forward auth
+}
+
+// Trusts reports whether the header may be taken from a request whose connection comes
+// from addr.
+func (f ForwardAuthConfig) Trusts(addr netip.Addr) bool {
+	return containsAddr(f.TrustedProxies, addr)
+}
+
+// containsAddr reports whether addr is in one of the CIDRs or addresses in list.
+func containsAddr(list []string, addr netip.Addr) bool {
+	addr = addr.Unmap()
+	for _, s := range list {
+		if p, err := parsePrefix(s); err == nil && p.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// parsePrefix parses a CIDR, or a single address as a prefix that holds only it.
+func parsePrefix(s string) (netip.Prefix, error) {
+	if addr, err := netip.ParseAddr(s); err == nil {
+		return netip.PrefixFrom(addr, addr.BitLen()), nil
+	}
+	return netip.ParsePrefix(s)
+}
+
+// CouchDBConfig controls how the server talks to CouchDB.
+type CouchDBConfig struct {
+	Host           string        `yaml:"host"`            // PAPAYA_COUCHDB_HOST
+	Port           int           `yaml:"port"`            // PAPAYA_COUCHDB_PORT
+	ProxiedURL     string        `yaml:"proxied_url"`     // COUCH_DB_PROXIED_URL
+	Vendor         string        `yaml:"vendor"`          // PAPAYA_DATABASE_VENDOR
+	RequestTimeout time.Duration `yaml:"request_timeout"` // For /api calls to CouchDB (_session, _users)
+	ProxyTimeout   time.Duration `yaml:"proxy_timeout"`   // For proxied /db requests; 0 disables (long-poll _changes feeds)
+	AdminUser      string        `yaml:"admin_user"`      // PAPAYA_COUCHDB_ADMIN_USER; for provisioning users
+	AdminPassword  string        `yaml:"admin_password"`  // PAPAYA_COUCHDB_ADMIN_PASS
+	RolesClaim     string        `yaml:"roles_claim"`     // Access-token claim for the user's _users roles (CouchDB's roles_claim_name); empty omits roles
+}
+
+// StaticConfig controls the SPA file server.
+type StaticConfig struct {
+	Dir         string        `yaml:"dir"`           // PAPAYA_STATIC_ASSETS_DIR
+	CacheMaxAge time.Duration `yaml:"cache_max_age"` // Cache-Control max-age for assets other than index.html
+	SPAFallback bool          `yaml:"spa_fallback"`  // Serve index.html for unknown paths
+}
+
+// FeaturesConfig toggles optional parts of the API.
+type FeaturesConfig struct {
+	Sync  bool `yaml:"sync"`  // Advertise sync to the app via /api/config
+	Admin bool `yaml:"admin"` // Mount /api/admin
+}
+
+// Default returns the configuration used when config.yaml is absent, and the base
+// that config.yaml is decoded on top of.
+func Default() *AppConfig {
+	return &AppConfig{
+		Server: ServerConfig{
+			ReadHeaderTimeout: 10 * time.Second,
+			IdleTimeout:       2 * time.Minute,
+			Preflight:         "strict",
+			LogLevel:          "info",
+			CSRF: CSRFConfig{
+				Enabled:    true,
+				ExemptAuth: []string{"bearer", "pat"},
+			},
+		},
+		Auth: AuthConfig{
+			AccessTokenTTL:  15 * time.Minute,
+			RefreshTokenTTL: 7 * 24 * time.Hour,
+			ShortRefreshTTL: 12 * time.Hour,
+			SessionMaxAge:   30 * 24 * time.Hour,
+			RefreshGrace:    10 * time.Second,
+			PruneInterval:   time.Hour,
+			PruneRetention:  7 * 24 * time.Hour,
+			MFAIssuer:       "Papaya",
+			MFAPendingTTL:   5 * time.Minute,
+			WebAuthnRPName:  "Papaya",
+			Store:           "sqlite",
+			Backend:         "couchdb",
+			LoginThrottle: LoginThrottleConfig{
+				Window:          time.Hour,
+				FreeAttempts:    3,
+				IPFreeAttempts:  10,
+				BaseDelay:       time.Second,
+				MaxDelay:        time.Minute,
+				LockoutAfter:    10,
+				IPLockoutAfter:  50,
+				LockoutDuration: 15 * time.Minute,
+			},
+			Cookies: CookiesConfig{Secure: "auto", SameSite: "lax"},
+			PersonalTokens: PersonalTokensConfig{
+				MaxTTL:         365 * 24 * time.Hour,
+				AccessTokenTTL: 5 * time.Minute,
+			},
+			LDAP: LDAPConfig{
+				UserFilter:        "(&(objectClass=person)(uid=%s))",
+				GroupFilter:       "(member=%s)",
+				UsernameAttribute: "uid",
+				Provision:         true,
+				Timeout:           10 * time.Second,
+			},
+			OIDC: OIDCConfig{
+				Scopes:        []string{"profile", "email"},
+				UsernameClaim: "sub",
+				Provision:     true,
+			},
+			ForwardAuth: ForwardAuthConfig{Header: "Remote-User"},
+		},
+		CouchDB: CouchDBConfig{
+			RequestTimeout: 10 * time.Second,
+			RolesClaim:     "_couchdb.roles",
+		},
+		Static: StaticConfig{
+			SPAFallback: true,
+		},
+		Features: FeaturesConfig{
+			Sync:  true,
+			Admin: true,
+		},
+	}
+}
+
+// Load reads config.yaml from configDir. configDir is set from env PAPAYA_CONFIG_DIR at runtime.
+// A missing file is not an error: Default() is returned. Unknown keys, type mismatches and
+// invalid values are reported together as *FieldError values joined with errors.Join.
 func Load(configDir string) (*AppConfig, error) {
-	_ = configDir
-	return nil, nil
+	path := filepath.Join(configDir, FileName)
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return Default(), nil
+		}
+		return nil, err
+	}
+	return Parse(path, data)
+}
+
+// Parse decodes config file contents. name is used as the file name in error messages.
+func Parse(name string, data []byte) (*AppConfig, error) {
+	cfg := Default()
+	var doc yaml.Node
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return nil, fmt.Errorf("%s: %w", name, err)
+	}
+	if len(doc.Content) == 0 {
+		return cfg, nil // Empty file
+	}
+	root := doc.Content[0]
+
+	var errs []error
+	for _, fe := range checkKeys(root, reflect.TypeOf(*cfg), "") {
+		fe.File = name
+		errs = append(errs, fe)
+	}
+	if len(errs) > 0 {
+		return nil, errors.Join(errs...)
+	}
+
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	if err := dec.Decode(cfg); err != nil {
+		var te *yaml.TypeError
+		if !errors.As(err, &te) {
+			return nil, fmt.Errorf("%s: %w", name, err)
+		}
+		for _, msg := range te.Errors {
+			errs = append(errs, typeError(name, root, msg))
+		}
+		return nil, errors.Join(errs...)
+	}
+
+	cfg.set = make(map[string]bool)
+	markSet(root, reflect.TypeOf(*cfg), "", cfg.set)
+
+	for _, fe := range cfg.validate() {
+		fe.File = name
+		fe.Line = lineOf(root, fe.Field)
+		errs = append(errs, fe)
+	}
+	if len(errs) > 0 {
+		return nil, errors.Join(errs...)
+	}
+	return cfg, nil
+}
+
+// FieldError describes a problem with one key in the config file.
+type FieldError struct {
+	File  string
+	Line  int    // 0 when the key is not present in the file
+	Field string // Dotted path, e.g. "server.address"
+	Msg   string
+}
+
+func (e *FieldError) Error() string {
+	if e.Line > 0 {
+		return fmt.Sprintf("%s:%d: %s: %s", e.File, e.Line, e.Field, e.Msg)
+	}
+	return fmt.Sprintf("%s: %s: %s", e.File, e.Field, e.Msg)
+}
+
+func (c *AppConfig) validate() []*FieldError {
+	var errs []*FieldError
+	// An absent port is 0 and left to the environment; one given in the file must be usable.
+	port := func(field string, p int) {
+		if p < 0 || p > 65535 || p == 0 && c.Has(field) {
+			errs = append(errs, &FieldError{Field: field, Msg: "must be between 1 and 65535"})
+		}
+	}
+	nonNegative := func(field string, d time.Duration) {
+		if d < 0 {
+			errs = append(errs, &FieldError{Field: field, Msg: "must not be negative"})
+		}
+	}
+	positive := func(field string, d time.Duration) {
+		if d <= 0 {
+			errs = append(errs, &FieldError{Field: field, Msg: "must be greater than zero"})
+		}
+	}
+	port("server.port", c.Server.Port)
+	port("couchdb.port", c.CouchDB.Port)
+	switch c.Server.Preflight {
+	case "strict", "warn", "off":
+	default:
+		errs = append(errs, &FieldError{Field: "server.preflight", Msg: `must be "strict", "warn" or "off"`})
+	}
+	switch c.Server.LogLevel {
+	case "debug", "info", "warn", "error":
+	default:
+		errs = append(errs, &FieldError{Field: "server.log_level", Msg: `must be "debug", "info", "warn" or "error"`})
+	}
+	nonNegative("server.read_header_timeout", c.Server.ReadHeaderTimeout)
+	nonNegative("server.idle_timeout", c.Server.IdleTimeout)
+	positive("auth.access_token_ttl", c.Auth.AccessTokenTTL)
+	positive("auth.refresh_token_ttl", c.Auth.RefreshTokenTTL)
+	if c.Auth.RefreshTokenTTL > 0 && c.Auth.RefreshTokenTTL < c.Auth.AccessTokenTTL {
+		errs = append(errs, &FieldError{Field: "auth.refresh_token_ttl", Msg: "must not be shorter than auth.access_token_ttl"})
+	}
+	positive("auth.short_refresh_token_ttl", c.Auth.ShortRefreshTTL)
+	if c.Auth.ShortRefreshTTL > 0 && c.Auth.ShortRefreshTTL < c.Auth.AccessTokenTTL {
+		errs = append(errs, &FieldError{Field: "auth.short_refresh_token_ttl", Msg: "must not be shorter than auth.access_token_ttl"})
+	}
+	nonNegative("auth.session_max_age", c.Auth.SessionMaxAge)
+	switch c.Auth.Store {
+	case "sqlite", "postgres", "memory":
+	default:
+		errs = append(errs, &FieldError{Field: "auth.store", Msg: `must be "sqlite", "postgres" or "memory"`})
+	}
+	nonNegative("auth.refresh_grace", c.Auth.RefreshGrace)
+	nonNegative("auth.prune_interval", c.Auth.PruneInterval)
+	nonNegative("auth.prune_retention", c.Auth.PruneRetention)
+	positive("auth.mfa_pending_ttl", c.Auth.MFAPendingTTL)
+	if o := c.Auth.OIDC; o.Issuer != "" {
+		if o.ClientID == "" {
+			errs = append(errs, &FieldError{Field: "auth.oidc.client_id", Msg: "must be set when auth.oidc.issuer is set"})
+		}
+		if o.RedirectURL == "" {
+			errs = append(errs, &FieldError{Field: "auth.oidc.redirect_url", Msg: "must be set when auth.oidc.issuer is set"})
+		}
+		if o.UsernameClaim == "" {
+			errs = append(errs, &FieldError{Field: "auth.oidc.username_claim", Msg: "must not be empty"})
+		}
+	}
+	switch c.Auth.Backend {
+	case "couchdb":
+	case "ldap":
+		if c.Auth.LDAP.URL == "" {
+			errs = append(errs, &FieldError{Field: "auth.ldap.url", Msg: `must be set when auth.backend is "ldap"`})
+		}
+		if c.Auth.LDAP.UserBaseDN == "" {
+			errs = append(errs, &FieldError{Field: "auth.ldap.user_base_dn", Msg: `must be set when auth.backend is "ldap"`})
+		}
+		if strings.Count(c.Auth.LDAP.UserFilter, "%s") != 1 {
+			errs = append(errs, &FieldError{Field: "auth.ldap.user_filter", Msg: "must contain %s once"})
+		}
+		if c.Auth.LDAP.GroupBaseDN != "" && strings.Count(c.Auth.LDAP.GroupFilter, "%s") != 1 {
+			errs = append(errs, &FieldError{Field: "auth.ldap.group_filter", Msg: "must contain %s once"})
+		}
+	default:
+		errs = append(errs, &FieldError{Field: "auth.backend", Msg: `must be "couchdb" or "ldap"`})
+	}
+	for _, p := range c.Auth.ForwardAuth.TrustedProxies {
+		if _, err := parsePrefix(p); err != nil {
+			errs = append(errs, &FieldError{Field: "auth.forward_auth.trusted_proxies", Msg: fmt.Sprintf("%q is not a CIDR or IP address", p)})
+		}
+	}
+	if len(c.Auth.ForwardAuth.TrustedProxies) > 0 && c.Auth.ForwardAuth.Header == "" {
+		errs = append(errs, &FieldError{Field: "auth.forward_auth.header", Msg: "must be set when auth.forward_auth.trusted_proxies is set"})
+	}
+	if c.Auth.WebAuthnRPID != "" && len(c.Auth.WebAuthnOrigins) == 0 {
+		errs = append(errs, &FieldError{Field: "auth.webauthn_origins", Msg: "must list at least one origin when auth.webauthn_rp_id is set"})
+	}
+	positive("auth.ldap.timeout", c.Auth.LDAP.Timeout)
+	if t := c.Auth.LoginThrottle; t.Window != 0 {
+		nonNegative("auth.login_throttle.window", t.Window)
+		nonNegative("auth.login_throttle.base_delay", t.BaseDelay)
+		nonNegative("auth.login_throttle.max_delay", t.MaxDelay)
+		nonNegative("auth.login_throttle.lockout_duration", t.LockoutDuration)
+		if t.FreeAttempts < 0 || t.IPFreeAttempts < 0 || t.LockoutAfter < 0 || t.IPLockoutAfter < 0 {
+			errs = append(errs, &FieldError{Field: "auth.login_throttle", Msg: "attempt counts must not be negative"})
+		}
+		if t.LockoutDuration > t.Window {
+			errs = append(errs, &FieldError{Field: "auth.login_throttle.lockout_duration", Msg: "must not be longer than auth.login_throttle.window"})
+		}
+	}
+	for _, a := range c.Server.CSRF.ExemptAuth {
+		if a != "bearer" && a != "pat" && a != "basic" {
+			errs = append(errs, &FieldError{Field: "server.csrf.exempt_auth", Msg: fmt.Sprintf(`%q is not "bearer", "pat" or "basic"`, a)})
+		}
+	}
+	for _, p := range c.Server.TrustedProxies {
+		if _, err := parsePrefix(p); err != nil {
+			errs = append(errs, &FieldError{Field: "server.trusted_proxies", Msg: fmt.Sprintf("%q is not a CIDR or IP address", p)})
+		}
+	}
+	for _, p := range c.Server.CSRF.TrustedProxies {
+		if _, err := parsePrefix(p); err != nil {
+			errs = append(errs, &FieldError{Field: "server.csrf.trusted_proxies", Msg: fmt.Sprintf("%q is not a CIDR or IP address", p)})
+		}
+	}
+	for _, p := range c.Server.CSRF.ExemptPaths {
+		if !strings.HasPrefix(p, "/") {
+			errs = append(errs, &FieldError{Field: "server.csrf.exempt_paths", Msg: fmt.Sprintf("%q must start with /", p)})
+		}
+	}
+	ck := c.Auth.Cookies
+	switch ck.Secure {
+	case "auto", "always", "never":
+	default:
+		errs = append(errs, &FieldError{Field: "auth.cookies.secure", Msg: `must be "auto", "always" or "never"`})
+	}
+	switch ck.SameSite {
+	case "lax", "strict":
+	case "none":
+		if ck.Secure != "always" && !ck.HostPrefix {
+			errs = append(errs, &FieldError{Field: "auth.cookies.same_site", Msg: `"none" needs auth.cookies.secure: always; browsers drop such cookies otherwise`})
+		}
+	default:
+		errs = append(errs, &FieldError{Field: "auth.cookies.same_site", Msg: `must be "lax", "strict" or "none"`})
+	}
+	if ck.HostPrefix && ck.Domain != "" {
+		errs = append(errs, &FieldError{Field: "auth.cookies.domain", Msg: "must be empty when auth.cookies.host_prefix is on"})
+	}
+	if ck.HostPrefix && ck.Secure == "never" {
+		errs = append(errs, &FieldError{Field: "auth.cookies.secure", Msg: `must not be "never" when auth.cookies.host_prefix is on`})
+	}
+	nonNegative("auth.personal_tokens.max_ttl", c.Auth.PersonalTokens.MaxTTL)
+	positive("auth.personal_tokens.access_token_ttl", c.Auth.PersonalTokens.AccessTokenTTL)
+	nonNegative("couchdb.request_timeout", c.CouchDB.RequestTimeout)
+	nonNegative("couchdb.proxy_timeout", c.CouchDB.ProxyTimeout)
+	nonNegative("static.cache_max_age", c.Static.CacheMaxAge)
+	return errs
+}
+
+// Has reports whether the dotted key (e.g. "server.port") is present in the file.
+func (c *AppConfig) Has(key string) bool {
+	return c.set[key]
+}
+
+// Value returns the value at the dotted key formatted as a string, whether it came from
+// the file or from Default. ok is false for unknown keys.
+func (c *AppConfig) Value(key string) (value string, ok bool) {
+	v := reflect.ValueOf(*c)
+	for _, part := range strings.Split(key, ".") {
+		if v.Kind() != reflect.Struct {
+			return "", false
+		}
+		i := fieldIndex(v.Type(), part)
+		if i < 0 {
+			return "", false
+		}
+		v = v.Field(i)
+	}
+	switch v.Kind() {
+	case reflect.Struct:
+		return "", false
+	case reflect.Slice:
+		parts := make([]string, v.Len())
+		for i := range parts {
+			parts[i] = fmt.Sprint(v.Index(i).Interface())
+		}
+		return strings.Join(parts, ","), true
+	case reflect.Map:
+		parts := make([]string, 0, v.Len())
+		for _, k := range v.MapKeys() {
+			parts = append(parts, fmt.Sprintf("%v=%v", k.Interface(), v.MapIndex(k).Interface()))
+		}
+		sort.Strings(parts)
+		return strings.Join(parts, ","), true
+	}
+	return fmt.Sprint(v.Interface()), true
+}
+
+// Keys returns every dotted leaf key config.yaml accepts, in declaration order.
+func Keys() []string {
+	return leafKeys(reflect.TypeOf(AppConfig{}), "")
 }
 
-// AppConfig is the in-memory representation of the app config file (not implemented yet).
-type AppConfig struct{}
+func leafKeys(t reflect.Type, prefix string) []string {
+	var keys []string
+	for i := 0; i < t.NumField(); i++ {
+		name := yamlName(t.Field(i))
+		if name == "" {
+			continue
+		}
+		path := joinPath(prefix, name)
+		if ft := t.Field(i).Type; ft.Kind() == reflect.Struct {
+			keys = append(keys, leafKeys(ft, path)...)
+		} else {
+			keys = append(keys, path)
+		}
+	}
+	return keys
+}
+
+// markSet records the dotted paths of all leaf keys (scalars, lists and maps) in a
+// mapping node that decodes into the struct type t.
+func markSet(node *yaml.Node, t reflect.Type, prefix string, set map[string]bool) {
+	if node.Kind != yaml.MappingNode || t.Kind() != reflect.Struct {
+		if prefix != "" {
+			set[prefix] = true
+		}
+		return
+	}
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		name := node.Content[i].Value
+		if j := fieldIndex(t, name); j >= 0 {
+			markSet(node.Content[i+1], t.Field(j).Type, joinPath(prefix, name), set)
+		}
+	}
+}
+
+func yamlName(f reflect.StructField) string {
+	if !f.IsExported() {
+		return ""
+	}
+	name, _, _ := strings.Cut(f.Tag.Get("yaml"), ",")
+	if name == "-" {
+		return ""
+	}
+	return name
+}
+
+func fieldIndex(t reflect.Type, name string) int {
+	for i := 0; i < t.NumField(); i++ {
+		if yamlName(t.Field(i)) == name {
+			return i
+		}
+	}
+	return -1
+}
+
+// checkKeys walks a mapping node alongside the struct type it decodes into and reports
+// keys that have no matching yaml tag.
+func checkKeys(node *yaml.Node, t reflect.Type, prefix string) []*FieldError {
+	if node.Kind != yaml.MappingNode || t.Kind() != reflect.Struct {
+		return nil
+	}
+	fields := make(map[string]reflect.Type, t.NumField())
+	for i := 0; i < t.NumField(); i++ {
+		if name := yamlName(t.Field(i)); name != "" {
+			fields[name] = t.Field(i).Type
+		}
+	}
+	var errs []*FieldError
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		key, val := node.Content[i], node.Content[i+1]
+		path := joinPath(prefix, key.Value)
+		ft, ok := fields[key.Value]
+		if !ok {
+			errs = append(errs, &FieldError{Line: key.Line, Field: path, Msg: "unknown key"})
+			continue
+		}
+		errs = append(errs, checkKeys(val, ft, path)...)
+	}
+	return errs
+}
+
+// lineOf returns the line of the key at the dotted path, or 0 if it is not in the file.
+func lineOf(root *yaml.Node, path string) int {
+	node := root
+	line := 0
+	for _, part := range strings.Split(path, ".") {
+		if node.Kind != yaml.MappingNode {
+			return 0
+		}
+		var next *yaml.Node
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			if node.Content[i].Value == part {
+				line = node.Content[i].Line
+				next = node.Content[i+1]
+				break
+			}
+		}
+		if next == nil {
+			return 0
+		}
+		node = next
+	}
+	return line
+}
+
+// pathAt returns the dotted path of the value that starts on the given line.
+func pathAt(node *yaml.Node, line int, prefix string) string {
+	if node.Kind != yaml.MappingNode {
+		return ""
+	}
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		key, val := node.Content[i], node.Content[i+1]
+		path := joinPath(prefix, key.Value)
+		if val.Line == line && val.Kind == yaml.ScalarNode {
+			return path
+		}
+		if p := pathAt(val, line, path); p != "" {
+			return p
+		}
+	}
+	return ""
+}
+
+var typeErrorLine = regexp.MustCompile(`^line (\d+): (.*)$`)
+
+// typeError converts one of yaml.TypeError's messages ("line N: cannot unmarshal ...")
+// into a FieldError naming the offending key.
+func typeError(name string, root *yaml.Node, msg string) error {
+	m := typeErrorLine.FindStringSubmatch(msg)
+	if m == nil {
+		return fmt.Errorf("%s: %s", name, msg)
+	}
+	line, _ := strconv.Atoi(m[1])
+	field := pathAt(root, line, "")
+	if field == "" {
+		return fmt.Errorf("%s:%d: %s", name, line, m[2])
+	}
+	return &FieldError{File: name, Line: line, Field: field, Msg: m[2]}
+}
+
+func joinPath(prefix, key string) string {
+	if prefix == "" {
+		return key
+	}
+	return prefix + "." + key
+}
@@ -0,0 +1,175 @@
+package config
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// fieldErrors returns the *FieldError values joined in err.
+func fieldErrors(t *testing.T, err error) []*FieldError {
+	t.Helper()
+	joined, ok := err.(interface{ Unwrap() []error })
+	if !ok {
+		t.Fatalf("error %v (%T) is not a joined error", err, err)
+	}
+	var out []*FieldError
+	for _, e := range joined.Unwrap() {
+		var fe *FieldError
+		if !errors.As(e, &fe) {
+			t.Fatalf("error %v (%T) is not a *FieldError", e, e)
+		}
+		out = append(out, fe)
+	}
+	return out
+}
+
+func TestParseDefaults(t *testing.T) {
+	for _, data := range []string{"", "# nothing set\n", "server: {}\n"} {
+		cfg, err := Parse("config.yaml", []byte(data))
+		if err != nil {
+			t.Fatalf("Parse(%q) error = %v", data, err)
+		}
+		want := Default()
+		cfg.set, want.set = nil, nil
+		if !reflect.DeepEqual(cfg, want) {
+			t.Errorf("Parse(%q) = %+v, want Default()", data, cfg)
+		}
+	}
+
+	d := Default()
+	checks := []struct {
+		key, want string
+	}{
+		{"server.preflight", "strict"},
+		{"server.log_level", "info"},
+		{"server.port", "0"},
+		{"server.csrf.exempt_auth", "bearer,pat"},
+		{"auth.access_token_ttl", "15m0s"},
+		{"auth.refresh_token_ttl", "168h0m0s"},
+		{"auth.store", "sqlite"},
+		{"auth.cookies.same_site", "lax"},
+		{"couchdb.roles_claim", "_couchdb.roles"},
+		{"features.sync", "true"},
+	}
+	for _, c := range checks {
+		if got, ok := d.Value(c.key); !ok || got != c.want {
+			t.Errorf("Default().Value(%q) = %q, %v; want %q", c.key, got, ok, c.want)
+		}
+	}
+	if errs := d.validate(); len(errs) != 0 {
+		t.Errorf("Default() does not validate: %v", errs)
+	}
+}
+
+func TestParseKeepsDefaultsForMissingKeys(t *testing.T) {
+	cfg, err := Parse("config.yaml", []byte("auth:\n  access_token_ttl: 5m\nserver:\n  port: 8080\n"))
+	if err != nil {
+		t.Fatalf("Parse() error = %v", err)
+	}
+	if cfg.Auth.AccessTokenTTL != 5*time.Minute || cfg.Server.Port != 8080 {
+		t.Errorf("Parse() = ttl %v, port %d; want 5m, 8080", cfg.Auth.AccessTokenTTL, cfg.Server.Port)
+	}
+	if cfg.Auth.RefreshTokenTTL != Default().Auth.RefreshTokenTTL {
+		t.Errorf("auth.refresh_token_ttl = %v, want the default", cfg.Auth.RefreshTokenTTL)
+	}
+	for key, want := range map[string]bool{"auth.access_token_ttl": true, "server.port": true, "auth.refresh_token_ttl": false, "couchdb.port": false} {
+		if got := cfg.Has(key); got != want {
+			t.Errorf("Has(%q) = %v, want %v", key, got, want)
+		}
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		data string
+		want []FieldError // File is always config.yaml
+	}{
+		{
+			"unknown keys",
+			"server:\n  port: 8080\n  prot: 1\nauth:\n  oidc:\n    isuer: x\nextra: true\n",
+			[]FieldError{
+				{Line: 3, Field: "server.prot", Msg: "unknown key"},
+				{Line: 6, Field: "auth.oidc.isuer", Msg: "unknown key"},
+				{Line: 7, Field: "extra", Msg: "unknown key"},
+			},
+		},
+		{
+			"wrong type",
+			"server:\n  log_level: info\n  port: eighty\n",
+			[]FieldError{{Line: 3, Field: "server.port", Msg: "cannot unmarshal !!str `eighty` into int"}},
+		},
+		{
+			"port 0",
+			"server:\n  port: 0\n",
+			[]FieldError{{Line: 2, Field: "server.port", Msg: "must be between 1 and 65535"}},
+		},
+		{
+			"port out of range",
+			"couchdb:\n  host: db\n  port: 70000\n",
+			[]FieldError{{Line: 3, Field: "couchdb.port", Msg: "must be between 1 and 65535"}},
+		},
+		{
+			"several invalid values",
+			"auth:\n  store: redis\n  access_token_ttl: 0s\n",
+			[]FieldError{
+				{Line: 3, Field: "auth.access_token_ttl", Msg: "must be greater than zero"},
+				{Line: 2, Field: "auth.store", Msg: `must be "sqlite", "postgres" or "memory"`},
+			},
+		},
+		{
+			"invalid value from a default",
+			"auth:\n  access_token_ttl: 200h\n",
+			[]FieldError{
+				{Line: 0, Field: "auth.refresh_token_ttl", Msg: "must not be shorter than auth.access_token_ttl"},
+				{Line: 0, Field: "auth.short_refresh_token_ttl", Msg: "must not be shorter than auth.access_token_ttl"},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg, err := Parse("config.yaml", []byte(tt.data))
+			if err == nil {
+				t.Fatalf("Parse() = %+v, want errors", cfg)
+			}
+			got := fieldErrors(t, err)
+			if len(got) != len(tt.want) {
+				t.Fatalf("Parse() error = %v, want %d field errors", err, len(tt.want))
+			}
+			for i, fe := range got {
+				want := tt.want[i]
+				want.File = "config.yaml"
+				if *fe != want {
+					t.Errorf("error %d = %+v, want %+v", i, *fe, want)
+				}
+			}
+		})
+	}
+}
+
+func TestFieldErrorString(t *testing.T) {
+	tests := []struct {
+		fe   FieldError
+		want string
+	}{
+		{FieldError{File: "/etc/papaya/config.yaml", Line: 4, Field: "server.port", Msg: "must be between 1 and 65535"}, "/etc/papaya/config.yaml:4: server.port: must be between 1 and 65535"},
+		{FieldError{File: "config.yaml", Field: "auth.refresh_token_ttl", Msg: "too short"}, "config.yaml: auth.refresh_token_ttl: too short"},
+	}
+	for _, tt := range tests {
+		if got := tt.fe.Error(); got != tt.want {
+			t.Errorf("Error() = %q, want %q", got, tt.want)
+		}
+	}
+}
+
+func TestLoadMissingFile(t *testing.T) {
+	cfg, err := Load(t.TempDir())
+	if err != nil {
+		t.Fatalf("Load() error = %v", err)
+	}
+	if cfg.Server.Preflight != "strict" || cfg.Has("server.preflight") {
+		t.Errorf("Load() = %+v, want Default()", cfg.Server)
+	}
+}
@@ -1,26 +1,47 @@
 package env
 
 import (
+	"errors"
+	"flag"
 	"fmt"
+	"net/url"
 	"os"
+	"path/filepath"
 	"strconv"
+
+	"github.com/fridayflag/papaya/internal/config"
 )
 
-// Config holds server configuration loaded from the environment at startup.
-// All values are read once; changing env vars requires a server restart.
-// See .env.example for variable names and purposes.
+// Config holds server configuration resolved from all sources at one point in time.
+// A Config is not modified after Load returns; Live swaps in a new one on reload.
+// See .env.example for variable names and purposes, and Load for the order in which
+// sources are consulted.
 type Config struct {
 	ServerPort        int
 	AuthTokenSecret   string
 	AuthRefreshSecret string
+	AuthMFASecret     string // Seals TOTP secrets; AuthRefreshSecret does when empty
 	AuthTokenKid      string
+	AuthSigningKey    string // PEM private key file for asymmetric access tokens; HMAC with AuthTokenSecret when empty
 	AuthDBPath        string // SQLite DB path for refresh token store (PAPAYA_CONFIG_DIR)
-	CouchDBHost        string
-	CouchDBPort        int
-	CouchDBProxiedURL  string // URL for /db/* proxy; from COUCH_DB_PROXIED_URL or built from host:port
-	DatabaseVendor     string // Expected vendor.name from CouchDB root (PAPAYA_DATABASE_VENDOR); used to detect managed instance
-	StaticAssetsDir    string
-	ConfigDir          string
+	AuthPostgresURL   string // Refresh-token store DSN when auth.store is "postgres"
+	AuthOIDCSecret    string // OIDC client secret (auth.oidc.client_secret)
+	AuthLDAPPassword  string // Password for auth.ldap.bind_dn
+	AuthKeyringPath   string // Access-token keyring written by `papaya keys rotate` (PAPAYA_CONFIG_DIR)
+	CouchDBHost       string
+	CouchDBPort       int
+	CouchDBProxiedURL string // URL for /db/* proxy; from COUCH_DB_PROXIED_URL or built from host:port
+	CouchDBAdminUser  string // Server admin for calls no user makes (provisioning); empty when not configured
+	CouchDBAdminPass  string
+	DatabaseVendor    string // Expected vendor.name from CouchDB root (PAPAYA_DATABASE_VENDOR); used to detect managed instance
+	StaticAssetsDir   string
+	ConfigDir         string
+	App               *config.AppConfig // Settings from config.yaml in ConfigDir; see config.Load
+
+	settings []Setting
+
+	couchDBProxiedUser     string // Merged into CouchDBProxiedURL by Load
+	couchDBProxiedPassword string
 }
 
 // CouchDBBaseURL returns the CouchDB origin without credentials (e.g. for _session).
@@ -28,54 +49,238 @@ func (c *Config) CouchDBBaseURL() string {
 	return fmt.Sprintf("http://%s:%d", c.CouchDBHost, c.CouchDBPort)
 }
 
-// Load reads configuration from the environment once at startup.
-func Load() (*Config, error) {
-	port, err := intEnv("PAPAYA_SERVER_PORT", 1234)
-	if err != nil {
+// Settings returns every effective setting with the source it was resolved from,
+// in a stable order (see `papaya config print`).
+func (c *Config) Settings() []Setting {
+	return c.settings
+}
+
+// Source identifies where an effective setting came from.
+type Source string
+
+const (
+	SourceFlag    Source = "flag"
+	SourceEnv     Source = "env"
+	SourceFile    Source = "config.yaml"
+	SourceDotEnv  Source = ".env"
+	SourceDefault Source = "default"
+)
+
+// Setting is one effective value and where it came from.
+type Setting struct {
+	Key    string // config.yaml key (e.g. "server.port"); "config_dir" for PAPAYA_CONFIG_DIR
+	Value  string
+	Source Source
+	Origin string // Flag, variable or file name within Source, e.g. "PAPAYA_SERVER_PORT"
+	Secret bool
+}
+
+// Display returns the value for printing. Secrets are masked; for URLs only the password is.
+func (s Setting) Display() string {
+	if !s.Secret || s.Value == "" {
+		return s.Value
+	}
+	if u, err := url.Parse(s.Value); err == nil && u.Scheme != "" && u.Host != "" {
+		if _, ok := u.User.Password(); ok {
+			return u.Redacted()
+		}
+		return s.Value
+	}
+	return "********"
+}
+
+// spec describes one setting that can come from any source.
+type spec struct {
+	key    string // config.yaml key, or the name `papaya config print` shows when noFile
+	env    string
+	flag   string // Empty for secrets, which should not appear in process listings
+	def    string
+	secret bool // Masked by Display; may also be read from the file named by <env>_FILE
+	noFile bool // Not settable from config.yaml (the config dir itself, the proxy credentials)
+	apply  func(c *Config, v string) error
+}
+
+var specs = []spec{
+	{key: "config_dir", env: "PAPAYA_CONFIG_DIR", flag: "config-dir", def: "/etc/papaya", noFile: true,
+		apply: func(c *Config, v string) error { c.ConfigDir = v; return nil }},
+	{key: "server.port", env: "PAPAYA_SERVER_PORT", flag: "port", def: "1234",
+		apply: func(c *Config, v string) (err error) { c.ServerPort, err = strconv.Atoi(v); return err }},
+	{key: "auth.token_secret", env: "PAPAYA_AUTH_TOKEN_SECRET", secret: true,
+		apply: func(c *Config, v string) error { c.AuthTokenSecret = v; return nil }},
+	{key: "auth.refresh_secret", env: "PAPAYA_AUTH_REFRESH_SECRET", secret: true,
+		apply: func(c *Config, v string) error { c.AuthRefreshSecret = v; return nil }},
+	{key: "auth.mfa_secret", env: "PAPAYA_AUTH_MFA_SECRET", secret: true,
+		apply: func(c *Config, v string) error { c.AuthMFASecret = v; return nil }},
+	{key: "auth.token_kid", env: "PAPAYA_AUTH_TOKEN_KID", flag: "token-kid",
+		apply: func(c *Config, v string) error { c.AuthTokenKid = v; return nil }},
+	{key: "auth.signing_key_file", env: "PAPAYA_AUTH_SIGNING_KEY_FILE", flag: "signing-key-file",
+		apply: func(c *Config, v string) error { c.AuthSigningKey = v; return nil }},
+	{key: "auth.postgres_url", env: "PAPAYA_AUTH_POSTGRES_URL", secret: true,
+		apply: func(c *Config, v string) error { c.AuthPostgresURL = v; return nil }},
+	{key: "auth.oidc.client_secret", env: "PAPAYA_AUTH_OIDC_CLIENT_SECRET", secret: true,
+		apply: func(c *Config, v string) error { c.AuthOIDCSecret = v; return nil }},
+	{key: "auth.ldap.bind_password", env: "PAPAYA_AUTH_LDAP_BIND_PASSWORD", secret: true,
+		apply: func(c *Config, v string) error { c.AuthLDAPPassword = v; return nil }},
+	{key: "couchdb.host", env: "PAPAYA_COUCHDB_HOST", flag: "couchdb-host", def: "localhost",
+		apply: func(c *Config, v string) error { c.CouchDBHost = v; return nil }},
+	{key: "couchdb.port", env: "PAPAYA_COUCHDB_PORT", flag: "couchdb-port", def: "5984",
+		apply: func(c *Config, v string) (err error) { c.CouchDBPort, err = strconv.Atoi(v); return err }},
+	{key: "couchdb.proxied_url", env: "COUCH_DB_PROXIED_URL", secret: true,
+		apply: func(c *Config, v string) error { c.CouchDBProxiedURL = v; return nil }},
+	{key: "couchdb.proxied_username", env: "COUCH_DB_PROXIED_USER", flag: "couchdb-proxied-user", noFile: true,
+		apply: func(c *Config, v string) error { c.couchDBProxiedUser = v; return nil }},
+	{key: "couchdb.proxied_password", env: "COUCH_DB_PROXIED_PASSWORD", secret: true, noFile: true,
+		apply: func(c *Config, v string) error { c.couchDBProxiedPassword = v; return nil }},
+	{key: "couchdb.admin_user", env: "PAPAYA_COUCHDB_ADMIN_USER",
+		apply: func(c *Config, v string) error { c.CouchDBAdminUser = v; return nil }},
+	{key: "couchdb.admin_password", env: "PAPAYA_COUCHDB_ADMIN_PASS", secret: true,
+		apply: func(c *Config, v string) error { c.CouchDBAdminPass = v; return nil }},
+	{key: "couchdb.vendor", env: "PAPAYA_DATABASE_VENDOR", flag: "database-vendor",
+		apply: func(c *Config, v string) error { c.DatabaseVendor = v; return nil }},
+	{key: "static.dir", env: "PAPAYA_STATIC_ASSETS_DIR", flag: "static-dir", def: "/var/www/papaya",
+		apply: func(c *Config, v string) error { c.StaticAssetsDir = v; return nil }},
+}
+
+// DotEnvFile is read from the working directory by Load.
+const DotEnvFile = ".env"
+
+// Load resolves configuration once at startup. args are the command-line flags (without the
+// program or subcommand name). Each setting is taken from the first source that has it:
+//
+//  1. command-line flags (e.g. -port)
+//  2. environment variables (e.g. PAPAYA_SERVER_PORT)
+//  3. config.yaml in the config directory (e.g. server.port)
+//  4. the .env file in the working directory
+//  5. built-in defaults
+//
+// The config directory and the proxy credentials cannot come from config.yaml.
+func Load(args []string) (*Config, error) {
+	fs := flag.NewFlagSet("papaya", flag.ContinueOnError)
+	flagValues := make(map[string]*string)
+	for _, s := range specs {
+		if s.flag != "" {
+			flagValues[s.flag] = fs.String(s.flag, "", fmt.Sprintf("%s (env %s)", s.key, s.env))
+		}
+	}
+	if err := fs.Parse(args); err != nil {
 		return nil, err
 	}
-	couchPort, err := intEnv("PAPAYA_COUCHDB_PORT", 5984)
+	if fs.NArg() > 0 {
+		return nil, fmt.Errorf("unexpected argument %q", fs.Arg(0))
+	}
+	flagsSet := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) { flagsSet[f.Name] = true })
+
+	dotEnv, err := readDotEnv(DotEnvFile)
 	if err != nil {
 		return nil, err
 	}
-	couchHost := getEnv("PAPAYA_COUCHDB_HOST", "localhost")
-	proxiedURL := getEnv("COUCH_DB_PROXIED_URL", "")
-	if proxiedURL == "" {
-		proxiedURL = fmt.Sprintf("http://%s:%d", couchHost, couchPort)
+
+	cfg := &Config{}
+	var app *config.AppConfig
+	for _, s := range specs {
+		st := Setting{Key: s.key, Secret: s.secret}
+		envValue, envOrigin, err := lookup(s, os.Getenv)
+		if err != nil {
+			return nil, err
+		}
+		dotValue, dotOrigin, err := lookup(s, func(k string) string { return dotEnv[k] })
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", DotEnvFile, err)
+		}
+		switch {
+		case s.flag != "" && flagsSet[s.flag]:
+			st.Value, st.Source, st.Origin = *flagValues[s.flag], SourceFlag, "-"+s.flag
+		case envOrigin != "":
+			st.Value, st.Source, st.Origin = envValue, SourceEnv, envOrigin
+		case !s.noFile && app.Has(s.key):
+			st.Value, _ = app.Value(s.key)
+			st.Source, st.Origin = SourceFile, filepath.Join(cfg.ConfigDir, config.FileName)
+		case dotOrigin != "":
+			st.Value, st.Source, st.Origin = dotValue, SourceDotEnv, dotOrigin
+		default:
+			st.Value, st.Source = s.def, SourceDefault
+		}
+		if err := s.apply(cfg, st.Value); err != nil {
+			return nil, fmt.Errorf("%s (%s %s): invalid value %q", s.key, st.Source, st.Origin, st.Value)
+		}
+		cfg.settings = append(cfg.settings, st)
+
+		if s.key == "config_dir" {
+			// Everything after the config dir may come from config.yaml.
+			if app, err = config.Load(cfg.ConfigDir); err != nil {
+				return nil, err
+			}
+		}
 	}
-	configDir := getEnv("PAPAYA_CONFIG_DIR", "/etc/papaya")
-	authDBPath := configDir + "/papaya.db"
-
-	return &Config{
-		ServerPort:        port,
-		AuthTokenSecret:   getEnv("PAPAYA_AUTH_TOKEN_SECRET", ""),
-		AuthRefreshSecret: getEnv("PAPAYA_AUTH_REFRESH_SECRET", ""),
-		AuthTokenKid:      getEnv("PAPAYA_AUTH_TOKEN_KID", ""),
-		AuthDBPath:        authDBPath,
-		CouchDBHost:       couchHost,
-		CouchDBPort:       couchPort,
-		CouchDBProxiedURL: proxiedURL,
-		DatabaseVendor:    getEnv("PAPAYA_DATABASE_VENDOR", ""),
-		StaticAssetsDir:   getEnv("PAPAYA_STATIC_ASSETS_DIR", "/var/www/papaya"),
-		ConfigDir:         configDir,
-	}, nil
-}
 
-func getEnv(key, def string) string {
-	if v := os.Getenv(key); v != "" {
-		return v
+	if cfg.CouchDBProxiedURL == "" {
+		cfg.CouchDBProxiedURL = fmt.Sprintf("http://%s:%d", cfg.CouchDBHost, cfg.CouchDBPort)
 	}
-	return def
+	if cfg.couchDBProxiedUser != "" || cfg.couchDBProxiedPassword != "" {
+		u, err := url.Parse(cfg.CouchDBProxiedURL)
+		if err != nil {
+			return nil, fmt.Errorf("couchdb.proxied_url: %w", err)
+		}
+		if cfg.couchDBProxiedPassword == "" {
+			u.User = url.User(cfg.couchDBProxiedUser)
+		} else {
+			u.User = url.UserPassword(cfg.couchDBProxiedUser, cfg.couchDBProxiedPassword)
+		}
+		cfg.CouchDBProxiedURL = u.String()
+	}
+	for i := range cfg.settings {
+		if cfg.settings[i].Key == "couchdb.proxied_url" {
+			cfg.settings[i].Value = cfg.CouchDBProxiedURL // Derived from host, port and credentials as needed
+		}
+	}
+	cfg.AuthDBPath = cfg.ConfigDir + "/papaya.db"
+	cfg.AuthKeyringPath = cfg.ConfigDir + "/jwt-keys.json"
+	cfg.App = app
+
+	// Keys only config.yaml can set are listed after the layered ones.
+	layered := make(map[string]bool, len(specs))
+	for _, s := range specs {
+		layered[s.key] = true
+	}
+	for _, key := range config.Keys() {
+		if layered[key] {
+			continue
+		}
+		st := Setting{Key: key, Source: SourceDefault}
+		st.Value, _ = app.Value(key)
+		if app.Has(key) {
+			st.Source, st.Origin = SourceFile, filepath.Join(cfg.ConfigDir, config.FileName)
+		}
+		cfg.settings = append(cfg.settings, st)
+	}
+	return cfg, nil
 }
 
-func intEnv(key string, def int) (int, error) {
-	s := os.Getenv(key)
-	if s == "" {
-		return def, nil
+// lookup reads a setting from an environment-like source: either the variable itself or,
+// for secrets, the file named by <variable>_FILE. origin is empty when neither is set.
+func lookup(s spec, getenv func(string) string) (value, origin string, err error) {
+	value = getenv(s.env)
+	path := ""
+	if s.secret {
+		path = getenv(s.env + "_FILE")
 	}
-	v, err := strconv.Atoi(s)
-	if err != nil {
-		return 0, fmt.Errorf("%s: invalid integer: %w", key, err)
+	switch {
+	case value != "" && path != "":
+		return "", "", fmt.Errorf("%s and %s_FILE are both set; use one", s.env, s.env)
+	case path != "":
+		value, err = readSecretFile(path)
+		if err != nil {
+			return "", "", fmt.Errorf("%s_FILE: %w", s.env, err)
+		}
+		return value, s.env + "_FILE", nil
+	case value != "":
+		return value, s.env, nil
 	}
-	return v, nil
+	return "", "", nil
+}
+
+// IsHelp reports whether err came from -h/-help on the command line.
+func IsHelp(err error) bool {
+	return errors.Is(err, flag.ErrHelp)
 }
@@ -0,0 +1,237 @@
+package env
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/fridayflag/papaya/internal/config"
+)
+
+// sources sets up every place Load reads from: a config dir holding configYAML (unless
+// empty), a .env file with dotEnv lines in the working directory, and the environment
+// variables in environ. Variables of the settings Load knows are cleared first.
+func sources(t *testing.T, configYAML string, dotEnv, environ []string) (configDir string) {
+	t.Helper()
+	for _, s := range specs {
+		t.Setenv(s.env, "")
+		t.Setenv(s.env+"_FILE", "")
+	}
+	configDir = t.TempDir()
+	if configYAML != "" {
+		if err := os.WriteFile(filepath.Join(configDir, "config.yaml"), []byte(configYAML), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	work := t.TempDir()
+	t.Chdir(work)
+	if len(dotEnv) > 0 {
+		if err := os.WriteFile(filepath.Join(work, DotEnvFile), []byte(strings.Join(dotEnv, "\n")+"\n"), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	t.Setenv("PAPAYA_CONFIG_DIR", configDir)
+	for _, kv := range environ {
+		k, v, _ := strings.Cut(kv, "=")
+		t.Setenv(k, v)
+	}
+	return configDir
+}
+
+// secretFile writes value to a file only its owner can read and returns its path.
+func secretFile(t *testing.T, value string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "secret")
+	if err := os.WriteFile(path, []byte(value+"\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// setting returns the effective setting called key.
+func setting(t *testing.T, cfg *Config, key string) Setting {
+	t.Helper()
+	for _, s := range cfg.Settings() {
+		if s.Key == key {
+			return s
+		}
+	}
+	t.Fatalf("no setting %s", key)
+	return Setting{}
+}
+
+func TestLoadPrecedence(t *testing.T) {
+	tests := []struct {
+		name       string
+		args       []string
+		environ    []string
+		configYAML string
+		dotEnv     []string
+		want       string
+		source     Source
+		origin     string // "" to skip; "config.yaml" for the file in the config dir
+	}{
+		{"default", nil, nil, "", nil, "1234", SourceDefault, ""},
+		{".env over default", nil, nil, "", []string{"PAPAYA_SERVER_PORT=2000"}, "2000", SourceDotEnv, "PAPAYA_SERVER_PORT"},
+		{"config.yaml over .env", nil, nil, "server:\n  port: 3000\n", []string{"PAPAYA_SERVER_PORT=2000"}, "3000", SourceFile, "config.yaml"},
+		{"env over config.yaml", nil, []string{"PAPAYA_SERVER_PORT=4000"}, "server:\n  port: 3000\n", []string{"PAPAYA_SERVER_PORT=2000"}, "4000", SourceEnv, "PAPAYA_SERVER_PORT"},
+		{"flag over env", []string{"-port", "5000"}, []string{"PAPAYA_SERVER_PORT=4000"}, "server:\n  port: 3000\n", []string{"PAPAYA_SERVER_PORT=2000"}, "5000", SourceFlag, "-port"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			configDir := sources(t, tt.configYAML, tt.dotEnv, tt.environ)
+			cfg, err := Load(tt.args)
+			if err != nil {
+				t.Fatalf("Load() error = %v", err)
+			}
+			st := setting(t, cfg, "server.port")
+			origin := tt.origin
+			if origin == "config.yaml" {
+				origin = filepath.Join(configDir, "config.yaml")
+			}
+			if st.Value != tt.want || st.Source != tt.source || tt.origin != "" && st.Origin != origin {
+				t.Errorf("server.port = %q from %s %s, want %q from %s %s", st.Value, st.Source, st.Origin, tt.want, tt.source, origin)
+			}
+			if got := strconv.Itoa(cfg.ServerPort); got != tt.want {
+				t.Errorf("ServerPort = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+// TestLoadSecretPrecedence checks secrets, which have no flag and may be read from the
+// file named by <variable>_FILE in the environment or in .env.
+func TestLoadSecretPrecedence(t *testing.T) {
+	tests := []struct {
+		name       string
+		environ    func(t *testing.T) []string
+		configYAML string
+		dotEnv     func(t *testing.T) []string
+		want       string
+		source     Source
+		origin     string
+	}{
+		{"unset", nil, "", nil, "", SourceDefault, ""},
+		{".env file", nil, "", func(t *testing.T) []string {
+			return []string{"PAPAYA_AUTH_TOKEN_SECRET_FILE=" + secretFile(t, "from-dotenv-file")}
+		}, "from-dotenv-file", SourceDotEnv, "PAPAYA_AUTH_TOKEN_SECRET_FILE"},
+		{"config.yaml over .env file", nil, "auth:\n  token_secret: from-yaml\n", func(t *testing.T) []string {
+			return []string{"PAPAYA_AUTH_TOKEN_SECRET_FILE=" + secretFile(t, "from-dotenv-file")}
+		}, "from-yaml", SourceFile, ""},
+		{"env file over config.yaml", func(t *testing.T) []string {
+			return []string{"PAPAYA_AUTH_TOKEN_SECRET_FILE=" + secretFile(t, "from-env-file")}
+		}, "auth:\n  token_secret: from-yaml\n", nil, "from-env-file", SourceEnv, "PAPAYA_AUTH_TOKEN_SECRET_FILE"},
+		{"env variable over config.yaml", func(*testing.T) []string {
+			return []string{"PAPAYA_AUTH_TOKEN_SECRET=from-env"}
+		}, "auth:\n  token_secret: from-yaml\n", func(t *testing.T) []string {
+			return []string{"PAPAYA_AUTH_TOKEN_SECRET=from-dotenv"}
+		}, "from-env", SourceEnv, "PAPAYA_AUTH_TOKEN_SECRET"},
+		{"env file over .env variable", func(t *testing.T) []string {
+			return []string{"PAPAYA_AUTH_TOKEN_SECRET_FILE=" + secretFile(t, "from-env-file")}
+		}, "", func(*testing.T) []string {
+			return []string{"PAPAYA_AUTH_TOKEN_SECRET=from-dotenv"}
+		}, "from-env-file", SourceEnv, "PAPAYA_AUTH_TOKEN_SECRET_FILE"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var environ, dotEnv []string
+			if tt.environ != nil {
+				environ = tt.environ(t)
+			}
+			if tt.dotEnv != nil {
+				dotEnv = tt.dotEnv(t)
+			}
+			sources(t, tt.configYAML, dotEnv, environ)
+			cfg, err := Load(nil)
+			if err != nil {
+				t.Fatalf("Load() error = %v", err)
+			}
+			st := setting(t, cfg, "auth.token_secret")
+			if st.Value != tt.want || st.Source != tt.source || tt.origin != "" && st.Origin != tt.origin {
+				t.Errorf("auth.token_secret = %q from %s %s, want %q from %s %s", st.Value, st.Source, st.Origin, tt.want, tt.source, tt.origin)
+			}
+			if cfg.AuthTokenSecret != tt.want {
+				t.Errorf("AuthTokenSecret = %q, want %q", cfg.AuthTokenSecret, tt.want)
+			}
+		})
+	}
+}
+
+func TestLoadErrors(t *testing.T) {
+	tests := []struct {
+		name       string
+		args       []string
+		environ    func(t *testing.T) []string
+		configYAML string
+		dotEnv     []string
+		wantErr    string
+	}{
+		{"variable and file", nil, func(t *testing.T) []string {
+			return []string{"PAPAYA_AUTH_TOKEN_SECRET=x", "PAPAYA_AUTH_TOKEN_SECRET_FILE=" + secretFile(t, "y")}
+		}, "", nil, "both set"},
+		{"missing secret file", nil, func(*testing.T) []string {
+			return []string{"PAPAYA_AUTH_TOKEN_SECRET_FILE=/nonexistent/secret"}
+		}, "", nil, "PAPAYA_AUTH_TOKEN_SECRET_FILE"},
+		{"no flag for secrets", []string{"-couchdb-proxied-url", "http://u:p@db:5984"}, nil, "", nil, "flag provided but not defined"},
+		{"proxy credentials not in config.yaml", nil, nil, "couchdb:\n  proxied_username: u\n", nil, "couchdb.proxied_username: unknown key"},
+		{"invalid port", nil, func(*testing.T) []string { return []string{"PAPAYA_SERVER_PORT=http"} }, "", nil, `server.port (env PAPAYA_SERVER_PORT): invalid value "http"`},
+		{"invalid .env", nil, nil, "", []string{"not a setting"}, "expected KEY=VALUE"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var environ []string
+			if tt.environ != nil {
+				environ = tt.environ(t)
+			}
+			sources(t, tt.configYAML, tt.dotEnv, environ)
+			if _, err := Load(tt.args); err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("Load() error = %v, want one mentioning %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+// TestLoadProxiedURL checks that the proxy credentials, which only the environment and
+// .env hold, are added to the proxied URL, and that the URL's password is masked.
+func TestLoadProxiedURL(t *testing.T) {
+	sources(t, "couchdb:\n  host: db\n  port: 6984\n", []string{"COUCH_DB_PROXIED_USER=papaya"}, []string{
+		"COUCH_DB_PROXIED_PASSWORD_FILE=" + secretFile(t, "s3cret"),
+	})
+	cfg, err := Load(nil)
+	if err != nil {
+		t.Fatalf("Load() error = %v", err)
+	}
+	if want := "http://papaya:s3cret@db:6984"; cfg.CouchDBProxiedURL != want {
+		t.Errorf("CouchDBProxiedURL = %q, want %q", cfg.CouchDBProxiedURL, want)
+	}
+	if got, want := setting(t, cfg, "couchdb.proxied_url").Display(), "http://papaya:xxxxx@db:6984"; got != want {
+		t.Errorf("couchdb.proxied_url displayed as %q, want %q", got, want)
+	}
+	if st := setting(t, cfg, "couchdb.proxied_username"); st.Source != SourceDotEnv {
+		t.Errorf("couchdb.proxied_username from %s, want %s", st.Source, SourceDotEnv)
+	}
+	if got := setting(t, cfg, "couchdb.proxied_password").Display(); got != "********" {
+		t.Errorf("couchdb.proxied_password displayed as %q, want it masked", got)
+	}
+}
+
+// TestSpecs checks the settings table against its own rules.
+func TestSpecs(t *testing.T) {
+	keys := map[string]bool{}
+	for _, k := range config.Keys() {
+		keys[k] = true
+	}
+	for _, s := range specs {
+		if s.secret && s.flag != "" {
+			t.Errorf("%s is secret but has flag -%s", s.key, s.flag)
+		}
+		if !s.noFile && !keys[s.key] {
+			t.Errorf("%s is not a config.yaml key; mark it noFile", s.key)
+		}
+		if s.noFile && keys[s.key] {
+			t.Errorf("%s is a config.yaml key but marked noFile", s.key)
+		}
+	}
+}
@@ -0,0 +1,153 @@
+package env
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/fridayflag/papaya/internal/config"
+)
+
+// Live holds the current Config and replaces it atomically on Reload.
+// Handlers call Get for every request instead of capturing a *Config, so settings that are
+// safe to change at runtime (token lifetimes, feature flags, log level, CORS origins, ...)
+// take effect without a restart. A Config returned by Get is never modified.
+type Live struct {
+	cur      atomic.Pointer[Config]
+	args     []string
+	mu       sync.Mutex // Serializes Reload
+	onReload []func(*Config)
+}
+
+// NewLive wraps cfg. args are the command-line flags cfg was loaded with; Reload uses them
+// again so flags keep their precedence.
+func NewLive(cfg *Config, args []string) *Live {
+	l := &Live{args: args}
+	l.cur.Store(cfg)
+	return l
+}
+
+// Get returns the current configuration snapshot.
+func (l *Live) Get() *Config {
+	return l.cur.Load()
+}
+
+// OnReload registers fn to be called with the new snapshot after each successful Reload.
+// Register before starting Watch or handling SIGHUP.
+func (l *Live) OnReload(fn func(*Config)) {
+	l.onReload = append(l.onReload, fn)
+}
+
+// Reload resolves the configuration again from all sources and swaps it in. Settings that
+// cannot change while the server runs keep their old value and are logged as warnings.
+// On error the current snapshot is kept.
+func (l *Live) Reload() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	next, err := Load(l.args)
+	if err != nil {
+		return err
+	}
+	old := l.Get()
+	for _, key := range keepRestartOnly(old, next) {
+		slog.Warn("config: setting changed but requires a restart; keeping the old value", "key", key)
+	}
+	l.cur.Store(next)
+	for _, fn := range l.onReload {
+		fn(next)
+	}
+	slog.Info("config: reloaded")
+	return nil
+}
+
+// Watch polls config.yaml every interval and calls Reload when its size or modification
+// time changes, until ctx is done. Reload errors are logged.
+func (l *Live) Watch(ctx context.Context, interval time.Duration) {
+	path := filepath.Join(l.Get().ConfigDir, config.FileName)
+	last := fileStamp(path)
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+		stamp := fileStamp(path)
+		if stamp == last {
+			continue
+		}
+		last = stamp
+		if err := l.Reload(); err != nil {
+			slog.Error("config: reload failed; keeping the current settings", "err", err)
+		}
+	}
+}
+
+func fileStamp(path string) string {
+	info, err := os.Stat(path)
+	if err != nil {
+		return ""
+	}
+	return fmt.Sprintf("%d/%d", info.Size(), info.ModTime().UnixNano())
+}
+
+// restartOnly lists the settings that are bound at startup (listener, stores, proxy, static
+// handler, signing secrets). Everything else is read from the live snapshot per request.
+var restartOnly = []struct {
+	key   string
+	field func(c *Config) any // Pointer to the field
+}{
+	{"config_dir", func(c *Config) any { return &c.ConfigDir }},
+	{"server.port", func(c *Config) any { return &c.ServerPort }},
+	{"server.address", func(c *Config) any { return &c.App.Server.Address }},
+	{"server.read_header_timeout", func(c *Config) any { return &c.App.Server.ReadHeaderTimeout }},
+	{"server.idle_timeout", func(c *Config) any { return &c.App.Server.IdleTimeout }},
+	{"server.trusted_proxies", func(c *Config) any { return &c.App.Server.TrustedProxies }},
+	{"auth.token_secret", func(c *Config) any { return &c.AuthTokenSecret }},
+	{"auth.refresh_secret", func(c *Config) any { return &c.AuthRefreshSecret }},
+	{"auth.mfa_secret", func(c *Config) any { return &c.AuthMFASecret }},
+	{"auth.token_kid", func(c *Config) any { return &c.AuthTokenKid }},
+	{"auth.signing_key_file", func(c *Config) any { return &c.AuthSigningKey }},
+	{"auth.store", func(c *Config) any { return &c.App.Auth.Store }},
+	{"auth.postgres_url", func(c *Config) any { return &c.AuthPostgresURL }},
+	{"auth.cookies.host_prefix", func(c *Config) any { return &c.App.Auth.Cookies.HostPrefix }},
+	{"couchdb.proxied_url", func(c *Config) any { return &c.CouchDBProxiedURL }},
+	{"couchdb.proxy_timeout", func(c *Config) any { return &c.App.CouchDB.ProxyTimeout }},
+	{"static.dir", func(c *Config) any { return &c.StaticAssetsDir }},
+	{"static.cache_max_age", func(c *Config) any { return &c.App.Static.CacheMaxAge }},
+	{"static.spa_fallback", func(c *Config) any { return &c.App.Static.SPAFallback }},
+}
+
+// keepRestartOnly copies restart-only values from old into next and returns the keys
+// whose value had changed.
+func keepRestartOnly(old, next *Config) []string {
+	var changed []string
+	for _, r := range restartOnly {
+		o := reflect.ValueOf(r.field(old)).Elem()
+		n := reflect.ValueOf(r.field(next)).Elem()
+		if !reflect.DeepEqual(o.Interface(), n.Interface()) {
+			changed = append(changed, r.key)
+			n.Set(o)
+		}
+	}
+	// Derived from config_dir, which is kept above.
+	next.AuthDBPath = old.AuthDBPath
+	next.AuthKeyringPath = old.AuthKeyringPath
+	for i, s := range next.settings {
+		for _, key := range changed {
+			if s.Key == key {
+				next.settings[i].Value = old.settings[i].Value
+				next.settings[i].Source = old.settings[i].Source
+				next.settings[i].Origin = old.settings[i].Origin
+			}
+		}
+	}
+	return changed
+}
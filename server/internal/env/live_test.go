@@ -0,0 +1,27 @@
+package env
+
+import (
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/fridayflag/papaya/internal/config"
+)
+
+func TestKeepRestartOnly(t *testing.T) {
+	old := &Config{ConfigDir: "/srv/papaya", AuthDBPath: "/srv/papaya/papaya.db", AuthKeyringPath: "/srv/papaya/jwt-keys.json", App: config.Default()}
+	old.App.Auth.AccessTokenTTL = 15 * time.Minute
+	next := &Config{ConfigDir: "/tmp/other", AuthDBPath: "/tmp/other/papaya.db", AuthKeyringPath: "/tmp/other/jwt-keys.json", App: config.Default()}
+	next.App.Auth.AccessTokenTTL = 5 * time.Minute
+
+	changed := keepRestartOnly(old, next)
+	if !slices.Equal(changed, []string{"config_dir"}) {
+		t.Errorf("changed = %v, want [config_dir]", changed)
+	}
+	if next.ConfigDir != old.ConfigDir || next.AuthDBPath != old.AuthDBPath || next.AuthKeyringPath != old.AuthKeyringPath {
+		t.Errorf("paths = %q, %q, %q; want the old ones kept", next.ConfigDir, next.AuthDBPath, next.AuthKeyringPath)
+	}
+	if next.App.Auth.AccessTokenTTL != 5*time.Minute {
+		t.Errorf("auth.access_token_ttl = %v, want the reloaded 5m", next.App.Auth.AccessTokenTTL)
+	}
+}
@@ -0,0 +1,37 @@
+package env
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// readSecretFile reads a secret mounted as a file (Docker/Kubernetes secrets) and trims
+// trailing newlines. The file must exist, be a regular file, be non-empty and must not be
+// accessible to group or others: anyone who can read it has the secret, and anyone who can
+// write it can swap it. With Docker and Kubernetes, mount secrets with mode 0400 or 0600.
+func readSecretFile(path string) (string, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return "", fmt.Errorf("secret file %s does not exist", path)
+		}
+		return "", err
+	}
+	if !info.Mode().IsRegular() {
+		return "", fmt.Errorf("secret file %s is not a regular file", path)
+	}
+	if perm := info.Mode().Perm(); perm&0o077 != 0 {
+		return "", fmt.Errorf("secret file %s is accessible to group or others (mode %04o); run chmod go-rwx", path, perm)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	secret := strings.TrimRight(string(data), "\r\n")
+	if secret == "" {
+		return "", fmt.Errorf("secret file %s is empty", path)
+	}
+	return secret, nil
+}
@@ -0,0 +1,57 @@
+package env
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestReadSecretFile(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, content string, mode os.FileMode) string {
+		t.Helper()
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chmod(path, mode); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+
+	tests := []struct {
+		name    string
+		path    string
+		want    string
+		wantErr string
+	}{
+		{"owner only", write("ok", "s3cret\n", 0o600), "s3cret", ""},
+		{"owner read-only", write("ro", "s3cret\r\n", 0o400), "s3cret", ""},
+		{"world readable", write("world-r", "s3cret", 0o644), "", "accessible to group or others"},
+		{"group readable", write("group-r", "s3cret", 0o640), "", "accessible to group or others"},
+		{"all read-only", write("all-ro", "s3cret", 0o444), "", "accessible to group or others"},
+		{"group writable", write("group-w", "s3cret", 0o620), "", "accessible to group or others"},
+		{"empty", write("empty", "\n", 0o600), "", "is empty"},
+		{"missing", filepath.Join(dir, "missing"), "", "does not exist"},
+		{"directory", dir, "", "not a regular file"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := readSecretFile(tt.path)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("readSecretFile() error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("readSecretFile() error = %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("readSecretFile() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,265 @@
+package preflight
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/fridayflag/papaya/internal/auth"
+	"github.com/fridayflag/papaya/internal/env"
+)
+
+// Status is the outcome of one check.
+type Status int
+
+const (
+	Pass Status = iota
+	Warn
+	Fail
+)
+
+func (s Status) String() string {
+	switch s {
+	case Pass:
+		return "PASS"
+	case Warn:
+		return "WARN"
+	default:
+		return "FAIL"
+	}
+}
+
+// Result is the outcome of one named check.
+type Result struct {
+	Name   string
+	Status Status
+	Detail string
+}
+
+// Report is the list of results from Run, in check order.
+type Report []Result
+
+// Failed reports whether any check failed.
+func (r Report) Failed() bool {
+	for _, res := range r {
+		if res.Status == Fail {
+			return true
+		}
+	}
+	return false
+}
+
+// Write prints one line per check as a table.
+func (r Report) Write(w io.Writer) error {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	for _, res := range r {
+		fmt.Fprintf(tw, "%s\t%s\t%s\n", res.Status, res.Name, res.Detail)
+	}
+	return tw.Flush()
+}
+
+// preflightUser is the JWT subject used to prove CouchDB accepts Papaya's tokens.
+// CouchDB does not require the subject to exist in _users.
+const preflightUser = "papaya-preflight"
+
+// minSecretLen is the length below which an HMAC secret is reported as weak (256 bits).
+const minSecretLen = 32
+
+// Run checks that cfg describes a working setup: secrets are set, the config and static
+// directories are usable, and CouchDB is reachable, is the expected vendor and accepts
+// tokens minted with every key in the access keyring. Checks that need CouchDB are skipped
+// with a warning when it cannot be reached.
+func Run(ctx context.Context, cfg *env.Config) Report {
+	var r Report
+	add := func(name string, status Status, format string, args ...any) {
+		r = append(r, Result{Name: name, Status: status, Detail: fmt.Sprintf(format, args...)})
+	}
+
+	accessKey, keyErr := auth.NewAccessKey(cfg.AuthTokenKid, cfg.AuthTokenSecret, cfg.AuthSigningKey)
+	switch {
+	case cfg.AuthSigningKey != "" && keyErr != nil:
+		add("auth.signing_key_file", Fail, "%v", keyErr)
+	case cfg.AuthSigningKey != "":
+		add("auth.signing_key_file", Pass, "%s key", accessKey.Method.Alg())
+	case cfg.AuthTokenSecret == "":
+		add("auth.token_secret", Fail, "not set; tokens would be signed with an empty key")
+	case len(cfg.AuthTokenSecret) < minSecretLen:
+		add("auth.token_secret", Warn, "only %d bytes; use at least %d random bytes", len(cfg.AuthTokenSecret), minSecretLen)
+	default:
+		add("auth.token_secret", Pass, "set")
+	}
+	switch {
+	case cfg.AuthRefreshSecret == "":
+		add("auth.refresh_secret", Fail, "not set; refresh tokens would be signed with an empty key")
+	case cfg.AuthRefreshSecret == cfg.AuthTokenSecret:
+		add("auth.refresh_secret", Warn, "same as auth.token_secret; CouchDB could mint refresh tokens")
+	default:
+		add("auth.refresh_secret", Pass, "set")
+	}
+	switch {
+	case cfg.AuthMFASecret == "":
+		add("auth.mfa_secret", Warn, "not set; TOTP secrets are sealed with auth.refresh_secret, so changing that disables every authenticator")
+	case cfg.AuthMFASecret == cfg.AuthRefreshSecret || cfg.AuthMFASecret == cfg.AuthTokenSecret:
+		add("auth.mfa_secret", Warn, "same as another auth secret; use a separate one")
+	case len(cfg.AuthMFASecret) < minSecretLen:
+		add("auth.mfa_secret", Warn, "only %d bytes; use at least %d random bytes", len(cfg.AuthMFASecret), minSecretLen)
+	default:
+		add("auth.mfa_secret", Pass, "set")
+	}
+	if cfg.AuthTokenKid == "" {
+		add("auth.token_kid", Warn, `not set; CouchDB will look the key up as "hmac:_default"`)
+	} else {
+		add("auth.token_kid", Pass, "%s", cfg.AuthTokenKid)
+	}
+	var ring *auth.Keyring
+	if keyErr == nil {
+		ring, keyErr = auth.LoadKeyring(cfg.AuthKeyringPath, accessKey)
+		if keyErr != nil {
+			add("auth.keyring", Fail, "%v", keyErr)
+		} else if _, err := os.Stat(cfg.AuthKeyringPath); err == nil {
+			add("auth.keyring", Pass, "%d keys, active %q", len(ring.Keys()), ring.Active().Kid)
+		}
+	}
+
+	if err := checkWritable(cfg.ConfigDir); err != nil {
+		add("config_dir", Fail, "%s is not writable: %v", cfg.ConfigDir, err)
+	} else {
+		add("config_dir", Pass, "%s is writable", cfg.ConfigDir)
+	}
+	switch cfg.App.Auth.Store {
+	case "postgres":
+		status, err := auth.PostgresMigrations(cfg.AuthPostgresURL)
+		if err != nil {
+			add("auth.store", Fail, "postgres: %v", err)
+			break
+		}
+		pending := 0
+		for _, m := range status {
+			if m.Pending() {
+				pending++
+			}
+		}
+		add("auth.store", Pass, "postgres reachable, %d pending migrations (applied at startup)", pending)
+	case "memory":
+		add("auth.store", Warn, "memory; sessions are lost on restart and not shared between replicas")
+	}
+	if o := cfg.App.Auth.OIDC; o.Issuer != "" {
+		var discovery struct {
+			Issuer string `json:"issuer"`
+		}
+		url := strings.TrimSuffix(o.Issuer, "/") + "/.well-known/openid-configuration"
+		err := getJSON(ctx, &http.Client{Timeout: cfg.App.CouchDB.RequestTimeout}, url, "", &discovery)
+		switch {
+		case err != nil:
+			add("auth.oidc", Fail, "discovery: %v", err)
+		case discovery.Issuer != o.Issuer:
+			add("auth.oidc", Fail, "provider reports issuer %q, expected %q", discovery.Issuer, o.Issuer)
+		case o.Provision && cfg.CouchDBAdminUser == "":
+			add("auth.oidc", Fail, "auth.oidc.provision needs couchdb.admin_user and couchdb.admin_password")
+		default:
+			add("auth.oidc", Pass, "%s", o.Issuer)
+		}
+	}
+
+	if info, err := os.Stat(cfg.StaticAssetsDir); err != nil || !info.IsDir() {
+		add("static.dir", Fail, "%s is not a directory", cfg.StaticAssetsDir)
+	} else if _, err := os.Stat(filepath.Join(cfg.StaticAssetsDir, "index.html")); err != nil {
+		add("static.dir", Warn, "%s has no index.html; the app will not load", cfg.StaticAssetsDir)
+	} else {
+		add("static.dir", Pass, "%s", cfg.StaticAssetsDir)
+	}
+
+	client := &http.Client{Timeout: cfg.App.CouchDB.RequestTimeout}
+	base := cfg.CouchDBBaseURL()
+	var root struct {
+		Vendor struct {
+			Name string `json:"name"`
+		} `json:"vendor"`
+	}
+	if err := getJSON(ctx, client, base+"/", "", &root); err != nil {
+		add("couchdb.reachable", Fail, "%v", err)
+		add("couchdb.vendor", Warn, "skipped; CouchDB not reachable")
+		add("couchdb.jwt", Warn, "skipped; CouchDB not reachable")
+		return r
+	}
+	add("couchdb.reachable", Pass, "%s", base)
+
+	switch {
+	case cfg.DatabaseVendor == "":
+		add("couchdb.vendor", Warn, "couchdb.vendor not set; cannot tell a managed instance from an external one")
+	case root.Vendor.Name != cfg.DatabaseVendor:
+		add("couchdb.vendor", Fail, "CouchDB reports vendor %q, expected %q", root.Vendor.Name, cfg.DatabaseVendor)
+	default:
+		add("couchdb.vendor", Pass, "%s", root.Vendor.Name)
+	}
+
+	if keyErr != nil || (cfg.AuthSigningKey == "" && cfg.AuthTokenSecret == "") {
+		add("couchdb.jwt", Warn, "skipped; no usable signing key")
+		return r
+	}
+	var session struct {
+		UserCtx struct {
+			Name *string `json:"name"`
+		} `json:"userCtx"`
+	}
+	const hint = "check that [jwt_keys] in papaya.couchdb.ini lists every key in use (see papaya keys couchdb)"
+	for _, key := range ring.Keys() {
+		// Keys that are not retired must keep working in CouchDB, not just the active one.
+		token, _, err := auth.MintAccessToken(preflightUser, "", time.Time{}, auth.Roles{}, key, time.Minute)
+		if err != nil {
+			add("couchdb.jwt", Fail, "kid %q: mint token: %v", key.Kid, err)
+			continue
+		}
+		session.UserCtx.Name = nil
+		if err := getJSON(ctx, client, base+"/_session", token, &session); err != nil {
+			add("couchdb.jwt", Fail, "CouchDB rejected the token for kid %q (%v); %s", key.Kid, err, hint)
+		} else if session.UserCtx.Name == nil || *session.UserCtx.Name != preflightUser {
+			add("couchdb.jwt", Fail, "CouchDB ignored the token for kid %q; %s", key.Kid, hint)
+		} else {
+			add("couchdb.jwt", Pass, "CouchDB accepts tokens signed with kid %q", key.Kid)
+		}
+	}
+	return r
+}
+
+// checkWritable creates and removes a temporary file in dir, creating dir first like auth.OpenSQLite does.
+func checkWritable(dir string) error {
+	if err := os.MkdirAll(dir, 0750); err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(dir, ".papaya-preflight-*")
+	if err != nil {
+		return err
+	}
+	name := f.Name()
+	_ = f.Close()
+	return os.Remove(name)
+}
+
+// getJSON GETs url (with bearer as a Bearer token when non-empty) and decodes a 200 response.
+func getJSON(ctx context.Context, client *http.Client, url, bearer string, out any) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+	if bearer != "" {
+		req.Header.Set("Authorization", "Bearer "+bearer)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %s: %s", url, resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
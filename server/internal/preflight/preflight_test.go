@@ -0,0 +1,328 @@
+package preflight
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/fridayflag/papaya/internal/auth"
+	"github.com/fridayflag/papaya/internal/config"
+	"github.com/fridayflag/papaya/internal/env"
+)
+
+const (
+	tokenSecret   = "token-secret-of-at-least-32-bytes"
+	refreshSecret = "refresh-secret-at-least-32-bytes!"
+	mfaSecret     = "mfa-secret-of-at-least-32-bytes!!"
+)
+
+// fakeCouch stands in for CouchDB: / reports vendor, and GET /_session names the subject
+// of a Bearer token that keys verifies, like CouchDB's JWT handler with [jwt_keys] set.
+type fakeCouch struct {
+	*httptest.Server
+	vendor    string
+	keys      auth.KeySet
+	ignoreJWT bool // Like CouchDB without the JWT handler: every session is anonymous
+}
+
+func newFakeCouch(t *testing.T) *fakeCouch {
+	f := &fakeCouch{vendor: "papaya"}
+	f.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch r.URL.Path {
+		case "/":
+			_ = json.NewEncoder(w).Encode(map[string]any{"couchdb": "Welcome", "vendor": map[string]any{"name": f.vendor}})
+		case "/_session":
+			var name any // null for an anonymous session
+			if token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok && !f.ignoreJWT {
+				username, err := auth.ValidateAccessToken(token, f.keys)
+				if err != nil {
+					w.WriteHeader(http.StatusUnauthorized)
+					_ = json.NewEncoder(w).Encode(map[string]any{"error": "unauthorized"})
+					return
+				}
+				name = username
+			}
+			_ = json.NewEncoder(w).Encode(map[string]any{"ok": true, "userCtx": map[string]any{"name": name}})
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	t.Cleanup(f.Close)
+	return f
+}
+
+// testConfig returns a setup every check passes against, with CouchDB served by couch.
+func testConfig(t *testing.T, couch *httptest.Server) *env.Config {
+	t.Helper()
+	static := t.TempDir()
+	if err := os.WriteFile(filepath.Join(static, "index.html"), []byte("<!doctype html>"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	configDir := t.TempDir()
+	cfg := &env.Config{
+		AuthTokenSecret:   tokenSecret,
+		AuthRefreshSecret: refreshSecret,
+		AuthMFASecret:     mfaSecret,
+		AuthTokenKid:      "papaya",
+		AuthKeyringPath:   filepath.Join(configDir, "jwt-keys.json"),
+		CouchDBAdminUser:  "admin",
+		CouchDBAdminPass:  "adminpw",
+		DatabaseVendor:    "papaya",
+		StaticAssetsDir:   static,
+		ConfigDir:         configDir,
+		App:               config.Default(),
+	}
+	host, port, err := net.SplitHostPort(strings.TrimPrefix(couch.URL, "http://"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.CouchDBHost = host
+	if cfg.CouchDBPort, err = strconv.Atoi(port); err != nil {
+		t.Fatal(err)
+	}
+	return cfg
+}
+
+// results returns the results of the check called name.
+func results(r Report, name string) []Result {
+	var out []Result
+	for _, res := range r {
+		if res.Name == name {
+			out = append(out, res)
+		}
+	}
+	return out
+}
+
+// issuer serves an OpenID discovery document reporting the given issuer, or 404 when empty.
+func issuer(t *testing.T, reported func(url string) string) string {
+	var srv *httptest.Server
+	srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		iss := reported(srv.URL)
+		if r.URL.Path != "/.well-known/openid-configuration" || iss == "" {
+			http.NotFound(w, r)
+			return
+		}
+		_ = json.NewEncoder(w).Encode(map[string]any{"issuer": iss})
+	}))
+	t.Cleanup(srv.Close)
+	return srv.URL
+}
+
+func TestRun(t *testing.T) {
+	tests := []struct {
+		name      string
+		check     string
+		configure func(t *testing.T, cfg *env.Config, couch *fakeCouch)
+		want      Status
+	}{
+		{"signing key file", "auth.signing_key_file", func(t *testing.T, cfg *env.Config, couch *fakeCouch) {
+			key, pemBytes, err := auth.GenerateKey(cfg.AuthTokenKid, "ec")
+			if err != nil {
+				t.Fatal(err)
+			}
+			cfg.AuthSigningKey = filepath.Join(t.TempDir(), "key.pem")
+			if err := os.WriteFile(cfg.AuthSigningKey, pemBytes, 0o600); err != nil {
+				t.Fatal(err)
+			}
+			couch.keys = key
+		}, Pass},
+		{"unreadable signing key file", "auth.signing_key_file", func(t *testing.T, cfg *env.Config, _ *fakeCouch) {
+			cfg.AuthSigningKey = filepath.Join(t.TempDir(), "key.pem")
+			if err := os.WriteFile(cfg.AuthSigningKey, []byte("not a key"), 0o600); err != nil {
+				t.Fatal(err)
+			}
+		}, Fail},
+
+		{"token secret", "auth.token_secret", nil, Pass},
+		{"short token secret", "auth.token_secret", func(_ *testing.T, cfg *env.Config, couch *fakeCouch) {
+			cfg.AuthTokenSecret = "short"
+			couch.keys = auth.HMACKey(cfg.AuthTokenKid, cfg.AuthTokenSecret)
+		}, Warn},
+		{"no token secret", "auth.token_secret", func(_ *testing.T, cfg *env.Config, _ *fakeCouch) { cfg.AuthTokenSecret = "" }, Fail},
+
+		{"refresh secret", "auth.refresh_secret", nil, Pass},
+		{"refresh secret same as token secret", "auth.refresh_secret", func(_ *testing.T, cfg *env.Config, _ *fakeCouch) {
+			cfg.AuthRefreshSecret = cfg.AuthTokenSecret
+		}, Warn},
+		{"no refresh secret", "auth.refresh_secret", func(_ *testing.T, cfg *env.Config, _ *fakeCouch) { cfg.AuthRefreshSecret = "" }, Fail},
+
+		{"MFA secret", "auth.mfa_secret", nil, Pass},
+		{"no MFA secret", "auth.mfa_secret", func(_ *testing.T, cfg *env.Config, _ *fakeCouch) { cfg.AuthMFASecret = "" }, Warn},
+		{"MFA secret same as refresh secret", "auth.mfa_secret", func(_ *testing.T, cfg *env.Config, _ *fakeCouch) {
+			cfg.AuthMFASecret = cfg.AuthRefreshSecret
+		}, Warn},
+		{"short MFA secret", "auth.mfa_secret", func(_ *testing.T, cfg *env.Config, _ *fakeCouch) { cfg.AuthMFASecret = "short" }, Warn},
+
+		{"token kid", "auth.token_kid", nil, Pass},
+		{"no token kid", "auth.token_kid", func(_ *testing.T, cfg *env.Config, couch *fakeCouch) {
+			cfg.AuthTokenKid = ""
+			couch.keys = auth.HMACKey("", cfg.AuthTokenSecret)
+		}, Warn},
+
+		{"keyring", "auth.keyring", func(t *testing.T, cfg *env.Config, _ *fakeCouch) {
+			ring, err := auth.LoadKeyring(cfg.AuthKeyringPath, auth.HMACKey(cfg.AuthTokenKid, cfg.AuthTokenSecret))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := ring.Save(); err != nil {
+				t.Fatal(err)
+			}
+		}, Pass},
+		{"corrupt keyring", "auth.keyring", func(t *testing.T, cfg *env.Config, _ *fakeCouch) {
+			if err := os.WriteFile(cfg.AuthKeyringPath, []byte("{"), 0o600); err != nil {
+				t.Fatal(err)
+			}
+		}, Fail},
+
+		{"config dir", "config_dir", nil, Pass},
+		{"config dir under a file", "config_dir", func(t *testing.T, cfg *env.Config, _ *fakeCouch) {
+			file := filepath.Join(t.TempDir(), "file")
+			if err := os.WriteFile(file, nil, 0o600); err != nil {
+				t.Fatal(err)
+			}
+			cfg.ConfigDir = filepath.Join(file, "papaya")
+		}, Fail},
+
+		{"memory store", "auth.store", func(_ *testing.T, cfg *env.Config, _ *fakeCouch) { cfg.App.Auth.Store = "memory" }, Warn},
+		{"unreachable postgres", "auth.store", func(_ *testing.T, cfg *env.Config, _ *fakeCouch) {
+			cfg.App.Auth.Store = "postgres"
+			cfg.AuthPostgresURL = "postgres://papaya@127.0.0.1:1/papaya?connect_timeout=5"
+		}, Fail},
+
+		{"OIDC provider", "auth.oidc", func(t *testing.T, cfg *env.Config, _ *fakeCouch) {
+			cfg.App.Auth.OIDC.Issuer = issuer(t, func(url string) string { return url })
+		}, Pass},
+		{"OIDC provider reports another issuer", "auth.oidc", func(t *testing.T, cfg *env.Config, _ *fakeCouch) {
+			cfg.App.Auth.OIDC.Issuer = issuer(t, func(string) string { return "https://accounts.example.com" })
+		}, Fail},
+		{"no OIDC discovery", "auth.oidc", func(t *testing.T, cfg *env.Config, _ *fakeCouch) {
+			cfg.App.Auth.OIDC.Issuer = issuer(t, func(string) string { return "" })
+		}, Fail},
+		{"OIDC provisioning without a CouchDB admin", "auth.oidc", func(t *testing.T, cfg *env.Config, _ *fakeCouch) {
+			cfg.App.Auth.OIDC.Issuer = issuer(t, func(url string) string { return url })
+			cfg.App.Auth.OIDC.Provision = true
+			cfg.CouchDBAdminUser, cfg.CouchDBAdminPass = "", ""
+		}, Fail},
+
+		{"static dir", "static.dir", nil, Pass},
+		{"static dir without index.html", "static.dir", func(t *testing.T, cfg *env.Config, _ *fakeCouch) { cfg.StaticAssetsDir = t.TempDir() }, Warn},
+		{"missing static dir", "static.dir", func(t *testing.T, cfg *env.Config, _ *fakeCouch) {
+			cfg.StaticAssetsDir = filepath.Join(t.TempDir(), "dist")
+		}, Fail},
+
+		{"CouchDB reachable", "couchdb.reachable", nil, Pass},
+		{"CouchDB down", "couchdb.reachable", func(_ *testing.T, _ *env.Config, couch *fakeCouch) { couch.Close() }, Fail},
+
+		{"vendor", "couchdb.vendor", nil, Pass},
+		{"no vendor configured", "couchdb.vendor", func(_ *testing.T, cfg *env.Config, _ *fakeCouch) { cfg.DatabaseVendor = "" }, Warn},
+		{"other vendor", "couchdb.vendor", func(_ *testing.T, _ *env.Config, couch *fakeCouch) { couch.vendor = "The Apache Software Foundation" }, Fail},
+		{"vendor with CouchDB down", "couchdb.vendor", func(_ *testing.T, _ *env.Config, couch *fakeCouch) { couch.Close() }, Warn},
+
+		{"JWT accepted", "couchdb.jwt", nil, Pass},
+		{"JWT signed with another secret", "couchdb.jwt", func(_ *testing.T, _ *env.Config, couch *fakeCouch) {
+			couch.keys = auth.HMACKey("papaya", "another-secret")
+		}, Fail},
+		{"JWT ignored", "couchdb.jwt", func(_ *testing.T, _ *env.Config, couch *fakeCouch) { couch.ignoreJWT = true }, Fail},
+		{"JWT without a usable key", "couchdb.jwt", func(t *testing.T, cfg *env.Config, _ *fakeCouch) {
+			cfg.AuthSigningKey = filepath.Join(t.TempDir(), "missing.pem")
+		}, Warn},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			couch := newFakeCouch(t)
+			cfg := testConfig(t, couch.Server)
+			couch.keys = auth.HMACKey(cfg.AuthTokenKid, cfg.AuthTokenSecret)
+			if tt.configure != nil {
+				tt.configure(t, cfg, couch)
+			}
+			report := Run(context.Background(), cfg)
+			got := results(report, tt.check)
+			if len(got) == 0 {
+				t.Fatalf("Run() has no %s result; got %v", tt.check, report)
+			}
+			for _, res := range got {
+				if res.Status != tt.want {
+					t.Errorf("%s = %s (%s), want %s", tt.check, res.Status, res.Detail, tt.want)
+				}
+			}
+			if tt.want == Fail && !report.Failed() {
+				t.Errorf("Failed() = false, want true")
+			}
+		})
+	}
+}
+
+func TestRunAllPass(t *testing.T) {
+	couch := newFakeCouch(t)
+	cfg := testConfig(t, couch.Server)
+	couch.keys = auth.HMACKey(cfg.AuthTokenKid, cfg.AuthTokenSecret)
+	report := Run(context.Background(), cfg)
+	for _, res := range report {
+		if res.Status != Pass {
+			t.Errorf("%s = %s (%s), want PASS", res.Name, res.Status, res.Detail)
+		}
+	}
+	if report.Failed() {
+		t.Errorf("Failed() = true, want false")
+	}
+}
+
+// TestRunKeyring checks that every key in the keyring is tried against CouchDB, not just
+// the active one, since tokens signed with older keys are still in use.
+func TestRunKeyring(t *testing.T) {
+	couch := newFakeCouch(t)
+	cfg := testConfig(t, couch.Server)
+	fallback := auth.HMACKey(cfg.AuthTokenKid, cfg.AuthTokenSecret)
+	ring, err := auth.LoadKeyring(cfg.AuthKeyringPath, fallback)
+	if err != nil {
+		t.Fatal(err)
+	}
+	next, err := auth.GenerateHMACKey("papaya-2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ring.Rotate(next); err != nil {
+		t.Fatal(err)
+	}
+	if err := ring.Save(); err != nil {
+		t.Fatal(err)
+	}
+	couch.keys = next // CouchDB was only given the new key
+
+	got := results(Run(context.Background(), cfg), "couchdb.jwt")
+	want := map[string]Status{`"papaya"`: Fail, `"papaya-2"`: Pass}
+	if len(got) != len(want) {
+		t.Fatalf("couchdb.jwt results = %v, want one per key", got)
+	}
+	for _, res := range got {
+		for kid, status := range want {
+			if strings.Contains(res.Detail, "kid "+kid) && res.Status != status {
+				t.Errorf("couchdb.jwt for kid %s = %s (%s), want %s", kid, res.Status, res.Detail, status)
+			}
+		}
+	}
+}
+
+func TestReportWrite(t *testing.T) {
+	r := Report{
+		{Name: "auth.token_secret", Status: Pass, Detail: "set"},
+		{Name: "couchdb.jwt", Status: Fail, Detail: "rejected"},
+	}
+	var b strings.Builder
+	if err := r.Write(&b); err != nil {
+		t.Fatal(err)
+	}
+	want := "PASS  auth.token_secret  set\nFAIL  couchdb.jwt        rejected\n"
+	if b.String() != want {
+		t.Errorf("Write() = %q, want %q", b.String(), want)
+	}
+}
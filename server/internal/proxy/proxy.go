@@ -1,21 +1,40 @@
 package proxy
 
 import (
+	"errors"
 	"io"
 	"net/http"
 	"net/url"
+	"strings"
 
 	"github.com/fridayflag/papaya/internal/auth"
+	"github.com/fridayflag/papaya/internal/config"
 )
 
+// TokenExchange trades a personal access token for a short-lived CouchDB access token,
+// provided it carries scope (auth.ScopeDBRead or auth.ScopeDBWrite). It returns
+// auth.ErrScopeMissing when the token is valid but lacks the scope.
+type TokenExchange func(token, scope string) (string, error)
+
+// RevokedCheck reports whether an access token has been revoked (logged out) before it
+// expired.
+type RevokedCheck func(token string) bool
+
 // ReverseProxy proxies requests to the given target base URL.
 // Prefix is stripped from the request path before forwarding (e.g. prefix "/db", path "/db/foo" -> "/foo").
-// When proxying to /db, the papaya_token cookie value is passed as a Bearer token in the Authorization header.
-func ReverseProxy(prefix, targetBaseURL string) (http.Handler, error) {
+// When proxying to /db, the access-token cookie (named accessCookie; see auth.CookieName) is passed as a Bearer token in the Authorization header,
+// unless the request has an Authorization header of its own.
+// A personal access token sent as "Authorization: Bearer pat_..." is swapped for the token
+// exchange returns instead; requests that write need auth.ScopeDBWrite (see readOnly).
+// Other Bearer tokens, and the cookie's, are refused with 401 when revoked says so, as
+// CouchDB would accept them until they expire.
+// Upstream requests are bounded by opts.ProxyTimeout (none when zero).
+func ReverseProxy(prefix, targetBaseURL string, opts config.CouchDBConfig, accessCookie string, exchange TokenExchange, revoked RevokedCheck) (http.Handler, error) {
 	base, err := url.Parse(targetBaseURL)
 	if err != nil {
 		return nil, err
 	}
+	client := &http.Client{Timeout: opts.ProxyTimeout}
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		path := r.URL.Path
 		if len(path) < len(prefix) || path[:len(prefix)] != prefix {
@@ -37,12 +56,38 @@ func ReverseProxy(prefix, targetBaseURL string) (http.Handler, error) {
 		for k, v := range r.Header {
 			req.Header[k] = v
 		}
-		// Extract papaya_token cookie and add as Bearer token header
-		if cookie, err := r.Cookie(auth.CookieAccessToken); err == nil && cookie != nil && cookie.Value != "" {
+		if token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok && auth.IsPersonalAccessToken(token) {
+			scope := auth.ScopeDBWrite
+			if readOnly(r) {
+				scope = auth.ScopeDBRead
+			}
+			access, err := exchange(token, scope)
+			if errors.Is(err, auth.ErrScopeMissing) {
+				http.Error(w, "personal access token lacks the "+scope+" scope", http.StatusForbidden)
+				return
+			}
+			if err != nil {
+				http.Error(w, "invalid or expired personal access token", http.StatusUnauthorized)
+				return
+			}
+			req.Header.Set("Authorization", "Bearer "+access)
+		} else if ok {
+			if revoked(token) {
+				http.Error(w, "access token revoked", http.StatusUnauthorized)
+				return
+			}
+		} else if cookie, err := r.Cookie(accessCookie); err == nil && cookie != nil && cookie.Value != "" && r.Header.Get("Authorization") == "" {
+			// Extract the access-token cookie and add as Bearer token header. A client's own
+			// Authorization wins, so a request that brings one never acts with the cookie
+			// (which is what lets server.csrf exempt such requests).
+			if revoked(cookie.Value) {
+				http.Error(w, "access token revoked", http.StatusUnauthorized)
+				return
+			}
 			req.Header.Set("Authorization", "Bearer "+cookie.Value)
 		}
 		req.Host = target.Host
-		resp, err := http.DefaultClient.Do(req)
+		resp, err := client.Do(req)
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusBadGateway)
 			return
@@ -55,3 +100,36 @@ func ReverseProxy(prefix, targetBaseURL string) (http.Handler, error) {
 		_, _ = io.Copy(w, resp.Body)
 	}), nil
 }
+
+// readOnlyPosts are the CouchDB endpoints that take a POST body but only read. Their
+// names start with "_", which database names and document IDs outside _design/ and
+// _local/ cannot.
+var readOnlyPosts = map[string]bool{
+	"_all_docs":    true,
+	"_bulk_get":    true,
+	"_changes":     true,
+	"_design_docs": true,
+	"_explain":     true,
+	"_find":        true,
+	"_local_docs":  true,
+	"_revs_diff":   true,
+}
+
+// readOnly reports whether r only reads from CouchDB: GET, HEAD and OPTIONS, and POSTs to
+// query endpoints, views and their /queries variants. Pull replication also writes
+// checkpoints to the source's _local documents; CouchDB clients carry on when that is
+// refused.
+func readOnly(r *http.Request) bool {
+	switch r.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return true
+	case http.MethodPost:
+		segs := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+		if n := len(segs); n > 1 && segs[n-1] == "queries" {
+			segs = segs[:n-1]
+		}
+		n := len(segs)
+		return readOnlyPosts[segs[n-1]] || n > 1 && segs[n-2] == "_view"
+	}
+	return false
+}
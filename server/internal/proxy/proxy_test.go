@@ -0,0 +1,99 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/fridayflag/papaya/internal/auth"
+	"github.com/fridayflag/papaya/internal/config"
+)
+
+func TestReadOnly(t *testing.T) {
+	tests := []struct {
+		method, path string
+		want         bool
+	}{
+		{http.MethodGet, "/db/budget/doc1", true},
+		{http.MethodHead, "/db/budget", true},
+		{http.MethodOptions, "/db/budget", true},
+		{http.MethodPost, "/db/budget/_all_docs", true},
+		{http.MethodPost, "/db/budget/_all_docs/queries", true},
+		{http.MethodPost, "/db/budget/_bulk_get", true},
+		{http.MethodPost, "/db/budget/_changes", true},
+		{http.MethodPost, "/db/budget/_find", true},
+		{http.MethodPost, "/db/budget/_explain", true},
+		{http.MethodPost, "/db/budget/_revs_diff", true},
+		{http.MethodPost, "/db/budget/_design/reports/_view/by_month", true},
+		{http.MethodPost, "/db/budget/_design/reports/_view/by_month/queries", true},
+		{http.MethodPost, "/db/budget", false},
+		{http.MethodPost, "/db/budget/_bulk_docs", false},
+		{http.MethodPost, "/db/budget/_purge", false},
+		{http.MethodPost, "/db/budget/_design/reports/_update/touch", false},
+		{http.MethodPut, "/db/budget/doc1", false},
+		{http.MethodPut, "/db/budget/_local/checkpoint", false},
+		{http.MethodDelete, "/db/budget/doc1", false},
+		{http.MethodPatch, "/db/budget/doc1", false},
+		{http.MethodPost, "/db/", false},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(tt.method, tt.path, nil)
+		if got := readOnly(r); got != tt.want {
+			t.Errorf("readOnly(%s %s) = %v, want %v", tt.method, tt.path, got, tt.want)
+		}
+	}
+}
+
+// TestPersonalAccessTokenScope checks that a token is exchanged for the scope the request
+// needs and that CouchDB only sees the access token it was swapped for.
+func TestPersonalAccessTokenScope(t *testing.T) {
+	var upstreamAuth string
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upstreamAuth = r.Header.Get("Authorization")
+	}))
+	defer upstream.Close()
+
+	const readToken, writeToken = auth.PATPrefix + "read", auth.PATPrefix + "write"
+	exchange := func(token, scope string) (string, error) {
+		switch {
+		case token == writeToken, token == readToken && scope == auth.ScopeDBRead:
+			return "access-" + scope, nil
+		case token == readToken:
+			return "", auth.ErrScopeMissing
+		}
+		return "", auth.ErrPATNotFound
+	}
+	h, err := ReverseProxy("/db", upstream.URL, config.CouchDBConfig{}, "access", exchange, func(string) bool { return false })
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name         string
+		method, path string
+		token        string
+		want         int
+		wantUpstream string // Authorization CouchDB gets; "" when the request must not reach it
+	}{
+		{"read with db:read", http.MethodGet, "/db/budget/doc1", readToken, http.StatusOK, "Bearer access-db:read"},
+		{"query with db:read", http.MethodPost, "/db/budget/_find", readToken, http.StatusOK, "Bearer access-db:read"},
+		{"write with db:read", http.MethodPut, "/db/budget/doc1", readToken, http.StatusForbidden, ""},
+		{"bulk write with db:read", http.MethodPost, "/db/budget/_bulk_docs", readToken, http.StatusForbidden, ""},
+		{"write with db:write", http.MethodPut, "/db/budget/doc1", writeToken, http.StatusOK, "Bearer access-db:write"},
+		{"read with db:write", http.MethodGet, "/db/budget/doc1", writeToken, http.StatusOK, "Bearer access-db:read"},
+		{"unknown token", http.MethodGet, "/db/budget/doc1", auth.PATPrefix + "revoked", http.StatusUnauthorized, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			upstreamAuth = ""
+			r := httptest.NewRequest(tt.method, tt.path, strings.NewReader("{}"))
+			r.Header.Set("Authorization", "Bearer "+tt.token)
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, r)
+			if w.Code != tt.want || upstreamAuth != tt.wantUpstream {
+				t.Errorf("%s %s = %d with CouchDB seeing %q, want %d and %q", tt.method, tt.path, w.Code, upstreamAuth, tt.want, tt.wantUpstream)
+			}
+		})
+	}
+}
@@ -4,17 +4,35 @@ import (
 	"net/http"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
+
+	"github.com/fridayflag/papaya/internal/config"
 )
 
 // SPA returns an http.Handler that serves files from dir.
-// Requests for paths that do not match a file are served index.html (SPA catch-all).
-func SPA(dir string) (http.Handler, error) {
+// Requests for paths that do not match a file are served index.html (SPA catch-all) unless
+// opts.SPAFallback is off. index.html is always served with "Cache-Control: no-cache";
+// other files get opts.CacheMaxAge when it is set.
+func SPA(dir string, opts config.StaticConfig) (http.Handler, error) {
 	abs, err := filepath.Abs(dir)
 	if err != nil {
 		return nil, err
 	}
 	absPrefix := filepath.Clean(abs) + string(filepath.Separator)
+	assetCache := ""
+	if opts.CacheMaxAge > 0 {
+		assetCache = "public, max-age=" + strconv.Itoa(int(opts.CacheMaxAge.Seconds()))
+	}
+	serveIndex := func(w http.ResponseWriter, r *http.Request, index *os.File) bool {
+		stat, _ := index.Stat()
+		if stat == nil {
+			return false
+		}
+		w.Header().Set("Cache-Control", "no-cache")
+		http.ServeContent(w, r, "index.html", stat.ModTime(), index)
+		return true
+	}
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		if r.Method != http.MethodGet && r.Method != http.MethodHead {
 			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
@@ -35,7 +53,7 @@ func SPA(dir string) (http.Handler, error) {
 		full = absFull
 		f, err := os.Open(full)
 		if err != nil {
-			if os.IsNotExist(err) {
+			if os.IsNotExist(err) && opts.SPAFallback {
 				// SPA: serve index.html so client-side router can handle the route
 				indexPath := filepath.Join(abs, "index.html")
 				index, err := os.Open(indexPath)
@@ -44,9 +62,7 @@ func SPA(dir string) (http.Handler, error) {
 					return
 				}
 				defer index.Close()
-				stat, _ := index.Stat()
-				if stat != nil {
-					http.ServeContent(w, r, "index.html", stat.ModTime(), index)
+				if serveIndex(w, r, index) {
 					return
 				}
 			}
@@ -67,14 +83,17 @@ func SPA(dir string) (http.Handler, error) {
 				return
 			}
 			defer index.Close()
-			istat, _ := index.Stat()
-			if istat != nil {
-				http.ServeContent(w, r, "index.html", istat.ModTime(), index)
+			if serveIndex(w, r, index) {
 				return
 			}
 			http.NotFound(w, r)
 			return
 		}
+		if stat.Name() == "index.html" {
+			w.Header().Set("Cache-Control", "no-cache")
+		} else if assetCache != "" {
+			w.Header().Set("Cache-Control", assetCache)
+		}
 		http.ServeContent(w, r, stat.Name(), stat.ModTime(), f)
 	}), nil
 }